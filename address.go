@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"path"
+	"strings"
+)
+
+// IP families for -ip-family. The plain ones only set which addresses come
+// first on a dual-stack host, the -only ones drop the other family entirely.
+const (
+	ipFamilyV4     = "v4"
+	ipFamilyV6     = "v6"
+	ipFamilyV4Only = "v4-only"
+	ipFamilyV6Only = "v6-only"
+)
+
+// validateIPFamily rejects an -ip-family the address selection doesn't know
+func validateIPFamily(family string) error {
+	switch family {
+	case ipFamilyV4, ipFamilyV6, ipFamilyV4Only, ipFamilyV6Only:
+		return nil
+	}
+	return errors.New("-ip-family must be v4, v6, v4-only or v6-only: " + family)
+}
+
+// splitGlobs parses a comma-separated list of interface name globs
+func splitGlobs(list string) ([]string, error) {
+	var globs []string
+	for _, glob := range strings.Split(list, ",") {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, errors.New("bad interface glob " + glob + ": " + err.Error())
+		}
+		globs = append(globs, glob)
+	}
+	return globs, nil
+}
+
+// ifaceAllowed reports whether an interface passes -iface and -exclude-iface.
+// Bridges like docker0 and br-* and VPN tunnels carry addresses the portal
+// doesn't know this host by.
+func ifaceAllowed(name string, include []string, exclude []string) bool {
+	matches := func(globs []string) bool {
+		for _, glob := range globs {
+			if ok, _ := path.Match(glob, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(include) > 0 && !matches(include) {
+		return false
+	}
+	return !matches(exclude)
+}
+
+// externalIP returns the addresses of every interface that is up as a JSON
+// array, ordered and filtered by -ip-family, -iface and -exclude-iface
+func externalIP() (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	include, err := splitGlobs(*ifaceInclude)
+	if err != nil {
+		return "", err
+	}
+	exclude, err := splitGlobs(*ifaceExclude)
+	if err != nil {
+		return "", err
+	}
+
+	var addrs []net.Addr
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue // interface down
+		}
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue // loopback interface
+		}
+		if !ifaceAllowed(iface.Name, include, exclude) {
+			continue // filtered out
+		}
+		ifaceAddrs, addrerr := iface.Addrs()
+		if addrerr != nil {
+			return "", addrerr
+		}
+		addrs = append(addrs, ifaceAddrs...)
+	}
+
+	ips := selectIPs(addrs, *ipFamily)
+	b, err := json.Marshal(ips)
+	if err != nil {
+		panic(err)
+	}
+	if len(ips) == 0 {
+		return string(b), errors.New("Are you connected to the network?")
+	}
+	return string(b), nil
+}
+
+// selectIPs keeps the IPv4 addresses and the global IPv6 ones, skipping
+// loopback and link-local addresses that mean nothing to the portal
+func selectIPs(addrs []net.Addr, family string) []string {
+	var v4, v6 []string
+	for _, addr := range addrs {
+		var ip net.IP
+		switch v := addr.(type) {
+		case *net.IPNet:
+			ip = v.IP
+		case *net.IPAddr:
+			ip = v.IP
+		}
+		if ip == nil || ip.IsLoopback() {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 = append(v4, ip4.String())
+		} else if ip.IsGlobalUnicast() {
+			v6 = append(v6, ip.String())
+		}
+	}
+
+	switch family {
+	case ipFamilyV6:
+		return append(v6, v4...)
+	case ipFamilyV4Only:
+		return v4
+	case ipFamilyV6Only:
+		return v6
+	}
+	return append(v4, v6...)
+}
+
+// mergeIPs adds addresses from outside interface enumeration to the JSON list
+// from externalIP, skipping blanks and ones already there
+func mergeIPs(ipJSON string, extra ...string) string {
+	var ips []string
+	json.Unmarshal([]byte(ipJSON), &ips)
+	for _, ip := range extra {
+		if ip != "" && !containsString(ips, ip) {
+			ips = append(ips, ip)
+		}
+	}
+	b, err := json.Marshal(ips)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
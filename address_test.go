@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectIPs(t *testing.T) {
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("127.0.0.1")},
+		&net.IPNet{IP: net.ParseIP("10.0.0.5")},
+		&net.IPNet{IP: net.ParseIP("fe80::1")},
+		&net.IPNet{IP: net.ParseIP("::1")},
+		&net.IPNet{IP: net.ParseIP("2001:db8::5")},
+		&net.IPAddr{IP: net.ParseIP("192.168.1.5")},
+	}
+
+	assert.Equal(t, []string{"10.0.0.5", "192.168.1.5", "2001:db8::5"}, selectIPs(addrs, ipFamilyV4))
+	assert.Equal(t, []string{"2001:db8::5", "10.0.0.5", "192.168.1.5"}, selectIPs(addrs, ipFamilyV6))
+	assert.Equal(t, []string{"10.0.0.5", "192.168.1.5"}, selectIPs(addrs, ipFamilyV4Only))
+	assert.Equal(t, []string{"2001:db8::5"}, selectIPs(addrs, ipFamilyV6Only))
+	assert.Empty(t, selectIPs(addrs[:1], ipFamilyV4))
+
+	assert.NoError(t, validateIPFamily(ipFamilyV6Only))
+	assert.Error(t, validateIPFamily("ipv6"))
+}
+
+func TestIfaceAllowed(t *testing.T) {
+	exclude, err := splitGlobs("docker0, br-*,veth*,")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docker0", "br-*", "veth*"}, exclude)
+
+	assert.True(t, ifaceAllowed("eth0", nil, exclude))
+	assert.False(t, ifaceAllowed("docker0", nil, exclude))
+	assert.False(t, ifaceAllowed("br-3f2a9c", nil, exclude))
+	assert.False(t, ifaceAllowed("veth12ab", nil, exclude))
+
+	include := []string{"eth*", "ens*"}
+	assert.True(t, ifaceAllowed("ens5", include, exclude))
+	assert.False(t, ifaceAllowed("tun0", include, exclude))
+	assert.False(t, ifaceAllowed("eth1", include, []string{"eth1"}), "exclusions win")
+
+	_, err = splitGlobs("eth[")
+	assert.Error(t, err)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/ottenhoff/go-patcher/v2/agentpb"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// runResults are the final results this run reported to the portal, per patch ID
+var runResults = map[string]patchOutcome{}
+
+// agentServer serves agentpb.Agent so a central controller can push patches
+// instead of the patcher polling the portal. Pushed patches go through the
+// same checks as polled ones and are reported to the portal just the same.
+type agentServer struct {
+	agentpb.UnimplementedAgentServer
+	portals []*portalConfig
+	// busy holds the one cycle allowed at a time, pushes queue up behind it
+	busy chan struct{}
+}
+
+// runAgent serves the agent API on -agent-listen until SIGINT or SIGTERM.
+// Every call needs the bearer token from -agent-token-file, and anything
+// beyond loopback needs TLS so the token is never sent in the clear.
+func runAgent(portals []*portalConfig) error {
+	if *agentTokenFile == "" {
+		return errors.New("agent mode needs -agent-token-file")
+	}
+	token, err := readSecretFile(*agentTokenFile)
+	if err != nil {
+		return err
+	}
+
+	options := agentAuth(token)
+	if *agentTLSCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(*agentTLSCert, *agentTLSKey)
+		if err != nil {
+			return err
+		}
+		options = append(options, grpc.Creds(creds))
+	} else if !isLoopback(*agentListen) {
+		return errors.New("agent API on " + *agentListen + " needs -agent-tls-cert and -agent-tls-key")
+	}
+
+	listener, err := net.Listen("tcp", *agentListen)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer(options...)
+	agent := &agentServer{portals: portals, busy: make(chan struct{}, 1)}
+	agentpb.RegisterAgentServer(server, agent)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *heartbeatInterval > 0 {
+		go runHeartbeats(ctx, portals)
+	}
+	go func() {
+		<-ctx.Done()
+		// Let a patch in progress finish, log streams are simply cut off
+		agent.busy <- struct{}{}
+		log.Info("Agent stopping")
+		server.Stop()
+	}()
+
+	log.Info("Agent API listening on ", listener.Addr(), " for ", len(portals), " portals")
+	return server.Serve(listener)
+}
+
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || ip != nil && ip.IsLoopback()
+}
+
+// agentAuth checks the token on every call before it reaches the agent
+func agentAuth(token string) []grpc.ServerOption {
+	return []grpc.ServerOption{grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := checkAgentToken(ctx, token); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}), grpc.StreamInterceptor(func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkAgentToken(stream.Context(), token); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	})}
+}
+
+// checkAgentToken wants "authorization: Bearer <token>" in the call metadata
+func checkAgentToken(ctx context.Context, token string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(value), []byte("Bearer "+token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or wrong agent token")
+}
+
+func (a *agentServer) ApplyPatch(ctx context.Context, req *agentpb.ApplyPatchRequest) (*agentpb.ApplyPatchResponse, error) {
+	portal := a.portal(req.Portal)
+	if portal == nil {
+		return nil, status.Error(codes.NotFound, "no portal named "+req.Portal)
+	}
+	// A signed push is checked exactly as a signed portal response would be
+	if err := verifySignature(portal.HMACSecret, req.PatchJson, req.Signature); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	patches, err := decodePatchResponses(req.PatchJson)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(patches) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no patches in patch_json")
+	}
+	// There is no next run to leave other server dirs for
+	for _, patch := range patches {
+		if patch.TomcatDir != patches[0].TomcatDir {
+			return nil, status.Error(codes.InvalidArgument, "patches for more than one server dir, push them separately")
+		}
+	}
+
+	select {
+	case a.busy <- struct{}{}:
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	defer func() { <-a.busy }()
+
+	log.Info("Applying ", len(patches), " patches pushed through the agent API for portal ", portal.Name)
+	err = runCycleSafely(portal, func() error {
+		return runCycle(portal, func() ([]*PatchResponse, error) { return patches, nil })
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// The cycle is over and the next one waits on busy, so the run globals are safe to read
+	resp := &agentpb.ApplyPatchResponse{RunId: runID}
+	for _, patch := range patches {
+		outcome, ok := runResults[patch.PatchID]
+		if !ok {
+			continue
+		}
+		resp.Results = append(resp.Results, &agentpb.PatchResult{PatchId: patch.PatchID, ResultValue: outcome.rv,
+			StartUptime: outcome.startup, Status: statusFor(outcome.rv, outcome.startup, statusReasons[patch.PatchID]).String()})
+	}
+	return resp, nil
+}
+
+// portal finds a portal by name, the first one when no name is given
+func (a *agentServer) portal(name string) *portalConfig {
+	for _, portal := range a.portals {
+		if name == "" || strings.EqualFold(portal.Name, name) {
+			return portal
+		}
+	}
+	return nil
+}
+
+func (a *agentServer) GetStatus(ctx context.Context, _ *agentpb.GetStatusRequest) (*agentpb.GetStatusResponse, error) {
+	current := currentRun.status()
+	resp := &agentpb.GetStatusResponse{State: current.State, Portal: current.Portal, RunId: current.RunID, PatchIds: current.PatchIDs,
+		RunStarted: current.RunStarted, Version: current.Version, AgentStarted: current.DaemonStarted}
+	if last := current.LastRun; last != nil {
+		resp.LastRun = &agentpb.RunRecord{RunId: last.RunID, Portal: last.Portal, PatchId: last.PatchID, TomcatDir: last.TomcatDir,
+			Started: last.Started.Unix(), Result: last.Result, StartupMs: last.StartupMillis}
+	}
+	return resp, nil
+}
+
+// StreamLogs attaches to the live stream like a -stream-socket client, so a
+// client too slow to keep up is dropped rather than holding up the run
+func (a *agentServer) StreamLogs(_ *agentpb.StreamLogsRequest, stream agentpb.Agent_StreamLogsServer) error {
+	client, server := net.Pipe()
+	live.attach(server)
+	go func() {
+		<-stream.Context().Done()
+		client.Close()
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := client.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&agentpb.LogChunk{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			if stream.Context().Err() != nil {
+				return nil
+			}
+			return status.Error(codes.Unavailable, "log stream closed")
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ottenhoff/go-patcher/v2/agentpb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func startTestAgent(t *testing.T, portals []*portalConfig) agentpb.AgentClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer(agentAuth("s3cret")...)
+	agentpb.RegisterAgentServer(server, &agentServer{portals: portals, busy: make(chan struct{}, 1)})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///agent", grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return agentpb.NewAgentClient(conn)
+}
+
+func TestAgentNeedsToken(t *testing.T) {
+	client := startTestAgent(t, []*portalConfig{{Name: "default"}})
+
+	_, err := client.GetStatus(context.Background(), &agentpb.GetStatusRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	wrong := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer guess")
+	_, err = client.GetStatus(wrong, &agentpb.GetStatusRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer s3cret")
+	resp, err := client.GetStatus(ctx, &agentpb.GetStatusRequest{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "idle", resp.State)
+		assert.Equal(t, patcherVersion, resp.Version)
+	}
+}
+
+func TestAgentRejectsBadPushes(t *testing.T) {
+	client := startTestAgent(t, []*portalConfig{{Name: "default"}, {Name: "signed", HMACSecret: "hmac-key"}})
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer s3cret")
+	apply := func(portal string, body string, signature string) codes.Code {
+		_, err := client.ApplyPatch(ctx, &agentpb.ApplyPatchRequest{Portal: portal, PatchJson: []byte(body), Signature: signature})
+		return status.Code(err)
+	}
+	patch := `{"patch_id": "63547", "tomcat_dir": "/opt/tomcat", "files": "", "sakaiprops": "x=y"}`
+
+	assert.Equal(t, codes.NotFound, apply("nosuch", patch, ""))
+	assert.Equal(t, codes.InvalidArgument, apply("", `{"patch_id": 63547}`, ""))
+	assert.Equal(t, codes.InvalidArgument, apply("", `[]`, ""))
+	assert.Equal(t, codes.InvalidArgument, apply("", `[`+patch+`, {"patch_id": "63548", "tomcat_dir": "/opt/tomcat2", "files": "", "sakaiprops": "x=y"}]`, ""))
+
+	// Pushes to a portal with an HMAC secret must be signed with it
+	assert.Equal(t, codes.PermissionDenied, apply("signed", patch, ""))
+	assert.Equal(t, codes.InvalidArgument, apply("signed", `[]`, signBody("hmac-key", []byte(`[]`), time.Now())))
+}
+
+func TestAgentStreamLogs(t *testing.T) {
+	oldLive := live
+	live = newLiveStream()
+	defer func() { live.Close(); live = oldLive }()
+	client := startTestAgent(t, []*portalConfig{{Name: "default"}})
+
+	ctx, cancel := context.WithTimeout(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer s3cret"), 5*time.Second)
+	defer cancel()
+	stream, err := client.StreamLogs(ctx, &agentpb.StreamLogsRequest{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	// The stream attaches once the call reaches the server
+	go func() {
+		for ctx.Err() == nil {
+			live.Write([]byte("Running step 1/2 for patch 63547\n"))
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	chunk, err := stream.Recv()
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(chunk.Data), "Running step 1/2 for patch 63547")
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	assert.True(t, isLoopback("127.0.0.1:7443"))
+	assert.True(t, isLoopback("[::1]:7443"))
+	assert.True(t, isLoopback("localhost:7443"))
+	assert.False(t, isLoopback("0.0.0.0:7443"))
+	assert.False(t, isLoopback(":7443"))
+}
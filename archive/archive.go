@@ -0,0 +1,615 @@
+// Package archive applies Sakai patch tarballs to a Tomcat directory.
+//
+// It holds the extraction logic used by go-patcher: the skip rules that protect
+// locally customized provider XML, the heuristics that clean out old components,
+// webapps and versioned JARs, and verification of what was written. Other tools
+// (image baking, local dev refresh scripts) should use Apply instead of
+// reimplementing any of it.
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
+)
+
+// DefaultSkipPattern matches provider configuration that must never be overwritten once it exists
+var DefaultSkipPattern = regexp.MustCompile(`^components/sakai-provider-pack/WEB-INF/.*(unboundid|components|jldap).*\.xml$`)
+
+// Compression formats understood by Apply and Extract
+const (
+	CompressionAuto  = ""
+	CompressionNone  = "none"
+	CompressionGzip  = "gzip"
+	CompressionZstd  = "zstd"
+	CompressionXz    = "xz"
+	CompressionBzip2 = "bzip2"
+	// CompressionZip reads a zip file instead of a tarball
+	CompressionZip = "zip"
+)
+
+// Options tunes how a patch is applied. The zero value matches go-patcher's behavior.
+type Options struct {
+	// SkipPattern matches files that are left alone if they already exist. Defaults to DefaultSkipPattern.
+	SkipPattern *regexp.Regexp
+
+	// NoCleanup disables removal of old components, webapps and versioned lib JARs
+	NoCleanup bool
+
+	// StagingDir is where non-seekable sources are spooled before applying. Defaults to os.TempDir().
+	StagingDir string
+
+	// Compression forces a format instead of sniffing the stream
+	Compression string
+
+	// Streaming keeps memory flat however large the patch is: zstd is decoded
+	// on one goroutine with a capped window, and every file is copied through
+	// one reused buffer. Slower on big hosts, but small ones don't get OOM-killed.
+	Streaming bool
+
+	// Sync fsyncs every written file and the directories holding them before
+	// returning, so a power loss right after extraction cannot leave empty files
+	Sync bool
+
+	// Owner, when set, is given every file and directory extracted. Only root
+	// can give files away.
+	Owner *Owner
+
+	// TarOwner gives extracted entries the uid and gid in their tar headers,
+	// taking precedence over Owner for them
+	TarOwner bool
+
+	// ModTimes gives extracted files, and the directories the patch creates,
+	// the modification times in their tar headers instead of the time of the run
+	ModTimes bool
+
+	// Xattrs restores the extended attributes in the PAX headers, on Linux
+	Xattrs bool
+
+	// Workers is how many regular files are written at once, 1 or less writes
+	// them one by one. Streaming always writes one by one.
+	Workers int
+
+	// Atomic makes Apply extract the whole patch next to the live tree before
+	// changing any of it, then move it into place with renames, swapping in
+	// every component it replaces as a whole. A crash or a full disk while
+	// extracting leaves target as it was.
+	Atomic bool
+}
+
+// Report describes what Apply or Extract did to the target directory.
+// All paths are relative to the target.
+type Report struct {
+	// Counts is the number of files per top-level component/webapp, or 1 per lib JAR
+	Counts  map[string]int
+	Written []string
+	Skipped []string
+	Removed []string
+	// Linked are the symlinks and hard links created, they have no size to verify
+	Linked []string
+
+	// sizes are the tar header sizes of the files written, or that would be
+	sizes map[string]int64
+	// dirs are the directory entries, in tarball order
+	dirs []dirEntry
+}
+
+// dirEntry is a directory entry of a tarball and where it goes
+type dirEntry struct {
+	path   string
+	header *tar.Header
+}
+
+// Apply stages src, removes whatever the patch replaces from target, extracts
+// the patch and then verifies every written file against the tar headers.
+// With Atomic set it's ApplyStaged instead.
+func Apply(target string, src io.Reader, opts Options) (Report, error) {
+	if opts.Atomic {
+		return ApplyStaged(target, src, opts, nil)
+	}
+	sweepStaged(target)
+	rs, cleanup, err := stage(src, opts)
+	if err != nil {
+		return Report{}, err
+	}
+	defer cleanup()
+
+	// Walk the archive once without writing to see what to clean out
+	plan, err := walk(target, rs, opts, true)
+	if err != nil {
+		return Report{}, err
+	}
+
+	var removed []string
+	if !opts.NoCleanup {
+		if removed, err = removeStale(target, plan.Counts, nil); err != nil {
+			return Report{}, err
+		}
+	}
+
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return Report{}, fmt.Errorf("could not rewind staged patch: %w", err)
+	}
+	report, err := walk(target, rs, opts, false)
+	report.Removed = removed
+	if err != nil {
+		return report, err
+	}
+	if opts.Sync {
+		if err := syncTree(target, report); err != nil {
+			return report, err
+		}
+	}
+
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return report, fmt.Errorf("could not rewind staged patch: %w", err)
+	}
+	return report, verify(target, rs, opts, report)
+}
+
+// Extract unrolls src into target in a single pass without any cleanup or verification
+func Extract(target string, src io.Reader, opts Options) (Report, error) {
+	report, err := walk(target, src, opts, false)
+	if err == nil && opts.Sync {
+		err = syncTree(target, report)
+	}
+	return report, err
+}
+
+// ShouldSkip reports whether the default skip rules protect this archive path
+func ShouldSkip(name string) bool {
+	return DefaultSkipPattern.MatchString(name)
+}
+
+// IsLibJar reports whether the archive path is a JAR in one of Tomcat's shared lib directories
+func IsLibJar(name string) bool {
+	isSharedJar := strings.HasPrefix(name, "shared/lib/")
+	isCommonJar := strings.HasPrefix(name, "common/lib/")
+	isLibDirJar := strings.HasPrefix(name, "lib/")
+	isJarFile := strings.HasSuffix(name, ".jar")
+	return (isSharedJar || isCommonJar || isLibDirJar) && isJarFile
+}
+
+// stage makes src seekable, spooling it to a temp file when needed
+func stage(src io.Reader, opts Options) (io.ReadSeeker, func(), error) {
+	if rs, ok := src.(io.ReadSeeker); ok {
+		return rs, func() {}, nil
+	}
+
+	tmp, err := os.CreateTemp(opts.StagingDir, "go-patcher-stage-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create staging file: %w", err)
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	if _, err := io.Copy(tmp, src); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("could not stage patch: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("could not rewind staged patch: %w", err)
+	}
+	log.Debug("Staged patch to ", tmp.Name())
+	return tmp, cleanup, nil
+}
+
+// streamingMaxMemory caps what the zstd decoder may allocate in streaming mode.
+// Patches are built with the default window of a few MB.
+const streamingMaxMemory = 64 << 20
+
+// xzMagic starts an xz stream
+var xzMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+
+// decompress wraps src according to the requested or sniffed compression
+func decompress(src io.Reader, opts Options) (io.ReadCloser, error) {
+	compression := opts.Compression
+	buffered := bufio.NewReader(src)
+	if compression == CompressionAuto {
+		magic, _ := buffered.Peek(6)
+		switch {
+		case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+			compression = CompressionGzip
+		case len(magic) >= 4 && magic[0] == 0x28 && magic[1] == 0xb5 && magic[2] == 0x2f && magic[3] == 0xfd:
+			compression = CompressionZstd
+		case bytes.HasPrefix(magic, xzMagic):
+			compression = CompressionXz
+		case len(magic) >= 4 && string(magic[:3]) == "BZh" && magic[3] >= '1' && magic[3] <= '9':
+			compression = CompressionBzip2
+		case bytes.HasPrefix(magic, zipMagic):
+			compression = CompressionZip
+		default:
+			compression = CompressionNone
+		}
+	}
+
+	switch compression {
+	case CompressionGzip:
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("could not read GZIP: %w", err)
+		}
+		return gz, nil
+	case CompressionZstd:
+		var decoderOpts []zstd.DOption
+		if opts.Streaming {
+			decoderOpts = append(decoderOpts, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true), zstd.WithDecoderMaxMemory(streamingMaxMemory))
+		}
+		decoder, err := zstd.NewReader(buffered, decoderOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("could not create zstd reader: %w", err)
+		}
+		return decoder.IOReadCloser(), nil
+	case CompressionXz:
+		decoder, err := xz.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("could not read XZ: %w", err)
+		}
+		return io.NopCloser(decoder), nil
+	case CompressionBzip2:
+		return io.NopCloser(bzip2.NewReader(buffered)), nil
+	case CompressionZip:
+		// zip reads at offsets, what bufio already took from src doesn't matter
+		if _, ok := src.(io.ReaderAt); ok {
+			return zipAsTar(src, opts.StagingDir)
+		}
+		return zipAsTar(buffered, opts.StagingDir)
+	case CompressionNone:
+		return io.NopCloser(buffered), nil
+	}
+	return nil, fmt.Errorf("unknown compression: %s", compression)
+}
+
+// walk reads every tar entry, counting what the cleanup heuristics need and
+// writing the entries to target unless dryRun is set
+func walk(target string, src io.Reader, opts Options, dryRun bool) (Report, error) {
+	report := Report{Counts: make(map[string]int), sizes: make(map[string]int64)}
+	skipPattern := opts.SkipPattern
+	if skipPattern == nil {
+		skipPattern = DefaultSkipPattern
+	}
+
+	reader, err := decompress(src, opts)
+	if err != nil {
+		return report, err
+	}
+
+	// nil lets io.Copy pick, which may allocate per file
+	var copyBuf []byte
+	if opts.Streaming {
+		copyBuf = make([]byte, 32*1024)
+	}
+	defer reader.Close()
+
+	// Writing into a directory changes its time, so directories get theirs last
+	var createdDirs []dirEntry
+
+	var pool *writerPool
+	if !dryRun && !opts.Streaming {
+		pool = newWriterPool(opts.Workers)
+	}
+	defer pool.close()
+
+	links := newLinkResolver(target, true)
+	tarBallReader := tar.NewReader(reader)
+	for {
+		if err := pool.failed(); err != nil {
+			return report, err
+		}
+		header, err := tarBallReader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return report, fmt.Errorf("could not read tarball: %w", err)
+		}
+		// git archive and others start with one, PAX records and GNU long
+		// names of the entries themselves are folded in by tar.Reader
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			log.Debug("Skipping PAX global header: ", header.Name)
+			continue
+		}
+
+		// get the individual filename and extract to the target directory
+		filename, err := entryName(header.Name)
+		if err != nil {
+			return report, err
+		}
+		fullPath := filepath.Join(target, filename)
+		if !isBeneath(target, fullPath) {
+			return report, fmt.Errorf("tarball entry %s points outside the target directory", header.Name)
+		}
+		// Nor may it get out through a symlink above it
+		if _, ok := links.resolve(path.Dir(filename), true); !ok {
+			return report, fmt.Errorf("tarball entry %s leads outside the target directory through a symlink", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			report.dirs = append(report.dirs, dirEntry{filename, header})
+			if !dryRun && !pathExists(fullPath) {
+				log.Debug("Creating directory: ", filename)
+				if err := opts.mkdirAll(fullPath, os.FileMode(header.Mode)); err != nil {
+					return report, fmt.Errorf("could not create directory %s: %w", filename, err)
+				}
+				if err := opts.chown(fullPath, header); err != nil {
+					return report, fmt.Errorf("could not change the owner of %s: %w", filename, err)
+				}
+				createdDirs = append(createdDirs, dirEntry{fullPath, header})
+			}
+
+		// GNU tar extracts contiguous files as regular ones
+		case tar.TypeReg, tar.TypeCont:
+			// A later entry for the same path wins
+			if pool.busy(fullPath) {
+				if err := pool.wait(); err != nil {
+					return report, err
+				}
+			}
+
+			// Do not overwrite an existing jldap-beans.xml or unboundid-ldap.xml or components.xml
+			if skipPattern.MatchString(filename) && pathExists(fullPath) {
+				log.Debug("Skipping file: ", filename)
+				report.Skipped = append(report.Skipped, filename)
+				continue
+			}
+
+			// See if there are any dirs we should wipe out
+			if len(filename) > len("components/a") {
+				splitPaths := strings.Split(filename, "/")
+				if len(splitPaths) > 1 {
+					firstTwoPaths := splitPaths[0] + "/" + splitPaths[1]
+					if IsLibJar(filename) {
+						report.Counts[filename] = 1
+					} else {
+						report.Counts[firstTwoPaths]++
+					}
+				}
+			}
+
+			report.sizes[filename] = header.Size
+			links.symlink(filename, "")
+			if dryRun {
+				continue
+			}
+
+			if pool != nil && header.Size <= workerFileLimit {
+				data := make([]byte, header.Size)
+				if _, err := io.ReadFull(tarBallReader, data); err != nil {
+					return report, fmt.Errorf("could not read tarball: %w", err)
+				}
+				filename, fullPath, header := filename, fullPath, header
+				pool.submit(fullPath, func() error {
+					return extractFile(opts, filename, fullPath, bytes.NewReader(data), header, nil)
+				})
+			} else if err := extractFile(opts, filename, fullPath, tarBallReader, header, copyBuf); err != nil {
+				return report, err
+			}
+			report.Written = append(report.Written, filename)
+
+		case tar.TypeSymlink, tar.TypeLink:
+			if err := checkLink(filename, header, links); err != nil {
+				return report, err
+			}
+			if header.Typeflag == tar.TypeSymlink {
+				links.symlink(filename, header.Linkname)
+			} else {
+				links.symlink(filename, "")
+			}
+			if dryRun {
+				continue
+			}
+			// What it links to, or a file it replaces, may still be being written
+			if err := pool.wait(); err != nil {
+				return report, err
+			}
+			if err := writeLink(opts, target, fullPath, header); err != nil {
+				return report, fmt.Errorf("could not create link %s from tarball: %w", filename, err)
+			}
+			if err := opts.chown(fullPath, header); err != nil {
+				return report, fmt.Errorf("could not change the owner of %s: %w", filename, err)
+			}
+			log.Debug("Linked tarball file: ", filename, " to ", header.Linkname)
+			report.Linked = append(report.Linked, filename)
+
+		default:
+			log.Errorf("Unable to untar type : %c in file %s", header.Typeflag, filename)
+		}
+	}
+
+	if err := pool.wait(); err != nil {
+		return report, err
+	}
+	return report, opts.restoreDirs(createdDirs)
+}
+
+// extractFile writes a regular file entry and gives it the owner and times
+// its header asks for
+func extractFile(opts Options, filename string, fullPath string, r io.Reader, header *tar.Header, buf []byte) error {
+	if err := writeFile(opts, fullPath, r, os.FileMode(header.Mode), buf); err != nil {
+		return fmt.Errorf("could not create file %s from tarball: %w", filename, err)
+	}
+	if err := opts.chown(fullPath, header); err != nil {
+		return fmt.Errorf("could not change the owner of %s: %w", filename, err)
+	}
+	if err := opts.restoreMetadata(fullPath, header); err != nil {
+		return fmt.Errorf("could not restore the times of %s: %w", filename, err)
+	}
+	log.Debug("Unrolled tarball file: ", filename)
+	return nil
+}
+
+func writeFile(opts Options, fullPath string, r io.Reader, mode os.FileMode, buf []byte) error {
+	// Not every tarball carries entries for its parent directories
+	if err := opts.mkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	// A file replaces a link rather than writing through it
+	if err := removeLink(fullPath); err != nil {
+		return err
+	}
+
+	writer, err := os.Create(fullPath)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	// os.File's ReadFrom would ignore buf and allocate its own
+	var dst io.Writer = writer
+	if buf != nil {
+		dst = struct{ io.Writer }{writer}
+	}
+	if _, err := io.CopyBuffer(dst, r, buf); err != nil {
+		return err
+	}
+	return os.Chmod(fullPath, mode)
+}
+
+// checkLink makes sure a link entry stays inside the tree, following the
+// symlinks links knows of on the way. A symlink's target is relative to the
+// symlink and a hard link's to the root of the tarball.
+func checkLink(filename string, header *tar.Header, links *linkResolver) error {
+	if header.Linkname == "" {
+		return fmt.Errorf("tarball link %s has no target", filename)
+	}
+	var ok bool
+	if header.Typeflag == tar.TypeSymlink {
+		if path.IsAbs(header.Linkname) {
+			return fmt.Errorf("tarball symlink %s points to the absolute path %s", filename, header.Linkname)
+		}
+		_, ok = links.resolve(path.Dir(filename)+"/"+header.Linkname, false)
+	} else if linkname, err := entryName(header.Linkname); err == nil {
+		_, ok = links.resolve(path.Dir(linkname), false)
+	}
+	if !ok {
+		return fmt.Errorf("tarball link %s to %s points outside the target directory", filename, header.Linkname)
+	}
+	return nil
+}
+
+// writeLink creates a link entry checked by checkLink, replacing whatever
+// file or link is in its place
+func writeLink(opts Options, target string, fullPath string, header *tar.Header) error {
+	if err := opts.mkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(fullPath); err == nil {
+		if fi.IsDir() {
+			return errors.New("a directory is in the way")
+		}
+		if err := os.Remove(fullPath); err != nil {
+			return err
+		}
+	}
+	if header.Typeflag == tar.TypeSymlink {
+		return os.Symlink(header.Linkname, fullPath)
+	}
+	linkname, _ := entryName(header.Linkname)
+	source := filepath.Join(target, linkname)
+	fi, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", header.Linkname)
+	}
+	return os.Link(source, fullPath)
+}
+
+// removeLink removes the symlink at fullPath, if that's what is there
+func removeLink(fullPath string) error {
+	if fi, err := os.Lstat(fullPath); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return os.Remove(fullPath)
+	}
+	return nil
+}
+
+// verify compares the size of every written file with its tar header
+func verify(target string, src io.Reader, opts Options, report Report) error {
+	written := make(map[string]bool, len(report.Written))
+	for _, name := range report.Written {
+		written[name] = true
+	}
+
+	reader, err := decompress(src, opts)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var problems []string
+	tarBallReader := tar.NewReader(reader)
+	for {
+		header, err := tarBallReader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("could not read tarball: %w", err)
+		}
+		filename, err := entryName(header.Name)
+		if err != nil || (header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeCont) || !written[filename] {
+			continue
+		}
+
+		fi, err := os.Stat(filepath.Join(target, filename))
+		if err != nil {
+			problems = append(problems, filename+": "+err.Error())
+		} else if fi.Size() != header.Size {
+			problems = append(problems, fmt.Sprintf("%s: size %d, expected %d", filename, fi.Size(), header.Size))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("verification failed: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// entryName canonicalizes a tar entry name, so "./lib/a.jar" and
+// "lib//a.jar" are both "lib/a.jar". Absolute names are refused rather than
+// rebased onto the target, a tarball built with them wasn't meant for it.
+func entryName(name string) (string, error) {
+	if path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("tarball entry %s is an absolute path", name)
+	}
+	if strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("tarball entry %q has a NUL in its name", name)
+	}
+	cleaned := path.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("tarball entry %s points outside the target directory", name)
+	}
+	return cleaned, nil
+}
+
+// isBeneath reports whether path, once cleaned, is target or inside it. Tar
+// entries and the cleanup paths derived from them come from the patch, so
+// "../" must never reach the rest of the host.
+func isBeneath(target string, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(target), filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../") && !filepath.IsAbs(rel)
+}
+
+// exists returns whether the given file or directory exists or not
+func pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
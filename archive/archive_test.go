@@ -0,0 +1,328 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// buildTarball creates a gzipped tarball holding the given files
+func buildTarball(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("Failed to write tar content: %v", err)
+		}
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func writeTestFile(t *testing.T, path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+}
+
+func TestApplyCleansOutOldFiles(t *testing.T) {
+	target := t.TempDir()
+	writeTestFile(t, filepath.Join(target, "components/sakai-foo-pack/WEB-INF/lib/foo-impl-22.1.jar"), "old")
+	writeTestFile(t, filepath.Join(target, "webapps/foo-tool/index.html"), "old")
+	writeTestFile(t, filepath.Join(target, "lib/foo-api-22.1.jar"), "old")
+	writeTestFile(t, filepath.Join(target, "lib/bar-api-22.1.jar"), "untouched")
+
+	tarball := buildTarball(t, map[string]string{
+		"components/sakai-foo-pack/WEB-INF/components.xml":            "<beans/>",
+		"components/sakai-foo-pack/WEB-INF/lib/foo-impl-22.2.jar":     "new",
+		"components/sakai-foo-pack/WEB-INF/lib/foo-util-22.2.jar":     "new",
+		"components/sakai-foo-pack/WEB-INF/lib/foo-util-ext-22.2.jar": "new",
+		"webapps/foo-tool.war": "war",
+		"lib/foo-api-22.2.jar": "new",
+	})
+
+	// Wrap in a plain reader so the source has to be staged
+	report, err := Apply(target, io.MultiReader(bytes.NewReader(tarball)), Options{StagingDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Apply() returned error: %v", err)
+	}
+
+	assert.NoFileExists(t, filepath.Join(target, "components/sakai-foo-pack/WEB-INF/lib/foo-impl-22.1.jar"))
+	assert.NoDirExists(t, filepath.Join(target, "webapps/foo-tool"))
+	assert.NoFileExists(t, filepath.Join(target, "lib/foo-api-22.1.jar"))
+	assert.FileExists(t, filepath.Join(target, "lib/foo-api-22.2.jar"))
+	assert.FileExists(t, filepath.Join(target, "lib/bar-api-22.1.jar"))
+	assert.FileExists(t, filepath.Join(target, "webapps/foo-tool.war"))
+	assert.Len(t, report.Written, 6)
+	assert.ElementsMatch(t, []string{"components/sakai-foo-pack", "webapps/foo-tool", "lib/foo-api-22.1.jar"}, report.Removed)
+}
+
+func TestApplyKeepsProviderConfiguration(t *testing.T) {
+	target := t.TempDir()
+	xmlPath := filepath.Join(target, "components/sakai-provider-pack/WEB-INF/unboundid-ldap.xml")
+	writeTestFile(t, xmlPath, "<beans>local</beans>")
+
+	file, err := os.Open("../test.tar.zst")
+	if err != nil {
+		t.Fatalf("Failed to open test tarball: %v", err)
+	}
+	defer file.Close()
+
+	report, err := Apply(target, file, Options{})
+	if err != nil {
+		t.Fatalf("Apply() returned error: %v", err)
+	}
+
+	content, _ := os.ReadFile(xmlPath)
+	assert.Equal(t, "<beans>local</beans>", string(content))
+	assert.Equal(t, []string{"components/sakai-provider-pack/WEB-INF/unboundid-ldap.xml"}, report.Skipped)
+	assert.Equal(t, map[string]int{"components/sakai-provider-pack": 4}, report.Counts)
+	assert.Empty(t, report.Removed)
+	assert.FileExists(t, filepath.Join(target, "components/sakai-provider-pack/WEB-INF/components.xml"))
+}
+
+func TestApplyStreaming(t *testing.T) {
+	file, err := os.Open("../test.tar.zst")
+	if err != nil {
+		t.Fatalf("Failed to open test tarball: %v", err)
+	}
+	defer file.Close()
+
+	target := t.TempDir()
+	report, err := Apply(target, file, Options{Streaming: true})
+	if err != nil {
+		t.Fatalf("Apply() returned error: %v", err)
+	}
+	assert.Equal(t, map[string]int{"components/sakai-provider-pack": 5}, report.Counts)
+	assert.FileExists(t, filepath.Join(target, "components/sakai-provider-pack/WEB-INF/components.xml"))
+}
+
+func TestApplyRefusesEntriesOutsideTarget(t *testing.T) {
+	root := t.TempDir()
+	target := filepath.Join(root, "tomcat")
+	writeTestFile(t, filepath.Join(target, "lib/bar-api-22.1.jar"), "untouched")
+
+	tarball := buildTarball(t, map[string]string{"../escaped.sh": "#!/bin/sh\n"})
+	_, err := Apply(target, bytes.NewReader(tarball), Options{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "outside the target directory")
+	}
+	assert.NoFileExists(t, filepath.Join(root, "escaped.sh"))
+
+	// Check refuses them too, so a bad tarball is caught before it's applied
+	for _, name := range []string{"lib/../../escaped.sh", "/etc/cron.d/escaped", "./../escaped.sh"} {
+		tarball := buildTarball(t, map[string]string{"lib/bar-api-22.2.jar": "new", name: "#!/bin/sh\n"})
+		assert.Error(t, Check(bytes.NewReader(tarball), Options{}), name)
+		_, err := Apply(target, bytes.NewReader(tarball), Options{})
+		assert.Error(t, err, name)
+	}
+	assert.NoFileExists(t, filepath.Join(target, "etc/cron.d/escaped"))
+
+	name, err := entryName("./lib//a.jar")
+	assert.NoError(t, err)
+	assert.Equal(t, "lib/a.jar", name)
+	_, err = entryName("/etc/passwd")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "absolute path")
+	}
+
+	assert.True(t, isBeneath("/opt/tomcat", "/opt/tomcat/lib/a.jar"))
+	assert.True(t, isBeneath(".", "lib/a.jar"))
+	assert.False(t, isBeneath(".", "../a.jar"))
+	assert.False(t, isBeneath("/opt/tomcat", "/opt/tomcat-old/lib/a.jar"))
+	assert.True(t, isBeneath("/opt/tomcat", "/opt/tomcat/..a.jar"))
+}
+
+// buildLinkTarball writes headers in order, regular files get their name as content
+func buildLinkTarball(t *testing.T, headers []*tar.Header) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range headers {
+		hdr.Mode = 0644
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(hdr.Name))
+		}
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestApplyLinks(t *testing.T) {
+	headers := func() []*tar.Header {
+		return []*tar.Header{
+			{Name: "lib/foo-api-22.2.jar", Typeflag: tar.TypeReg},
+			{Name: "lib/foo-api.jar", Typeflag: tar.TypeSymlink, Linkname: "foo-api-22.2.jar"},
+			{Name: "shared/lib", Typeflag: tar.TypeSymlink, Linkname: "../lib"},
+			{Name: "lib/foo-copy.jar", Typeflag: tar.TypeLink, Linkname: "lib/foo-api-22.2.jar"},
+			{Name: "shared/lib/bar-api-22.2.jar", Typeflag: tar.TypeReg},
+		}
+	}
+	for name, apply := range map[string]func(string, []byte) (Report, error){
+		"Apply": func(target string, tarball []byte) (Report, error) {
+			return Apply(target, bytes.NewReader(tarball), Options{NoCleanup: true})
+		},
+		"ApplyStaged": func(target string, tarball []byte) (Report, error) {
+			return ApplyStaged(target, bytes.NewReader(tarball), Options{NoCleanup: true}, nil)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			target := t.TempDir()
+			writeTestFile(t, filepath.Join(target, "lib/foo-api.jar"), "replaced by the symlink")
+			report, err := apply(target, buildLinkTarball(t, headers()))
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.ElementsMatch(t, []string{"lib/foo-api.jar", "shared/lib", "lib/foo-copy.jar"}, report.Linked)
+
+			link, _ := os.Readlink(filepath.Join(target, "lib/foo-api.jar"))
+			assert.Equal(t, "foo-api-22.2.jar", link)
+			content, _ := os.ReadFile(filepath.Join(target, "lib/foo-copy.jar"))
+			assert.Equal(t, "lib/foo-api-22.2.jar", string(content))
+			content, _ = os.ReadFile(filepath.Join(target, "lib/bar-api-22.2.jar"))
+			assert.Equal(t, "shared/lib/bar-api-22.2.jar", string(content), "written through the symlinked directory")
+		})
+	}
+
+	target := t.TempDir()
+	for _, header := range []*tar.Header{
+		{Name: "lib/passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		{Name: "lib/up", Typeflag: tar.TypeSymlink, Linkname: "../../etc"},
+		{Name: "lib/passwd", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"},
+		{Name: "lib/empty", Typeflag: tar.TypeSymlink},
+	} {
+		tarball := buildLinkTarball(t, []*tar.Header{header})
+		assert.Error(t, Check(bytes.NewReader(tarball), Options{}), header.Linkname)
+		_, err := Apply(target, bytes.NewReader(tarball), Options{})
+		assert.Error(t, err, header.Linkname)
+		_, err = os.Lstat(filepath.Join(target, header.Name))
+		assert.True(t, os.IsNotExist(err), header.Linkname)
+	}
+}
+
+func TestApplySymlinkChain(t *testing.T) {
+	// Each link is fine on its own, together a/b/c is the parent of target
+	chain := func() []byte {
+		return buildLinkTarball(t, []*tar.Header{
+			{Name: "a/", Typeflag: tar.TypeDir},
+			{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "a/b/c", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "a/b/c/escaped.txt", Typeflag: tar.TypeReg},
+		})
+	}
+	// A link from an earlier patch is on disk, not in the tarball
+	onDisk := func() []byte {
+		return buildLinkTarball(t, []*tar.Header{
+			{Name: "a/b/c", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "a/b/c/escaped.txt", Typeflag: tar.TypeReg},
+		})
+	}
+	for name, apply := range map[string]func(string, []byte) (Report, error){
+		"Apply": func(target string, tarball []byte) (Report, error) {
+			return Apply(target, bytes.NewReader(tarball), Options{NoCleanup: true})
+		},
+		"Atomic": func(target string, tarball []byte) (Report, error) {
+			return Apply(target, bytes.NewReader(tarball), Options{NoCleanup: true, Atomic: true})
+		},
+		"Extract": func(target string, tarball []byte) (Report, error) {
+			return Extract(target, bytes.NewReader(tarball), Options{})
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			parent := t.TempDir()
+			target := filepath.Join(parent, "target")
+			os.Mkdir(target, 0755)
+			_, err := apply(target, chain())
+			assert.Error(t, err)
+			assert.NoFileExists(t, filepath.Join(parent, "escaped.txt"))
+			assert.NoFileExists(t, filepath.Join(target, "escaped.txt"))
+
+			parent = t.TempDir()
+			target = filepath.Join(parent, "target")
+			os.MkdirAll(filepath.Join(target, "a"), 0755)
+			os.Symlink("..", filepath.Join(target, "a/b"))
+			_, err = apply(target, onDisk())
+			assert.Error(t, err)
+			assert.NoFileExists(t, filepath.Join(parent, "escaped.txt"))
+			_, err = os.Lstat(filepath.Join(target, "c"))
+			assert.True(t, os.IsNotExist(err), "no link to outside the target")
+		})
+	}
+	assert.Error(t, Check(bytes.NewReader(chain()), Options{}))
+}
+
+func TestApplyThroughAbsoluteSymlink(t *testing.T) {
+	// webapps moved to another volume by whoever runs the server
+	target, volume := t.TempDir(), t.TempDir()
+	os.Symlink(volume, filepath.Join(target, "webapps"))
+	tarball := buildLinkTarball(t, []*tar.Header{{Name: "webapps/sakai.war", Typeflag: tar.TypeReg}})
+	for _, atomic := range []bool{false, true} {
+		_, err := Apply(target, bytes.NewReader(tarball), Options{NoCleanup: true, Atomic: atomic})
+		assert.NoError(t, err)
+		assert.FileExists(t, filepath.Join(volume, "sakai.war"))
+		os.Remove(filepath.Join(volume, "sakai.war"))
+	}
+
+	// But a link in the tarball can't lead there
+	tarball = buildLinkTarball(t, []*tar.Header{{Name: "lib/apps", Typeflag: tar.TypeSymlink, Linkname: "../webapps"}})
+	_, err := Apply(target, bytes.NewReader(tarball), Options{NoCleanup: true})
+	assert.Error(t, err)
+}
+
+func TestApplyPAXAndGNUHeaders(t *testing.T) {
+	longDir := "webapps/" + strings.Repeat("sakai-long-directory-name/", 8)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	// What git archive writes first
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": "8d99483"}})
+	for _, hdr := range []*tar.Header{
+		{Name: longDir + "gnu.jsp", Typeflag: tar.TypeReg, Format: tar.FormatGNU},
+		{Name: longDir + "pax.jsp", Typeflag: tar.TypeReg, Format: tar.FormatPAX, PAXRecords: map[string]string{"SCHILY.xattr.user.note": "x"}},
+		{Name: "lib/contiguous.jar", Typeflag: tar.TypeCont},
+	} {
+		hdr.Mode, hdr.Size = 0644, int64(len(hdr.Name))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		tw.Write([]byte(hdr.Name))
+	}
+	tw.Close()
+	gz.Close()
+
+	target := t.TempDir()
+	report, err := Apply(target, bytes.NewReader(buf.Bytes()), Options{NoCleanup: true})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{longDir + "gnu.jsp", longDir + "pax.jsp", "lib/contiguous.jar"}, report.Written)
+	for _, name := range report.Written {
+		content, _ := os.ReadFile(filepath.Join(target, name))
+		assert.Equal(t, name, string(content))
+	}
+	assert.NoFileExists(t, filepath.Join(target, "pax_global_header"))
+}
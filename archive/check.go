@@ -0,0 +1,39 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+)
+
+// Check reads a whole patch without writing anything, so a truncated or corrupt
+// download is caught while the server is still up. It covers the gzip or zstd
+// checksums, the tar structure and entries pointing outside the target.
+func Check(src io.Reader, opts Options) error {
+	_, err := Measure(src, opts)
+	return err
+}
+
+// Measure is Check that also adds up the bytes the patch would write, so the
+// disk can be checked for room before the server stops
+func Measure(src io.Reader, opts Options) (int64, error) {
+	reader, err := decompress(src, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	opts.Compression = CompressionNone
+	report, err := walk(".", reader, opts, true)
+	if err != nil {
+		return 0, err
+	}
+	// The compressed formats only check their trailer once read to the end
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return 0, fmt.Errorf("could not read tarball: %w", err)
+	}
+	var size int64
+	for _, fileSize := range report.sizes {
+		size += fileSize
+	}
+	return size, nil
+}
@@ -0,0 +1,38 @@
+package archive
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	tarball := buildTarball(t, map[string]string{
+		"components/sakai-kernel/WEB-INF/lib/kernel.jar": "kernel",
+		"lib/sakai-kernel-api-23.1.jar":                  "api",
+	})
+	assert.NoError(t, Check(bytes.NewReader(tarball), Options{}))
+
+	// Truncated downloads and flipped bits fail before anything is touched
+	assert.Error(t, Check(bytes.NewReader(tarball[:len(tarball)-6]), Options{}))
+	corrupt := append([]byte{}, tarball...)
+	corrupt[len(corrupt)-5] ^= 0xff
+	assert.Error(t, Check(bytes.NewReader(corrupt), Options{}))
+
+	escaping := buildTarball(t, map[string]string{"../../etc/cron.d/patch": "* * * * * root true"})
+	assert.Error(t, Check(bytes.NewReader(escaping), Options{}))
+}
+
+func TestMeasure(t *testing.T) {
+	tarball := buildTarball(t, map[string]string{
+		"components/sakai-kernel/WEB-INF/lib/kernel.jar": "kernel",
+		"lib/sakai-kernel-api-23.1.jar":                  "api",
+	})
+	size, err := Measure(bytes.NewReader(tarball), Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len("kernel")+len("api")), size)
+
+	_, err = Measure(bytes.NewReader(tarball[:len(tarball)-6]), Options{})
+	assert.Error(t, err)
+}
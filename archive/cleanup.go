@@ -0,0 +1,157 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// removeStale deletes the old components, exploded webapps and versioned lib
+// JARs that the patch is about to replace. Components swap has a staged copy
+// of are swapped for it instead of being deleted.
+func removeStale(target string, counts map[string]int, swap *dirSwap) ([]string, error) {
+	var removed []string
+
+	for fileMapPath, cnt := range counts {
+		isWebapp := strings.HasPrefix(fileMapPath, "webapps")
+		isWarFile := strings.HasSuffix(fileMapPath, ".war")
+		isComponents := strings.HasPrefix(fileMapPath, "components")
+		isSharedJar := IsLibJar(fileMapPath)
+		isProvidersDir := strings.Contains(fileMapPath, "sakai-provider-pack")
+		pathArray := strings.Split(fileMapPath, "/")
+		pathToDelete := pathArray[0] + "/" + pathArray[1]
+		if !isBeneath(target, filepath.Join(target, fileMapPath)) {
+			return removed, fmt.Errorf("refusing to clean up %s outside the target directory", fileMapPath)
+		}
+
+		if cnt > 3 && isComponents && !isProvidersDir {
+			swapped, err := swap.replace(target, pathToDelete)
+			if err != nil {
+				return removed, fmt.Errorf("could not swap in components path %s: %w", pathToDelete, err)
+			}
+			if swapped {
+				log.Debug("Swapped in components path: ", pathToDelete)
+			} else {
+				if err := os.RemoveAll(filepath.Join(target, pathToDelete)); err != nil {
+					return removed, fmt.Errorf("could not remove components path %s: %w", pathToDelete, err)
+				}
+				log.Debug("Deleting components path: ", pathToDelete)
+			}
+			removed = append(removed, pathToDelete)
+
+			// Special case with content-review
+			if strings.Contains(pathToDelete, "sakai-content-review-pack-federated") {
+				specialPath := "components/sakai-content-review-pack"
+				if err := os.RemoveAll(filepath.Join(target, specialPath)); err != nil {
+					return removed, fmt.Errorf("could not remove special path %s: %w", specialPath, err)
+				}
+				log.Debug("Special path delete: ", specialPath)
+				removed = append(removed, specialPath)
+			}
+		} else if isWebapp && isWarFile {
+			webappFolder := strings.TrimSuffix(pathToDelete, ".war")
+			if err := os.RemoveAll(filepath.Join(target, webappFolder)); err != nil {
+				return removed, fmt.Errorf("could not remove webapp path %s: %w", webappFolder, err)
+			}
+			log.Debug("Deleting webapp path: ", webappFolder)
+			removed = append(removed, webappFolder)
+		} else if isSharedJar {
+			// Need to wildcard the name to remove old versions
+			wildcardedFilename := ReplaceNumbers(fileMapPath)
+			if strings.Contains(fileMapPath, "gradebook2") {
+				wildcardedFilename = fileMapPath
+			}
+			wildcardedFilename = strings.Replace(wildcardedFilename, "-SNAPSHOT", "", 1)
+			files, err := removeFiles(target, wildcardedFilename)
+			removed = append(removed, files...)
+			if err != nil {
+				return removed, fmt.Errorf("could not delete wildcarded path %s: %w", wildcardedFilename, err)
+			}
+		}
+	}
+
+	return removed, nil
+}
+
+// ReplaceNumbers replaces consecutive digits in a string with a single asterisk.
+func ReplaceNumbers(s string) string {
+	// Initialize an output slice of runes to store the transformed characters.
+	// The length is estimated based on the input string length.
+	outputRunes := make([]rune, 0, len(s))
+
+	// Track whether the last rune was a digit to handle consecutive digits.
+	lastWasDigit := false
+
+	// Iterate over each rune in the input string.
+	for _, currentRune := range s {
+		// Check if the current rune is a digit.
+		if currentRune >= '0' && currentRune <= '9' {
+			// If the last rune was not a digit, add an asterisk to the output.
+			if !lastWasDigit {
+				outputRunes = append(outputRunes, '*')
+				lastWasDigit = true
+			}
+			// Skip adding the digit itself.
+			continue
+		}
+		// For non-digit runes, add them to the output and set lastWasDigit to false.
+		outputRunes = append(outputRunes, currentRune)
+		lastWasDigit = false
+	}
+	// Convert the output runes back to a string and return it.
+	return string(outputRunes)
+}
+
+// removeFiles deletes regular files under target matching the glob, leaving
+// directories, symlinked JARs and the JARs they point at alone. It returns the
+// relative paths removed.
+func removeFiles(target string, wildcardedPath string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(target, wildcardedPath))
+	if err != nil {
+		log.Errorf("Failed to glob %s", wildcardedPath)
+		return nil, err
+	}
+	log.Debugf("Found files matching %s: %v", wildcardedPath, files)
+
+	toSkip := make(map[string]bool)
+	linkTargets := make(map[string]bool)
+	resolved := make(map[string]string)
+	for _, file := range files {
+		fi, lerr := os.Lstat(file)
+		if lerr != nil {
+			return nil, lerr
+		}
+		realFile, symerr := filepath.EvalSymlinks(file)
+		if symerr != nil {
+			log.Error("Failed to eval symlink", file, symerr)
+			return nil, symerr
+		}
+		resolved[file] = realFile
+		if fi.IsDir() {
+			toSkip[file] = true
+		} else if fi.Mode()&os.ModeSymlink != 0 {
+			toSkip[file] = true
+			linkTargets[realFile] = true
+		}
+	}
+
+	var removed []string
+	for _, file := range files {
+		if toSkip[file] || linkTargets[resolved[file]] {
+			log.Debugf("Skipping file: %s", file)
+			continue
+		}
+		log.Debugf("Removing: %s", file)
+		if err := os.Remove(file); err != nil {
+			log.Errorf("Failed to remove %s: %s", file, err)
+			return removed, err
+		}
+		if rel, err := filepath.Rel(target, file); err == nil {
+			removed = append(removed, rel)
+		}
+	}
+	return removed, nil
+}
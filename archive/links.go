@@ -0,0 +1,102 @@
+package archive
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxLinkHops is how many symlinks a path may go through, as with ELOOP
+const maxLinkHops = 40
+
+// linkResolver tells where a path under root really leads, following the
+// symlinks the walk extracted so far and, with onDisk, those already there.
+// A lexical check can't see that "a/b/c" is "../c" when a/b is a link to "..".
+type linkResolver struct {
+	root   string
+	onDisk bool
+
+	// created are the symlinks extracted so far by name, with their targets
+	created map[string]string
+	// plain are paths found on disk not to be symlinks
+	plain map[string]bool
+}
+
+func newLinkResolver(root string, onDisk bool) *linkResolver {
+	return &linkResolver{root: root, onDisk: onDisk, created: map[string]string{}, plain: map[string]bool{}}
+}
+
+// symlink records name as a symlink to linkname, or as no longer being one
+// when linkname is empty
+func (r *linkResolver) symlink(name string, linkname string) {
+	if linkname == "" {
+		delete(r.created, name)
+		return
+	}
+	r.created[name] = linkname
+}
+
+// readlink returns the target of the symlink at name, if it is one. fromDisk
+// is set when it wasn't extracted by this walk.
+func (r *linkResolver) readlink(name string) (linkname string, isLink bool, fromDisk bool) {
+	if linkname, ok := r.created[name]; ok {
+		return linkname, true, false
+	}
+	if !r.onDisk || r.plain[name] {
+		return "", false, false
+	}
+	fullPath := filepath.Join(r.root, name)
+	if fi, err := os.Lstat(fullPath); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if linkname, err := os.Readlink(fullPath); err == nil {
+			return filepath.ToSlash(linkname), true, true
+		}
+	}
+	r.plain[name] = true
+	return "", false, false
+}
+
+// resolve follows name component by component, symlinks included, and
+// returns where it leads relative to root. ok is false if that is outside
+// root. name isn't cleaned first, "a/b/.." is the parent of wherever a/b leads.
+//
+// A tarball can't extract an absolute symlink, so one on disk was made by
+// whoever runs the server, e.g. for a webapps directory on another volume.
+// With trustMounts a path may lead through one; name is then returned as is.
+func (r *linkResolver) resolve(name string, trustMounts bool) (resolved string, ok bool) {
+	var parts []string
+	pending := strings.Split(name, "/")
+	for hops := 0; len(pending) > 0; {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(parts) == 0 {
+				return "", false
+			}
+			parts = parts[:len(parts)-1]
+			continue
+		}
+
+		current := path.Join(path.Join(parts...), part)
+		linkname, isLink, fromDisk := r.readlink(current)
+		if !isLink {
+			parts = append(parts, part)
+			continue
+		}
+		if hops++; hops > maxLinkHops {
+			return "", false
+		}
+		if path.IsAbs(linkname) {
+			if fromDisk && trustMounts {
+				return name, true
+			}
+			return "", false
+		}
+		// The link's target is relative to the directory it's in
+		pending = append(strings.Split(linkname, "/"), pending...)
+	}
+	return path.Join(parts...), true
+}
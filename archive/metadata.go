@@ -0,0 +1,51 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// xattrPrefix marks the PAX records GNU tar and bsdtar keep extended attributes in
+const xattrPrefix = "SCHILY.xattr."
+
+// restoreMetadata gives an extracted entry the extended attributes and the
+// modification time in its header, as far as Options asks for them. A
+// filesystem that won't take an attribute isn't worth failing the patch over.
+func (opts Options) restoreMetadata(path string, header *tar.Header) error {
+	if opts.Xattrs {
+		for key, value := range header.PAXRecords {
+			if !strings.HasPrefix(key, xattrPrefix) {
+				continue
+			}
+			name := strings.TrimPrefix(key, xattrPrefix)
+			if err := setXattr(path, name, value); err != nil {
+				log.Warning("Could not restore extended attribute ", name, " of ", path, ": ", err)
+			}
+		}
+	}
+	return opts.restoreModTime(path, header)
+}
+
+// restoreModTime sets the modification time in header, and the access time if
+// the header has one
+func (opts Options) restoreModTime(path string, header *tar.Header) error {
+	if !opts.ModTimes || header.ModTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(path, header.AccessTime, header.ModTime)
+}
+
+// restoreDirs gives the directories created for dirs their metadata, the
+// deepest first so that setting one doesn't change its parent's time again
+func (opts Options) restoreDirs(dirs []dirEntry) error {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := opts.restoreMetadata(dirs[i].path, dirs[i].header); err != nil {
+			return fmt.Errorf("could not restore the times of %s: %w", dirs[i].path, err)
+		}
+	}
+	return nil
+}
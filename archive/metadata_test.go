@@ -0,0 +1,53 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestApplyModTimesAndXattrs(t *testing.T) {
+	built := time.Date(2024, 12, 2, 10, 30, 0, 0, time.UTC)
+	xattrs := map[string]string{xattrPrefix + "user.build": "63548"}
+	tarball := func() []byte {
+		return buildLinkTarball(t, []*tar.Header{
+			{Name: "webapps/sakai-foo/", Typeflag: tar.TypeDir, ModTime: built.Add(-time.Hour)},
+			{Name: "webapps/sakai-foo/index.jsp", Typeflag: tar.TypeReg, ModTime: built, PAXRecords: xattrs},
+			{Name: "lib/foo-api-22.2.jar", Typeflag: tar.TypeReg, ModTime: built},
+		})
+	}
+
+	target := t.TempDir()
+	_, err := Apply(target, bytes.NewReader(tarball()), Options{NoCleanup: true, ModTimes: true, Xattrs: true})
+	assert.NoError(t, err)
+	info, _ := os.Stat(filepath.Join(target, "webapps/sakai-foo/index.jsp"))
+	assert.True(t, built.Equal(info.ModTime()), info.ModTime())
+	info, _ = os.Stat(filepath.Join(target, "webapps/sakai-foo"))
+	assert.True(t, built.Add(-time.Hour).Equal(info.ModTime()), "written into, yet the directory keeps its time")
+
+	value := make([]byte, 64)
+	if n, err := unix.Lgetxattr(filepath.Join(target, "webapps/sakai-foo/index.jsp"), "user.build", value); err == nil {
+		assert.Equal(t, "63548", string(value[:n]))
+	} else {
+		t.Log("no user xattrs on this filesystem: ", err)
+	}
+
+	// Staged files keep their times when they're moved into place
+	target = t.TempDir()
+	_, err = ApplyStaged(target, bytes.NewReader(tarball()), Options{NoCleanup: true, ModTimes: true}, nil)
+	assert.NoError(t, err)
+	info, _ = os.Stat(filepath.Join(target, "lib/foo-api-22.2.jar"))
+	assert.True(t, built.Equal(info.ModTime()))
+
+	target = t.TempDir()
+	_, err = Apply(target, bytes.NewReader(tarball()), Options{NoCleanup: true})
+	assert.NoError(t, err)
+	info, _ = os.Stat(filepath.Join(target, "lib/foo-api-22.2.jar"))
+	assert.WithinDuration(t, time.Now(), info.ModTime(), time.Minute)
+}
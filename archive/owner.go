@@ -0,0 +1,56 @@
+package archive
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+)
+
+// Owner is who extracted files should belong to, for a patcher running as
+// root on behalf of the server's own user
+type Owner struct {
+	UID int
+	GID int
+}
+
+// ownerOf picks the owner of an entry: the tar header's with TarOwner, else
+// Owner. ok is false when files are left to whoever writes them.
+func (opts Options) ownerOf(header *tar.Header) (owner Owner, ok bool) {
+	if opts.TarOwner && header != nil {
+		return Owner{header.Uid, header.Gid}, true
+	}
+	if opts.Owner != nil {
+		return *opts.Owner, true
+	}
+	return Owner{}, false
+}
+
+// chown gives path, not what it links to, to the owner of header
+func (opts Options) chown(path string, header *tar.Header) error {
+	owner, ok := opts.ownerOf(header)
+	if !ok {
+		return nil
+	}
+	return os.Lchown(path, owner.UID, owner.GID)
+}
+
+// mkdirAll is os.MkdirAll, with the directories it creates given to Owner.
+// Existing directories keep their owner.
+func (opts Options) mkdirAll(dir string, mode os.FileMode) error {
+	if opts.Owner == nil {
+		return os.MkdirAll(dir, mode)
+	}
+	var missing []string
+	for d := dir; !pathExists(d) && d != filepath.Dir(d); d = filepath.Dir(d) {
+		missing = append(missing, d)
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := opts.chown(missing[i], nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
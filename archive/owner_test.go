@@ -0,0 +1,65 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ownerOfPath(t *testing.T, path string) Owner {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := fi.Sys().(*syscall.Stat_t)
+	return Owner{int(stat.Uid), int(stat.Gid)}
+}
+
+func TestApplyOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("only root can give files away")
+	}
+	tarball := buildLinkTarball(t, []*tar.Header{
+		{Name: "webapps/sakai-foo/", Typeflag: tar.TypeDir, Uid: 3000, Gid: 3000},
+		{Name: "webapps/sakai-foo/index.jsp", Typeflag: tar.TypeReg, Uid: 3001, Gid: 3001},
+		{Name: "lib/foo-api-22.2.jar", Typeflag: tar.TypeReg, Uid: 3002, Gid: 3002},
+		{Name: "lib/foo-api.jar", Typeflag: tar.TypeSymlink, Linkname: "foo-api-22.2.jar", Uid: 3003, Gid: 3003},
+	})
+	tomcat := Owner{1234, 5678}
+
+	target := t.TempDir()
+	writeTestFile(t, filepath.Join(target, "webapps/ROOT/index.jsp"), "existing")
+	_, err := Apply(target, bytes.NewReader(tarball), Options{NoCleanup: true, Owner: &tomcat})
+	assert.NoError(t, err)
+	for _, name := range []string{"webapps/sakai-foo", "webapps/sakai-foo/index.jsp", "lib", "lib/foo-api-22.2.jar", "lib/foo-api.jar"} {
+		assert.Equal(t, tomcat, ownerOfPath(t, filepath.Join(target, name)), name)
+	}
+	assert.Equal(t, Owner{0, 0}, ownerOfPath(t, filepath.Join(target, "webapps")), "existing directories keep their owner")
+
+	// Staged files are given away before they're moved into place
+	target = t.TempDir()
+	_, err = ApplyStaged(target, bytes.NewReader(tarball), Options{NoCleanup: true, Owner: &tomcat}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, tomcat, ownerOfPath(t, filepath.Join(target, "lib")))
+	assert.Equal(t, tomcat, ownerOfPath(t, filepath.Join(target, "lib/foo-api-22.2.jar")))
+
+	// The tarball's owners win for its own entries, created parents are still the server's
+	target = t.TempDir()
+	_, err = Apply(target, bytes.NewReader(tarball), Options{NoCleanup: true, Owner: &tomcat, TarOwner: true})
+	assert.NoError(t, err)
+	assert.Equal(t, Owner{3000, 3000}, ownerOfPath(t, filepath.Join(target, "webapps/sakai-foo")))
+	assert.Equal(t, Owner{3001, 3001}, ownerOfPath(t, filepath.Join(target, "webapps/sakai-foo/index.jsp")))
+	assert.Equal(t, Owner{3003, 3003}, ownerOfPath(t, filepath.Join(target, "lib/foo-api.jar")))
+	assert.Equal(t, tomcat, ownerOfPath(t, filepath.Join(target, "lib")))
+
+	// Without an owner nothing is given away
+	target = t.TempDir()
+	_, err = Apply(target, bytes.NewReader(tarball), Options{NoCleanup: true})
+	assert.NoError(t, err)
+	assert.Equal(t, Owner{0, 0}, ownerOfPath(t, filepath.Join(target, "lib/foo-api-22.2.jar")))
+}
@@ -0,0 +1,324 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNotApplied marks an ApplyStaged error that left the target untouched, so
+// the patch can be tried again from another source
+var ErrNotApplied = errors.New("patch not applied")
+
+// stagedDirPattern names the staging directory ApplyStaged makes in the target
+const stagedDirPattern = ".go-patcher-staged-*"
+
+// retiredDirPattern names the directory in the target that what a patch
+// replaces as a whole is moved to
+const retiredDirPattern = ".go-patcher-retired-*"
+
+// ApplyStaged reads src once, for a source that can't be rewound such as an
+// HTTP response. The patch is unpacked into a staging directory inside target,
+// so it never needs room in StagingDir and moving it into place is a rename.
+// Nothing in target changes until src has been read to the end and accept, if
+// given, approves of it, e.g. by checking a checksum of what was read.
+func ApplyStaged(target string, src io.Reader, opts Options, accept func() error) (Report, error) {
+	sweepStaged(target)
+	staging, err := os.MkdirTemp(target, stagedDirPattern)
+	if err != nil {
+		return Report{}, fmt.Errorf("%w: could not create staging directory: %w", ErrNotApplied, err)
+	}
+	defer os.RemoveAll(staging)
+
+	staged, err := walk(staging, src, opts, false)
+	if err != nil {
+		return Report{}, fmt.Errorf("%w: %w", ErrNotApplied, err)
+	}
+	// The tar end marker may come before the end of the stream, accept needs all of it
+	if _, err := io.Copy(io.Discard, src); err != nil {
+		return Report{}, fmt.Errorf("%w: could not read tarball: %w", ErrNotApplied, err)
+	}
+	if accept != nil {
+		if err := accept(); err != nil {
+			return Report{}, fmt.Errorf("%w: %w", ErrNotApplied, err)
+		}
+	}
+
+	if err := checkStaged(target, staging, staged); err != nil {
+		return Report{}, fmt.Errorf("%w: %w", ErrNotApplied, err)
+	}
+
+	report := Report{Counts: staged.Counts, sizes: staged.sizes}
+	swap := &dirSwap{staging: staging, opts: opts}
+	defer swap.cleanup()
+	if !opts.NoCleanup {
+		if report.Removed, err = removeStale(target, staged.Counts, swap); err != nil {
+			return report, err
+		}
+	}
+
+	// Directory entries before the files in them, which would get directories
+	// of the default mode otherwise, and so that empty ones come along
+	var createdDirs []dirEntry
+	for _, dir := range staged.dirs {
+		name := dir.path
+		if len(staged.Linked) > 0 {
+			if name, err = resolveStaged(staging, name); err != nil {
+				return report, err
+			}
+		}
+		// A symlink to a directory is moved with the links
+		if fi, err := os.Lstat(filepath.Join(staging, name)); err != nil || !fi.IsDir() {
+			continue
+		}
+		fullPath := filepath.Join(target, name)
+		if swap.covers(name+"/") || pathExists(fullPath) {
+			continue
+		}
+		if err := opts.mkdirAll(fullPath, os.FileMode(dir.header.Mode)); err != nil {
+			return report, fmt.Errorf("could not create directory %s: %w", name, err)
+		}
+		if err := opts.chown(fullPath, dir.header); err != nil {
+			return report, fmt.Errorf("could not change the owner of %s: %w", name, err)
+		}
+		createdDirs = append(createdDirs, dirEntry{fullPath, dir.header})
+	}
+
+	skipPattern := opts.SkipPattern
+	if skipPattern == nil {
+		skipPattern = DefaultSkipPattern
+	}
+	moved := make(map[string]bool, len(staged.Written))
+	for _, name := range staged.Written {
+		if len(staged.Linked) > 0 {
+			resolved, err := resolveStaged(staging, name)
+			if err != nil {
+				return report, err
+			}
+			report.sizes[resolved] = staged.sizes[name]
+			name = resolved
+		}
+		if moved[name] {
+			continue
+		}
+		moved[name] = true
+		if swap.covers(name) {
+			report.Written = append(report.Written, name)
+			continue
+		}
+		fullPath := filepath.Join(target, name)
+		// Do not overwrite an existing jldap-beans.xml or unboundid-ldap.xml or components.xml
+		if skipPattern.MatchString(name) && pathExists(fullPath) {
+			log.Debug("Skipping file: ", name)
+			report.Skipped = append(report.Skipped, name)
+			continue
+		}
+		if err := opts.mkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			return report, fmt.Errorf("could not create directory for %s: %w", name, err)
+		}
+		if err := os.Rename(filepath.Join(staging, name), fullPath); err != nil {
+			return report, fmt.Errorf("could not move %s into place: %w", name, err)
+		}
+		report.Written = append(report.Written, name)
+	}
+	// Links last, a file under a symlinked directory was staged where it points
+	for _, name := range staged.Linked {
+		if swap.covers(name) {
+			report.Linked = append(report.Linked, name)
+			continue
+		}
+		fullPath := filepath.Join(target, name)
+		if fi, err := os.Lstat(fullPath); err == nil && fi.IsDir() {
+			return report, fmt.Errorf("could not move link %s into place: a directory is in the way", name)
+		}
+		if err := opts.mkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			return report, fmt.Errorf("could not create directory for %s: %w", name, err)
+		}
+		if err := os.Rename(filepath.Join(staging, name), fullPath); err != nil {
+			return report, fmt.Errorf("could not move %s into place: %w", name, err)
+		}
+		report.Linked = append(report.Linked, name)
+	}
+	if err := opts.restoreDirs(createdDirs); err != nil {
+		return report, err
+	}
+	if opts.Sync {
+		if err := syncTree(target, report); err != nil {
+			return report, err
+		}
+	}
+	return report, verifySizes(target, report)
+}
+
+// dirSwap moves the directories a patch replaces as a whole from the staging
+// directory into target, a rename each. What they replace is kept in retired
+// until the patch is in place.
+type dirSwap struct {
+	staging string
+	opts    Options
+	retired string
+	swapped []string
+}
+
+// replace swaps the staged copy of dir for the one in target. It reports false
+// when nothing of dir was staged.
+func (s *dirSwap) replace(target string, dir string) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	staged := filepath.Join(s.staging, dir)
+	if fi, err := os.Lstat(staged); err != nil || !fi.IsDir() {
+		return false, nil
+	}
+	live := filepath.Join(target, dir)
+	var old string
+	if _, err := os.Lstat(live); err == nil {
+		if s.retired == "" {
+			if s.retired, err = os.MkdirTemp(target, retiredDirPattern); err != nil {
+				return false, err
+			}
+		}
+		old = filepath.Join(s.retired, dir)
+		if err := os.MkdirAll(filepath.Dir(old), 0755); err != nil {
+			return false, err
+		}
+		if err := os.Rename(live, old); err != nil {
+			return false, err
+		}
+	}
+	err := s.opts.mkdirAll(filepath.Dir(live), 0755)
+	if err == nil {
+		err = os.Rename(staged, live)
+	}
+	if err != nil {
+		// Put the old one back, it's still whole
+		if old != "" {
+			os.Rename(old, live)
+		}
+		return false, err
+	}
+	s.swapped = append(s.swapped, dir)
+	return true, nil
+}
+
+// covers reports whether name came into place with a swapped directory
+func (s *dirSwap) covers(name string) bool {
+	for _, dir := range s.swapped {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanup removes the directories swapped out
+func (s *dirSwap) cleanup() {
+	if s.retired != "" {
+		os.RemoveAll(s.retired)
+	}
+}
+
+// sweepStaged removes the staging directories of an ApplyStaged that was
+// interrupted, e.g. by the patcher being killed. A directory it had moved out
+// of the way but not yet replaced is put back first.
+func sweepStaged(target string) {
+	staging, _ := filepath.Glob(filepath.Join(target, stagedDirPattern))
+	retired, _ := filepath.Glob(filepath.Join(target, retiredDirPattern))
+	for _, dir := range retired {
+		restored := true
+		// dirSwap only replaces components/<name>
+		old, _ := filepath.Glob(filepath.Join(dir, "*", "*"))
+		for _, path := range old {
+			rel, _ := filepath.Rel(dir, path)
+			live := filepath.Join(target, rel)
+			if _, err := os.Lstat(live); !os.IsNotExist(err) {
+				continue
+			}
+			log.Warning("Putting back ", rel, ", an interrupted patch left nothing in its place")
+			if err := os.Rename(path, live); err != nil {
+				// It's the only copy left
+				log.Warning("Could not put back ", rel, ", keeping ", dir, ": ", err)
+				restored = false
+				break
+			}
+		}
+		if restored {
+			staging = append(staging, dir)
+		}
+	}
+	for _, dir := range staging {
+		log.Info("Removing ", dir, " left by an interrupted patch")
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warning("Could not remove ", dir, ": ", err)
+		}
+	}
+}
+
+// checkStaged follows what was staged through the symlinks already in target,
+// which the walk into the staging directory couldn't see
+func checkStaged(target string, staging string, staged Report) error {
+	links := newLinkResolver(target, true)
+	for _, name := range staged.Linked {
+		if _, ok := links.resolve(path.Dir(name), true); !ok {
+			return fmt.Errorf("tarball entry %s leads outside the target directory through a symlink", name)
+		}
+		linkname, err := os.Readlink(filepath.Join(staging, name))
+		if err != nil {
+			// A hard link, it's a file of its own by now
+			links.symlink(name, "")
+			continue
+		}
+		linkname = filepath.ToSlash(linkname)
+		if _, ok := links.resolve(path.Dir(name)+"/"+linkname, false); !ok {
+			return fmt.Errorf("tarball link %s to %s points outside the target directory", name, linkname)
+		}
+		links.symlink(name, linkname)
+	}
+	for _, name := range staged.Written {
+		if _, ok := links.resolve(path.Dir(name), true); !ok {
+			return fmt.Errorf("tarball entry %s leads outside the target directory through a symlink", name)
+		}
+	}
+	return nil
+}
+
+// resolveStaged follows the symlinks the patch staged above name, to where
+// the file really is. The links are checked to stay inside the staging dir.
+func resolveStaged(staging string, name string) (string, error) {
+	root, err := filepath.EvalSymlinks(staging)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join(staging, filepath.Dir(name)))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, filepath.Join(dir, filepath.Base(name)))
+	if err != nil || !isBeneath(root, filepath.Join(root, rel)) {
+		return "", fmt.Errorf("%s resolves outside the staging directory", name)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// verifySizes compares the size of every written file with its tar header
+func verifySizes(target string, report Report) error {
+	var problems []string
+	for _, name := range report.Written {
+		fi, err := os.Stat(filepath.Join(target, name))
+		if err != nil {
+			problems = append(problems, name+": "+err.Error())
+		} else if fi.Size() != report.sizes[name] {
+			problems = append(problems, fmt.Sprintf("%s: size %d, expected %d", name, fi.Size(), report.sizes[name]))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("verification failed: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
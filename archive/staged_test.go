@@ -0,0 +1,207 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyStaged(t *testing.T) {
+	target := t.TempDir()
+	writeTestFile(t, filepath.Join(target, "components/sakai-foo-pack/WEB-INF/lib/foo-impl-22.1.jar"), "old")
+	writeTestFile(t, filepath.Join(target, "lib/foo-api-22.1.jar"), "old")
+	writeTestFile(t, filepath.Join(target, "components/sakai-provider-pack/WEB-INF/unboundid-ldap.xml"), "<beans>local</beans>")
+
+	tarball := buildTarball(t, map[string]string{
+		"components/sakai-foo-pack/WEB-INF/components.xml":            "<beans/>",
+		"components/sakai-foo-pack/WEB-INF/lib/foo-impl-22.2.jar":     "new",
+		"components/sakai-foo-pack/WEB-INF/lib/foo-util-22.2.jar":     "new",
+		"components/sakai-foo-pack/WEB-INF/lib/foo-util-ext-22.2.jar": "new",
+		"components/sakai-provider-pack/WEB-INF/unboundid-ldap.xml":   "<beans/>",
+		"lib/foo-api-22.2.jar": "new",
+	})
+
+	read := 0
+	accept := func() error {
+		assert.Equal(t, len(tarball), read, "the whole stream is read before anything changes")
+		return nil
+	}
+	report, err := ApplyStaged(target, readCounter{io.MultiReader(bytes.NewReader(tarball)), &read}, Options{}, accept)
+	if err != nil {
+		t.Fatalf("ApplyStaged() returned error: %v", err)
+	}
+
+	assert.NoFileExists(t, filepath.Join(target, "components/sakai-foo-pack/WEB-INF/lib/foo-impl-22.1.jar"))
+	assert.NoFileExists(t, filepath.Join(target, "lib/foo-api-22.1.jar"))
+	assert.FileExists(t, filepath.Join(target, "lib/foo-api-22.2.jar"))
+	content, _ := os.ReadFile(filepath.Join(target, "components/sakai-provider-pack/WEB-INF/unboundid-ldap.xml"))
+	assert.Equal(t, "<beans>local</beans>", string(content))
+	assert.Len(t, report.Written, 5)
+	assert.Equal(t, []string{"components/sakai-provider-pack/WEB-INF/unboundid-ldap.xml"}, report.Skipped)
+	assert.ElementsMatch(t, []string{"components/sakai-foo-pack", "lib/foo-api-22.1.jar"}, report.Removed)
+
+	staging, _ := filepath.Glob(filepath.Join(target, stagedDirPattern))
+	assert.Empty(t, staging)
+}
+
+func TestApplyStagedLeavesTargetAlone(t *testing.T) {
+	target := t.TempDir()
+	writeTestFile(t, filepath.Join(target, "lib/foo-api-22.1.jar"), "old")
+	tarball := buildTarball(t, map[string]string{"lib/foo-api-22.2.jar": "new"})
+
+	// Rejected once read
+	_, err := ApplyStaged(target, bytes.NewReader(tarball), Options{}, func() error { return errors.New("checksum mismatch") })
+	assert.True(t, errors.Is(err, ErrNotApplied))
+	// Cut off halfway
+	_, err = ApplyStaged(target, io.LimitReader(bytes.NewReader(tarball), int64(len(tarball)/2)), Options{}, nil)
+	assert.True(t, errors.Is(err, ErrNotApplied))
+
+	assert.FileExists(t, filepath.Join(target, "lib/foo-api-22.1.jar"))
+	assert.NoFileExists(t, filepath.Join(target, "lib/foo-api-22.2.jar"))
+	entries, _ := os.ReadDir(target)
+	assert.Len(t, entries, 1, "only lib is left")
+}
+
+func TestApplyAtomic(t *testing.T) {
+	target := t.TempDir()
+	writeTestFile(t, filepath.Join(target, "components/sakai-foo-pack/WEB-INF/lib/foo-impl-22.1.jar"), "old")
+	writeTestFile(t, filepath.Join(target, "components/sakai-provider-pack/WEB-INF/unboundid-ldap.xml"), "<beans>local</beans>")
+	tarball := buildTarball(t, map[string]string{
+		"components/sakai-foo-pack/WEB-INF/components.xml":            "<beans/>",
+		"components/sakai-foo-pack/WEB-INF/lib/foo-impl-22.2.jar":     "new",
+		"components/sakai-foo-pack/WEB-INF/lib/foo-util-22.2.jar":     "new",
+		"components/sakai-foo-pack/WEB-INF/lib/foo-util-ext-22.2.jar": "new",
+		"components/sakai-provider-pack/WEB-INF/unboundid-ldap.xml":   "<beans/>",
+		"lib/foo-api-22.2.jar": "new",
+	})
+
+	// Nothing changes when the patch can't be extracted in full
+	_, err := Apply(target, io.LimitReader(bytes.NewReader(tarball), int64(len(tarball)/2)), Options{Atomic: true})
+	assert.True(t, errors.Is(err, ErrNotApplied))
+	assert.FileExists(t, filepath.Join(target, "components/sakai-foo-pack/WEB-INF/lib/foo-impl-22.1.jar"))
+	assert.NoDirExists(t, filepath.Join(target, "lib"))
+
+	report, err := Apply(target, bytes.NewReader(tarball), Options{Atomic: true})
+	assert.NoError(t, err)
+	assert.Len(t, report.Written, 5)
+	assert.Equal(t, []string{"components/sakai-provider-pack/WEB-INF/unboundid-ldap.xml"}, report.Skipped)
+	assert.Equal(t, []string{"components/sakai-foo-pack"}, report.Removed)
+	assert.NoFileExists(t, filepath.Join(target, "components/sakai-foo-pack/WEB-INF/lib/foo-impl-22.1.jar"))
+	assert.FileExists(t, filepath.Join(target, "components/sakai-foo-pack/WEB-INF/lib/foo-util-ext-22.2.jar"))
+	assert.FileExists(t, filepath.Join(target, "lib/foo-api-22.2.jar"))
+	content, _ := os.ReadFile(filepath.Join(target, "components/sakai-provider-pack/WEB-INF/unboundid-ldap.xml"))
+	assert.Equal(t, "<beans>local</beans>", string(content))
+
+	// The staged and the swapped out copies are gone
+	staging, _ := filepath.Glob(filepath.Join(target, stagedDirPattern))
+	assert.Empty(t, staging)
+	retired, _ := filepath.Glob(filepath.Join(target, retiredDirPattern))
+	assert.Empty(t, retired)
+}
+
+func TestApplyAtomicSweepsInterruptedPatch(t *testing.T) {
+	target := t.TempDir()
+	writeTestFile(t, filepath.Join(target, ".go-patcher-staged-123/lib/foo-api-22.2.jar"), "staged")
+	// Killed between moving sakai-foo-pack out and its new copy in
+	writeTestFile(t, filepath.Join(target, ".go-patcher-retired-456/components/sakai-foo-pack/WEB-INF/components.xml"), "old")
+	// And after swapping sakai-bar-pack
+	writeTestFile(t, filepath.Join(target, ".go-patcher-retired-789/components/sakai-bar-pack/WEB-INF/components.xml"), "old")
+	writeTestFile(t, filepath.Join(target, "components/sakai-bar-pack/WEB-INF/components.xml"), "new")
+
+	tarball := buildTarball(t, map[string]string{"lib/foo-api-22.2.jar": "new"})
+	_, err := Apply(target, bytes.NewReader(tarball), Options{Atomic: true})
+	assert.NoError(t, err)
+
+	entries, _ := os.ReadDir(target)
+	for _, entry := range entries {
+		assert.NotContains(t, entry.Name(), ".go-patcher-")
+	}
+	content, _ := os.ReadFile(filepath.Join(target, "components/sakai-foo-pack/WEB-INF/components.xml"))
+	assert.Equal(t, "old", string(content))
+	content, _ = os.ReadFile(filepath.Join(target, "components/sakai-bar-pack/WEB-INF/components.xml"))
+	assert.Equal(t, "new", string(content))
+}
+
+func TestApplyAtomicDirectories(t *testing.T) {
+	modTime := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range []*tar.Header{
+		{Name: "components/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "components/sakai-foo-pack/", Typeflag: tar.TypeDir, Mode: 0750},
+		{Name: "components/sakai-foo-pack/WEB-INF/", Typeflag: tar.TypeDir, Mode: 0750},
+		{Name: "components/sakai-foo-pack/WEB-INF/components.xml", Typeflag: tar.TypeReg, Mode: 0640},
+		{Name: "components/sakai-foo-pack/WEB-INF/lib/foo-impl-22.2.jar", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "components/sakai-foo-pack/WEB-INF/lib/foo-util-22.2.jar", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "components/sakai-foo-pack/WEB-INF/lib/foo-util-ext-22.2.jar", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "webapps/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "webapps/sakai-foo-tool/", Typeflag: tar.TypeDir, Mode: 0750},
+		{Name: "webapps/sakai-foo-tool/index.jsp", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "webapps/sakai-foo-tool/cache/", Typeflag: tar.TypeDir, Mode: 0700},
+	} {
+		hdr.ModTime = modTime
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		tw.Write([]byte(hdr.Name)[:hdr.Size])
+	}
+	tw.Close()
+	gz.Close()
+
+	// What's in a tree, with the times not from the tarball left out
+	type entry struct {
+		mode    os.FileMode
+		modTime time.Time
+	}
+	tree := func(target string) map[string]entry {
+		entries := map[string]entry{}
+		filepath.Walk(target, func(path string, fi os.FileInfo, err error) error {
+			if rel, _ := filepath.Rel(target, path); rel != "." && rel != "components" {
+				entries[rel] = entry{mode: fi.Mode()}
+				if fi.ModTime().Equal(modTime) {
+					entries[rel] = entry{fi.Mode(), modTime}
+				}
+			}
+			return err
+		})
+		return entries
+	}
+	apply := func(atomic bool) map[string]entry {
+		target := t.TempDir()
+		writeTestFile(t, filepath.Join(target, "components/sakai-foo-pack/WEB-INF/lib/foo-impl-22.1.jar"), "old")
+		_, err := Apply(target, bytes.NewReader(buf.Bytes()), Options{ModTimes: true, Atomic: atomic})
+		assert.NoError(t, err)
+		return tree(target)
+	}
+
+	atomic := apply(true)
+	assert.Equal(t, apply(false), atomic)
+	assert.Equal(t, os.ModeDir|0700, atomic["webapps/sakai-foo-tool/cache"].mode, "the empty directory is there")
+	assert.Equal(t, os.ModeDir|0750, atomic["webapps/sakai-foo-tool"].mode)
+	assert.Equal(t, modTime, atomic["webapps/sakai-foo-tool"].modTime)
+	assert.Equal(t, os.ModeDir|0750, atomic["components/sakai-foo-pack"].mode)
+}
+
+// readCounter counts the bytes read from r
+type readCounter struct {
+	r io.Reader
+	n *int
+}
+
+func (c readCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += n
+	return n, err
+}
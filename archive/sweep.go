@@ -0,0 +1,104 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MinArchiveSize is the smallest possible zip: an empty end of central directory record
+const MinArchiveSize = 22
+
+// ArchiveExtensions are the Java archives Sweep checks
+var ArchiveExtensions = []string{".jar", ".war", ".ear"}
+
+var zipMagic = []byte("PK\x03\x04")
+var emptyZipMagic = []byte("PK\x05\x06")
+
+// Problem is a broken archive found by Sweep, with the path relative to the target
+type Problem struct {
+	Path   string
+	Reason string
+}
+
+func (p Problem) String() string {
+	return p.Path + " " + p.Reason
+}
+
+// Sweep looks in the given directories, relative to target, for JARs and WARs that
+// are empty, truncated or not zips at all. These are what a failed extraction
+// leaves behind, and Tomcat only reports them as a confusing startup failure.
+func Sweep(target string, dirs []string) ([]Problem, error) {
+	unique := map[string]bool{}
+	for _, dir := range dirs {
+		unique[filepath.Clean(dir)] = true
+	}
+	sorted := make([]string, 0, len(unique))
+	for dir := range unique {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+
+	var problems []Problem
+	for _, dir := range sorted {
+		entries, err := os.ReadDir(filepath.Join(target, dir))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return problems, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !isArchive(entry.Name()) {
+				continue
+			}
+			name := filepath.ToSlash(filepath.Join(dir, entry.Name()))
+			if reason := checkArchiveFile(filepath.Join(target, name)); reason != "" {
+				problems = append(problems, Problem{Path: name, Reason: reason})
+			}
+		}
+	}
+	return problems, nil
+}
+
+func isArchive(name string) bool {
+	for _, ext := range ArchiveExtensions {
+		if strings.EqualFold(filepath.Ext(name), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkArchiveFile returns why the file is broken, or "" if it looks like a zip
+func checkArchiveFile(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return "could not be opened: " + err.Error()
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "could not be read: " + err.Error()
+	}
+
+	switch {
+	case info.Size() == 0:
+		return "is empty"
+	case info.Size() < MinArchiveSize:
+		return fmt.Sprintf("is truncated (%d bytes)", info.Size())
+	}
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return "could not be read: " + err.Error()
+	}
+	if !bytes.Equal(magic, zipMagic) && !bytes.Equal(magic, emptyZipMagic) {
+		return "is not a zip file"
+	}
+	return ""
+}
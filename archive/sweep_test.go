@@ -0,0 +1,27 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSweep(t *testing.T) {
+	target := t.TempDir()
+	writeTestFile(t, filepath.Join(target, "lib/good.jar"), "PK\x03\x04"+string(make([]byte, 40)))
+	writeTestFile(t, filepath.Join(target, "lib/empty.jar"), "")
+	writeTestFile(t, filepath.Join(target, "lib/short.jar"), "PK\x03\x04")
+	writeTestFile(t, filepath.Join(target, "lib/README.txt"), "")
+	writeTestFile(t, filepath.Join(target, "webapps/portal.war"), "<html>404 Not Found from the CDN</html>")
+	os.MkdirAll(filepath.Join(target, "webapps/portal"), 0755)
+
+	problems, err := Sweep(target, []string{"webapps", "lib", "lib/", "components/gone"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Problem{
+		{Path: "lib/empty.jar", Reason: "is empty"},
+		{Path: "lib/short.jar", Reason: "is truncated (4 bytes)"},
+		{Path: "webapps/portal.war", Reason: "is not a zip file"},
+	}, problems)
+}
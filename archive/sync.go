@@ -0,0 +1,94 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// syncWorkers bounds how many fsyncs are in flight at once. Syncing files in
+// parallel after extraction lets the disk batch the writeback instead of
+// paying for a flush after every single file.
+const syncWorkers = 8
+
+// syncTree flushes every written file, then every directory whose entries the
+// patch changed, so nothing reported as written can come back empty after a
+// power loss. Directories are synced once each, after all of their files.
+func syncTree(target string, report Report) error {
+	files := make([]string, 0, len(report.Written))
+	for _, name := range report.Written {
+		files = append(files, filepath.Join(target, name))
+	}
+	if err := syncAll(files); err != nil {
+		return err
+	}
+
+	changed := append(append([]string{}, report.Written...), report.Removed...)
+	if err := syncAll(parentDirs(target, changed)); err != nil {
+		return err
+	}
+	log.Debugf("Synced %d files to disk", len(files))
+	return nil
+}
+
+// parentDirs lists every directory between target and the given paths,
+// target included, since MkdirAll may have created any of them
+func parentDirs(target string, names []string) []string {
+	seen := map[string]bool{target: true}
+	for _, name := range names {
+		for dir := filepath.Dir(filepath.Join(target, name)); !seen[dir]; dir = filepath.Dir(dir) {
+			if rel, err := filepath.Rel(target, dir); err != nil || strings.HasPrefix(rel, "..") {
+				break
+			}
+			seen[dir] = true
+		}
+	}
+	dirs := make([]string, 0, len(seen))
+	for dir := range seen {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// syncAll fsyncs paths across syncWorkers goroutines and returns the first error
+func syncAll(paths []string) error {
+	work := make(chan string)
+	errs := make(chan error, len(paths))
+	var wg sync.WaitGroup
+	for i := 0; i < syncWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range work {
+				if err := syncPath(path); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for _, path := range paths {
+		work <- path
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not sync %s: %w", path, err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("could not sync %s: %w", path, err)
+	}
+	return nil
+}
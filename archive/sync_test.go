@@ -0,0 +1,50 @@
+package archive
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParentDirs(t *testing.T) {
+	target := filepath.Join("/opt", "tomcat")
+	dirs := parentDirs(target, []string{
+		"components/sakai-foo-pack/WEB-INF/lib/foo-impl-22.2.jar",
+		"components/sakai-foo-pack/WEB-INF/components.xml",
+		"lib/foo-api-22.2.jar",
+		"webapps/foo-tool",
+	})
+	assert.Equal(t, []string{
+		"/opt/tomcat",
+		"/opt/tomcat/components",
+		"/opt/tomcat/components/sakai-foo-pack",
+		"/opt/tomcat/components/sakai-foo-pack/WEB-INF",
+		"/opt/tomcat/components/sakai-foo-pack/WEB-INF/lib",
+		"/opt/tomcat/lib",
+		"/opt/tomcat/webapps",
+	}, dirs)
+
+	// Nothing outside the target is ever synced
+	assert.Equal(t, []string{".", "lib"}, parentDirs(".", []string{"lib/a.jar", "../escape.jar"}))
+	assert.NotContains(t, parentDirs("/opt/tomcat", []string{"../../etc/passwd"}), "/")
+}
+
+func TestApplyWithSync(t *testing.T) {
+	target := t.TempDir()
+	tarball := buildTarball(t, map[string]string{
+		"components/sakai-foo-pack/WEB-INF/components.xml": "<beans/>",
+		"lib/foo-api-22.2.jar":                             "new",
+	})
+
+	report, err := Apply(target, bytes.NewReader(tarball), Options{Sync: true})
+	assert.NoError(t, err)
+	assert.Len(t, report.Written, 2)
+
+	assert.NoError(t, syncAll(parentDirs(target, report.Written)))
+	err = syncAll([]string{filepath.Join(target, "lib/foo-api-22.2.jar"), filepath.Join(target, "missing.jar")})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "missing.jar")
+	}
+}
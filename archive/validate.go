@@ -0,0 +1,49 @@
+package archive
+
+import (
+	"archive/zip"
+	"io"
+	"path/filepath"
+)
+
+const manifestName = "META-INF/MANIFEST.MF"
+
+// Validate opens every JAR, WAR and EAR among files, relative to target, as a zip
+// and reads its manifest, which checks the central directory and the manifest's CRC.
+// A corrupt artifact otherwise surfaces hours later as a NoClassDefFoundError.
+func Validate(target string, files []string) []Problem {
+	var problems []Problem
+	for _, file := range files {
+		if !isArchive(file) {
+			continue
+		}
+		if reason := validateArchive(filepath.Join(target, file)); reason != "" {
+			problems = append(problems, Problem{Path: filepath.ToSlash(file), Reason: reason})
+		}
+	}
+	return problems
+}
+
+func validateArchive(path string) string {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return "is not a valid zip: " + err.Error()
+	}
+	defer reader.Close()
+
+	for _, entry := range reader.File {
+		if entry.Name != manifestName {
+			continue
+		}
+		manifest, err := entry.Open()
+		if err != nil {
+			return "has an unreadable manifest: " + err.Error()
+		}
+		_, err = io.Copy(io.Discard, manifest)
+		manifest.Close()
+		if err != nil {
+			return "has an unreadable manifest: " + err.Error()
+		}
+	}
+	return ""
+}
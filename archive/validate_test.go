@@ -0,0 +1,43 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func buildJar(t *testing.T, manifest string) []byte {
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	entry, err := writer.CreateHeader(&zip.FileHeader{Name: "META-INF/MANIFEST.MF", Method: zip.Store})
+	assert.NoError(t, err)
+	entry.Write([]byte(manifest))
+	entry, _ = writer.Create("org/sakaiproject/Kernel.class")
+	entry.Write([]byte("cafebabe"))
+	assert.NoError(t, writer.Close())
+	return buf.Bytes()
+}
+
+func TestValidate(t *testing.T) {
+	target := t.TempDir()
+	jar := buildJar(t, "Manifest-Version: 1.0\nImplementation-Version: 23.1\n")
+	os.MkdirAll(filepath.Join(target, "lib"), 0755)
+	os.WriteFile(filepath.Join(target, "lib/good.jar"), jar, 0644)
+
+	// Cut off the central directory, as an interrupted extraction would
+	os.WriteFile(filepath.Join(target, "lib/truncated.jar"), jar[:len(jar)/2], 0644)
+
+	// Flip a byte of the stored manifest so its CRC no longer matches
+	corrupt := bytes.Replace(jar, []byte("Implementation-Version: 23.1"), []byte("Implementation-Version: 23.2"), 1)
+	os.WriteFile(filepath.Join(target, "lib/corrupt.jar"), corrupt, 0644)
+
+	problems := Validate(target, []string{"lib/good.jar", "lib/truncated.jar", "lib/corrupt.jar", "lib/README.txt"})
+	assert.Len(t, problems, 2)
+	assert.Equal(t, "lib/truncated.jar", problems[0].Path)
+	assert.Contains(t, problems[0].Reason, "is not a valid zip")
+	assert.Equal(t, Problem{Path: "lib/corrupt.jar", Reason: "has an unreadable manifest: zip: checksum error"}, problems[1])
+}
@@ -0,0 +1,93 @@
+package archive
+
+import (
+	"sync"
+)
+
+// workerFileLimit is the largest entry handed to an extraction worker. The
+// tar stream can only be read in order, so a worker's entry is read into
+// memory first; bigger ones are written by the walk itself.
+const workerFileLimit = 4 << 20
+
+// writerPool writes regular files on Workers goroutines while the walk reads
+// on. Anything that depends on a file being written, a link to it or another
+// entry for the same path, waits for the pool first.
+type writerPool struct {
+	jobs    chan func() error
+	workers sync.WaitGroup
+	running sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+
+	// pending are the paths submitted since the last wait
+	pending map[string]bool
+}
+
+// newWriterPool starts workers goroutines, or returns nil to write every
+// file in order when there's only one
+func newWriterPool(workers int) *writerPool {
+	if workers <= 1 {
+		return nil
+	}
+	p := &writerPool{jobs: make(chan func() error, workers), pending: map[string]bool{}}
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+		go func() {
+			defer p.workers.Done()
+			for job := range p.jobs {
+				if err := job(); err != nil {
+					p.mu.Lock()
+					if p.err == nil {
+						p.err = err
+					}
+					p.mu.Unlock()
+				}
+				p.running.Done()
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues a write of path, blocking while every worker is busy
+func (p *writerPool) submit(path string, job func() error) {
+	p.pending[path] = true
+	p.running.Add(1)
+	p.jobs <- job
+}
+
+// busy reports whether path has a write in flight
+func (p *writerPool) busy(path string) bool {
+	return p != nil && p.pending[path]
+}
+
+// failed returns the first error of a write so far
+func (p *writerPool) failed() error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// wait blocks until every submitted write is done and returns the first error
+func (p *writerPool) wait() error {
+	if p == nil {
+		return nil
+	}
+	p.running.Wait()
+	p.pending = map[string]bool{}
+	return p.failed()
+}
+
+// close waits for the writes in flight and stops the workers
+func (p *writerPool) close() {
+	if p == nil {
+		return
+	}
+	p.running.Wait()
+	close(p.jobs)
+	p.workers.Wait()
+}
@@ -0,0 +1,71 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyWorkers(t *testing.T) {
+	headers := []*tar.Header{{Name: "webapps/sakai-foo/", Typeflag: tar.TypeDir}}
+	for i := 1; i < 50; i++ {
+		headers = append(headers, &tar.Header{Name: fmt.Sprintf("webapps/sakai-foo/page-%02d.jsp", i), Typeflag: tar.TypeReg})
+	}
+	headers = append(headers,
+		// Linked once the file it links to is written
+		&tar.Header{Name: "webapps/sakai-foo/index.jsp", Typeflag: tar.TypeLink, Linkname: "webapps/sakai-foo/page-49.jsp"},
+		// The later entry for a path wins, buildLinkTarball writes the name as content
+		&tar.Header{Name: "./webapps/sakai-foo/page-00.jsp", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "webapps/sakai-foo/./page-00.jsp", Typeflag: tar.TypeReg},
+	)
+	tarball := buildLinkTarball(t, headers)
+
+	for _, opts := range []Options{{Workers: 8}, {Workers: 8, Atomic: true}, {Workers: 8, Streaming: true}} {
+		target := t.TempDir()
+		report, err := Apply(target, bytes.NewReader(tarball), opts)
+		assert.NoError(t, err)
+		assert.Contains(t, report.Written, "webapps/sakai-foo/page-00.jsp")
+		assert.Equal(t, []string{"webapps/sakai-foo/index.jsp"}, report.Linked)
+		for i := 1; i < 50; i++ {
+			name := fmt.Sprintf("webapps/sakai-foo/page-%02d.jsp", i)
+			content, _ := os.ReadFile(filepath.Join(target, name))
+			assert.Equal(t, name, string(content))
+		}
+		content, _ := os.ReadFile(filepath.Join(target, "webapps/sakai-foo/index.jsp"))
+		assert.Equal(t, "webapps/sakai-foo/page-49.jsp", string(content))
+		content, _ = os.ReadFile(filepath.Join(target, "webapps/sakai-foo/page-00.jsp"))
+		assert.Equal(t, "webapps/sakai-foo/./page-00.jsp", string(content))
+	}
+}
+
+func TestApplyWorkersFail(t *testing.T) {
+	target := t.TempDir()
+	// A file where a directory should be fails the writes beneath it
+	writeTestFile(t, filepath.Join(target, "webapps/sakai-foo"), "in the way")
+	var headers []*tar.Header
+	for i := 0; i < 20; i++ {
+		headers = append(headers, &tar.Header{Name: fmt.Sprintf("webapps/sakai-foo/page-%02d.jsp", i), Typeflag: tar.TypeReg})
+	}
+	_, err := Apply(target, bytes.NewReader(buildLinkTarball(t, headers)), Options{Workers: 4})
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "could not create file"), err.Error())
+	}
+
+	var pool *writerPool
+	assert.False(t, pool.busy("a"))
+	assert.NoError(t, pool.wait())
+	pool = newWriterPool(2)
+	pool.submit("a", func() error { return errors.New("disk full") })
+	pool.submit("b", func() error { return nil })
+	assert.True(t, pool.busy("a"))
+	assert.EqualError(t, pool.wait(), "disk full")
+	assert.False(t, pool.busy("a"))
+	pool.close()
+}
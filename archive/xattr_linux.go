@@ -0,0 +1,8 @@
+package archive
+
+import "golang.org/x/sys/unix"
+
+// setXattr sets an extended attribute on path itself, not what it links to
+func setXattr(path string, name string, value string) error {
+	return unix.Lsetxattr(path, name, []byte(value), 0)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package archive
+
+import "errors"
+
+// setXattr has no portable way to set attributes outside Linux
+func setXattr(path string, name string, value string) error {
+	return errors.New("extended attributes are only restored on Linux")
+}
@@ -0,0 +1,131 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// zipAsTar reads a zip file as the tarball it would be, so zip patches go
+// through the same skip rules, cleanup, modes and verification as tarballs.
+// The central directory is at the end, so a source that can't be read at any
+// offset is spooled to stagingDir first.
+func zipAsTar(src io.Reader, stagingDir string) (io.ReadCloser, error) {
+	file, size, cleanup, err := zipSource(src, stagingDir)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(file, size)
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("could not read zip: %w", err)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeZipAsTar(tar.NewWriter(writer), zr))
+	}()
+	return &zipTarReader{PipeReader: reader, cleanup: cleanup}, nil
+}
+
+// zipSource is src as something zip can read at any offset
+func zipSource(src io.Reader, stagingDir string) (io.ReaderAt, int64, func(), error) {
+	if file, ok := src.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		size, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("could not size zip: %w", err)
+		}
+		return file, size, func() {}, nil
+	}
+
+	tmp, err := os.CreateTemp(stagingDir, "go-patcher-zip-*")
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("could not create staging file: %w", err)
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	size, err := io.Copy(tmp, src)
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, fmt.Errorf("could not stage zip: %w", err)
+	}
+	return tmp, size, cleanup, nil
+}
+
+// writeZipAsTar writes every zip entry as a tar entry. Reading an entry to
+// its end checks its CRC-32.
+func writeZipAsTar(tw *tar.Writer, zr *zip.Reader) error {
+	for _, f := range zr.File {
+		info := f.FileInfo()
+		header := &tar.Header{Name: f.Name, Mode: int64(info.Mode().Perm()), ModTime: f.Modified}
+		switch {
+		case info.IsDir():
+			header.Typeflag = tar.TypeDir
+		case info.Mode().IsRegular():
+			header.Typeflag = tar.TypeReg
+			header.Size = int64(f.UncompressedSize64)
+		case info.Mode()&os.ModeSymlink != 0:
+			// A zip keeps a symlink's target as its content
+			header.Typeflag = tar.TypeSymlink
+			target, err := readZipLink(f)
+			if err != nil {
+				return err
+			}
+			header.Linkname = target
+		default:
+			log.Errorf("Unable to unzip mode %s of file %s", info.Mode().Type(), f.Name)
+			continue
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("could not read %s from zip: %w", f.Name, err)
+		}
+		_, err = io.Copy(tw, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("could not read %s from zip: %w", f.Name, err)
+		}
+	}
+	return tw.Close()
+}
+
+// readZipLink reads the target of a symlink entry
+func readZipLink(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", fmt.Errorf("could not read %s from zip: %w", f.Name, err)
+	}
+	defer rc.Close()
+	target, err := io.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return "", fmt.Errorf("could not read %s from zip: %w", f.Name, err)
+	}
+	return string(target), nil
+}
+
+// zipTarReader removes the spooled zip once the tar stream is closed
+type zipTarReader struct {
+	*io.PipeReader
+	cleanup func()
+}
+
+func (r *zipTarReader) Close() error {
+	err := r.PipeReader.Close()
+	r.cleanup()
+	return err
+}
@@ -0,0 +1,86 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func buildZip(t *testing.T, files map[string]string, modes map[string]os.FileMode) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		header.SetMode(0644)
+		if mode, ok := modes[name]; ok {
+			header.SetMode(mode)
+		}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestApplyZip(t *testing.T) {
+	target := t.TempDir()
+	writeTestFile(t, filepath.Join(target, "lib/foo-api-22.1.jar"), "old")
+	writeTestFile(t, filepath.Join(target, "components/sakai-provider-pack/WEB-INF/unboundid-ldap.xml"), "local")
+	patch := buildZip(t, map[string]string{
+		"lib/foo-api-22.2.jar": "new",
+		"components/sakai-provider-pack/WEB-INF/unboundid-ldap.xml": "shipped",
+		"bin/foo.sh": "#!/bin/sh",
+	}, map[string]os.FileMode{"bin/foo.sh": 0755})
+
+	report, err := Apply(target, bytes.NewReader(patch), Options{})
+	assert.NoError(t, err)
+	assert.Len(t, report.Written, 2)
+	assert.Equal(t, []string{"components/sakai-provider-pack/WEB-INF/unboundid-ldap.xml"}, report.Skipped)
+	assert.NoFileExists(t, filepath.Join(target, "lib/foo-api-22.1.jar"))
+	info, err := os.Stat(filepath.Join(target, "bin/foo.sh"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	// A stream is spooled to read the central directory
+	report, err = Apply(t.TempDir(), io.MultiReader(bytes.NewReader(patch)), Options{StagingDir: t.TempDir()})
+	assert.NoError(t, err)
+	assert.Len(t, report.Written, 3)
+
+	// Symlinks are kept as symlinks
+	target = t.TempDir()
+	patch = buildZip(t, map[string]string{"lib/foo-api-22.2.jar": "new", "lib/foo-api.jar": "foo-api-22.2.jar"},
+		map[string]os.FileMode{"lib/foo-api.jar": os.ModeSymlink | 0777})
+	report, err = Apply(target, bytes.NewReader(patch), Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"lib/foo-api.jar"}, report.Linked)
+	link, _ := os.Readlink(filepath.Join(target, "lib/foo-api.jar"))
+	assert.Equal(t, "foo-api-22.2.jar", link)
+}
+
+func TestCheckZip(t *testing.T) {
+	patch := buildZip(t, map[string]string{"lib/kernel.jar": "kernel kernel kernel kernel"}, nil)
+	assert.NoError(t, Check(bytes.NewReader(patch), Options{}))
+
+	// Stored entries let a flipped bit through to the CRC-32
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "lib/kernel.jar", Method: zip.Store})
+	w.Write([]byte("kernel"))
+	zw.Close()
+	corrupt := buf.Bytes()
+	corrupt[bytes.Index(corrupt, []byte("lib/kernel.jarkernel"))+len("lib/kernel.jar")] ^= 0xff
+	assert.Error(t, Check(bytes.NewReader(corrupt), Options{}))
+
+	escaping := buildZip(t, map[string]string{"../../etc/cron.d/patch": "* * * * * root true"}, nil)
+	assert.Error(t, Check(bytes.NewReader(escaping), Options{}))
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// blockMapSuffix names the block map a build publishes next to a tarball,
+// written by "go-patcher blockmap"
+const blockMapSuffix = ".blocks"
+
+// blockMapSize is the block size "go-patcher blockmap" writes maps with
+const blockMapSize = 64 * 1024
+
+// incrementalSeeds is how many of the most recently used cached tarballs are
+// searched for blocks to reuse, every one is read through
+const incrementalSeeds = 2
+
+// blockMap describes a tarball block by block, so whatever a cached tarball
+// already has in common with it needn't be downloaded again
+type blockMap struct {
+	BlockSize int        `json:"block_size"`
+	Length    int64      `json:"length"`
+	SHA256    string     `json:"sha256"`
+	Blocks    []blockSum `json:"blocks"`
+}
+
+// blockSum is the rolling checksum of a block, to find it at any offset, and
+// the start of its SHA-256, to be sure
+type blockSum struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// blockSource is where a block was found in a cached tarball
+type blockSource struct {
+	path   string
+	offset int64
+}
+
+// makeBlockMap reads a tarball into a block map
+func makeBlockMap(r io.Reader, blockSize int) (blockMap, error) {
+	m := blockMap{BlockSize: blockSize}
+	whole := sha256.New()
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			whole.Write(block[:n])
+			m.Blocks = append(m.Blocks, blockSum{Weak: weakSum(block[:n]), Strong: strongSum(block[:n])})
+			m.Length += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return blockMap{}, err
+		}
+	}
+	m.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	return m, nil
+}
+
+// writeBlockMaps writes the block map of each tarball next to it, for
+// "go-patcher blockmap"
+func writeBlockMaps(w io.Writer, tarballs []string) error {
+	if len(tarballs) == 0 {
+		return errors.New("usage: go-patcher blockmap <tarball>...")
+	}
+	for _, tarball := range tarballs {
+		file, err := os.Open(tarball)
+		if err != nil {
+			return err
+		}
+		m, err := makeBlockMap(bufio.NewReader(file), blockMapSize)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", tarball, err)
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(tarball+blockMapSuffix, data, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Wrote %s%s, %d blocks\n", tarball, blockMapSuffix, len(m.Blocks))
+	}
+	return nil
+}
+
+// weakSum is rsync's rolling checksum of a block
+func weakSum(block []byte) uint32 {
+	a, b := weakParts(block)
+	return a | b<<16
+}
+
+func strongSum(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:16])
+}
+
+// findBlocks rolls a window over a cached tarball, adding the blocks of m it
+// finds to found. The last block is left out when it's short, it can't be
+// told from the window.
+func findBlocks(seed string, m blockMap, found map[int]blockSource) error {
+	size := m.BlockSize
+	byWeak := map[uint32][]int{}
+	for i, block := range m.Blocks {
+		if _, ok := found[i]; ok || (i == len(m.Blocks)-1 && m.Length%int64(size) != 0) {
+			continue
+		}
+		byWeak[block.Weak] = append(byWeak[block.Weak], i)
+	}
+	if len(byWeak) == 0 {
+		return nil
+	}
+
+	file, err := os.Open(seed)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReaderSize(file, 1024*1024)
+
+	// window holds the last size bytes read, starting at head
+	window := make([]byte, size)
+	fill := func() (bool, error) {
+		_, err := io.ReadFull(reader, window)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	ok, err := fill()
+	if !ok {
+		return err
+	}
+	var offset int64
+	head := 0
+	a, b := weakParts(window)
+	contiguous := make([]byte, size)
+	for {
+		if candidates := byWeak[a&0xffff|b<<16]; len(candidates) > 0 {
+			copy(contiguous, window[head:])
+			copy(contiguous[size-head:], window[:head])
+			strong := strongSum(contiguous)
+			matched := false
+			for _, i := range candidates {
+				if _, ok := found[i]; !ok && m.Blocks[i].Strong == strong {
+					found[i] = blockSource{seed, offset}
+					matched = true
+				}
+			}
+			if matched {
+				// Blocks don't overlap, the next one starts after this
+				offset += int64(size)
+				head = 0
+				if ok, err := fill(); !ok {
+					return err
+				}
+				a, b = weakParts(window)
+				continue
+			}
+		}
+
+		c, err := reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		out := window[head]
+		window[head] = c
+		head = (head + 1) % size
+		offset++
+		a += uint32(c) - uint32(out)
+		b += a - uint32(size)*uint32(out)
+	}
+}
+
+// weakParts are the two halves of weakSum, kept apart while rolling
+func weakParts(block []byte) (uint32, uint32) {
+	var a, b uint32
+	for i, c := range block {
+		a += uint32(c)
+		b += uint32(len(block)-i) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+// incrementalDownload builds dest from the blocks cached tarballs share with
+// the new one and downloads only the rest, when -incremental-sync is set and
+// a source has a block map. It returns the source, or "" to download in full.
+func incrementalDownload(sources []string, dest string, patchID string) string {
+	if !*incrementalSync {
+		return ""
+	}
+	for _, source := range sources {
+		// A block map sits next to a tarball on a mirror, not inside a signed URL
+		if isSFTPURL(source) || strings.Contains(source, "?") {
+			continue
+		}
+		m, err := fetchBlockMap(source)
+		if err != nil {
+			log.Debug("No block map for ", source, ": ", err)
+			continue
+		}
+		if err := syncBlocks(source, m, dest, patchID); err != nil {
+			log.Warning("Downloading ", filepath.Base(dest), " in full: ", err)
+			os.Remove(dest + ".part")
+			return ""
+		}
+		return source
+	}
+	return ""
+}
+
+func fetchBlockMap(source string) (blockMap, error) {
+	fileURL := source + blockMapSuffix
+	if isS3URL(source) {
+		signed, err := presignS3(fileURL)
+		if err != nil {
+			return blockMap{}, err
+		}
+		fileURL = signed
+	}
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return blockMap{}, err
+	}
+	setRunHeaders(req)
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return blockMap{}, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return blockMap{}, err
+	}
+	var m blockMap
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024*1024)).Decode(&m); err != nil {
+		return blockMap{}, err
+	}
+	if m.BlockSize <= 0 || m.BlockSize > 16<<20 || int64(len(m.Blocks)) != (m.Length+int64(m.BlockSize)-1)/int64(m.BlockSize) || !validChecksum(m.SHA256) {
+		return blockMap{}, errors.New("block map doesn't add up")
+	}
+	return m, nil
+}
+
+// syncBlocks copies the blocks the cache has and fetches the others with
+// range requests, then hands the result to the same checks as a download
+func syncBlocks(source string, m blockMap, dest string, patchID string) error {
+	checksum := expectedChecksum(patchID, filepath.Base(dest))
+	if checksum != "" && checksum != m.SHA256 {
+		return fmt.Errorf("block map is of %s, the portal sent %s", m.SHA256, checksum)
+	}
+	entries := cacheEntries()
+	if len(entries) > incrementalSeeds {
+		entries = entries[len(entries)-incrementalSeeds:]
+	}
+	found := map[int]blockSource{}
+	for i := len(entries) - 1; i >= 0 && len(found) < len(m.Blocks); i-- {
+		if err := findBlocks(entries[i].path, m, found); err != nil {
+			log.Debug("Could not search ", entries[i].path, ": ", err)
+		}
+	}
+	if len(found) == 0 {
+		return errors.New("no cached tarball shares any blocks with it")
+	}
+
+	defer trackPhase("download")()
+	partial := dest + ".part"
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Truncate(m.Length); err != nil {
+		return err
+	}
+
+	// Consecutive missing blocks are fetched in one request
+	type byteRange struct{ start, end int64 }
+	var missing []byteRange
+	var missingBytes int64
+	block := make([]byte, m.BlockSize)
+	seeds := map[string]*os.File{}
+	defer func() {
+		for _, seed := range seeds {
+			seed.Close()
+		}
+	}()
+	for i := range m.Blocks {
+		start := int64(i) * int64(m.BlockSize)
+		end := min(start+int64(m.BlockSize), m.Length) - 1
+		if from, ok := found[i]; ok {
+			if err := copyBlock(from, seeds, file, start, block[:end-start+1]); err != nil {
+				return err
+			}
+			continue
+		}
+		missingBytes += end - start + 1
+		if n := len(missing); n > 0 && missing[n-1].end == start-1 {
+			missing[n-1].end = end
+		} else {
+			missing = append(missing, byteRange{start, end})
+		}
+	}
+	log.Infof("Reusing %.1f of %.1f MB of %s from cached tarballs, downloading %.1f MB in %d ranges",
+		megabytes(m.Length-missingBytes), megabytes(m.Length), filepath.Base(dest), megabytes(missingBytes), len(missing))
+
+	fileURL := source
+	if isS3URL(source) {
+		if fileURL, err = presignS3(source); err != nil {
+			return err
+		}
+	}
+	progress := startProgress(filepath.Base(dest))
+	defer progress.Stop()
+	progress.restart(0, missingBytes)
+	for _, r := range missing {
+		err := retry(fmt.Sprintf("Download of bytes %d-%d", r.start, r.end), func() error {
+			return fetchChunk(context.Background(), fileURL, file, r.start, r.end, progress)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	// The block map's checksum is the portal's, if it sent one
+	return finishDownload(partial, dest, m.Length, false, m.SHA256)
+}
+
+// copyBlock copies a block found in a cached tarball into place, seeds holds
+// the cached tarballs opened so far
+func copyBlock(from blockSource, seeds map[string]*os.File, to *os.File, offset int64, buf []byte) error {
+	seed, ok := seeds[from.path]
+	if !ok {
+		var err error
+		if seed, err = os.Open(from.path); err != nil {
+			return err
+		}
+		seeds[from.path] = seed
+	}
+	n, err := seed.ReadAt(buf, from.offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	_, err = to.WriteAt(buf[:n], offset)
+	return err
+}
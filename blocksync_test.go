@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// buildTestTar makes an uncompressed tarball, which keeps the blocks of
+// unchanged files intact between builds
+func buildTestTar(t *testing.T, files map[string][]byte, order []string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range order {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg, ModTime: time.Unix(1700000000, 0)})
+		tw.Write(files[name])
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestIncrementalDownload(t *testing.T) {
+	defer func(dir, web string, on bool) { *patchDir, *patchWeb, *incrementalSync = dir, web, on }(*patchDir, *patchWeb, *incrementalSync)
+	*patchDir, *incrementalSync = t.TempDir(), true
+	fastRetries(t, 2)
+
+	random := rand.New(rand.NewSource(63547))
+	files := map[string][]byte{}
+	order := []string{"lib/kernel.jar", "components/portal/portal.jar", "components/content/content.jar"}
+	for _, name := range order {
+		files[name] = make([]byte, 40000)
+		random.Read(files[name])
+	}
+	previous := buildTestTar(t, files, order)
+	files["components/portal/portal.jar"] = append([]byte("patched "), files["components/portal/portal.jar"][:30000]...)
+	current := buildTestTar(t, files, order)
+
+	// The previous build is in the cache
+	os.MkdirAll(cacheDir(), 0755)
+	os.WriteFile(filepath.Join(cacheDir(), strings.Repeat("a", 64)), previous, 0644)
+	m, err := makeBlockMap(bytes.NewReader(current), 4096)
+	assert.NoError(t, err)
+	blocks, _ := json.Marshal(m)
+
+	var served int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, blockMapSuffix) {
+			w.Write(blocks)
+			return
+		}
+		counter := &countingWriter{ResponseWriter: w}
+		http.ServeContent(counter, r, "patch.tar", time.Time{}, bytes.NewReader(current))
+		served += counter.n
+	}))
+	defer server.Close()
+	*patchWeb = server.URL + "/"
+
+	path := fetchTarball("sakai-builder/patch-63548.tar", "63548")
+	got, _ := os.ReadFile(path)
+	assert.Equal(t, current, got)
+	assert.Less(t, served, int64(len(current))/2, "only the changed blocks are downloaded")
+
+	// Nothing in common, nothing reused
+	os.RemoveAll(cacheDir())
+	assert.Empty(t, incrementalDownload([]string{server.URL + "/sakai-builder/patch-63548.tar"}, filepath.Join(*patchDir, "patch-63548.tar"), "63548"))
+}
+
+func TestFindBlocksAtAnyOffset(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	data := make([]byte, 10000)
+	random.Read(data)
+	m, _ := makeBlockMap(bytes.NewReader(data), 1000)
+
+	// The same bytes shifted by an insertion are still found
+	seed := filepath.Join(t.TempDir(), "seed")
+	os.WriteFile(seed, append([]byte("inserted"), data...), 0644)
+	found := map[int]blockSource{}
+	assert.NoError(t, findBlocks(seed, m, found))
+	assert.Len(t, found, 10)
+	assert.Equal(t, blockSource{seed, 8 + 3000}, found[3])
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cacheMaxBytes is -cache-max-size in bytes, 0 for no limit
+var cacheMaxBytes int64
+
+// cacheLimits say how much of the tarball cache to keep, 0 turning a limit off
+type cacheLimits struct {
+	maxAge   time.Duration
+	maxBytes int64
+	keep     int
+}
+
+// configuredCacheLimits are the -cache-max-age, -cache-max-size and -cache-keep limits
+func configuredCacheLimits() cacheLimits {
+	return cacheLimits{maxAge: *cacheMaxAge, maxBytes: cacheMaxBytes, keep: *cacheKeep}
+}
+
+// cacheDir holds downloaded tarballs named by their SHA-256, shared by every
+// instance patched from this patchDir. A tarball is found again only by the
+// checksum the portal sends, a file name may be reused for new content.
+func cacheDir() string {
+	return filepath.Join(*patchDir, "cache")
+}
+
+// cachedTarball returns the cached tarball with this checksum, or "" when
+// there is none. patchDir is often a shared /tmp so the copy is hashed again,
+// a bad one is dropped and downloaded anew.
+func cachedTarball(sum string) string {
+	if sum == "" {
+		return ""
+	}
+	cached := filepath.Join(cacheDir(), sum)
+	if !pathExists(cached) {
+		return ""
+	}
+	// Cached before -tarball-pubkey was set, download it again along with its signature
+	if tarballKey != nil && !pathExists(cached+signatureSuffix) {
+		return ""
+	}
+	if err := verifyChecksum(cached, sum); err != nil {
+		log.Warning("Removing bad cached tarball ", cached, ": ", err)
+		os.Remove(cached)
+		os.Remove(cached + signatureSuffix)
+		return ""
+	}
+	// Pruning goes by last use
+	now := time.Now()
+	os.Chtimes(cached, now, now)
+	return cached
+}
+
+// storeInCache moves a verified download into the cache and returns where it
+// is now. sum may be "" when the portal sent none. The tarball stays where it
+// is when the cache can't take it.
+func storeInCache(path string, sum string) string {
+	if sum == "" {
+		var err error
+		if sum, err = fileChecksum(path); err != nil {
+			log.Warning("Not caching ", path, ": ", err)
+			return path
+		}
+	}
+	if err := os.MkdirAll(cacheDir(), 0755); err != nil {
+		log.Warning("Not caching ", path, ": ", err)
+		return path
+	}
+	cached := filepath.Join(cacheDir(), sum)
+	// A stale signature must not vouch for the new copy
+	os.Remove(cached + signatureSuffix)
+	if err := os.Rename(path, cached); err != nil {
+		log.Warning("Not caching ", path, ": ", err)
+		return path
+	}
+	log.Debug("Cached ", filepath.Base(path), " as ", cached)
+	return cached
+}
+
+// cacheEntry is a cached tarball along with its signature, if any
+type cacheEntry struct {
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+// cacheEntries lists the cache, least recently used first
+func cacheEntries() []cacheEntry {
+	files, err := os.ReadDir(cacheDir())
+	if err != nil {
+		return nil
+	}
+	var entries []cacheEntry
+	for _, file := range files {
+		if !file.Type().IsRegular() || !validChecksum(file.Name()) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		entry := cacheEntry{path: filepath.Join(cacheDir(), file.Name()), size: info.Size(), lastUsed: info.ModTime()}
+		if sig, err := os.Stat(entry.path + signatureSuffix); err == nil {
+			entry.size += sig.Size()
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastUsed.Before(entries[j].lastUsed) })
+	return entries
+}
+
+// pruneCache removes tarballs unused for longer than maxAge, then the least
+// recently used until no more than keep are left and they fit in maxBytes
+func pruneCache(limits cacheLimits, now time.Time) (removed int, freed int64) {
+	entries := cacheEntries()
+	left := len(entries)
+	var total int64
+	for _, entry := range entries {
+		total += entry.size
+	}
+	for _, entry := range entries {
+		tooOld := limits.maxAge > 0 && now.Sub(entry.lastUsed) > limits.maxAge
+		tooMany := limits.keep > 0 && left > limits.keep
+		tooBig := limits.maxBytes > 0 && total > limits.maxBytes
+		if !tooOld && !tooMany && !tooBig {
+			continue
+		}
+		if err := os.Remove(entry.path); err != nil {
+			log.Warning("Could not remove cached tarball ", entry.path, ": ", err)
+			continue
+		}
+		os.Remove(entry.path + signatureSuffix)
+		log.Debug("Removed cached tarball ", entry.path)
+		removed++
+		freed += entry.size
+		left--
+		total -= entry.size
+	}
+	return removed, freed
+}
+
+// runCacheCommand applies the cache limits now rather than on the next idle
+// check-in, for "go-patcher cache clean"
+func runCacheCommand(w io.Writer, args []string) error {
+	if len(args) != 1 || args[0] != "clean" {
+		return errors.New("usage: go-patcher cache clean [flags]")
+	}
+	removed, freed := pruneCache(configuredCacheLimits(), time.Now())
+	var total int64
+	entries := cacheEntries()
+	for _, entry := range entries {
+		total += entry.size
+	}
+	fmt.Fprintf(w, "Removed %d cached tarballs, freeing %.1f MB\n", removed, megabytes(freed))
+	fmt.Fprintf(w, "%d tarballs, %.1f MB, left in %s\n", len(entries), megabytes(total), cacheDir())
+	return nil
+}
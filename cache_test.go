@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchTarballSharesCache(t *testing.T) {
+	oldDir, oldWeb := *patchDir, *patchWeb
+	defer func() { *patchDir, *patchWeb = oldDir, oldWeb }()
+	defer func() { tarballChecksums = map[string]map[string]string{} }()
+	*patchDir = t.TempDir()
+
+	tarball, _ := os.ReadFile("test.tar.gz")
+	sum, _ := fileChecksum("test.tar.gz")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(tarball)
+	}))
+	defer server.Close()
+	*patchWeb = server.URL + "/"
+
+	// Without a checksum from the portal the cache can't be trusted to hold the same content
+	path := fetchTarball("sakai-builder/patch-63547.tar.gz", "63547")
+	assert.Equal(t, filepath.Join(cacheDir(), sum), path)
+	fetchTarball("sakai-builder/patch-63547.tar.gz", "63547")
+	assert.Equal(t, 2, requests)
+
+	// Other instances applying the same tarball take it from the cache
+	for _, patchID := range []string{"63548", "63549"} {
+		tarballChecksums[patchID] = map[string]string{"patch-63547.tar.gz": "sha256:" + sum}
+		assert.Equal(t, path, fetchTarball("sakai-builder/patch-63547.tar.gz", patchID))
+	}
+	assert.Equal(t, 2, requests)
+
+	// A damaged copy is downloaded again
+	os.WriteFile(path, []byte("damaged"), 0644)
+	assert.Equal(t, path, fetchTarball("sakai-builder/patch-63547.tar.gz", "63549"))
+	assert.Equal(t, 3, requests)
+	assert.NoError(t, verifyChecksum(path, sum))
+}
+
+func TestCachedTarballNeedsSignature(t *testing.T) {
+	oldDir := *patchDir
+	defer func() { *patchDir = oldDir }()
+	*patchDir = t.TempDir()
+	defer func() { tarballKey = nil }()
+
+	sum, _ := fileChecksum("test.tar.gz")
+	tarball, _ := os.ReadFile("test.tar.gz")
+	os.MkdirAll(cacheDir(), 0755)
+	os.WriteFile(filepath.Join(cacheDir(), sum), tarball, 0644)
+	assert.Equal(t, filepath.Join(cacheDir(), sum), cachedTarball(sum))
+
+	tarballKey = &minisignKey{}
+	assert.Equal(t, "", cachedTarball(sum), "cached before signatures were required")
+	os.WriteFile(filepath.Join(cacheDir(), sum+signatureSuffix), []byte("signature"), 0644)
+	assert.Equal(t, filepath.Join(cacheDir(), sum), cachedTarball(sum))
+}
+
+func TestPruneCache(t *testing.T) {
+	oldDir := *patchDir
+	defer func() { *patchDir = oldDir }()
+	*patchDir = t.TempDir()
+	os.MkdirAll(cacheDir(), 0755)
+
+	now := time.Now()
+	cache := func(sum string, size int, age time.Duration) string {
+		path := filepath.Join(cacheDir(), sum)
+		os.WriteFile(path, make([]byte, size), 0644)
+		os.Chtimes(path, now.Add(-age), now.Add(-age))
+		return path
+	}
+	stale := cache("aa00000000000000000000000000000000000000000000000000000000000000", 100, 40*24*time.Hour)
+	os.WriteFile(stale+signatureSuffix, []byte("signature"), 0644)
+	older := cache("bb00000000000000000000000000000000000000000000000000000000000000", 300, 2*time.Hour)
+	newer := cache("cc00000000000000000000000000000000000000000000000000000000000000", 300, time.Hour)
+	unrelated := filepath.Join(cacheDir(), "notes.txt")
+	os.WriteFile(unrelated, nil, 0644)
+
+	removed, freed := pruneCache(cacheLimits{maxAge: 30 * 24 * time.Hour}, now)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, int64(109), freed)
+	assert.False(t, pathExists(stale))
+	assert.False(t, pathExists(stale+signatureSuffix))
+
+	// The least recently used goes first
+	removed, _ = pruneCache(cacheLimits{maxBytes: 500}, now)
+	assert.Equal(t, 1, removed)
+	assert.False(t, pathExists(older))
+	assert.True(t, pathExists(newer))
+	assert.True(t, pathExists(unrelated))
+
+	removed, _ = pruneCache(cacheLimits{}, now)
+	assert.Equal(t, 0, removed)
+}
+
+func TestCacheClean(t *testing.T) {
+	oldDir, oldKeep := *patchDir, *cacheKeep
+	defer func() { *patchDir, *cacheKeep = oldDir, oldKeep }()
+	*patchDir = t.TempDir()
+	os.MkdirAll(cacheDir(), 0755)
+
+	now := time.Now()
+	for i, sum := range []string{"aa", "bb", "cc", "dd"} {
+		path := filepath.Join(cacheDir(), sum+strings.Repeat("0", 62))
+		os.WriteFile(path, make([]byte, 1024*1024), 0644)
+		os.Chtimes(path, now.Add(-time.Duration(4-i)*time.Hour), now.Add(-time.Duration(4-i)*time.Hour))
+	}
+
+	*cacheKeep = 3
+	var out bytes.Buffer
+	assert.NoError(t, runCacheCommand(&out, []string{"clean"}))
+	assert.Contains(t, out.String(), "Removed 1 cached tarballs, freeing 1.0 MB")
+	assert.Contains(t, out.String(), "3 tarballs, 3.0 MB, left in "+cacheDir())
+	assert.False(t, pathExists(filepath.Join(cacheDir(), "aa"+strings.Repeat("0", 62))), "least recently used")
+
+	assert.Error(t, runCacheCommand(&out, nil))
+	assert.Error(t, runCacheCommand(&out, []string{"purge"}))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// tarballChecksums are the SHA-256 sums the portal sent, by patch ID and then
+// tarball file name
+var tarballChecksums = map[string]map[string]string{}
+
+// expectedChecksum is the sum the portal sent for a tarball, "" when it sent none
+func expectedChecksum(patchID string, fileName string) string {
+	return normalizeChecksum(tarballChecksums[patchID][fileName])
+}
+
+// normalizeChecksum accepts "sha256:<hex>" as well as bare hex in either case
+func normalizeChecksum(sum string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(sum), "sha256:"))
+}
+
+func validChecksum(sum string) bool {
+	decoded, err := hex.DecodeString(normalizeChecksum(sum))
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// verifyChecksum hashes the file and compares it to the expected sum, which
+// passes when empty so portals that don't send checksums keep working
+func verifyChecksum(path string, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	actual, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("SHA-256 mismatch: portal sent %s, file has %s", expected, actual)
+	}
+	return nil
+}
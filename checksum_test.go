@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testTarballSum(t *testing.T) string {
+	tarball, err := os.ReadFile("test.tar.gz")
+	assert.NoError(t, err)
+	sum := sha256.Sum256(tarball)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	sum := testTarballSum(t)
+	assert.NoError(t, verifyChecksum("test.tar.gz", sum))
+	assert.NoError(t, verifyChecksum("test.tar.gz", ""), "no checksum from the portal")
+	err := verifyChecksum("test.tar.gz", strings.Repeat("0", 64))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), sum)
+}
+
+func TestPatchChecksumsAreValidated(t *testing.T) {
+	sum := testTarballSum(t)
+	assert.True(t, validChecksum("sha256:"+strings.ToUpper(sum)))
+	assert.Equal(t, sum, normalizeChecksum("sha256:"+strings.ToUpper(sum)))
+
+	_, err := decodePatchResponse([]byte(`{"patch_id": "63547", "tomcat_dir": "/opt/tomcat", "checksums": {"a.tar.gz": "abc123"}}`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `checksums["a.tar.gz"]`)
+
+	patch, err := decodePatchResponse([]byte(`{"patch_id": "63547", "tomcat_dir": "/opt/tomcat", "checksums": {"a.tar.gz": "sha256:` + sum + `"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:"+sum, patch.Checksums["a.tar.gz"])
+}
+
+func TestDownloadFileRetriesChecksumMismatch(t *testing.T) {
+	fastRetries(t, 3)
+	defer func() { tarballChecksums = map[string]map[string]string{} }()
+
+	tarball, _ := os.ReadFile("test.tar.gz")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(tarball)
+	}))
+	defer server.Close()
+	dest := filepath.Join(t.TempDir(), "patch.tar.gz")
+
+	tarballChecksums = map[string]map[string]string{"63547": {"patch.tar.gz": strings.Repeat("0", 64)}}
+	err := downloadFile(server.URL+"/patch.tar.gz", dest, "63547", true)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "SHA-256 mismatch")
+	assert.Equal(t, 3, requests, "a mismatch is retried")
+	assert.False(t, pathExists(dest))
+	assert.False(t, pathExists(dest+".part"), "a bad download is not resumed")
+
+	tarballChecksums["63547"]["patch.tar.gz"] = "sha256:" + testTarballSum(t)
+	assert.NoError(t, downloadFile(server.URL+"/patch.tar.gz", dest, "63547", true))
+	assert.True(t, pathExists(dest))
+}
+
+func TestFetchTarballVerifiesLocalFile(t *testing.T) {
+	defer func() { tarballChecksums = map[string]map[string]string{} }()
+	local := filepath.Join(t.TempDir(), "local.tar.gz")
+	tarball, _ := os.ReadFile("test.tar.gz")
+	assert.NoError(t, os.WriteFile(local, tarball, 0644))
+
+	tarballChecksums = map[string]map[string]string{"63547": {"local.tar.gz": testTarballSum(t)}}
+	assert.Equal(t, local, fetchTarball(local, "63547"))
+
+	tarballChecksums["63547"]["local.tar.gz"] = strings.Repeat("0", 64)
+	assert.Panics(t, func() { fetchTarball(local, "63547") })
+}
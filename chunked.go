@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// minChunkSize keeps small tarballs in one request, splitting them only adds round trips
+var minChunkSize int64 = 8 << 20
+
+// downloadChunked fetches fileURL into file in -download-chunks concurrent
+// ranged requests, each retried on its own. It reports false, leaving the
+// download to the caller, when the server can't serve ranges or the file is
+// too small to be worth splitting.
+func downloadChunked(fileURL string, file *os.File, progress *downloadProgress) (bool, error) {
+	chunks := int64(*downloadChunks)
+	size, err := rangeSize(fileURL)
+	if err != nil {
+		log.Debug("Not splitting download of ", redactURL(fileURL), ": ", err)
+		return false, nil
+	}
+	if size < chunks*minChunkSize {
+		chunks = max(size/minChunkSize, 1)
+	}
+	if chunks < 2 {
+		return false, nil
+	}
+	if err := file.Truncate(size); err != nil {
+		return true, err
+	}
+	log.Info("Downloading ", redactURL(fileURL), " (", size, " bytes) in ", chunks, " chunks")
+	progress.restart(0, size)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	chunkSize := (size + chunks - 1) / chunks
+	errs := make(chan error, chunks)
+	launched := 0
+	for start := int64(0); start < size; start += chunkSize {
+		start, end := start, min(start+chunkSize, size)-1
+		go func() {
+			err := retry(fmt.Sprintf("Download of bytes %d-%d", start, end), func() error {
+				return fetchChunk(ctx, fileURL, file, start, end, progress)
+			})
+			if err != nil {
+				// One missing chunk spoils the file, stop the others
+				cancel()
+			}
+			errs <- err
+		}()
+		launched++
+	}
+	var firstErr error
+	for i := 0; i < launched; i++ {
+		if err := <-errs; err != nil && (firstErr == nil || errors.Is(firstErr, context.Canceled)) {
+			firstErr = err
+		}
+	}
+	return true, firstErr
+}
+
+// rangeSize asks for the first byte to learn the size and whether ranges work
+func rangeSize(fileURL string) (int64, error) {
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	setRunHeaders(req)
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, errors.New("server answered " + resp.Status + " to a range request")
+	}
+	// Content-Range: bytes 0-0/12345
+	_, total, found := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	size, err := strconv.ParseInt(total, 10, 64)
+	if !found || err != nil {
+		return 0, errors.New("no size in Content-Range " + resp.Header.Get("Content-Range"))
+	}
+	return size, nil
+}
+
+// fetchChunk writes bytes start to end, inclusive, at their place in file
+func fetchChunk(ctx context.Context, fileURL string, file *os.File, start int64, end int64, progress *downloadProgress) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", fileURL, nil)
+	if err != nil {
+		return permanentError{err}
+	}
+	setRunHeaders(req)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := downloadClient.Do(req)
+	if ctx.Err() != nil {
+		return permanentError{ctx.Err()}
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return permanentError{errors.New("server stopped serving ranges, answered " + resp.Status)}
+	}
+
+	body := io.TeeReader(downloadLimiter.reader(io.LimitReader(resp.Body, end-start+1)), progress)
+	n, err := io.Copy(io.NewOffsetWriter(file, start), body)
+	atomic.AddInt64(&downloadedBytes, n)
+	if err == nil && n != end-start+1 {
+		err = fmt.Errorf("got %d of %d bytes", n, end-start+1)
+	}
+	if err != nil {
+		// The whole chunk is fetched again
+		progress.discard(n)
+	}
+	if ctx.Err() != nil {
+		return permanentError{ctx.Err()}
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadFileInChunks(t *testing.T) {
+	fastRetries(t, 3)
+	*downloadChunks, minChunkSize = 3, 64
+	defer func() { *downloadChunks, minChunkSize = 1, 8<<20 }()
+
+	tarball, _ := os.ReadFile("test.tar.gz")
+	var mu sync.Mutex
+	var ranges []string
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		// The middle chunk fails once and is fetched again on its own
+		fail := r.Header.Get("Range") == "bytes=95-189" && !failed
+		failed = failed || fail
+		mu.Unlock()
+		if fail {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "patch.tar.gz", time.Time{}, strings.NewReader(string(tarball)))
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "patch.tar.gz")
+	assert.NoError(t, downloadFile(server.URL+"/patch.tar.gz", dest, "63547", true))
+	downloaded, _ := os.ReadFile(dest)
+	assert.Equal(t, tarball, downloaded)
+	sort.Strings(ranges)
+	assert.Equal(t, []string{"bytes=0-0", "bytes=0-94", "bytes=190-284", "bytes=95-189", "bytes=95-189"}, ranges)
+}
+
+func TestDownloadChunkedFallsBack(t *testing.T) {
+	*downloadChunks, minChunkSize = 4, 64
+	defer func() { *downloadChunks, minChunkSize = 1, 8<<20 }()
+
+	tarball, _ := os.ReadFile("test.tar.gz")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// No range support
+		w.Write(tarball)
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "patch.tar.gz")
+	assert.NoError(t, downloadFile(server.URL+"/patch.tar.gz", dest, "63547", true))
+	assert.Equal(t, 2, requests, "the probe, then one plain request")
+	downloaded, _ := os.ReadFile(dest)
+	assert.Equal(t, tarball, downloaded)
+
+	// Too small to split into more than one chunk
+	minChunkSize = 1024
+	file, _ := os.Create(filepath.Join(t.TempDir(), "small.part"))
+	defer file.Close()
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "patch.tar.gz", time.Time{}, strings.NewReader(string(tarball)))
+	})
+	progress := startProgress("small.tar.gz")
+	defer progress.Stop()
+	chunked, err := downloadChunked(server.URL+"/patch.tar.gz", file, progress)
+	assert.False(t, chunked)
+	assert.NoError(t, err)
+}
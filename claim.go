@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const claimPath = "/longsight/remote/patch/claim"
+
+// claimNonces are the random values sent with each inProgress claim this run, by patch ID.
+// Two hosts with overlapping IP registrations can both be handed the same patch,
+// and the nonce tells them apart when reading back who the portal recorded.
+var claimNonces = map[string]string{}
+
+// claimRecord is the portal's view of who holds a patch
+type claimRecord struct {
+	Nonce    string `json:"claim_nonce"`
+	Hostname string `json:"hostname"`
+}
+
+func newClaimNonce() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("Could not generate a claim nonce: " + err.Error())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// claimPatch claims a patch and reads the claim back. It returns false and the
+// reason if another host's claim landed instead, or if the claim can't be
+// confirmed at all; the lease then runs out and the portal hands the patch out
+// again. Portals without the claim endpoint answer 404 and every claim counts
+// as won, as before.
+func claimPatch(patchID string) (bool, string) {
+	claimNonces[patchID] = newClaimNonce()
+	updateAdminPortal(inProgress, "0", patchID)
+
+	var holder *claimRecord
+	err := activePortal.withFailover(func() (err error) {
+		holder, err = fetchClaim(patchID)
+		return err
+	})
+	if err != nil {
+		log.Warning("Could not confirm the claim on patch ", patchID, ": ", err)
+		return false, "could not confirm the claim: " + err.Error()
+	}
+	if holder == nil || holder.Nonce == claimNonces[patchID] {
+		return true, ""
+	}
+	if holder.Hostname == "" {
+		return false, "claimed by another host"
+	}
+	return false, "claimed by " + holder.Hostname
+}
+
+// fetchClaim asks the portal which claim it recorded, nil if it doesn't track claims
+func fetchClaim(patchID string) (*claimRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	query := url.Values{"patch_id": {patchID}}
+	req, err := http.NewRequestWithContext(ctx, "GET", activePortal.endpoint(claimPath)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	setPortalHeaders(req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	holder := &claimRecord{}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, holder); err != nil {
+		return nil, errors.New("claim response is not JSON: " + err.Error())
+	}
+	return holder, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimPatch(t *testing.T) {
+	claimNonces = map[string]string{}
+	defer func() { claimNonces = map[string]string{} }()
+
+	// The portal keeps the last claim posted, or one from another host when rival is set
+	var recorded, rival string
+	found := true
+	http.DefaultClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		status, body := http.StatusOK, ""
+		if req.Method == "POST" {
+			req.ParseForm()
+			recorded = req.PostForm.Get("claim_nonce")
+		} else if req.URL.Path == claimPath {
+			assert.Equal(t, "63547", req.URL.Query().Get("patch_id"))
+			body = `{"claim_nonce": "` + recorded + `"}`
+			if rival != "" {
+				body = `{"claim_nonce": "` + rival + `", "hostname": "lms2.example.edu"}`
+			}
+			if !found {
+				status = http.StatusNotFound
+			}
+		}
+		return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+	})
+	defer func() { http.DefaultClient.Transport = nil }()
+
+	won, _ := claimPatch("63547")
+	assert.True(t, won)
+	assert.Len(t, recorded, 32)
+	assert.Equal(t, recorded, claimNonces["63547"])
+
+	// Every claim gets a fresh nonce, and another host's claim landed last
+	first := recorded
+	rival = first
+	won, reason := claimPatch("63547")
+	assert.False(t, won)
+	assert.NotEqual(t, first, recorded)
+	assert.Equal(t, "claimed by lms2.example.edu", reason)
+
+	// Portals that don't track claims
+	found = false
+	won, _ = claimPatch("63547")
+	assert.True(t, won)
+}
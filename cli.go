@@ -0,0 +1,362 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// cliCommand is a subcommand as shown in help, the man page and completions
+type cliCommand struct {
+	name    string
+	summary string
+	// flags are the ones that matter to the command, nil for all of them
+	flags []string
+}
+
+var cliCommands = []cliCommand{
+	{"", "Check each portal once, apply any patches and exit. This is what cron runs.", nil},
+	{"daemon", "Check each portal every -interval until stopped, sending heartbeats in between.", nil},
+	{"agent", "Serve the gRPC agent API on -agent-listen so a controller can push patches, see agentpb/agent.proto.", nil},
+	{"prefetch", "Download and check the tarballs of every assigned patch into -dir without touching the server, then exit.", nil},
+	{"inventory", "Report every instance in the registry to its portal and exit.",
+		[]string{"portal", "portals", "token", "token-file", "instances", "log", "proxy", "ca-cert", "client-cert", "client-key"}},
+	{"mockportal", "Serve the patches in -patch-json as a local portal to try them against a test server.",
+		[]string{"patch-json", "mock-listen", "tarball-dir", "token", "hmac-secret-file", "log"}},
+	{"stats", "Print run trends from the local run history.", []string{"state-dir", "log"}},
+	{"cache", "Run cache clean to remove cached tarballs beyond -cache-keep, -cache-max-size and -cache-max-age now.",
+		[]string{"dir", "cache-keep", "cache-max-size", "cache-max-age", "log"}},
+	{"blockmap", "Write the .blocks map -incremental-sync needs next to each tarball given, to publish along with it.", []string{"log"}},
+	{"help", "Show help for a command, or a topic: codes, config.", []string{}},
+	{"man", "Print the man page, e.g. go-patcher man | man -l -", []string{}},
+	{"completion", "Print a bash, zsh or fish completion script.", []string{}},
+}
+
+// flagValues enumerates the flags that only take a fixed set of values
+var flagValues = map[string][]string{
+	"log":         {"debug", "info", "warn", "error", "fatal", "panic"},
+	"environment": {"auto", envContainer, envVM, envBareMetal},
+	"ip-family":   {ipFamilyV4, ipFamilyV6, ipFamilyV4Only, ipFamilyV6Only},
+	"sandbox":     {sandboxOff, sandboxAuto, sandboxLandlock},
+}
+
+// resultCodes are the patch results reported to the portal
+var resultCodes = [][2]string{
+	{patchDefer, "deferred, the portal offers the patch again later"},
+	{patchSuccess, "applied and the server came back"},
+	{tomcatDown, "applied but the server did not come back"},
+	{tomcatNoShutdown, "the server could not be stopped"},
+	{inProgress, "claimed by this host and being applied"},
+}
+
+// configFiles are the YAML files the patcher reads, with the flag naming each one
+var configFiles = []struct {
+	flag   string
+	config any
+}{
+	{"portals", portalList{}},
+	{"instances", instanceRegistry{}},
+	{"overrides", hostOverrides{}},
+}
+
+func findCommand(name string) (cliCommand, bool) {
+	for _, command := range cliCommands {
+		if command.name == name {
+			return command, true
+		}
+	}
+	return cliCommand{}, false
+}
+
+// runHelpCommand handles the commands that need neither a token nor a portal.
+// It reports false for every other command.
+func runHelpCommand(w io.Writer, name string, args []string) (bool, error) {
+	switch name {
+	case "help":
+		topic := ""
+		if len(args) > 0 {
+			topic = args[0]
+		}
+		return true, printHelp(w, topic)
+	case "man":
+		printMan(w)
+		return true, nil
+	case "completion":
+		if len(args) == 0 {
+			return true, fmt.Errorf("completion needs a shell: bash, zsh or fish")
+		}
+		return true, printCompletion(w, args[0])
+	}
+	return false, nil
+}
+
+func printHelp(w io.Writer, topic string) error {
+	switch topic {
+	case "codes":
+		printCodes(w)
+		return nil
+	case "config":
+		printConfigKeys(w)
+		return nil
+	}
+	if _, ok := findCommand(topic); !ok {
+		return fmt.Errorf("no help for %q, try go-patcher help", topic)
+	}
+	printUsage(w, topic)
+	return nil
+}
+
+// printUsage is the -help output of a command
+func printUsage(w io.Writer, name string) {
+	command, ok := findCommand(name)
+	if !ok {
+		command = cliCommands[0]
+	}
+	if command.name == "" {
+		fmt.Fprintf(w, "Usage: go-patcher [command] [flags]\n\n%s\n\nCommands:\n", command.summary)
+		for _, sub := range cliCommands[1:] {
+			fmt.Fprintf(w, "  %-11s %s\n", sub.name, sub.summary)
+		}
+		fmt.Fprint(w, "\nRun go-patcher help codes for result codes, go-patcher help config for config keys.\n")
+	} else {
+		fmt.Fprintf(w, "Usage: go-patcher %s [flags]\n\n%s\n", command.name, command.summary)
+	}
+
+	flags := commandFlags(command)
+	if len(flags) == 0 {
+		return
+	}
+	fmt.Fprint(w, "\nFlags:\n")
+	for _, f := range flags {
+		kind, usage := flag.UnquoteUsage(f)
+		fmt.Fprintf(w, "  -%s %s\n    \t%s", f.Name, kind, usage)
+		if f.DefValue != "" && f.DefValue != "false" {
+			fmt.Fprintf(w, " (default %q)", f.DefValue)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// commandFlags are the registered flags a command uses, in name order
+func commandFlags(command cliCommand) []*flag.Flag {
+	var flags []*flag.Flag
+	flag.VisitAll(func(f *flag.Flag) {
+		if command.flags == nil || contains(command.flags, f.Name) {
+			flags = append(flags, f)
+		}
+	})
+	return flags
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func printCodes(w io.Writer) {
+	fmt.Fprint(w, "Result codes:\n")
+	for _, code := range resultCodes {
+		fmt.Fprintf(w, "  %-3s %s\n", code[0], code[1])
+	}
+	fmt.Fprint(w, "\nstart_uptime codes, -1 with result 2 and the rest with a deferred patch:\n")
+	for _, code := range startupCodes() {
+		fmt.Fprintf(w, "  %-4s %s\n", code[0], code[1])
+	}
+	fmt.Fprint(w, "  A positive start_uptime is how long the server took to start, in milliseconds.\n")
+}
+
+// startupCodes are the negative start_uptime codes in numeric order
+func startupCodes() [][2]string {
+	codes := [][2]string{{"-1", reasonServerDown}}
+	for code, reason := range legacyReasons {
+		codes = append(codes, [2]string{code, reason})
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		a, _ := strconv.Atoi(codes[i][0])
+		b, _ := strconv.Atoi(codes[j][0])
+		return a > b
+	})
+	return codes
+}
+
+func printConfigKeys(w io.Writer) {
+	for i, file := range configFiles {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Keys in the -%s file (%s):\n", file.flag, flag.Lookup(file.flag).DefValue)
+		for _, key := range yamlKeys(reflect.TypeOf(file.config), "") {
+			fmt.Fprintf(w, "  %s\n", key)
+		}
+	}
+}
+
+// yamlKeys lists the YAML keys of a config struct, nested ones as parent.child
+// and list items as parent[].child
+func yamlKeys(t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		key := prefix + name
+		inner := field.Type
+		if inner.Kind() == reflect.Slice && inner.Elem().Kind() != reflect.String {
+			key += "[]"
+			inner = inner.Elem()
+		}
+		for inner.Kind() == reflect.Pointer {
+			inner = inner.Elem()
+		}
+		if inner.Kind() == reflect.Struct {
+			keys = append(keys, yamlKeys(inner, key+".")...)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// roffEscape keeps hyphens and backslashes literal and stops lines starting as requests
+func roffEscape(text string) string {
+	text = strings.ReplaceAll(text, `\`, `\e`)
+	text = strings.ReplaceAll(text, "-", `\-`)
+	if strings.HasPrefix(text, ".") || strings.HasPrefix(text, "'") {
+		text = `\&` + text
+	}
+	return text
+}
+
+// printMan writes the man page in roff
+func printMan(w io.Writer) {
+	fmt.Fprint(w, ".TH GO\\-PATCHER 8 \"\" \"go-patcher\" \"System Administration\"\n")
+	fmt.Fprint(w, ".SH NAME\ngo\\-patcher \\- apply patches from the admin portal to Sakai servers\n")
+	fmt.Fprint(w, ".SH SYNOPSIS\n.B go\\-patcher\n[\\fIcommand\\fR] [\\fIflags\\fR]\n")
+	fmt.Fprintf(w, ".SH DESCRIPTION\n%s\n", roffEscape(cliCommands[0].summary))
+
+	fmt.Fprint(w, ".SH COMMANDS\n")
+	for _, command := range cliCommands[1:] {
+		fmt.Fprintf(w, ".TP\n.B %s\n%s\n", command.name, roffEscape(command.summary))
+	}
+
+	fmt.Fprint(w, ".SH OPTIONS\n")
+	for _, f := range commandFlags(cliCommands[0]) {
+		kind, usage := flag.UnquoteUsage(f)
+		fmt.Fprintf(w, ".TP\n.BI \\-%s \" %s\"\n%s", roffEscape(f.Name), kind, roffEscape(usage))
+		if f.DefValue != "" && f.DefValue != "false" {
+			fmt.Fprintf(w, " (default %s)", roffEscape(f.DefValue))
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprint(w, ".SH RESULT CODES\n")
+	for _, code := range resultCodes {
+		fmt.Fprintf(w, ".TP\n.B %s\n%s\n", code[0], roffEscape(code[1]))
+	}
+	fmt.Fprint(w, ".SH START_UPTIME CODES\n\\-1 comes with result 2, the others with a deferred patch. A positive value is the startup time in milliseconds.\n")
+	for _, code := range startupCodes() {
+		fmt.Fprintf(w, ".TP\n.B %s\n%s\n", roffEscape(code[0]), roffEscape(code[1]))
+	}
+
+	fmt.Fprint(w, ".SH FILES\n")
+	for _, file := range configFiles {
+		fmt.Fprintf(w, ".TP\n.I %s\nSet with \\fB\\-%s\\fR. Keys:\n", roffEscape(flag.Lookup(file.flag).DefValue), file.flag)
+		for _, key := range yamlKeys(reflect.TypeOf(file.config), "") {
+			fmt.Fprintf(w, ".br\n%s\n", roffEscape(key))
+		}
+	}
+}
+
+// printCompletion writes a completion script for the shell
+func printCompletion(w io.Writer, shell string) error {
+	var commands []string
+	for _, command := range cliCommands[1:] {
+		commands = append(commands, command.name)
+	}
+	flags := commandFlags(cliCommands[0])
+
+	switch shell {
+	case "bash":
+		var names []string
+		for _, f := range flags {
+			names = append(names, "-"+f.Name)
+		}
+		fmt.Fprint(w, "_go_patcher() {\n\tlocal cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}\n\tcase $prev in\n")
+		for _, f := range flags {
+			if values, ok := flagValues[f.Name]; ok {
+				fmt.Fprintf(w, "\t-%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", f.Name, strings.Join(values, " "))
+			}
+		}
+		fmt.Fprint(w, "\tcompletion) COMPREPLY=($(compgen -W \"bash zsh fish\" -- \"$cur\")); return ;;\n")
+		fmt.Fprintf(w, "\thelp) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n\tesac\n",
+			strings.Join(append(commands, "codes", "config"), " "))
+		fmt.Fprintf(w, "\tif [[ $cur != -* && $COMP_CWORD -eq 1 ]]; then\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\treturn\n\tfi\n",
+			strings.Join(commands, " "))
+		fmt.Fprintf(w, "\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n}\ncomplete -o default -F _go_patcher go-patcher\n",
+			strings.Join(names, " "))
+	case "zsh":
+		fmt.Fprint(w, "#compdef go-patcher\n\n_go_patcher() {\n\tlocal -a commands\n\tcommands=(\n")
+		for _, command := range cliCommands[1:] {
+			fmt.Fprintf(w, "\t\t'%s:%s'\n", command.name, zshQuote(command.summary))
+		}
+		fmt.Fprint(w, "\t)\n\t_arguments \\\n")
+		for _, f := range flags {
+			_, usage := flag.UnquoteUsage(f)
+			spec := fmt.Sprintf("-%s[%s]", f.Name, zshQuote(usage))
+			if values, ok := flagValues[f.Name]; ok {
+				spec += ":" + f.Name + ":(" + strings.Join(values, " ") + ")"
+			} else if !isBoolFlag(f) {
+				spec += ":" + f.Name + ":_files"
+			}
+			fmt.Fprintf(w, "\t\t'%s' \\\n", spec)
+		}
+		fmt.Fprint(w, "\t\t'1:command:_describe command commands' \\\n\t\t'*::arg:_files'\n}\n\n_go_patcher \"$@\"\n")
+	case "fish":
+		for _, command := range cliCommands[1:] {
+			fmt.Fprintf(w, "complete -c go-patcher -n __fish_use_subcommand -f -a %s -d %s\n", command.name, fishQuote(command.summary))
+		}
+		fmt.Fprint(w, "complete -c go-patcher -n '__fish_seen_subcommand_from completion' -f -a 'bash zsh fish'\n")
+		fmt.Fprintf(w, "complete -c go-patcher -n '__fish_seen_subcommand_from help' -f -a %s\n",
+			fishQuote(strings.Join(append(commands, "codes", "config"), " ")))
+		for _, f := range flags {
+			_, usage := flag.UnquoteUsage(f)
+			line := fmt.Sprintf("complete -c go-patcher -o %s -d %s", f.Name, fishQuote(usage))
+			if values, ok := flagValues[f.Name]; ok {
+				line += " -x -a " + fishQuote(strings.Join(values, " "))
+			} else if !isBoolFlag(f) {
+				line += " -r"
+			}
+			fmt.Fprintln(w, line)
+		}
+	default:
+		return fmt.Errorf("no completion for %q, use bash, zsh or fish", shell)
+	}
+	return nil
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// zshQuote makes text safe inside a single-quoted _arguments spec
+func zshQuote(text string) string {
+	return strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(text)
+}
+
+func fishQuote(text string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(text) + "'"
+}
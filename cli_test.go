@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestYamlKeys(t *testing.T) {
+	keys := yamlKeys(reflect.TypeOf(hostOverrides{}), "")
+	assert.Contains(t, keys, "pin_patches")
+	assert.Contains(t, keys, "timeouts.startup_wait_seconds")
+	assert.NotContains(t, keys, "applied")
+
+	keys = yamlKeys(reflect.TypeOf(portalList{}), "")
+	assert.Contains(t, keys, "portals[].url")
+	assert.Contains(t, keys, "portals[].pin_sha256")
+}
+
+func TestHelpCommands(t *testing.T) {
+	var out bytes.Buffer
+	handled, err := runHelpCommand(&out, "help", []string{"stats"})
+	assert.True(t, handled)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "Usage: go-patcher stats [flags]")
+	assert.Contains(t, out.String(), "-state-dir")
+	assert.NotContains(t, out.String(), "-token")
+
+	out.Reset()
+	runHelpCommand(&out, "help", nil)
+	assert.Contains(t, out.String(), "daemon")
+	assert.Contains(t, out.String(), "-token")
+
+	out.Reset()
+	runHelpCommand(&out, "help", []string{"codes"})
+	assert.Contains(t, out.String(), "-12  "+reasonPropertyEdits)
+	assert.Less(t, strings.Index(out.String(), "-2 "), strings.Index(out.String(), "-10 "))
+
+	_, err = runHelpCommand(&out, "help", []string{"nonsense"})
+	assert.Error(t, err)
+	_, err = runHelpCommand(&out, "completion", []string{"tcsh"})
+	assert.Error(t, err)
+
+	handled, _ = runHelpCommand(&out, "daemon", nil)
+	assert.False(t, handled)
+}
+
+func TestManPage(t *testing.T) {
+	var out bytes.Buffer
+	printMan(&out)
+	assert.True(t, strings.HasPrefix(out.String(), ".TH GO\\-PATCHER 8"))
+	assert.Contains(t, out.String(), ".BI \\-ip\\-family \" string\"")
+	assert.Contains(t, out.String(), "instances[].config_url")
+	for _, line := range strings.Split(out.String(), "\n") {
+		assert.False(t, strings.HasPrefix(line, "-"), "unescaped line %q", line)
+	}
+}
+
+func TestCompletionScripts(t *testing.T) {
+	var out bytes.Buffer
+	assert.NoError(t, printCompletion(&out, "bash"))
+	assert.Contains(t, out.String(), `-sandbox) COMPREPLY=($(compgen -W "off auto landlock"`)
+	if bash, err := exec.LookPath("bash"); err == nil {
+		check := exec.Command(bash, "-n")
+		check.Stdin = &out
+		assert.NoError(t, check.Run(), "bash completion does not parse")
+	}
+
+	out.Reset()
+	assert.NoError(t, printCompletion(&out, "zsh"))
+	assert.Contains(t, out.String(), "'-environment[runtime environment\\: auto, container, vm or bare-metal]:environment:(auto container vm bare-metal)'")
+
+	out.Reset()
+	assert.NoError(t, printCompletion(&out, "fish"))
+	assert.Contains(t, out.String(), "complete -c go-patcher -o log -d 'Log level (debug, info, warn, error, fatal, panic)' -x -a 'debug info warn error fatal panic'")
+}
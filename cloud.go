@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// metadataBase is the link-local instance metadata service shared by EC2, GCP and Azure
+var metadataBase = "http://169.254.169.254"
+
+// metadataTimeout keeps hosts outside a cloud from waiting on a service that isn't there
+const metadataTimeout = time.Second
+
+// metadataClient talks to the metadata service directly, never through -proxy
+var metadataClient = &http.Client{Transport: &http.Transport{}, Timeout: metadataTimeout}
+
+// cloudIdentity is what the metadata service says about this instance. Behind
+// NAT the interfaces only show the private address, the public one comes from here.
+type cloudIdentity struct {
+	Provider   string `json:"provider"`
+	InstanceID string `json:"instance_id"`
+	PrivateIP  string `json:"private_ip,omitempty"`
+	PublicIP   string `json:"public_ip,omitempty"`
+}
+
+var (
+	cloudOnce   sync.Once
+	cloudCached *cloudIdentity
+)
+
+// cloudMetadata asks the metadata service once per process, nil off the cloud
+// or with -cloud-metadata=false
+func cloudMetadata() *cloudIdentity {
+	cloudOnce.Do(func() {
+		if !*useCloudMetadata || runtimeEnv == envBareMetal {
+			return
+		}
+		cloudCached = detectCloud()
+		if cloudCached != nil {
+			log.Debugf("Cloud metadata: %+v", *cloudCached)
+		}
+	})
+	return cloudCached
+}
+
+// detectCloud tries each provider's metadata API in turn
+func detectCloud() *cloudIdentity {
+	for _, probe := range []func() (*cloudIdentity, error){ec2Identity, gcpIdentity, azureIdentity} {
+		identity, err := probe()
+		if err == nil && identity.InstanceID != "" {
+			return identity
+		}
+		log.Debug("No cloud metadata: ", err)
+	}
+	return nil
+}
+
+// metadataGet fetches one metadata value with the provider's headers
+func metadataGet(method string, path string, headers map[string]string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), metadataTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, metadataBase+path, nil)
+	if err != nil {
+		return "", err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(path + ": " + resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// ec2Identity uses IMDSv2, which needs a session token first
+func ec2Identity() (*cloudIdentity, error) {
+	token, err := metadataGet("PUT", "/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{"X-aws-ec2-metadata-token": token}
+	identity := &cloudIdentity{Provider: "ec2"}
+	if identity.InstanceID, err = metadataGet("GET", "/latest/meta-data/instance-id", headers); err != nil {
+		return nil, err
+	}
+	identity.PrivateIP, _ = metadataGet("GET", "/latest/meta-data/local-ipv4", headers)
+	// Only instances with a public address have this one
+	identity.PublicIP, _ = metadataGet("GET", "/latest/meta-data/public-ipv4", headers)
+	return identity, nil
+}
+
+func gcpIdentity() (*cloudIdentity, error) {
+	headers := map[string]string{"Metadata-Flavor": "Google"}
+	identity := &cloudIdentity{Provider: "gcp"}
+	var err error
+	if identity.InstanceID, err = metadataGet("GET", "/computeMetadata/v1/instance/id", headers); err != nil {
+		return nil, err
+	}
+	identity.PrivateIP, _ = metadataGet("GET", "/computeMetadata/v1/instance/network-interfaces/0/ip", headers)
+	identity.PublicIP, _ = metadataGet("GET", "/computeMetadata/v1/instance/network-interfaces/0/access-configs/0/external-ip", headers)
+	return identity, nil
+}
+
+func azureIdentity() (*cloudIdentity, error) {
+	body, err := metadataGet("GET", "/metadata/instance?api-version=2021-02-01", map[string]string{"Metadata": "true"})
+	if err != nil {
+		return nil, err
+	}
+	var instance struct {
+		Compute struct {
+			VMID string `json:"vmId"`
+		} `json:"compute"`
+		Network struct {
+			Interface []struct {
+				IPv4 struct {
+					IPAddress []struct {
+						PrivateIPAddress string `json:"privateIpAddress"`
+						PublicIPAddress  string `json:"publicIpAddress"`
+					} `json:"ipAddress"`
+				} `json:"ipv4"`
+			} `json:"interface"`
+		} `json:"network"`
+	}
+	if err := json.Unmarshal([]byte(body), &instance); err != nil {
+		return nil, err
+	}
+	identity := &cloudIdentity{Provider: "azure", InstanceID: instance.Compute.VMID}
+	if len(instance.Network.Interface) > 0 && len(instance.Network.Interface[0].IPv4.IPAddress) > 0 {
+		addr := instance.Network.Interface[0].IPv4.IPAddress[0]
+		identity.PrivateIP, identity.PublicIP = addr.PrivateIPAddress, addr.PublicIPAddress
+	}
+	return identity, nil
+}
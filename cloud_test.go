@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectCloud(t *testing.T) {
+	ec2 := map[string]string{
+		"/latest/meta-data/instance-id": "i-0abc123",
+		"/latest/meta-data/local-ipv4":  "172.31.5.10",
+		"/latest/meta-data/public-ipv4": "54.1.2.3",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/latest/api/token" {
+			w.Write([]byte("imds-token"))
+			return
+		}
+		value, ok := ec2[r.URL.Path]
+		if !ok || r.Header.Get("X-aws-ec2-metadata-token") != "imds-token" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(value + "\n"))
+	}))
+	defer server.Close()
+	oldBase := metadataBase
+	metadataBase = server.URL
+	defer func() { metadataBase = oldBase }()
+
+	assert.Equal(t, &cloudIdentity{Provider: "ec2", InstanceID: "i-0abc123", PrivateIP: "172.31.5.10", PublicIP: "54.1.2.3"}, detectCloud())
+	assert.Equal(t, `["172.31.5.10","54.1.2.3"]`, mergeIPs(`["172.31.5.10"]`, "172.31.5.10", "", "54.1.2.3"))
+}
+
+func TestDetectCloudAzure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metadata/instance" || r.Header.Get("Metadata") != "true" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"compute": {"vmId": "02aab8a4-74ef-476e-8182-f6d2ba4166a6"},
+			"network": {"interface": [{"ipv4": {"ipAddress": [{"privateIpAddress": "10.1.0.4", "publicIpAddress": "20.3.4.5"}]}}]}}`))
+	}))
+	defer server.Close()
+	oldBase := metadataBase
+	metadataBase = server.URL
+	defer func() { metadataBase = oldBase }()
+
+	assert.Equal(t, &cloudIdentity{Provider: "azure", InstanceID: "02aab8a4-74ef-476e-8182-f6d2ba4166a6", PrivateIP: "10.1.0.4", PublicIP: "20.3.4.5"}, detectCloud())
+
+	// Nothing answers off the cloud
+	server.Close()
+	assert.Nil(t, detectCloud())
+}
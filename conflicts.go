@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultConflictingProcesses match backup agents, integrity scans and package
+// transactions that we must not restart Tomcat underneath
+const defaultConflictingProcesses = `\baide\b,\b(yum|dnf|rpm|apt-get|dpkg|unattended-upgrade)\b,` +
+	`\b(mysqldump|xtrabackup|mariabackup|rsnapshot|duplicity|restic|borg)\b,\bbpbkar\b,\bdsmc\b`
+
+// compileConflictPatterns parses the comma-separated list of process regexps
+func compileConflictPatterns(patterns string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// conflictingProcesses lists running processes that should defer this patch
+func conflictingProcesses() []string {
+	patterns, err := compileConflictPatterns(*conflictingProcs)
+	if err != nil {
+		panic("Bad -conflicting-procs pattern: " + err.Error())
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	out, err := exec.Command("ps", "-eo", "pid=,args=").Output()
+	if err != nil {
+		log.Warning("Could not list processes to check for conflicts: ", err)
+		return nil
+	}
+	return findConflictingProcesses(string(out), patterns, os.Getpid())
+}
+
+// findConflictingProcesses matches "pid args" lines from ps against the patterns
+func findConflictingProcesses(psOutput string, patterns []*regexp.Regexp, selfPID int) []string {
+	var conflicts []string
+	for _, line := range strings.Split(psOutput, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if pid, err := strconv.Atoi(fields[0]); err != nil || pid == selfPID {
+			continue
+		}
+
+		args := strings.Join(fields[1:], " ")
+		for _, pattern := range patterns {
+			if pattern.MatchString(args) {
+				log.Debug("Found conflicting process: ", line)
+				conflicts = append(conflicts, strings.TrimSpace(line))
+				break
+			}
+		}
+	}
+	return conflicts
+}
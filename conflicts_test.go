@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindConflictingProcesses(t *testing.T) {
+	psOutput := `    1 /sbin/init
+  812 /usr/sbin/bacula-fd -fP -c /etc/bacula/bacula-fd.conf
+ 1203 /usr/bin/python3 /usr/bin/yum -y update
+ 1500 /usr/sbin/aide --check
+ 2210 /opt/java/bin/java -Dcatalina.base=/opt/tomcat org.apache.catalina.startup.Bootstrap start
+ 3301 mysqldump --single-transaction sakai
+ 4000 /usr/local/bin/go-patcher -conflicting-procs yum
+`
+	patterns, err := compileConflictPatterns(defaultConflictingProcesses)
+	assert.NoError(t, err)
+
+	conflicts := findConflictingProcesses(psOutput, patterns, 4000)
+	assert.Equal(t, []string{
+		"1203 /usr/bin/python3 /usr/bin/yum -y update",
+		"1500 /usr/sbin/aide --check",
+		"3301 mysqldump --single-transaction sakai",
+	}, conflicts)
+
+	patterns, err = compileConflictPatterns("")
+	assert.NoError(t, err)
+	assert.Empty(t, findConflictingProcesses(psOutput, patterns, 4000))
+
+	_, err = compileConflictPatterns("aide,(unclosed")
+	assert.Error(t, err)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runTracker follows the cycle in progress for the control and agent APIs,
+// which read it from their own goroutines while the cycle writes to the run globals
+type runTracker struct {
+	mu        sync.Mutex
+	running   bool
+	portal    string
+	runID     string
+	patchIDs  []string
+	started   time.Time
+	nextCheck time.Time
+	cancel    bool
+}
+
+var currentRun runTracker
+
+// controlAPI lets orchestration tools drive the daemon without a shell on the
+// host: check the portals now, report what the daemon is doing, cancel a run.
+// A nil *controlAPI is a no-op so callers don't need to check -control-listen.
+type controlAPI struct {
+	server  *http.Server
+	trigger chan struct{}
+}
+
+// control is the daemon's API, nil unless -control-listen is set
+var control *controlAPI
+
+// controlStatus is the answer to GET /status
+type controlStatus struct {
+	State           string     `json:"state"`
+	Portal          string     `json:"portal,omitempty"`
+	RunID           string     `json:"run_id,omitempty"`
+	PatchIDs        []string   `json:"patch_ids,omitempty"`
+	RunStarted      int64      `json:"run_started,omitempty"`
+	CancelRequested bool       `json:"cancel_requested,omitempty"`
+	NextCheck       int64      `json:"next_check,omitempty"`
+	DaemonStarted   int64      `json:"daemon_started"`
+	Version         string     `json:"version"`
+	LastRun         *runRecord `json:"last_run,omitempty"`
+}
+
+// startControlAPI serves the API on a Unix socket, for an address starting
+// with a slash, or on a loopback host:port
+func startControlAPI(address string) (*controlAPI, error) {
+	listener, err := controlListener(address)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &controlAPI{trigger: make(chan struct{}, 1)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/check", c.handleCheck)
+	mux.HandleFunc("/status", c.handleStatus)
+	mux.HandleFunc("/cancel", c.handleCancel)
+	c.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go c.server.Serve(listener)
+	log.Info("Control API listening on ", address)
+	return c, nil
+}
+
+func controlListener(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "/") {
+		if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+		listener, err := net.Listen("unix", address)
+		if err != nil {
+			return nil, err
+		}
+		// Anyone who can connect can cancel a run, so only the patcher's user may
+		os.Chmod(address, 0600)
+		return listener, nil
+	}
+
+	// There is no authentication, so never listen beyond this host
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errors.New("control API must listen on a Unix socket or a loopback address, not " + address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// handleCheck wakes the daemon to check every portal now. During a run the
+// check follows as soon as the run is done.
+func (c *controlAPI) handleCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeControlError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	select {
+	case c.trigger <- struct{}{}:
+		log.Info("Portal check requested through the control API")
+	default:
+		// A check is already queued
+	}
+	writeControlJSON(w, http.StatusAccepted, map[string]string{"result": "check queued"})
+}
+
+func (c *controlAPI) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeControlError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	writeControlJSON(w, http.StatusOK, currentRun.status())
+}
+
+// handleCancel asks the current run to stop at the next safe point: before
+// the server is stopped, or between patches once it is down. A server that
+// was stopped is always started again.
+func (c *controlAPI) handleCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeControlError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	runID, running := currentRun.requestCancel()
+	if !running {
+		writeControlError(w, http.StatusConflict, "no run in progress")
+		return
+	}
+	log.Warning("Cancel of run ", runID, " requested through the control API")
+	writeControlJSON(w, http.StatusAccepted, map[string]string{"result": "cancel requested", "run_id": runID})
+}
+
+// status reports the run in progress, or when the next check is due
+func (t *runTracker) status() controlStatus {
+	t.mu.Lock()
+	status := controlStatus{State: "idle", DaemonStarted: daemonStarted.Unix(), Version: patcherVersion}
+	if t.running {
+		status.State, status.Portal, status.RunID = "running", t.portal, t.runID
+		status.PatchIDs = append([]string(nil), t.patchIDs...)
+		status.RunStarted, status.CancelRequested = t.started.Unix(), t.cancel
+	} else if !t.nextCheck.IsZero() {
+		status.NextCheck = t.nextCheck.Unix()
+	}
+	t.mu.Unlock()
+
+	if records, err := loadHistory(historyPath()); err == nil && len(records) > 0 {
+		status.LastRun = &records[len(records)-1]
+	}
+	return status
+}
+
+func writeControlJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeControlError(w http.ResponseWriter, code int, message string) {
+	writeControlJSON(w, code, map[string]string{"error": message})
+}
+
+// runStarting records the cycle being reported on and clears an old cancel
+func (t *runTracker) runStarting(portal string, runID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running, t.portal, t.runID, t.patchIDs, t.started, t.cancel = true, portal, runID, nil, time.Now(), false
+}
+
+// claimed records the patches the run is applying
+func (t *runTracker) claimed(patchIDs []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.patchIDs = append([]string(nil), patchIDs...)
+}
+
+func (t *runTracker) runFinished() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running, t.cancel = false, false
+}
+
+// requestCancel flags the run in progress, if there is one
+func (t *runTracker) requestCancel() (runID string, running bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running {
+		t.cancel = true
+	}
+	return t.runID, t.running
+}
+
+// canceled is checked at the points where a run can safely stop
+func (t *runTracker) canceled() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cancel
+}
+
+func (t *runTracker) scheduled(next time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextCheck = next
+}
+
+// triggered fires when a check is requested, never for a nil API
+func (c *controlAPI) triggered() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.trigger
+}
+
+// Close stops serving and removes a Unix socket
+func (c *controlAPI) Close() {
+	if c == nil {
+		return
+	}
+	c.server.Close()
+	log.Debug("Closed control API")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestControlAPI(t *testing.T) {
+	// Unix socket paths are limited to about 100 bytes, too short for some test temp dirs
+	dir, err := os.MkdirTemp("", "control")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "control.sock")
+
+	api, err := startControlAPI(socket)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer api.Close()
+	info, err := os.Stat(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	}}}
+	call := func(method string, path string) (int, map[string]any) {
+		req, _ := http.NewRequest(method, "http://patcher"+path, nil)
+		resp, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			return 0, nil
+		}
+		defer resp.Body.Close()
+		var body map[string]any
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	code, status := call("GET", "/status")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "idle", status["state"])
+	assert.Equal(t, patcherVersion, status["version"])
+
+	code, body := call("POST", "/cancel")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, "no run in progress", body["error"])
+
+	currentRun.runStarting("default", "0f8a2b")
+	defer currentRun.runFinished()
+	currentRun.claimed([]string{"63547"})
+	code, _ = call("POST", "/cancel")
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.True(t, currentRun.canceled())
+	_, status = call("GET", "/status")
+	assert.Equal(t, "running", status["state"])
+	assert.Equal(t, "0f8a2b", status["run_id"])
+	assert.Equal(t, []any{"63547"}, status["patch_ids"])
+	assert.Equal(t, true, status["cancel_requested"])
+
+	// The next run starts without the old cancel
+	currentRun.runFinished()
+	currentRun.runStarting("default", "9c1d4e")
+	assert.False(t, currentRun.canceled())
+
+	// Checks queue up behind each other, at most one waits
+	code, _ = call("POST", "/check")
+	assert.Equal(t, http.StatusAccepted, code)
+	code, _ = call("POST", "/check")
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Len(t, api.triggered(), 1)
+
+	code, _ = call("GET", "/check")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
+
+func TestControlListenerLoopbackOnly(t *testing.T) {
+	_, err := controlListener("0.0.0.0:0")
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "loopback"), err.Error())
+	}
+	listener, err := controlListener("127.0.0.1:0")
+	if assert.NoError(t, err) {
+		listener.Close()
+	}
+}
+
+func TestNilControlAPI(t *testing.T) {
+	var api *controlAPI
+	assert.Nil(t, api.triggered())
+	api.Close()
+}
+
+func TestCancelBatch(t *testing.T) {
+	stepResults = map[string][]stepResult{}
+	statusReasons = map[string]string{}
+	restartedFor := ""
+	restart := func(patchID string) (string, string, string, error) {
+		restartedFor = patchID
+		return patchSuccess, "95000", "", nil
+	}
+	remaining := []batchStep{
+		{patchID: "63548", step: patchStep{Type: stepHook, Value: "ok.sh"}},
+		{patchID: "63548", step: patchStep{Type: stepRestart}},
+	}
+	outcomes := cancelBatch(remaining, []string{"63547"}, []string{"63547"}, map[string]patchOutcome{}, false, restart)
+
+	// The patch in hand is brought up, the one that never started is deferred
+	assert.Equal(t, "63547", restartedFor)
+	assert.Equal(t, map[string]patchOutcome{"63547": {patchSuccess, "95000"}, "63548": {patchDefer, "-5"}}, outcomes)
+	assert.Equal(t, map[string]string{"63548": reasonCanceled}, statusReasons)
+	assert.Equal(t, []stepResult{{Type: stepRestart, Status: stepOK}}, stepResults["63547"])
+	assert.Equal(t, []stepResult{{Type: stepHook, Status: stepSkipped}, {Type: stepRestart, Status: stepSkipped}}, stepResults["63548"])
+
+	// Nothing to bring back when the server already runs everything applied
+	restartedFor = ""
+	cancelBatch(remaining, nil, nil, map[string]patchOutcome{}, true, restart)
+	assert.Empty(t, restartedFor)
+	statusReasons = map[string]string{}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runPatchCycleSafely turns a panic in one cycle into an error so the daemon,
+// and the other portals in a cron run, carry on
+func runPatchCycleSafely(portal *portalConfig) error {
+	return runCycleSafely(portal, func() error { return runPatchCycle(portal) })
+}
+
+func runCycleSafely(portal *portalConfig, cycle func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Debug(string(debug.Stack()))
+			err = fmt.Errorf("patch cycle for portal %s failed: %v", portal.Name, r)
+		}
+	}()
+	return cycle()
+}
+
+// runDaemon checks every portal in turn each -interval until SIGINT or SIGTERM.
+// Cycles run one at a time, so portals never share a Tomcat downtime or any run state.
+func runDaemon(portals []*portalConfig) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Info("Starting daemon for ", len(portals), " portals, checking every ", *pollInterval)
+	if !waitStartupJitter(ctx) {
+		return
+	}
+	if *heartbeatInterval > 0 {
+		go runHeartbeats(ctx, portals)
+	}
+	for {
+		for _, portal := range portals {
+			if ctx.Err() != nil {
+				break
+			}
+			if err := runPatchCycleSafely(portal); err != nil {
+				log.Error(err)
+			}
+		}
+
+		// Up to a tenth of the interval extra keeps restarted daemons from polling in step
+		wait := *pollInterval + jitter(*pollInterval/10)
+		currentRun.scheduled(time.Now().Add(wait))
+		select {
+		case <-ctx.Done():
+			log.Info("Daemon stopping")
+			return
+		case <-control.triggered():
+			log.Info("Checking portals now as requested through the control API")
+		case <-time.After(wait):
+		}
+	}
+}
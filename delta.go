@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// bsdiffMagic starts a BSDIFF40 patch, the format of bsdiff 4.x
+const bsdiffMagic = "BSDIFF40"
+
+// maxDeltaResult bounds the file a delta may build, it's built in memory
+const maxDeltaResult = 4 << 30
+
+// deltaStep is a delta step's value, "<file> <base sha256> <diff> <new sha256>".
+// The diff is a bsdiff patch turning the deployed file, which must have the
+// base checksum, into the new one. file is relative to the server dir and the
+// diff is fetched like a tarball.
+type deltaStep struct {
+	target string
+	base   string
+	diff   string
+	result string
+}
+
+func parseDeltaStep(value string) (deltaStep, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 4 {
+		return deltaStep{}, errors.New("delta step must be \"<file> <base sha256> <diff> <new sha256>\": " + value)
+	}
+	delta := deltaStep{target: fields[0], base: normalizeChecksum(fields[1]), diff: fields[2], result: normalizeChecksum(fields[3])}
+	if !filepath.IsLocal(delta.target) {
+		return deltaStep{}, errors.New("delta step file must be a relative path inside the server dir: " + delta.target)
+	}
+	if !validChecksum(delta.base) || !validChecksum(delta.result) {
+		return deltaStep{}, errors.New("delta step checksums must be SHA-256 hex digests: " + value)
+	}
+	return delta, nil
+}
+
+// buildFromDelta fetches the diff and applies it to the deployed file in
+// serverDir, leaving the new file in the cache under its checksum. The server
+// dir isn't touched, so this can run while the server is still up.
+func buildFromDelta(value string, serverDir string, patchID string) (string, error) {
+	delta, err := parseDeltaStep(value)
+	if err != nil {
+		return "", err
+	}
+	if cached := cachedTarball(delta.result); cached != "" {
+		log.Info("Using ", delta.target, " built from a delta earlier, cached as ", cached)
+		return cached, nil
+	}
+
+	deployed := filepath.Join(serverDir, delta.target)
+	sum, err := fileChecksum(deployed)
+	if err != nil {
+		return "", fmt.Errorf("delta for %s: %w", delta.target, err)
+	}
+	if sum != delta.base {
+		return "", fmt.Errorf("delta for %s is against %s, the deployed file is %s", delta.target, delta.base, sum)
+	}
+	// A bsdiff patch isn't a tarball, it's checked by the checksum of what it builds
+	diffPath, err := fetchPatchFileSafely(delta.diff, patchID, false)
+	if err != nil {
+		return "", err
+	}
+	old, err := os.ReadFile(deployed)
+	if err != nil {
+		return "", err
+	}
+	diff, err := os.ReadFile(diffPath)
+	if err != nil {
+		return "", err
+	}
+	built, err := bspatch(old, diff)
+	if err != nil {
+		return "", fmt.Errorf("delta for %s: %w", delta.target, err)
+	}
+	if actual := sha256.Sum256(built); hex.EncodeToString(actual[:]) != delta.result {
+		return "", fmt.Errorf("delta for %s built %s, expected %s", delta.target, hex.EncodeToString(actual[:]), delta.result)
+	}
+
+	if err := os.MkdirAll(*patchDir, 0755); err != nil {
+		return "", err
+	}
+	partial := filepath.Join(*patchDir, "delta-"+delta.result+".part")
+	if err := os.WriteFile(partial, built, 0644); err != nil {
+		return "", err
+	}
+	log.Info("Built ", delta.target, " from a ", len(diff), " byte delta")
+	return storeInCache(partial, delta.result), nil
+}
+
+// runDeltaStep replaces a deployed file with the one its delta builds
+func runDeltaStep(value string, patchID string) error {
+	delta, err := parseDeltaStep(value)
+	if err != nil {
+		return err
+	}
+	built, prefetched, err := activePrefetch.tarball(value)
+	if err != nil {
+		return err
+	}
+	if !prefetched {
+		if built, err = buildFromDelta(value, ".", patchID); err != nil {
+			return err
+		}
+	}
+
+	// An earlier step of the batch may have replaced the file since
+	sum, err := fileChecksum(delta.target)
+	if err != nil {
+		return err
+	}
+	if sum == delta.result {
+		log.Info(delta.target, " is already up to date")
+		return nil
+	}
+	if sum != delta.base {
+		return fmt.Errorf("%s changed to %s since its delta was built", delta.target, sum)
+	}
+	if err := replaceFile(built, delta.target); err != nil {
+		return fmt.Errorf("could not replace %s: %w", delta.target, err)
+	}
+	outputBuffer.WriteString("Rebuilt " + delta.target + " from a delta\n")
+	patchedFiles[patchID] = append(patchedFiles[patchID], delta.target)
+	return nil
+}
+
+// replaceFile copies src over dest through a temporary file next to it, so
+// dest is never seen half written, keeping dest's mode
+func replaceFile(src string, dest string) error {
+	info, err := os.Stat(dest)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dest + ".go-patcher-new"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && err == nil && patcherUID == 0 {
+		// Root mustn't leave the server a file it can't replace next time
+		err = out.Chown(int(stat.Uid), int(stat.Gid))
+	}
+	if err == nil && *fsyncExtracted {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// bspatch applies a BSDIFF40 patch: a header, then bzip2 compressed control
+// triples, diff bytes added to the old file and extra bytes copied as is
+func bspatch(old []byte, patch []byte) ([]byte, error) {
+	if len(patch) < 32 || string(patch[:8]) != bsdiffMagic {
+		return nil, errors.New("not a BSDIFF40 patch")
+	}
+	ctrlLen, diffLen, newSize := offtin(patch[8:16]), offtin(patch[16:24]), offtin(patch[24:32])
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 || newSize > maxDeltaResult || 32+ctrlLen+diffLen > int64(len(patch)) {
+		return nil, errors.New("corrupt BSDIFF40 header")
+	}
+	ctrl := bzip2.NewReader(bytes.NewReader(patch[32 : 32+ctrlLen]))
+	diff := bzip2.NewReader(bytes.NewReader(patch[32+ctrlLen : 32+ctrlLen+diffLen]))
+	extra := bzip2.NewReader(bytes.NewReader(patch[32+ctrlLen+diffLen:]))
+
+	built := make([]byte, newSize)
+	var oldPos, newPos int64
+	var triple [24]byte
+	for newPos < newSize {
+		if _, err := io.ReadFull(ctrl, triple[:]); err != nil {
+			return nil, fmt.Errorf("corrupt BSDIFF40 control block: %w", err)
+		}
+		add, copied, seek := offtin(triple[0:8]), offtin(triple[8:16]), offtin(triple[16:24])
+
+		if add < 0 || newPos+add > newSize {
+			return nil, errors.New("corrupt BSDIFF40 patch: diff runs past the new file")
+		}
+		if _, err := io.ReadFull(diff, built[newPos:newPos+add]); err != nil {
+			return nil, fmt.Errorf("corrupt BSDIFF40 diff block: %w", err)
+		}
+		for i := int64(0); i < add; i++ {
+			if oldPos+i >= 0 && oldPos+i < int64(len(old)) {
+				built[newPos+i] += old[oldPos+i]
+			}
+		}
+		newPos += add
+		oldPos += add
+
+		if copied < 0 || newPos+copied > newSize {
+			return nil, errors.New("corrupt BSDIFF40 patch: extra runs past the new file")
+		}
+		if _, err := io.ReadFull(extra, built[newPos:newPos+copied]); err != nil {
+			return nil, fmt.Errorf("corrupt BSDIFF40 extra block: %w", err)
+		}
+		newPos += copied
+		oldPos += seek
+	}
+	return built, nil
+}
+
+// offtin reads bsdiff's sign and magnitude little endian integers
+func offtin(buf []byte) int64 {
+	value := int64(binary.LittleEndian.Uint64(buf) &^ (1 << 63))
+	if buf[7]&0x80 != 0 {
+		return -value
+	}
+	return value
+}
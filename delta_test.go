@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	deltaOldSum = "19d633a5f4d46700f7061f81e3d7dabe4339c6cae4e8d8146d072b46f9d4cd28"
+	deltaNewSum = "670abf5a3f6cfc0df4ac25f6e51739e554e8f645ddc444b636174689dcb4d23e"
+)
+
+func TestBspatch(t *testing.T) {
+	old, _ := os.ReadFile("testdata/delta/kernel-old.jar")
+	want, _ := os.ReadFile("testdata/delta/kernel-new.jar")
+	patch, _ := os.ReadFile("testdata/delta/kernel.jar.bsdiff")
+
+	built, err := bspatch(old, patch)
+	assert.NoError(t, err)
+	assert.Equal(t, want, built)
+
+	_, err = bspatch(old, patch[:len(patch)-20])
+	assert.Error(t, err, "truncated")
+	_, err = bspatch(old, []byte("PK\x03\x04 a jar, not a patch at all"))
+	assert.Error(t, err)
+}
+
+func TestRunDeltaStep(t *testing.T) {
+	abs, _ := filepath.Abs("testdata/delta/kernel.jar.bsdiff")
+	oldDir, _ := os.Getwd()
+	defer os.Chdir(oldDir)
+	defer func(dir string) { *patchDir = dir }(*patchDir)
+	*patchDir = t.TempDir()
+	defer func() { patchedFiles = map[string][]string{} }()
+
+	serverDir := t.TempDir()
+	old, _ := os.ReadFile("testdata/delta/kernel-old.jar")
+	want, _ := os.ReadFile("testdata/delta/kernel-new.jar")
+	os.MkdirAll(filepath.Join(serverDir, "lib"), 0755)
+	os.WriteFile(filepath.Join(serverDir, "lib", "sakai-kernel-api-23.1.jar"), old, 0640)
+	value := strings.Join([]string{"lib/sakai-kernel-api-23.1.jar", deltaOldSum, abs, deltaNewSum}, " ")
+
+	// Built next to the running server, into the cache
+	built, err := buildFromDelta(value, serverDir, "63547")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(cacheDir(), deltaNewSum), built)
+
+	os.Chdir(serverDir)
+	assert.NoError(t, runDeltaStep(value, "63547"))
+	deployed, _ := os.ReadFile("lib/sakai-kernel-api-23.1.jar")
+	assert.Equal(t, want, deployed)
+	info, _ := os.Stat("lib/sakai-kernel-api-23.1.jar")
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	assert.Equal(t, []string{"lib/sakai-kernel-api-23.1.jar"}, patchedFiles["63547"])
+
+	// Run again it finds the file up to date, a file it wasn't built for is left alone
+	assert.NoError(t, runDeltaStep(value, "63547"))
+	os.WriteFile("lib/sakai-kernel-api-23.1.jar", []byte("local build"), 0640)
+	assert.Error(t, runDeltaStep(value, "63547"))
+	os.Remove(built)
+	_, err = buildFromDelta(value, serverDir, "63547")
+	assert.Error(t, err)
+}
+
+func TestParseDeltaStep(t *testing.T) {
+	_, err := parseDeltaStep("lib/kernel.jar " + deltaOldSum + " sakai-builder/kernel.jar.bsdiff sha256:" + deltaNewSum)
+	assert.NoError(t, err)
+	_, err = parseDeltaStep("../../etc/passwd " + deltaOldSum + " sakai-builder/kernel.jar.bsdiff " + deltaNewSum)
+	assert.Error(t, err)
+	_, err = parseDeltaStep("lib/kernel.jar abc sakai-builder/kernel.jar.bsdiff " + deltaNewSum)
+	assert.Error(t, err)
+	_, err = parseDeltaStep("lib/kernel.jar sakai-builder/kernel.jar.bsdiff")
+	assert.Error(t, err)
+}
+
+func TestBuildFromDeltaDownload(t *testing.T) {
+	defer func(dir, web string) { *patchDir, *patchWeb = dir, web }(*patchDir, *patchWeb)
+	*patchDir = t.TempDir()
+	fastRetries(t, 2)
+
+	diff, _ := os.ReadFile("testdata/delta/kernel.jar.bsdiff")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/sakai-builder/kernel.jar.bsdiff", r.URL.Path)
+		w.Write(diff)
+	}))
+	defer server.Close()
+	*patchWeb = server.URL + "/"
+
+	serverDir := t.TempDir()
+	old, _ := os.ReadFile("testdata/delta/kernel-old.jar")
+	want, _ := os.ReadFile("testdata/delta/kernel-new.jar")
+	os.MkdirAll(filepath.Join(serverDir, "lib"), 0755)
+	os.WriteFile(filepath.Join(serverDir, "lib", "sakai-kernel-api-23.1.jar"), old, 0644)
+	value := strings.Join([]string{"lib/sakai-kernel-api-23.1.jar", deltaOldSum, "sakai-builder/kernel.jar.bsdiff", deltaNewSum}, " ")
+	os.Remove(filepath.Join(cacheDir(), deltaNewSum))
+
+	// A bsdiff patch isn't a tarball, it's downloaded once and not refused as corrupt
+	built, err := buildFromDelta(value, serverDir, "63547")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests)
+	content, _ := os.ReadFile(built)
+	assert.Equal(t, want, content)
+}
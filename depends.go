@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+)
+
+// appliedPatches is the local ledger of patches from the active portal that went in
+// cleanly on this host. Runs recorded before per-patch results count a batch as
+// applied only when its last patch, and so every patch, succeeded.
+func appliedPatches(records []runRecord) map[string]bool {
+	applied := map[string]bool{}
+	for _, record := range records {
+		portal := record.Portal
+		if portal == "" {
+			portal = defaultPortalName
+		}
+		if portal != activePortal.Name {
+			continue
+		}
+		if record.Results != nil {
+			for patchID, result := range record.Results {
+				if result == patchSuccess {
+					applied[patchID] = true
+				}
+			}
+			continue
+		}
+		if record.Result != patchSuccess {
+			continue
+		}
+		for _, patchID := range strings.Split(record.PatchID, ",") {
+			applied[patchID] = true
+		}
+	}
+	return applied
+}
+
+// orderBatch splits a batch into patches whose prerequisites are met and the
+// prerequisites each held patch still waits for. A patch earlier in the batch
+// counts as applied since runBatch stops at the first failure.
+func orderBatch(batch []*PatchResponse, applied map[string]bool) ([]*PatchResponse, map[string][]string) {
+	var ready []*PatchResponse
+	held := map[string][]string{}
+	for _, patch := range batch {
+		var missing []string
+		for _, dependency := range patch.DependsOn {
+			if !applied[dependency] {
+				missing = append(missing, dependency)
+			}
+		}
+		if len(missing) > 0 {
+			held[patch.PatchID] = missing
+			continue
+		}
+		ready = append(ready, patch)
+		applied[patch.PatchID] = true
+	}
+	return ready, held
+}
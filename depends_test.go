@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderBatch(t *testing.T) {
+	applied := appliedPatches([]runRecord{
+		{PatchID: "63540,63541", Result: patchSuccess},
+		{PatchID: "63542", Result: tomcatDown},
+		// 63543 went in at its own restart, 63544 failed after it
+		{PatchID: "63543,63544", Result: tomcatDown, Results: map[string]string{"63543": patchSuccess, "63544": tomcatDown}},
+	})
+	assert.Equal(t, map[string]bool{"63540": true, "63541": true, "63543": true}, applied)
+
+	batch := []*PatchResponse{
+		{PatchID: "63550", DependsOn: []string{"63541"}},
+		{PatchID: "63551", DependsOn: []string{"63550"}},
+		{PatchID: "63552", DependsOn: []string{"63542"}},
+		{PatchID: "63553", DependsOn: []string{"63552"}},
+		{PatchID: "63554"},
+	}
+	ready, held := orderBatch(batch, applied)
+	assert.Equal(t, []*PatchResponse{batch[0], batch[1], batch[4]}, ready)
+	assert.Equal(t, map[string][]string{"63552": {"63542"}, "63553": {"63552"}}, held)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// minFreeBytes is the parsed -min-free-space, what every filesystem a run
+// writes to must have left once the patch is on it
+var minFreeBytes int64
+
+// diskNeed is room a run is about to take in a directory
+type diskNeed struct {
+	dir   string
+	bytes int64
+}
+
+// diskFree is the space left in dir for an unprivileged user
+func diskFree(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// existingDir walks up from dir to the first directory that exists, patchDir
+// is only created once there's something to download
+func existingDir(dir string) string {
+	for !pathExists(dir) && dir != filepath.Dir(dir) {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+// tarballDiskNeeds estimates from the sizes the portal sent what downloading
+// the batch takes in the patch dir and extracting it takes in tomcatDir.
+// Tarballs already on disk need no download, and tarballs of unknown size
+// are left to the check once they've been read through.
+func tarballDiskNeeds(batch []*PatchResponse, tomcatDir string) []diskNeed {
+	var download, extract int64
+	seen := map[string]bool{}
+	for _, patch := range batch {
+		for _, step := range patchSteps(patch) {
+			if step.Type != stepTarball {
+				continue
+			}
+			for _, tarball := range strings.SplitN(step.Value, " ", 10) {
+				fileName := path.Base(redactURL(tarball))
+				size, ok := patch.Sizes[fileName]
+				if !ok || seen[tarball] {
+					continue
+				}
+				seen[tarball] = true
+				extract += int64(float64(size) * *expansionRatio)
+				sum := expectedChecksum(patch.PatchID, fileName)
+				if *streamDownload || pathExists(tarball) || findInPatchRepo(fileName) != "" ||
+					(sum != "" && pathExists(filepath.Join(cacheDir(), sum))) {
+					continue
+				}
+				download += size
+			}
+		}
+	}
+	return []diskNeed{{*patchDir, download}, {tomcatDir, extract}}
+}
+
+// checkDiskSpace makes sure every filesystem would keep -min-free-space after
+// taking what the run needs, adding up the needs of directories that share one
+func checkDiskSpace(needs []diskNeed) error {
+	type filesystem struct {
+		dirs  []string
+		bytes int64
+	}
+	var devices []uint64
+	filesystems := map[uint64]*filesystem{}
+	for _, need := range needs {
+		if need.dir == "" || need.bytes <= 0 {
+			continue
+		}
+		dir := existingDir(need.dir)
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		device := uint64(info.Sys().(*syscall.Stat_t).Dev)
+		if filesystems[device] == nil {
+			filesystems[device] = &filesystem{}
+			devices = append(devices, device)
+		}
+		filesystems[device].dirs = append(filesystems[device].dirs, need.dir)
+		filesystems[device].bytes += need.bytes
+	}
+
+	for _, device := range devices {
+		fs := filesystems[device]
+		free, err := diskFree(existingDir(fs.dirs[0]))
+		if err != nil {
+			return fmt.Errorf("could not check free space in %s: %w", fs.dirs[0], err)
+		}
+		if free-fs.bytes < minFreeBytes {
+			return fmt.Errorf("%s has %.1f MB free, the patch needs %.1f MB and -min-free-space keeps %.1f MB",
+				strings.Join(fs.dirs, " and "), megabytes(free), megabytes(fs.bytes), megabytes(minFreeBytes))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTarballDiskNeeds(t *testing.T) {
+	dir := t.TempDir()
+	defer func(patch string) { *patchDir = patch }(*patchDir)
+	*patchDir = filepath.Join(dir, "patches")
+	defer func() { tarballChecksums = map[string]map[string]string{} }()
+
+	sum, _ := fileChecksum("test.tar.gz")
+	os.MkdirAll(cacheDir(), 0755)
+	os.WriteFile(filepath.Join(cacheDir(), sum), []byte("cached"), 0644)
+	tarballChecksums["63548"] = map[string]string{"patch-63548.tar.gz": sum}
+
+	batch := []*PatchResponse{
+		{PatchID: "63547", Files: "sakai-builder/patch-63547.tar.gz", Sizes: map[string]int64{"patch-63547.tar.gz": 100}},
+		{PatchID: "63548", Files: "sakai-builder/patch-63548.tar.gz", Sizes: map[string]int64{"patch-63548.tar.gz": 10}},
+		{PatchID: "63549", Files: "sakai-builder/patch-63549.tar.gz"},
+	}
+	// The cached tarball still has to be extracted, the one of unknown size waits for its tar headers
+	assert.Equal(t, []diskNeed{{*patchDir, 100}, {"/opt/tomcat", 330}}, tarballDiskNeeds(batch, "/opt/tomcat"))
+
+	_, err := decodePatchResponse([]byte(`{"patch_id": "63547", "tomcat_dir": "/opt/tomcat", "sizes": {"a.tar.gz": -1}}`))
+	assert.Error(t, err)
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	defer func(min int64) { minFreeBytes = min }(minFreeBytes)
+	minFreeBytes = 0
+
+	free, err := diskFree(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, checkDiskSpace([]diskNeed{{filepath.Join(dir, "not", "yet"), 1024}}))
+	assert.NoError(t, checkDiskSpace([]diskNeed{{dir, 0}}), "nothing needed, nothing to check")
+
+	// Directories on the same filesystem add up
+	err = checkDiskSpace([]diskNeed{{dir, free/2 + 1}, {filepath.Join(dir, "patches"), free/2 + 1}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), dir+" and "+filepath.Join(dir, "patches"))
+
+	minFreeBytes = free
+	assert.Error(t, checkDiskSpace([]diskNeed{{dir, 1}}))
+}
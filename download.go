@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ottenhoff/go-patcher/v2/archive"
+	log "github.com/sirupsen/logrus"
+)
+
+const downloadPath = "/longsight/json/patches/download"
+const maxDownloadRedirects = 5
+
+// downloadClient follows CDN redirects but never from https to http
+var downloadClient = &http.Client{CheckRedirect: checkDownloadRedirect}
+
+func checkDownloadRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxDownloadRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxDownloadRedirects)
+	}
+	if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+		return errors.New("refusing redirect from https to " + req.URL.Scheme + ": " + req.URL.Redacted())
+	}
+	return nil
+}
+
+// isSignedURLExpired recognizes a presigned URL past its expiry: S3 answers
+// "Request has expired", CloudFront "Signature expired", STS "ExpiredToken"
+func isSignedURLExpired(statusCode int, body []byte) bool {
+	if statusCode != http.StatusForbidden && statusCode != http.StatusBadRequest {
+		return false
+	}
+	return strings.Contains(strings.ToLower(string(body)), "expired")
+}
+
+// downloadFile fetches fileURL into dest. Interrupted downloads resume from the
+// partial file with a Range request, and an expired signed URL is swapped for a
+// fresh one from the portal before the next attempt. s3:// URLs are signed
+// here instead, and signed again when they expire; sftp:// URLs have their own path.
+// isArchive has the download read through as a tarball before it's accepted,
+// delta diffs and signatures are not.
+func downloadFile(fileURL string, dest string, patchID string, isArchive bool) error {
+	if isSFTPURL(fileURL) {
+		return downloadSFTP(fileURL, dest, patchID, isArchive)
+	}
+	partial := dest + ".part"
+	checksum := expectedChecksum(patchID, filepath.Base(dest))
+	defer trackPhase("download")()
+	progress := startProgress(filepath.Base(dest))
+	defer progress.Stop()
+
+	source := fileURL
+	if isS3URL(source) {
+		signed, err := presignS3(source)
+		if err != nil {
+			return fmt.Errorf("could not sign %s: %w", source, err)
+		}
+		fileURL = signed
+	}
+
+	return retry("Download "+redactURL(fileURL), func() error {
+		// A long download or a resume can outlive the signature
+		fileURL = renewSignedURL(source, fileURL, patchID)
+		file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return permanentError{err}
+		}
+		defer file.Close()
+		offset, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return permanentError{err}
+		}
+
+		if offset == 0 && *downloadChunks > 1 {
+			if chunked, err := downloadChunked(fileURL, file, progress); chunked {
+				if err != nil {
+					// Chunks leave holes behind, so the next attempt starts over. It
+					// goes through the single request path if the URL has expired.
+					file.Truncate(0)
+					return fmt.Errorf("chunked download failed: %v", err)
+				}
+				return finishDownload(partial, dest, -1, !isArchive, checksum)
+			}
+		}
+
+		req, err := http.NewRequest("GET", fileURL, nil)
+		if err != nil {
+			return permanentError{err}
+		}
+		setRunHeaders(req)
+		if offset > 0 {
+			req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+			log.Info("Resuming download of ", redactURL(fileURL), " at byte ", offset)
+		}
+
+		resp, err := downloadClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			// The server ignored the Range header, start over
+			if err := file.Truncate(0); err != nil {
+				return permanentError{err}
+			}
+			file.Seek(0, io.SeekStart)
+			offset = 0
+		case http.StatusRequestedRangeNotSatisfiable:
+			// The partial file is already complete
+			return finishDownload(partial, dest, -1, !isArchive, checksum)
+		default:
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			if isSignedURLExpired(resp.StatusCode, body) {
+				fresh, err := freshSignedURL(source, fileURL, patchID)
+				if err != nil {
+					return permanentError{fmt.Errorf("signed URL expired: %w", err)}
+				}
+				log.Warning("Signed URL expired, retrying with a fresh one")
+				fileURL = fresh
+				return errors.New("signed URL expired")
+			}
+			return checkResponse(resp)
+		}
+
+		expected := int64(-1)
+		if resp.ContentLength >= 0 {
+			expected = offset + resp.ContentLength
+		}
+		progress.restart(offset, expected)
+		// A download from the start is checked as it streams in, a resumed one once complete
+		var body io.Reader = io.TeeReader(downloadLimiter.reader(resp.Body), progress)
+		var checked chan error
+		var pipe *io.PipeWriter
+		if offset == 0 && isArchive {
+			body, checked, pipe = checkWhileStreaming(body)
+		}
+		n, err := io.Copy(file, body)
+		var checkErr error
+		if checked != nil {
+			pipe.Close()
+			checkErr = <-checked
+		}
+		atomic.AddInt64(&downloadedBytes, n)
+		log.Debug("Copied remote file bytes: ", n)
+		if err != nil {
+			// Keep the partial file so the next attempt resumes
+			return err
+		}
+		if checkErr != nil {
+			os.Remove(partial)
+			return fmt.Errorf("downloaded patch is corrupt: %w", checkErr)
+		}
+		if err := finishDownload(partial, dest, expected, checked != nil || !isArchive, checksum); err != nil {
+			return err
+		}
+		if isArchive {
+			rememberValidators(dest, resp.Header)
+		}
+		return nil
+	})
+}
+
+// checkWhileStreaming tees src into archive.Check, so verifying a tarball
+// costs no time after the last byte arrives. The caller closes the pipe
+// once src is read and then receives the result.
+func checkWhileStreaming(src io.Reader) (io.Reader, chan error, *io.PipeWriter) {
+	reader, writer := io.Pipe()
+	checked := make(chan error, 1)
+	go func() {
+		err := archive.Check(reader, archive.Options{})
+		// Keep draining so the download never stalls on a failed check
+		io.Copy(io.Discard, reader)
+		checked <- err
+	}()
+	return io.TeeReader(src, writer), checked, writer
+}
+
+// finishDownload checks the size and checksum of a completed partial file,
+// verifies the archive unless that already happened while streaming or it
+// isn't one, and moves it into place
+func finishDownload(partial string, dest string, expected int64, checked bool, checksum string) error {
+	info, err := os.Stat(partial)
+	if err != nil {
+		return permanentError{err}
+	}
+	if expected >= 0 && info.Size() != expected {
+		os.Remove(partial)
+		return fmt.Errorf("downloaded %d bytes but expected %d", info.Size(), expected)
+	}
+	// A mismatch may be a bad mirror or a stale cache, so it's worth another try
+	if err := verifyChecksum(partial, checksum); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	if !checked {
+		if err := checkArchiveFile(partial); err != nil {
+			os.Remove(partial)
+			return fmt.Errorf("downloaded patch is corrupt: %w", err)
+		}
+	}
+	return os.Rename(partial, dest)
+}
+
+func checkArchiveFile(path string) error {
+	_, err := measureArchiveFile(path)
+	return err
+}
+
+// measureArchiveFile is checkArchiveFile that also returns the extracted size
+func measureArchiveFile(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return archive.Measure(file, archive.Options{})
+}
+
+// refreshDownloadURL asks the portal to sign a new URL for a patch file. The
+// answer is signed like the patch JSON, else anyone in the middle could swap
+// in a tarball of their own.
+func refreshDownloadURL(patchID string, expiredURL string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	query := url.Values{"patch_id": {patchID}, "file": {strings.SplitN(expiredURL, "?", 2)[0]}}
+	req, err := http.NewRequestWithContext(ctx, "GET", activePortal.endpoint(downloadPath)+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	setPortalHeaders(req)
+
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return "", err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	if err := verifySignature(activePortal.HMACSecret, body, resp.Header.Get(signatureHeader)); err != nil {
+		return "", err
+	}
+	var refreshed struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(body, &refreshed); err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(refreshed.URL, "https://") {
+		return "", errors.New("portal returned an unusable URL")
+	}
+	return refreshed.URL, nil
+}
+
+// freshSignedURL signs an s3:// source again, or asks the portal for a fresh
+// URL in place of one it signed
+func freshSignedURL(source string, fileURL string, patchID string) (string, error) {
+	if isS3URL(source) {
+		fresh, err := presignS3(source)
+		if err != nil {
+			return "", fmt.Errorf("could not sign %s again: %w", source, err)
+		}
+		return fresh, nil
+	}
+	var fresh string
+	err := activePortal.withFailover(func() (err error) {
+		fresh, err = refreshDownloadURL(patchID, fileURL)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("the portal did not provide a new URL: %w", err)
+	}
+	return fresh, nil
+}
+
+// signedURLMargin is how close to its expiry a signed URL is replaced before
+// a request rather than after the request fails
+const signedURLMargin = time.Minute
+
+// renewSignedURL replaces a signed URL about to expire, going on with the old
+// one if no fresh one can be had
+func renewSignedURL(source string, fileURL string, patchID string) string {
+	expiry, ok := signedURLExpiry(fileURL)
+	if !ok || time.Until(expiry) > signedURLMargin {
+		return fileURL
+	}
+	fresh, err := freshSignedURL(source, fileURL, patchID)
+	if err != nil {
+		log.Warning("Signed URL for ", redactURL(fileURL), " expires at ", expiry.Format(time.RFC3339), ": ", err)
+		return fileURL
+	}
+	log.Info("Signed URL for ", redactURL(fileURL), " expires at ", expiry.Format(time.RFC3339), ", using a fresh one")
+	return fresh
+}
+
+// signedURLExpiry reads when a presigned URL stops working: SigV4 URLs carry
+// X-Amz-Date and X-Amz-Expires, SigV2 and CloudFront URLs an Expires time
+func signedURLExpiry(fileURL string) (time.Time, bool) {
+	parsed, err := url.Parse(fileURL)
+	if err != nil {
+		return time.Time{}, false
+	}
+	query := parsed.Query()
+	if signed, expires := query.Get("X-Amz-Date"), query.Get("X-Amz-Expires"); signed != "" && expires != "" {
+		start, err := time.Parse("20060102T150405Z", signed)
+		seconds, err2 := strconv.Atoi(expires)
+		if err != nil || err2 != nil {
+			return time.Time{}, false
+		}
+		return start.Add(time.Duration(seconds) * time.Second), true
+	}
+	if expires := query.Get("Expires"); expires != "" {
+		seconds, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(seconds, 0), true
+	}
+	return time.Time{}, false
+}
+
+// redactURL drops the query string, which holds the signature of a presigned URL
+func redactURL(fileURL string) string {
+	return strings.SplitN(fileURL, "?", 2)[0]
+}
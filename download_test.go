@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadFileResumes(t *testing.T) {
+	fastRetries(t, 3)
+
+	tarball, _ := os.ReadFile("test.tar.gz")
+	content := string(tarball)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) == 1 {
+			// Drop the connection half way through
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write([]byte(content[:200]))
+			return
+		}
+		http.ServeContent(w, r, "patch.tar.gz", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "patch.tar.gz")
+	assert.NoError(t, downloadFile(server.URL+"/patch.tar.gz", dest, "63547", true))
+	assert.Equal(t, []string{"", "bytes=200-"}, ranges)
+	downloaded, _ := os.ReadFile(dest)
+	assert.Equal(t, content, string(downloaded))
+}
+
+func TestDownloadFileRefreshesExpiredURL(t *testing.T) {
+	fastRetries(t, 3)
+
+	tarball, _ := os.ReadFile("test.tar.gz")
+	var refreshedFor string
+	downloadClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		respond := func(status int, body string) (*http.Response, error) {
+			return &http.Response{StatusCode: status, Status: http.StatusText(status), ContentLength: int64(len(body)),
+				Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+		}
+		switch {
+		case strings.HasPrefix(req.URL.String(), activePortal.endpoint(downloadPath)):
+			refreshedFor = req.URL.Query().Get("file")
+			return respond(http.StatusOK, `{"url": "https://patches.example.com/a.tar.gz?X-Amz-Signature=fresh"}`)
+		case req.URL.Query().Get("X-Amz-Signature") == "stale":
+			return respond(http.StatusForbidden, "<Error><Code>AccessDenied</Code><Message>Request has expired</Message></Error>")
+		}
+		return respond(http.StatusOK, string(tarball))
+	})
+	defer func() { downloadClient.Transport = nil }()
+
+	dest := filepath.Join(t.TempDir(), "a.tar.gz")
+	assert.NoError(t, downloadFile("https://patches.example.com/a.tar.gz?X-Amz-Signature=stale", dest, "63547", true))
+	assert.Equal(t, "https://patches.example.com/a.tar.gz", refreshedFor, "signature is not sent back")
+	downloaded, _ := os.ReadFile(dest)
+	assert.Equal(t, tarball, downloaded)
+}
+
+func TestRefreshDownloadURLChecksSignature(t *testing.T) {
+	oldPortal := activePortal
+	activePortal = &portalConfig{Name: "default", URL: "https://portal.example.edu", HMACSecret: "s3cret"}
+	defer func() { activePortal = oldPortal }()
+
+	body := `{"url": "https://attacker.example.com/a.tar.gz"}`
+	signature := ""
+	downloadClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		if signature != "" {
+			header.Set(signatureHeader, signature)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: header,
+			Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+	})
+	defer func() { downloadClient.Transport = nil }()
+
+	_, err := refreshDownloadURL("63547", "https://patches.example.com/a.tar.gz?X-Amz-Signature=stale")
+	assert.Error(t, err, "unsigned")
+	signature = signBody("s3cret", []byte(body), time.Now().Add(-time.Hour))
+	_, err = refreshDownloadURL("63547", "https://patches.example.com/a.tar.gz?X-Amz-Signature=stale")
+	assert.Error(t, err, "replayed")
+
+	body = `{"url": "https://patches.example.com/a.tar.gz?X-Amz-Signature=fresh"}`
+	signature = signBody("s3cret", []byte(body), time.Now())
+	fresh, err := refreshDownloadURL("63547", "https://patches.example.com/a.tar.gz?X-Amz-Signature=stale")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://patches.example.com/a.tar.gz?X-Amz-Signature=fresh", fresh)
+}
+
+func TestCheckDownloadRedirect(t *testing.T) {
+	secure, _ := http.NewRequest("GET", "https://cdn.example.com/a.tar.gz", nil)
+	plain, _ := http.NewRequest("GET", "http://cdn.example.com/a.tar.gz", nil)
+	assert.NoError(t, checkDownloadRedirect(secure, []*http.Request{secure}))
+	assert.Error(t, checkDownloadRedirect(plain, []*http.Request{secure}), "no downgrade")
+	assert.Error(t, checkDownloadRedirect(secure, []*http.Request{secure, secure, secure, secure, secure}))
+}
+
+func TestDownloadFileRejectsCorruptArchive(t *testing.T) {
+	fastRetries(t, 2)
+
+	tarball, _ := os.ReadFile("test.tar.gz")
+	corrupt := append([]byte{}, tarball...)
+	corrupt[len(corrupt)-5] ^= 0xff
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Write(corrupt)
+			return
+		}
+		w.Write(tarball)
+	}))
+	defer server.Close()
+
+	// The corrupt copy is thrown away and downloaded again from the start
+	dest := filepath.Join(t.TempDir(), "patch.tar.gz")
+	assert.NoError(t, downloadFile(server.URL+"/patch.tar.gz", dest, "63547", true))
+	assert.Equal(t, 2, requests)
+	downloaded, _ := os.ReadFile(dest)
+	assert.Equal(t, tarball, downloaded)
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(corrupt) })
+	err := downloadFile(server.URL+"/patch.tar.gz", dest+"2", "63547", true)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "corrupt")
+	}
+	assert.False(t, pathExists(dest+"2.part"))
+}
+
+func TestDownloadFileRenewsExpiringURL(t *testing.T) {
+	tarball, _ := os.ReadFile("test.tar.gz")
+	signedAt := time.Now().Add(-14 * time.Minute).UTC().Format("20060102T150405Z")
+	stale := "https://patches.example.com/a.tar.gz?X-Amz-Date=" + signedAt + "&X-Amz-Expires=900&X-Amz-Signature=stale"
+	staleRequests := 0
+	downloadClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		body := string(tarball)
+		switch {
+		case strings.HasPrefix(req.URL.String(), activePortal.endpoint(downloadPath)):
+			body = `{"url": "https://patches.example.com/a.tar.gz?X-Amz-Signature=fresh"}`
+		case req.URL.Query().Get("X-Amz-Signature") == "stale":
+			staleRequests++
+		}
+		return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", ContentLength: int64(len(body)),
+			Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+	})
+	defer func() { downloadClient.Transport = nil }()
+
+	// A minute of signature left is too little to start on
+	dest := filepath.Join(t.TempDir(), "a.tar.gz")
+	assert.NoError(t, downloadFile(stale, dest, "63547", true))
+	assert.Equal(t, 0, staleRequests)
+	downloaded, _ := os.ReadFile(dest)
+	assert.Equal(t, tarball, downloaded)
+}
+
+func TestSignedURLExpiry(t *testing.T) {
+	expiry, ok := signedURLExpiry("https://b.s3.amazonaws.com/a.tar.gz?X-Amz-Date=20260101T120000Z&X-Amz-Expires=3600&X-Amz-Signature=abc")
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2026, 1, 1, 13, 0, 0, 0, time.UTC), expiry.UTC())
+
+	expiry, ok = signedURLExpiry("https://d111111abcdef8.cloudfront.net/a.tar.gz?Expires=1767272400&Signature=abc&Key-Pair-Id=K1")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1767272400), expiry.Unix())
+
+	_, ok = signedURLExpiry("https://patches.example.com/sakai-builder/a.tar.gz")
+	assert.False(t, ok)
+	_, ok = signedURLExpiry("https://b.s3.amazonaws.com/a.tar.gz?X-Amz-Date=yesterday&X-Amz-Expires=3600")
+	assert.False(t, ok)
+}
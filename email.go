@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// emailLogBytes is how much of the server log is attached
+const emailLogBytes = 256 * 1024
+
+// smtpSend delivers a message, replaced in tests. It uses STARTTLS when the server offers it.
+var smtpSend = smtp.SendMail
+
+// notifyEmail mails the outcome of a patch that left the server down or
+// couldn't stop it, with the server log and the patcher output attached.
+// Unlike cron mail it only fires when something needs a person.
+func notifyEmail(rv string, startup string, patchID string) {
+	if *smtpServer == "" || (rv != tomcatDown && rv != tomcatNoShutdown) {
+		return
+	}
+	recipients := splitList(*smtpTo)
+	if len(recipients) == 0 {
+		log.Warning("-smtp-server is set but -smtp-to is empty, not emailing about patch ", patchID)
+		return
+	}
+	hostname, _ := os.Hostname()
+	from := *smtpFrom
+	if from == "" {
+		from = "go-patcher@" + hostname
+	}
+
+	var auth smtp.Auth
+	if *smtpUser != "" {
+		password, err := readSecretFile(*smtpPasswordFile)
+		if err != nil {
+			log.Warning("Could not read SMTP password: ", err)
+			return
+		}
+		host, _, _ := net.SplitHostPort(*smtpServer)
+		auth = smtp.PlainAuth("", *smtpUser, password, host)
+	}
+
+	message, err := failureEmail(from, recipients, rv, startup, patchID)
+	if err == nil {
+		err = smtpSend(*smtpServer, auth, from, recipients, message)
+	}
+	if err != nil {
+		log.Warning("Could not email about patch ", patchID, ": ", err)
+	}
+}
+
+// splitList splits a comma-separated flag, dropping blanks
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// failureEmail builds a multipart message in the patch's locale. The attachments are left off when
+// the host withholds output from the portal.
+func failureEmail(from string, to []string, rv string, startup string, patchID string) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	text, err := parts.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprint(text, strings.ReplaceAll(renderNotification("body", rv, startup, patchID), "\n", "\r\n"))
+
+	if resultDetail == detailFull {
+		if serverLog, err := readTail(activeProfile.logFile(), emailLogBytes); err == nil {
+			if err := attach(parts, filepath.Base(activeProfile.logFile()), serverLog); err != nil {
+				return nil, err
+			}
+		}
+		if err := attach(parts, "go-patcher.log", outputBuffer.String()); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\nTo: %s\r\n", from, strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8",
+		"[go-patcher] "+renderNotification("subject", rv, startup, patchID)))
+	fmt.Fprintf(&message, "Date: %s\r\nMIME-Version: 1.0\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", parts.Boundary())
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
+
+// attach adds a text file as a base64 attachment, wrapped at 76 columns
+func attach(parts *multipart.Writer, name string, content string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "base64")
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	part, err := parts.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(content))
+	for len(encoded) > 76 {
+		fmt.Fprintf(part, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	_, err = fmt.Fprintf(part, "%s\r\n", encoded)
+	return err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifyEmail(t *testing.T) {
+	type sent struct {
+		addr    string
+		auth    smtp.Auth
+		from    string
+		to      []string
+		message []byte
+	}
+	var mails []sent
+	smtpSend = func(addr string, auth smtp.Auth, from string, to []string, message []byte) error {
+		mails = append(mails, sent{addr, auth, from, to, message})
+		return nil
+	}
+	defer func() { smtpSend = smtp.SendMail }()
+
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "smtp")
+	os.WriteFile(passwordFile, []byte("hunter2\n"), 0600)
+	*smtpServer, *smtpTo, *smtpFrom = "mail.example.edu:587", "ops@example.edu, oncall@example.edu", "patcher@example.edu"
+	*smtpUser, *smtpPasswordFile = "patcher", passwordFile
+	defer func() { *smtpServer, *smtpTo, *smtpFrom, *smtpUser, *smtpPasswordFile = "", "", "", "", "" }()
+
+	originalWd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(originalWd)
+	os.MkdirAll("logs", 0755)
+	os.WriteFile("logs/catalina.out", []byte("SEVERE: Context [/portal] startup failed\n"), 0644)
+
+	outputBuffer.Reset()
+	defer outputBuffer.Reset()
+	outputBuffer.WriteString("Starting Tomcat\n")
+	statusReasons = map[string]string{"63547": reasonStartupFailed}
+	defer func() { statusReasons = map[string]string{} }()
+
+	// Only failures that need a person are mailed
+	notifyEmail(patchSuccess, "84211", "63547")
+	notifyEmail(patchDefer, "-8", "63547")
+	assert.Empty(t, mails)
+
+	notifyEmail(tomcatDown, "-1", "63547")
+	if !assert.Len(t, mails, 1) {
+		return
+	}
+	assert.Equal(t, "mail.example.edu:587", mails[0].addr)
+	assert.NotNil(t, mails[0].auth)
+	assert.Equal(t, "patcher@example.edu", mails[0].from)
+	assert.Equal(t, []string{"ops@example.edu", "oncall@example.edu"}, mails[0].to)
+
+	message, err := mail.ReadMessage(bytes.NewReader(mails[0].message))
+	if !assert.NoError(t, err) {
+		return
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	assert.True(t, strings.HasPrefix(subject, "[go-patcher] Patch 63547 failed/startup_failed on "), subject)
+	_, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+
+	attachments := map[string]string{}
+	parts := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err != nil {
+			break
+		}
+		content, _ := io.ReadAll(part)
+		if part.FileName() == "" {
+			assert.Contains(t, string(content), "Patch 63547 failed/startup_failed")
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(content), "\r\n", ""))
+		assert.NoError(t, err)
+		attachments[part.FileName()] = string(decoded)
+	}
+	assert.Equal(t, map[string]string{
+		"catalina.out":   "SEVERE: Context [/portal] startup failed\n",
+		"go-patcher.log": "Starting Tomcat\n",
+	}, attachments)
+
+	// Hosts that keep output to themselves get the status only
+	resultDetail = detailStatus
+	defer func() { resultDetail = detailFull }()
+	notifyEmail(tomcatNoShutdown, "0", "63547")
+	if assert.Len(t, mails, 2) {
+		assert.NotContains(t, string(mails[1].message), "attachment")
+	}
+}
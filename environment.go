@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Runtime environments, reported to the portal and used to adapt the patch flow
+const (
+	envContainer = "container"
+	envVM        = "vm"
+	envBareMetal = "bare-metal"
+)
+
+// runtimeEnv is detected once at startup, or set with -environment
+var runtimeEnv = envBareMetal
+
+// readinessPollInterval is how often waitForReadiness probes
+var readinessPollInterval = 5 * time.Second
+
+// containerCgroupMarkers show up in /proc/1/cgroup inside Docker, Kubernetes, containerd, Podman and LXC
+var containerCgroupMarkers = []string{"docker", "kubepods", "containerd", "libpod", "lxc"}
+
+// hypervisorVendors are DMI product names and vendors of virtual machines
+var hypervisorVendors = []string{"kvm", "qemu", "vmware", "virtualbox", "xen", "amazon ec2", "google compute engine", "microsoft corporation", "openstack", "bochs", "parallels"}
+
+// initRuntimeEnv resolves -environment, detecting the environment for "auto"
+func initRuntimeEnv(setting string) error {
+	switch setting {
+	case "", "auto":
+		runtimeEnv = detectRuntimeEnv("/")
+		if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+			runtimeEnv = envContainer
+		}
+		log.Debug("Detected runtime environment: ", runtimeEnv)
+	case envContainer, envVM, envBareMetal:
+		runtimeEnv = setting
+	default:
+		return errors.New("-environment must be auto, container, vm or bare-metal: " + setting)
+	}
+	return nil
+}
+
+// detectRuntimeEnv looks for container and virtualization markers below root
+func detectRuntimeEnv(root string) string {
+	for _, marker := range []string{".dockerenv", "run/.containerenv"} {
+		if pathExists(root + marker) {
+			return envContainer
+		}
+	}
+	if cgroup, err := os.ReadFile(root + "proc/1/cgroup"); err == nil {
+		for _, marker := range containerCgroupMarkers {
+			if strings.Contains(string(cgroup), marker) {
+				return envContainer
+			}
+		}
+	}
+
+	for _, file := range []string{"sys/class/dmi/id/product_name", "sys/class/dmi/id/sys_vendor"} {
+		dmi, err := os.ReadFile(root + file)
+		if err != nil {
+			continue
+		}
+		for _, vendor := range hypervisorVendors {
+			if strings.Contains(strings.ToLower(string(dmi)), vendor) {
+				return envVM
+			}
+		}
+	}
+	if cpuinfo, err := os.ReadFile(root + "proc/cpuinfo"); err == nil && strings.Contains(string(cpuinfo), " hypervisor") {
+		return envVM
+	}
+	return envBareMetal
+}
+
+// hostKillAllowed is false in containers, where the ps based process hunt can
+// see the wrong processes and the orchestrator owns the server's lifecycle
+func hostKillAllowed() bool {
+	return runtimeEnv != envContainer
+}
+
+// useReadinessProbe prefers the instance's readiness_url over the server log in
+// containers, which often log to stdout rather than catalina.out
+func useReadinessProbe() bool {
+	return runtimeEnv == envContainer && activeInstance.ReadinessURL != ""
+}
+
+// waitForReadiness polls the readiness URL until it answers, reporting the time
+// it took as the startup time
+func waitForReadiness(readinessURL string, waitSeconds int) (string, string) {
+	started := time.Now()
+	probe := healthCheck{Type: checkHTTP, Target: readinessURL}
+	for time.Since(started) < time.Duration(waitSeconds)*time.Second {
+		if strings.Contains(activeProfile.checkStartup(), "ignite") {
+			log.Warning("Found ignite error in logs. Will try again later.")
+			return patchDefer, "-2"
+		}
+		err := runHealthCheck(probe, "")
+		if err == nil {
+			return patchSuccess, strconv.FormatInt(time.Since(started).Milliseconds(), 10)
+		}
+		log.Debug("Readiness probe not passing yet: ", err)
+		time.Sleep(readinessPollInterval)
+	}
+	return tomcatDown, "-1"
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectRuntimeEnv(t *testing.T) {
+	write := func(root string, file string, content string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, file)), 0755)
+		os.WriteFile(filepath.Join(root, file), []byte(content), 0644)
+	}
+
+	root := t.TempDir() + "/"
+	assert.Equal(t, envBareMetal, detectRuntimeEnv(root))
+
+	write(root, "proc/cpuinfo", "flags\t\t: fpu vme de pse\n")
+	write(root, "sys/class/dmi/id/product_name", "PowerEdge R640\n")
+	assert.Equal(t, envBareMetal, detectRuntimeEnv(root))
+
+	write(root, "sys/class/dmi/id/sys_vendor", "QEMU\n")
+	assert.Equal(t, envVM, detectRuntimeEnv(root))
+
+	// A container on a VM is a container
+	write(root, "proc/1/cgroup", "0::/kubepods/burstable/pod1234/abcd\n")
+	assert.Equal(t, envContainer, detectRuntimeEnv(root))
+
+	root = t.TempDir() + "/"
+	write(root, ".dockerenv", "")
+	assert.Equal(t, envContainer, detectRuntimeEnv(root))
+
+	root = t.TempDir() + "/"
+	write(root, "proc/cpuinfo", "flags\t\t: fpu vme hypervisor\n")
+	assert.Equal(t, envVM, detectRuntimeEnv(root))
+}
+
+func TestInitRuntimeEnv(t *testing.T) {
+	defer func() { runtimeEnv = envBareMetal }()
+	assert.NoError(t, initRuntimeEnv(envContainer))
+	assert.False(t, hostKillAllowed())
+	assert.Error(t, initRuntimeEnv("mainframe"))
+}
+
+func TestWaitForReadiness(t *testing.T) {
+	ready := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready {
+			ready = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	oldInterval := readinessPollInterval
+	readinessPollInterval = 10 * time.Millisecond
+	defer func() { readinessPollInterval = oldInterval }()
+	activeProfile = jettyProfile{log: filepath.Join(t.TempDir(), "missing.log")}
+	defer func() { activeProfile = tomcatProfile{} }()
+
+	rv, startup := waitForReadiness(server.URL, 5)
+	assert.Equal(t, patchSuccess, rv)
+	assert.NotEqual(t, "-1", startup)
+
+	server.Close()
+	rv, startup = waitForReadiness(server.URL, 0)
+	assert.Equal(t, tomcatDown, rv)
+	assert.Equal(t, "-1", startup)
+}
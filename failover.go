@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A portal url may list several base URLs, e.g. during a migration or for a
+// standby. Requests go to the URL that last worked and move down the list on
+// connection errors and server errors.
+
+// baseURLs splits the comma-separated portal url
+func (p *portalConfig) baseURLs() []string {
+	var urls []string
+	for _, base := range strings.Split(p.URL, ",") {
+		if base = strings.TrimSpace(base); base != "" {
+			urls = append(urls, strings.TrimRight(base, "/"))
+		}
+	}
+	return urls
+}
+
+// validateURLs makes sure every base URL is usable
+func (p *portalConfig) validateURLs() error {
+	urls := p.baseURLs()
+	if len(urls) == 0 {
+		return fmt.Errorf("portal %s has no url", p.Name)
+	}
+	for _, base := range urls {
+		if parsed, err := url.Parse(base); err != nil || parsed.Host == "" {
+			return fmt.Errorf("portal %s has a bad url: %s", p.Name, base)
+		}
+	}
+	return nil
+}
+
+// currentURL is the base URL requests go to right now
+func (p *portalConfig) currentURL() string {
+	urls := p.baseURLs()
+	if len(urls) == 0 {
+		return ""
+	}
+	return urls[int(p.current.Load())%len(urls)]
+}
+
+// withFailover runs fn, which builds its request from endpoint, against each base
+// URL in turn until one answers. Client errors from the portal are not a reason
+// to fail over; the next URL would only say the same thing.
+func (p *portalConfig) withFailover(fn func() error) error {
+	urls := p.baseURLs()
+	var err error
+	for tried := 0; tried < len(urls); tried++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		var permanent permanentError
+		if errors.As(err, &permanent) || len(urls) == 1 {
+			return err
+		}
+		failed := p.currentURL()
+		p.current.Add(1)
+		log.Warning("Portal ", p.Name, " failed at ", failed, ", failing over to ", p.currentURL(), ": ", err)
+	}
+	return err
+}
+
+// retryPortal retries a portal request, failing over between base URLs on every attempt
+func retryPortal(description string, fn func() error) error {
+	return retry(description, func() error {
+		return activePortal.withFailover(fn)
+	})
+}
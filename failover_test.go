@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithFailover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	var hits int
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer up.Close()
+
+	portal := &portalConfig{Name: "a", URL: down.URL + ", " + up.URL + "/"}
+	assert.NoError(t, portal.validateURLs())
+	get := func(path string) func() error {
+		return func() error {
+			resp, err := http.Get(portal.endpoint(path))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			return checkResponse(resp)
+		}
+	}
+
+	assert.NoError(t, portal.withFailover(get("/ok")))
+	assert.Equal(t, up.URL, portal.currentURL())
+
+	// The working URL sticks for later requests
+	assert.NoError(t, portal.withFailover(get("/ok")))
+	assert.Equal(t, 2, hits)
+
+	// A client error is the portal's answer, not an outage
+	assert.Error(t, portal.withFailover(get("/missing")))
+	assert.Equal(t, up.URL, portal.currentURL())
+
+	// Everything down: every URL is tried once
+	up.Close()
+	assert.Error(t, portal.withFailover(get("/ok")))
+}
+
+func TestValidateURLs(t *testing.T) {
+	assert.NoError(t, (&portalConfig{URL: "https://a.example.com,https://b.example.com"}).validateURLs())
+	assert.Error(t, (&portalConfig{URL: " , "}).validateURLs())
+	assert.Error(t, (&portalConfig{URL: "https://a.example.com,b.example.com"}).validateURLs())
+}
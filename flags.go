@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var configHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// parseFlags reads a flag step's "name=value" lines
+func parseFlags(value string) ([][2]string, error) {
+	var flags [][2]string
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, setting, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.Contains(line, "#") {
+			return nil, errors.New("feature flags must be name=value lines: " + line)
+		}
+		flags = append(flags, [2]string{name, strings.TrimSpace(setting)})
+	}
+	if len(flags) == 0 {
+		return nil, errors.New("flag step has no flags")
+	}
+	return flags, nil
+}
+
+// runFlagStep toggles feature flags shipped dark in a tarball. They always go
+// to the property files so they survive restarts. When the server is already
+// up and the instance has a config_url, Sakai's runtime configuration service
+// takes them too, so they apply without another restart; otherwise they take
+// effect at the next start.
+func runFlagStep(value string, patchID string, running bool) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	flags, err := parseFlags(value)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, flag := range flags {
+		lines = append(lines, flag[0]+"="+flag[1])
+	}
+	activeProfile.applyProperties(strings.Join(lines, "\n"), patchID)
+
+	if !running {
+		return nil
+	}
+	if activeInstance.ConfigURL == "" {
+		log.Warning("Instance has no config_url, feature flags for patch ", patchID, " take effect at the next restart")
+		outputBuffer.WriteString("Feature flags take effect at the next restart: " + strings.Join(lines, ", ") + "\n")
+		return nil
+	}
+	for _, flag := range flags {
+		if err := setRuntimeConfig(activeInstance.ConfigURL, activeInstance.ConfigTokenFile, flag[0], flag[1]); err != nil {
+			return fmt.Errorf("could not set %s at runtime: %w", flag[0], err)
+		}
+		log.Info("Set feature flag ", flag[0], "=", flag[1], " at runtime")
+	}
+	return nil
+}
+
+// setRuntimeConfig posts one setting to the instance's runtime configuration endpoint
+func setRuntimeConfig(configURL string, tokenFile string, name string, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	form := url.Values{"name": {name}, "value": {value}}
+	req, err := http.NewRequestWithContext(ctx, "POST", configURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	setRunHeaders(req)
+	if tokenFile != "" {
+		token, err := readSecretFile(tokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Auth-Token", token)
+	}
+
+	resp, err := configHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("config service responded " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFlags(t *testing.T) {
+	flags, err := parseFlags("portal.new.editor=true\n\n lessonbuilder.v2 = false \n")
+	assert.NoError(t, err)
+	assert.Equal(t, [][2]string{{"portal.new.editor", "true"}, {"lessonbuilder.v2", "false"}}, flags)
+
+	_, err = parseFlags("portal.new.editor")
+	assert.Error(t, err)
+	_, err = parseFlags("#x=1")
+	assert.Error(t, err)
+	_, err = parseFlags("\n")
+	assert.Error(t, err)
+}
+
+func TestRunFlagStep(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "sakai"), 0755)
+	os.WriteFile(filepath.Join(dir, "sakai/sakai.properties"), []byte("portal.new.editor=false\n"), 0644)
+	originalWd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(originalWd)
+
+	tokenFile := filepath.Join(dir, "config-token")
+	os.WriteFile(tokenFile, []byte("admin-secret\n"), 0600)
+
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		got = append(got, r.Header.Get("X-Auth-Token")+" "+r.PostForm.Get("name")+"="+r.PostForm.Get("value"))
+		if r.PostForm.Get("name") == "broken.flag" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+	activeInstance = instanceConfig{ConfigURL: server.URL, ConfigTokenFile: tokenFile}
+	defer func() { activeInstance = instanceConfig{} }()
+
+	// Before a restart the property file is enough
+	assert.NoError(t, runFlagStep("portal.new.editor=true", "63547", false))
+	assert.Equal(t, "true", readProperty("portal.new.editor"))
+	assert.Empty(t, got)
+
+	// A running server gets them at runtime too
+	assert.NoError(t, runFlagStep("portal.new.editor=false", "63547", true))
+	assert.Equal(t, []string{"admin-secret portal.new.editor=false"}, got)
+	assert.Equal(t, "false", readProperty("portal.new.editor"))
+
+	err := runFlagStep("broken.flag=1", "63547", true)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "403")
+	}
+
+	// Without a config_url they wait for the next restart
+	activeInstance = instanceConfig{}
+	got = nil
+	assert.NoError(t, runFlagStep("portal.new.editor=true", "63547", true))
+	assert.Empty(t, got)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const retentionPath = "/longsight/remote/patch/retention"
+
+// gcInterval spaces out garbage collection, idle check-ins can be a minute apart
+var gcInterval = 6 * time.Hour
+
+// retentionPolicy is the portal's say on which patch debris a host may delete
+type retentionPolicy struct {
+	// SupersededPatches are patch IDs whose pre-patch logs, config snapshots and manifests can go
+	SupersededPatches []string `json:"superseded_patches"`
+	// SupersededFiles are cached tarball names that will not be applied again
+	SupersededFiles []string `json:"superseded_files"`
+	// MaxAgeDays removes any artifact older than this, 0 keeps artifacts whatever their age
+	MaxAgeDays int `json:"max_age_days"`
+}
+
+// collectGarbage removes cached tarballs, pre-patch logs and snapshots the
+// portal's retention policy no longer needs. It runs on idle check-ins only,
+// never while a patch is being applied, and at most every gcInterval.
+func collectGarbage(portal *portalConfig) {
+	stamp := filepath.Join(*stateDir, "last-gc-"+portal.Name)
+	if info, err := os.Stat(stamp); err == nil && time.Since(info.ModTime()) < gcInterval {
+		return
+	}
+
+	if removed, freed := pruneCache(configuredCacheLimits(), time.Now()); removed > 0 {
+		log.Infof("Removed %d cached tarballs, freeing %d bytes", removed, freed)
+	}
+
+	var policy *retentionPolicy
+	err := portal.withFailover(func() (err error) {
+		policy, err = fetchRetentionPolicy()
+		return err
+	})
+	if err != nil {
+		log.Warning("Could not fetch the retention policy from portal ", portal.Name, ": ", err)
+		return
+	}
+	if os.MkdirAll(*stateDir, 0755) == nil {
+		os.WriteFile(stamp, nil, 0644)
+	}
+	if policy == nil {
+		return
+	}
+
+	removed, freed := 0, int64(0)
+	for _, artifact := range garbage(portal, *policy, time.Now()) {
+		info, err := os.Lstat(artifact)
+		if err != nil {
+			continue
+		}
+		if err := os.RemoveAll(artifact); err != nil {
+			log.Warning("Could not remove ", artifact, ": ", err)
+			continue
+		}
+		log.Debug("Removed patch artifact ", artifact)
+		removed++
+		freed += info.Size()
+	}
+	if removed > 0 {
+		log.Infof("Removed %d patch artifacts for portal %s, freeing %d bytes", removed, portal.Name, freed)
+	}
+}
+
+// fetchRetentionPolicy asks the active portal for its policy, nil if it has none
+func fetchRetentionPolicy() (*retentionPolicy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", activePortal.endpoint(retentionPath), nil)
+	if err != nil {
+		return nil, err
+	}
+	setPortalHeaders(req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, err
+	}
+	policy := &retentionPolicy{}
+	if err := json.Unmarshal(body, policy); err != nil {
+		return nil, errors.New("retention policy is not JSON: " + err.Error())
+	}
+	return policy, nil
+}
+
+// garbage lists the artifacts the policy lets go. Only the patcher's own
+// artifacts are considered, whatever names the portal sends.
+func garbage(portal *portalConfig, policy retentionPolicy, now time.Time) []string {
+	expired := func(path string) bool {
+		if policy.MaxAgeDays <= 0 {
+			return false
+		}
+		info, err := os.Lstat(path)
+		return err == nil && now.Sub(info.ModTime()) > time.Duration(policy.MaxAgeDays)*24*time.Hour
+	}
+	superseded := func(patchID string) bool {
+		return containsString(policy.SupersededPatches, patchID)
+	}
+	var artifacts []string
+
+	// Cached tarballs and the partial downloads an interrupted run left behind
+	tarballs, _ := os.ReadDir(*patchDir)
+	for _, entry := range tarballs {
+		name := entry.Name()
+		if entry.IsDir() || !isPatchFile(strings.TrimSuffix(name, ".part")) {
+			continue
+		}
+		path := filepath.Join(*patchDir, name)
+		if containsString(policy.SupersededFiles, strings.TrimSuffix(name, ".part")) || expired(path) {
+			artifacts = append(artifacts, path)
+		}
+	}
+
+	// Server logs and config files set aside before each patch
+	registry := loadInstanceRegistry(*instancesFile)
+	for _, dir := range portalServerDirs(portal, registry) {
+		profile, err := profileFor(registry.lookup(dir))
+		if err != nil {
+			continue
+		}
+		var patterns []string
+		for _, file := range []string{profile.logFile(), filepath.Join(profile.propertyDir(), "*")} {
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(dir, file)
+			}
+			patterns = append(patterns, file+"-pre-patch-*")
+		}
+		for _, pattern := range patterns {
+			matches, _ := filepath.Glob(pattern)
+			for _, path := range matches {
+				patchID := path[strings.LastIndex(path, "-pre-patch-")+len("-pre-patch-"):]
+				if superseded(patchID) || expired(path) {
+					artifacts = append(artifacts, path)
+				}
+			}
+		}
+	}
+
+	// Checksum manifests and property backups in the state dir
+	for _, patchID := range policy.SupersededPatches {
+		if validPatchID(patchID) && pathExists(manifestPath(patchID)) {
+			artifacts = append(artifacts, manifestPath(patchID))
+		}
+	}
+	backups, _ := filepath.Glob(filepath.Join(*stateDir, "property-backups", "*"))
+	for _, path := range backups {
+		if expired(path) {
+			artifacts = append(artifacts, path)
+		}
+	}
+	return artifacts
+}
+
+// isPatchFile matches the tarball names fetchTarball caches
+func isPatchFile(name string) bool {
+	for _, suffix := range []string{".tar.gz", ".tgz", ".tar.zst", ".tar.xz", ".txz", ".tar.bz2", ".tbz2", ".tar", ".zip"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// portalServerDirs are the server dirs of this portal: registered, listed
+// for the portal, or patched before according to the run history
+func portalServerDirs(portal *portalConfig, registry *instanceRegistry) []string {
+	candidates := append([]string{}, portal.Instances...)
+	for _, instance := range registry.Instances {
+		candidates = append(candidates, instance.Dir)
+	}
+	if records, err := loadHistory(historyPath()); err == nil {
+		for _, record := range records {
+			candidates = append(candidates, record.TomcatDir)
+		}
+	}
+
+	var dirs []string
+	for _, dir := range candidates {
+		dir = filepath.Clean(dir)
+		if dir != "." && portal.servesInstance(dir) && !containsString(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
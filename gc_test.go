@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	dir := t.TempDir()
+	defer func(patch, state, instances string) { *patchDir, *stateDir, *instancesFile = patch, state, instances }(*patchDir, *stateDir, *instancesFile)
+	*patchDir, *stateDir, *instancesFile = filepath.Join(dir, "patches"), filepath.Join(dir, "state"), filepath.Join(dir, "instances.yaml")
+	tomcatDir := filepath.Join(dir, "tomcat")
+	wildflyDir := filepath.Join(dir, "wildfly")
+	os.WriteFile(*instancesFile, []byte("instances:\n  - dir: "+wildflyDir+"\n    profile: wildfly\n"), 0644)
+
+	old := time.Now().Add(-40 * 24 * time.Hour)
+	write := func(path string, aged bool) string {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte("debris"), 0644)
+		if aged {
+			os.Chtimes(path, old, old)
+		}
+		return path
+	}
+	supersededTarball := write(filepath.Join(*patchDir, "sakai-23.1-63001.tar.gz"), false)
+	agedPartial := write(filepath.Join(*patchDir, "sakai-23.1-63002.tar.zst.part"), true)
+	freshTarball := write(filepath.Join(*patchDir, "sakai-23.1-63547.tar.gz"), false)
+	unrelated := write(filepath.Join(*patchDir, "notes.txt"), true)
+	supersededLog := write(filepath.Join(tomcatDir, "logs", "catalina.out-pre-patch-63001"), false)
+	freshLog := write(filepath.Join(tomcatDir, "logs", "catalina.out-pre-patch-63547"), false)
+	agedConfig := write(filepath.Join(wildflyDir, "standalone", "configuration", "standalone.xml-pre-patch-62000"), true)
+	supersededManifest := write(manifestPath("63001"), false)
+	agedBackup := filepath.Join(*stateDir, "property-backups", "20200101-000000-old")
+	write(filepath.Join(agedBackup, "sakai.properties"), false)
+	os.Chtimes(agedBackup, old, old)
+
+	// The tomcat dir is only known from the run history
+	recordRun("63001", tomcatDir, patchSuccess, "95000", nil)
+
+	requests := 0
+	status := http.StatusOK
+	http.DefaultClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests++
+		assert.Equal(t, retentionPath, req.URL.Path)
+		body := `{"superseded_patches": ["63001", "../../etc"], "superseded_files": ["sakai-23.1-63001.tar.gz", "notes.txt"], "max_age_days": 30}`
+		return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+	})
+	defer func() { http.DefaultClient.Transport = nil }()
+
+	portal := &portalConfig{Name: "default", URL: "https://portal.example.edu"}
+	oldPortal := activePortal
+	activePortal = portal
+	defer func() { activePortal = oldPortal }()
+	collectGarbage(portal)
+
+	for _, gone := range []string{supersededTarball, agedPartial, supersededLog, agedConfig, supersededManifest, agedBackup} {
+		assert.False(t, pathExists(gone), gone)
+	}
+	for _, kept := range []string{freshTarball, unrelated, freshLog} {
+		assert.True(t, pathExists(kept), kept)
+	}
+
+	// Idle check-ins in between don't ask again
+	collectGarbage(portal)
+	assert.Equal(t, 1, requests)
+
+	// Portals without a retention policy leave everything alone
+	os.Remove(filepath.Join(*stateDir, "last-gc-default"))
+	status = http.StatusNotFound
+	collectGarbage(portal)
+	assert.Equal(t, 2, requests)
+	assert.True(t, pathExists(freshTarball))
+}
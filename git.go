@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ottenhoff/go-patcher/v2/archive"
+	log "github.com/sirupsen/logrus"
+)
+
+// gitTimeout bounds a fetch, a hung remote would otherwise hold the downtime open
+const gitTimeout = 10 * time.Minute
+
+// gitProtocols are the only transports git may use, redirects and submodules included
+var gitProtocols = "https:ssh"
+
+// parseGitSource splits a git step's value, "<url> [ref]", defaulting to the
+// remote's HEAD. Only https and ssh remotes are allowed, a local path or a
+// value git would read as an option never reaches the command line.
+func parseGitSource(value string) (repo string, ref string, err error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", "", errors.New("git step must be \"<url> [ref]\": " + value)
+	}
+	repo, ref = fields[0], "HEAD"
+	if len(fields) == 2 {
+		ref = fields[1]
+	}
+	scpLike := strings.Contains(repo, "@") && strings.Contains(repo, ":") && !strings.Contains(repo, "://")
+	if !strings.HasPrefix(repo, "https://") && !strings.HasPrefix(repo, "ssh://") && !scpLike {
+		return "", "", errors.New("git step needs an https or ssh URL: " + repo)
+	}
+	if strings.HasPrefix(repo, "-") || strings.HasPrefix(ref, "-") {
+		return "", "", errors.New("git step URL and ref must not start with -")
+	}
+	return repo, ref, nil
+}
+
+// runGitStep applies the tree a git step points at
+func runGitStep(value string, patchID string) error {
+	repo, ref, err := parseGitSource(value)
+	if err != nil {
+		return err
+	}
+	return applyGitRef(repo, ref, patchID)
+}
+
+// applyGitRef fetches just the commit at ref into a bare repository in
+// patchDir, kept between runs so later fetches are small, and applies its
+// tree like an unrolled tarball
+func applyGitRef(repo string, ref string, patchID string) error {
+	sum := sha256.Sum256([]byte(repo))
+	gitDir := filepath.Join(*patchDir, "git", hex.EncodeToString(sum[:8]))
+
+	doneFetching := trackPhase("download")
+	commit, err := fetchGitRef(gitDir, repo, ref)
+	doneFetching()
+	if err != nil {
+		return err
+	}
+	log.Info("Applying ", redactGitURL(repo), " ", ref, " at ", commit)
+	outputBuffer.WriteString("Applying " + redactGitURL(repo) + " " + ref + " at commit " + commit + "\n")
+
+	tree := filepath.Join(*patchDir, "git-"+patchID+".tar")
+	defer os.Remove(tree)
+	if _, err := git(gitDir, "archive", "--format=tar", "--output="+tree, commit); err != nil {
+		return err
+	}
+
+	return confined(sandboxDirs(), func() error {
+		file, err := os.Open(tree)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		doneExtracting := trackPhase("extract")
+		// git archive records root as every file's owner, so -tar-owner doesn't apply
+		report, err := archive.Apply(".", file, archive.Options{StagingDir: *patchDir, Sync: *fsyncExtracted, Compression: archive.CompressionNone,
+			Owner: serverOwner, ModTimes: *keepModTimes, Atomic: *atomicExtract, Workers: extractionWorkers()})
+		doneExtracting()
+		if err != nil {
+			return fmt.Errorf("could not apply %s at %s: %w", redactGitURL(repo), commit, err)
+		}
+		log.Debugf("Applied %s at %s: %d written, %d skipped, %d removed", redactGitURL(repo), commit, len(report.Written), len(report.Skipped), len(report.Removed))
+		patchedFiles[patchID] = append(patchedFiles[patchID], report.Written...)
+		return nil
+	})
+}
+
+// fetchGitRef makes a depth 1 fetch of ref and returns the commit it points at
+func fetchGitRef(gitDir string, repo string, ref string) (string, error) {
+	if !pathExists(filepath.Join(gitDir, "HEAD")) {
+		if err := os.MkdirAll(gitDir, 0700); err != nil {
+			return "", err
+		}
+		if _, err := git(gitDir, "init", "--bare", "--quiet"); err != nil {
+			return "", err
+		}
+	}
+	if _, err := git(gitDir, "fetch", "--quiet", "--depth=1", "--no-tags", "--", repo, ref); err != nil {
+		return "", err
+	}
+	return git(gitDir, "rev-parse", "--verify", "FETCH_HEAD^{commit}")
+}
+
+// redactGitURL hides a password or token in an https remote
+func redactGitURL(repo string) string {
+	if parsed, err := url.Parse(repo); err == nil && parsed.User != nil {
+		return parsed.Redacted()
+	}
+	return repo
+}
+
+// git runs a git command against gitDir. It never prompts for credentials
+// and won't follow a remote to a protocol other than https or ssh.
+func git(gitDir string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", append([]string{"--git-dir=" + gitDir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL="+gitProtocols, "GIT_SSH_COMMAND=ssh -o BatchMode=yes")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGitSource(t *testing.T) {
+	repo, ref, err := parseGitSource("https://github.com/example/sakai-config.git v23.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://github.com/example/sakai-config.git", repo)
+	assert.Equal(t, "v23.1", ref)
+
+	_, ref, err = parseGitSource("git@github.com:example/sakai-config.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "HEAD", ref)
+
+	for _, bad := range []string{"", "/srv/config.git", "file:///srv/config.git", "ext::sh -c touch% /tmp/pwned",
+		"https://github.com/example/a.git --upload-pack=touch", "https://github.com/example/a.git main extra"} {
+		_, _, err := parseGitSource(bad)
+		assert.Error(t, err, bad)
+	}
+
+	_, err = decodePatchResponse([]byte(`{"patch_id": "63547", "tomcat_dir": "/opt/tomcat", "steps": [{"type": "git", "value": "/srv/config.git"}]}`))
+	assert.Error(t, err)
+}
+
+// testGitRepo makes a repository with one commit holding files
+func testGitRepo(t *testing.T, files map[string]string) string {
+	repo := t.TempDir()
+	run := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+	run("init", "--quiet", "--initial-branch=main")
+	for name, content := range files {
+		os.MkdirAll(filepath.Join(repo, filepath.Dir(name)), 0755)
+		os.WriteFile(filepath.Join(repo, name), []byte(content), 0644)
+	}
+	run("add", ".")
+	run("commit", "--quiet", "-m", "config")
+	run("tag", "v1")
+	return repo
+}
+
+func TestApplyGitRef(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git")
+	}
+	gitProtocols = "file"
+	defer func() { gitProtocols = "https:ssh" }()
+	oldPatchDir := *patchDir
+	*patchDir = t.TempDir()
+	defer func() { *patchDir = oldPatchDir }()
+	defer func() { patchedFiles = map[string][]string{} }()
+
+	repo := testGitRepo(t, map[string]string{"sakai/local.properties": "mail.smtp=localhost\n", "lib/README": "config only\n"})
+	originalWd, _ := os.Getwd()
+	tomcat := t.TempDir()
+	os.Chdir(tomcat)
+	defer os.Chdir(originalWd)
+
+	assert.NoError(t, applyGitRef("file://"+repo, "v1", "63547"))
+	written, _ := os.ReadFile(filepath.Join(tomcat, "sakai", "local.properties"))
+	assert.Equal(t, "mail.smtp=localhost\n", string(written))
+	assert.False(t, pathExists(filepath.Join(tomcat, ".git")))
+	assert.ElementsMatch(t, []string{"sakai/local.properties", "lib/README"}, patchedFiles["63547"])
+
+	// The bare repository is reused, the tree export is not
+	assert.NoError(t, applyGitRef("file://"+repo, "main", "63548"))
+	entries, _ := os.ReadDir(*patchDir)
+	assert.Len(t, entries, 1)
+
+	err := applyGitRef("file://"+repo, "no-such-ref", "63549")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "git fetch")
+}
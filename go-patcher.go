@@ -1,34 +1,31 @@
 package main
 
 import (
-	"archive/tar"
 	"bufio"
 	"bytes"
-	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/klauspost/compress/zstd"
+	"github.com/ottenhoff/go-patcher/v2/archive"
 	log "github.com/sirupsen/logrus"
 )
 
-const patcherURL = "https://admin.longsight.com/longsight/json/patches"
-const patcherUserAgent = "GoPatcher v1.0"
+const patchesPath = "/longsight/json/patches"
+const updatePath = "/longsight/remote/patch/update"
 const processGrepPattern = "ps x|grep -v grep|grep java"
 const tomcatServerStartupPattern = "Server startup in"
 const igniteMismatchPattern = "Fix cache configuration or set system property"
@@ -43,121 +40,683 @@ const (
 
 // Declare flag variables as global variables
 var token *string
+var tokenFile *string
 var logLevel *string
 var patchDir *string
 var patchWeb *string
 var localIP *string
 var startupWaitSeconds *int
+var overridesFile *string
+var hookDir *string
+var mysqlClient *string
+var stateDir *string
+var retryAttempts *int
+var retryDelay *time.Duration
+var conflictingProcs *string
+var maxResultSize *int
+var downloadChunks *int
+var progressInterval *time.Duration
+var maxDownloadRate *string
+var s3Region *string
+var s3Endpoint *string
+var sftpKey *string
+var patchRepo *string
+var cacheMaxAge *time.Duration
+var cacheMaxSize *string
+var cacheKeep *int
+var sftpKnownHosts *string
+var uploadFullResult *bool
+var fsyncExtracted *bool
+var ipFamily *string
+var ifaceInclude *string
+var ifaceExclude *string
+var useCloudMetadata *bool
+var startupJitter *time.Duration
+var webhookURL *string
+var streamingExtract *bool
+var streamDownload *bool
+var incrementalSync *bool
+var minFreeSpace *string
+var expansionRatio *float64
+var tarOwner *bool
+var keepModTimes *bool
+var keepXattrs *bool
+var atomicExtract *bool
+var extractWorkers *int
+var peerListen *string
+var peerList *string
+var peerTokenFile *string
+var sandboxMode *string
+var slackWebhookFile *string
+var templatesDir *string
+var otlpEndpoint *string
+var metricsTextfileDir *string
+var pushgatewayURL *string
+var pagerDutyKeyFile *string
+var opsgenieKeyFile *string
+var smtpServer *string
+var smtpFrom *string
+var smtpTo *string
+var smtpUser *string
+var smtpPasswordFile *string
+var instancesFile *string
+var leaseInterval *time.Duration
+var streamSocket *string
+var recordDir *string
+var replayDir *string
+var mockPatchJSON *string
+var mockListen *string
+var mockTarballDir *string
+var streamToPortal *bool
+var controlListen *string
+var agentListen *string
+var agentTokenFile *string
+var agentTLSCert *string
+var agentTLSKey *string
+var proxyURL *string
+var dialTimeout *time.Duration
+var tlsHandshakeTimeout *time.Duration
+var responseHeaderTimeout *time.Duration
+var idleConnTimeout *time.Duration
+var tcpKeepAlive *time.Duration
+var caCert *string
+var portalURL *string
+var portalsFile *string
+var hmacSecretFile *string
+var tarballPubkey *string
+var pinSHA256 *string
+var allowedDirs *string
+var allowedPatchIDs *string
+var tokenScopeFlag *string
+var pollInterval *time.Duration
+var heartbeatInterval *time.Duration
+var environment *string
+var nodeID *string
+var clientCert *string
+var clientKey *string
+
+// subcommand is the optional first argument, e.g. "stats"
+var subcommand string
+
+// commandArgs follow the subcommand, e.g. "clean" in "go-patcher cache clean"
+var commandArgs []string
 
 var propertyFiles = [4]string{"sakai.properties", "dev.properties", "local.properties", "instance.properties"}
-var skipPattern = regexp.MustCompile(`^components/sakai-provider-pack/WEB-INF/.*(unboundid|components|jldap).*\.xml$`)
 var patcherUID = uint32(os.Getuid())
+
+// serverOwner is who extracted files are given to when root patches a server
+// run by another user, nil otherwise
+var serverOwner *archive.Owner
 var outputBuffer bytes.Buffer
 
+// live streams the run to -stream-socket, nil when not requested
+var live *liveStream
+
+// patchedFiles are the paths, relative to the server dir, written by each patch's tarballs this run
+var patchedFiles = map[string][]string{}
+
 func main() {
 	initParseCommandLineFlags()
+	overrides = loadOverrides(*overridesFile)
+	if err := initRuntimeEnv(*environment); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateIPFamily(*ipFamily); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateSandbox(*sandboxMode); err != nil {
+		log.Fatal(err)
+	}
+	for _, globs := range []string{*ifaceInclude, *ifaceExclude} {
+		if _, err := splitGlobs(globs); err != nil {
+			log.Fatal(err)
+		}
+	}
+	initHTTPTransport()
+	if err := loadTarballKey(*tarballPubkey); err != nil {
+		log.Fatal("Could not load -tarball-pubkey: ", err)
+	}
+	if *peerTokenFile != "" {
+		token, err := readSecretFile(*peerTokenFile)
+		if err != nil {
+			log.Fatal("Could not read -peer-token-file: ", err)
+		}
+		peerToken = token
+	}
+	limiter, err := parseDownloadRate(*maxDownloadRate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	downloadLimiter = limiter
+	maxBytes, err := parseByteSize(*cacheMaxSize)
+	if err != nil {
+		log.Fatal("-cache-max-size: ", err)
+	}
+	cacheMaxBytes = int64(maxBytes)
+	minFree, err := parseByteSize(*minFreeSpace)
+	if err != nil {
+		log.Fatal("-min-free-space: ", err)
+	}
+	minFreeBytes = int64(minFree)
+	log.AddHook(runIDHook{})
 
-	ip, _ := externalIP()
-	log.Debug("Auto-detected IPs on this server:" + ip)
+	switch subcommand {
+	case "", "daemon", "agent", "inventory", "prefetch":
+	case "stats":
+		records, err := loadHistory(historyPath())
+		if err != nil {
+			log.Fatal("Could not read run history: ", err)
+		}
+		printStats(os.Stdout, records, 10)
+		os.Exit(0)
+	case "cache":
+		if err := runCacheCommand(os.Stdout, commandArgs); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		os.Exit(0)
+	case "blockmap":
+		if err := writeBlockMaps(os.Stdout, commandArgs); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		os.Exit(0)
+	case "mockportal":
+		if err := runMockPortal(); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	default:
+		fmt.Println("Unknown command: " + subcommand + ", see go-patcher help")
+		os.Exit(1)
+	}
 
-	// User is overriding the auto-detected IPs
-	if len(*localIP) > 3 {
-		var ipArray = [1]string{*localIP}
-		ipJSON, err := json.Marshal(ipArray)
+	portals, err := loadPortals(*portalsFile)
+	if err != nil {
+		log.Fatal("Could not load portals: ", err)
+	}
+	if err := registerPins(portals); err != nil {
+		log.Fatal(err)
+	}
+
+	if subcommand == "inventory" {
+		if err := runInventory(portals); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *streamSocket != "" {
+		stream, err := startLiveStream(*streamSocket)
 		if err != nil {
-			panic("Bad ip provided on command-line")
+			log.Warning("Could not open live output socket: ", err)
+		} else {
+			live = stream
 		}
-		ip = string(ipJSON)
-		log.Debug("User-overridden IP:", ip)
+	}
+	// StreamLogs and -stream-to-portal need the live stream even without -stream-socket
+	if live == nil && (subcommand == "agent" || *streamToPortal) {
+		live = newLiveStream()
+	}
+	if live != nil {
+		log.SetOutput(io.MultiWriter(os.Stderr, live))
 	}
 
-	// See if there are any patches available for this IP
-	data := checkForPatchesFromPortal(ip)
+	// Only the long-running modes are around to serve their peers
+	var peers *peerServer
+	if *peerListen != "" && (subcommand == "agent" || subcommand == "daemon") {
+		server, err := startPeerServer(*peerListen)
+		if err != nil {
+			log.Warning("Could not serve cached tarballs to peers: ", err)
+		} else {
+			peers = server
+		}
+	}
+
+	if subcommand == "agent" {
+		err := runAgent(portals)
+		peers.Close()
+		live.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if subcommand == "daemon" {
+		if *controlListen != "" {
+			api, err := startControlAPI(*controlListen)
+			if err != nil {
+				log.Warning("Could not start control API: ", err)
+			} else {
+				control = api
+			}
+		}
+		runDaemon(portals)
+		control.Close()
+		peers.Close()
+		live.Close()
+		os.Exit(0)
+	}
+
+	// Stage every assigned tarball ahead of the maintenance window, then exit
+	if subcommand == "prefetch" {
+		stageOnly = true
+	}
+
+	// Cron mode: one cycle per portal, then exit
+	waitStartupJitter(context.Background())
+	failed := false
+	for _, portal := range portals {
+		if err := runPatchCycleSafely(portal); err != nil {
+			log.Error(err)
+			failed = true
+		}
+	}
+
+	// Exiting after patching!
+	live.Close()
+	if failed {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// resetRunState clears everything a previous cycle left in the package globals
+func resetRunState() {
+	outputBuffer.Reset()
+	stepResults = map[string][]stepResult{}
+	phaseTimings = map[string]float64{}
+	phaseUsages = map[string]phaseUsage{}
+	downloadedBytes = 0
+	runStarted = time.Now()
+	patchedFiles = map[string][]string{}
+	manifestHashes = map[string]string{}
+	startupErrors = map[string]startupErrorReport{}
+	statusReasons = map[string]string{}
+	claimNonces = map[string]string{}
+	runResults = map[string]patchOutcome{}
+	patchLocales = map[string]string{}
+	tarballChecksums = map[string]map[string]string{}
+	runSpans = nil
+	rootSpanID = newSpanID()
+	resultDetail = detailFull
+	activeProfile = tomcatProfile{}
+	activeInstance = instanceConfig{}
+	runID = newRunID()
+}
+
+// runPatchCycle checks one portal for patches and applies them
+func runPatchCycle(portal *portalConfig) error {
+	return runCycle(portal, func() ([]*PatchResponse, error) {
+		ip := hostIPs()
+
+		// See if there are any patches available for this IP
+		doneChecking := startSpan("portal_check")
+		defer doneChecking()
+		return checkForPatchesFromPortal(ip)
+	})
+}
+
+// runCycle applies the patches fetch returns, whether polled from the portal
+// or pushed through the agent API
+func runCycle(portal *portalConfig, fetch func() ([]*PatchResponse, error)) error {
+	activePortal = portal
+	resetRunState()
+	log.Debug("Starting run ", runID, " for portal ", portal.Name)
+	currentRun.runStarting(portal.Name, runID)
+	defer currentRun.runFinished()
+	if wd, err := os.Getwd(); err == nil {
+		defer os.Chdir(wd)
+	}
+
+	// Deliver results from earlier runs that never reached the portal
+	flushSpool()
+
+	patches, err := fetch()
+	if err != nil {
+		return err
+	}
+
+	// The portal rotates credentials by handing out the next token with a patch
+	for _, patch := range patches {
+		if err := portal.rotateToken(patch.NewToken); err != nil {
+			log.Error(err)
+		}
+		// Keep the token out of the debug dumps below
+		patch.NewToken = ""
+		if patch.Locale != "" {
+			patchLocales[patch.PatchID] = patch.Locale
+		}
+		if len(patch.Checksums) > 0 {
+			tarballChecksums[patch.PatchID] = patch.Checksums
+		}
+	}
+
+	// Deferrals go out at the detail each patch's own instance allows
+	registry := loadInstanceRegistry(*instancesFile)
+
+	// A portal account may only patch the instances it manages on this host
+	var served []*PatchResponse
+	for _, patch := range patches {
+		if portal.servesInstance(patch.TomcatDir) {
+			served = append(served, patch)
+			continue
+		}
+		log.Warning("Portal ", portal.Name, " sent patch ", patch.PatchID, " for ", patch.TomcatDir, " which it does not manage")
+		outputBuffer.WriteString("Instance " + patch.TomcatDir + " is not managed by portal " + portal.Name + " on this host\n")
+		deferPatch(registry, "-9", patch)
+	}
+	patches = served
+
+	// Instructions outside the local policy are refused before anything touches the disk
+	var inPolicy []*PatchResponse
+	for _, patch := range patches {
+		if err := portal.checkPolicy(patch); err != nil {
+			log.Warning("Refusing patch ", patch.PatchID, " from portal ", portal.Name, ": ", err)
+			outputBuffer.WriteString("Patch " + patch.PatchID + " refused by local policy: " + err.Error() + "\n")
+			deferPatch(registry, "-10", patch)
+			continue
+		}
+		inPolicy = append(inPolicy, patch)
+	}
+	patches = inPolicy
+
+	// A scoped token only gets to do what both this host and the portal allow
+	scope := portal.effectiveScope()
+	var inScope []*PatchResponse
+	for _, patch := range patches {
+		if err := scope.allows(patch, registry.lookup(patch.TomcatDir)); err != nil {
+			log.Warning("Refusing patch ", patch.PatchID, " from portal ", portal.Name, ": ", err)
+			outputBuffer.WriteString("Patch " + patch.PatchID + " is outside the token scope: " + err.Error() + "\n")
+			deferPatch(registry, "-11", patch)
+			continue
+		}
+		inScope = append(inScope, patch)
+	}
+	patches = inScope
+
+	// Tarballs of patches the portal only wants staged are fetched now, the
+	// patch is applied in a later run
+	useStagedChecksums(patches)
+	var toApply []*PatchResponse
+	for _, patch := range patches {
+		if !patch.PrefetchOnly && !stageOnly {
+			toApply = append(toApply, patch)
+			continue
+		}
+		err := stageTarballs(patch)
+		if err != nil {
+			log.Warning("Could not stage patch ", patch.PatchID, ": ", err)
+			outputBuffer.WriteString("Could not stage patch " + patch.PatchID + ": " + err.Error() + "\n")
+		}
+		// "go-patcher prefetch" is the operator's doing, the portal hears of it when the patch is applied
+		if stageOnly {
+			continue
+		}
+		if err != nil {
+			deferPatch(registry, "-13", patch)
+		} else {
+			deferPatch(registry, "-14", patch)
+		}
+	}
+	if len(toApply) == 0 && len(patches) > 0 {
+		return nil
+	}
+	patches = toApply
 
 	// If no patches, exit nicely
-	if len(data) < 1 {
+	if len(patches) == 0 {
 		log.Debug("No patches returned from portal")
-		os.Exit(0)
+		// Idle check-ins are when patch debris gets cleaned up
+		collectGarbage(portal)
+		return nil
 	}
 
-	// Extract info from the JSON patch info
-	patchID := data["patch_id"].(string)
-	tomcatDir := data["tomcat_dir"].(string)
-	patchFiles := data["files"].(string)
-	sakaiProperties := data["sakaiprops"].(string)
-	log.Debug("Patch returned from portal: ", data)
+	// One downtime covers one server directory, anything else waits for the next run
+	tomcatDir := patches[0].TomcatDir
+	var batch []*PatchResponse
+	for _, patch := range patches {
+		log.Debugf("Patch returned from portal: %+v", patch)
+		if patch.TomcatDir != tomcatDir {
+			log.Info("Leaving patch ", patch.PatchID, " for ", patch.TomcatDir, " until the next run")
+			continue
+		}
+		batch = append(batch, patch)
+	}
 
 	// Make sure the Tomcat directory exists on this host
 	checkTomcatDirExists(tomcatDir)
+
+	// The instance registry says whether this is Tomcat, Jetty, ...
+	instance := registry.lookup(tomcatDir)
+	activeInstance = instance
+	profile, err := profileFor(instance)
+	if err != nil {
+		panic(err.Error())
+	}
+	activeProfile = profile
+	if resultDetail, err = resultDetailFor(instance); err != nil {
+		panic(err.Error())
+	}
+	log.Debug("Using deployment profile: ", activeProfile.name())
+	live.follow(filepath.Join(tomcatDir, activeProfile.logFile()))
 	checkTomcatOwnership(tomcatDir)
 
-	// Update the admin portal to exclusively claim this patch
-	updateAdminPortal(inProgress, "0", patchID)
+	// Operators can veto or pin patches on this host only
+	var allowed []*PatchResponse
+	for _, patch := range batch {
+		if overrides.allowsPatch(patch.PatchID) {
+			allowed = append(allowed, patch)
+			continue
+		}
+		log.Warning("Patch ", patch.PatchID, " not allowed by host overrides: ", overrides.summary())
+		outputBuffer.WriteString("Patch " + patch.PatchID + " not allowed by host overrides: " + overrides.summary() + "\n")
+		updateAdminPortal(patchDefer, "-3", patch.PatchID)
+	}
+	batch = allowed
 
-	os.Chdir(tomcatDir)
-	log.Debug("Chdir to ", tomcatDir)
-	stopTomcat(tomcatDir)
+	// Only claim patches inside their maintenance window, cron may fire at any time
+	allowed = nil
+	for _, patch := range batch {
+		if patch.inWindow(time.Now()) {
+			allowed = append(allowed, patch)
+			continue
+		}
+		log.Info("Patch ", patch.PatchID, " is outside its maintenance window ", patch.WindowStart, " to ", patch.WindowEnd)
+		outputBuffer.WriteString("Patch " + patch.PatchID + " is outside its maintenance window " + patch.WindowStart + " to " + patch.WindowEnd + "\n")
+		updateAdminPortal(patchDefer, "-8", patch.PatchID)
+	}
 
-	// Modify the properties files
-	if len(sakaiProperties) > 0 {
-		// Kill Tomcat and exit for special scenario
-		if strings.TrimSpace(sakaiProperties) == "die" {
-			log.Errorf("Killing Tomcat per patcher: %s", tomcatDir)
-			updateAdminPortal(patchSuccess, "1", patchID)
-			os.Exit(0)
-		} else {
-			modifyPropertyFiles(sakaiProperties, patchID)
+	// Local property edits made since the portal created a patch are not overwritten blindly
+	batch = allowed
+	allowed = nil
+	for _, patch := range batch {
+		conflicts := propertyConflicts(tomcatDir, patch)
+		if len(conflicts) == 0 {
+			allowed = append(allowed, patch)
+			continue
 		}
+		log.Warning("Patch ", patch.PatchID, " conflicts with local property edits: ", conflicts)
+		outputBuffer.WriteString("Patch " + patch.PatchID + " conflicts with property edits made on this host since it was created:\n" + strings.Join(conflicts, "\n") + "\n")
+		updateAdminPortal(patchDefer, "-12", patch.PatchID)
 	}
 
-	// Unroll the tarball
-	if len(patchFiles) > 3 {
-		if strings.Contains(patchFiles, " ") {
-			patches := strings.SplitN(patchFiles, " ", 10)
-			for _, patch := range patches {
-				applyTarballPatch(patch)
-			}
-		} else {
-			applyTarballPatch(patchFiles)
+	// Prerequisites must already be on this host, or earlier in this batch
+	history, err := loadHistory(historyPath())
+	if err != nil {
+		log.Warning("Could not read run history for depends_on: ", err)
+	}
+	batch, held := orderBatch(allowed, appliedPatches(history))
+	for _, patch := range allowed {
+		missing, ok := held[patch.PatchID]
+		if !ok {
+			continue
 		}
+		log.Warning("Patch ", patch.PatchID, " waits for patches not yet applied: ", missing)
+		outputBuffer.WriteString("Patch " + patch.PatchID + " waits for patches not yet applied: " + strings.Join(missing, ", ") + "\n")
+		updateAdminPortal(patchDefer, "-6", patch.PatchID)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
 
-		// Update the version to better cache bust
-		// We are going to save bytes and just use the last two digits of the patch ID
-		modifyPropertyFiles("portal.cdn.version="+patchID[len(patchID)-3:], patchID)
+	// Restarting Tomcat mid-backup has produced corrupt snapshots, so wait for maintenance jobs to finish
+	if conflicts := conflictingProcesses(); len(conflicts) > 0 {
+		log.Warning("Deferring patches while maintenance jobs run: ", conflicts)
+		outputBuffer.WriteString("Deferred while maintenance jobs run:\n" + strings.Join(conflicts, "\n") + "\n")
+		for _, patch := range batch {
+			updateAdminPortal(patchDefer, "-4", patch.PatchID)
+		}
+		return nil
 	}
 
-	// Clean up the lib so we don't have dupe mysql-connector JARs
-	checkForUnnecessaryJars(tomcatDir)
+	// Last chance for the portal to halt a fleet-wide rollout before Tomcat goes down
+	if paused, reason := patchingPaused(batch); paused {
+		log.Warning("Deferring patches: ", reason)
+		outputBuffer.WriteString("Deferred: " + reason + "\n")
+		for _, patch := range batch {
+			updateAdminPortal(patchDefer, "-7", patch.PatchID)
+		}
+		return nil
+	}
 
-	// Time to start up Tomcat
-	startTomcat(patchID)
+	// Update the admin portal to exclusively claim these patches
+	var patchIDs []string
+	var claimed []*PatchResponse
+	for _, patch := range batch {
+		if won, reason := claimPatch(patch.PatchID); !won {
+			// The status now belongs to whoever holds the claim, so nothing is reported
+			log.Warning("Standing down on patch ", patch.PatchID, ": ", reason)
+			outputBuffer.WriteString("Standing down on patch " + patch.PatchID + ": " + reason + "\n")
+			continue
+		}
+		claimed = append(claimed, patch)
+		patchIDs = append(patchIDs, patch.PatchID)
+	}
+	batch = claimed
+	if len(batch) == 0 {
+		return nil
+	}
+	stopHeartbeat := startLeaseHeartbeat(patchIDs)
+	defer stopHeartbeat()
+	currentRun.claimed(patchIDs)
+
+	// The last point a run can be called off with the server untouched
+	if currentRun.canceled() {
+		log.Warning("Run canceled through the control API before stopping ", activeProfile.name())
+		outputBuffer.WriteString("Canceled through the control API before the server was stopped\n")
+		stopHeartbeat()
+		for _, patch := range batch {
+			statusReasons[patch.PatchID] = reasonCanceled
+			updateAdminPortal(patchDefer, "-5", patch.PatchID)
+		}
+		return nil
+	}
 
-	// Check for server startup in logs/catalina.out after 40 seconds
-	time.Sleep(40 * 1000 * time.Millisecond)
-	for z := 40; z < *startupWaitSeconds; z += 10 {
-		serverStartupTime := checkServerStartup()
-		if strings.Contains(serverStartupTime, "ignite") {
-			log.Warning("Found ignite error in logs. Will try again later.")
-			updateAdminPortal(patchDefer, "-2", patchID)
-			os.Exit(0)
-		} else if !strings.Contains(serverStartupTime, "false") {
-			parsedTime := parseServerStartupTime(serverStartupTime)
-			if parsedTime > 0 {
-				updateAdminPortal(patchSuccess, strconv.FormatInt(parsedTime, 10), patchID)
-			} else {
-				updateAdminPortal(tomcatDown, "-1", patchID)
+	stopLogStream := streamLogToPortal(patchIDs)
+	defer stopLogStream()
+
+	// A full disk halfway through extraction costs downtime, a deferral doesn't
+	if err := checkDiskSpace(tarballDiskNeeds(batch, tomcatDir)); err != nil {
+		log.Error("Not downloading patches for ", activeProfile.name(), ": ", err)
+		outputBuffer.WriteString("Not enough disk space, " + err.Error() + "\n")
+		stopHeartbeat()
+		for _, patch := range batch {
+			updateAdminPortal(patchDefer, "-15", patch.PatchID)
+		}
+		return nil
+	}
+
+	os.Chdir(tomcatDir)
+	log.Debug("Chdir to ", tomcatDir)
+	activePrefetch = prefetchBatch(batch)
+	defer func() {
+		activePrefetch.wait()
+		activePrefetch = nil
+	}()
+	// A tarball that can't be fetched or read through costs no downtime
+	if err := activePrefetch.tarballsReady(); err != nil {
+		log.Error("Not stopping ", activeProfile.name(), ": ", err)
+		outputBuffer.WriteString("Not stopping the server, " + err.Error() + "\n")
+		stopHeartbeat()
+		for _, patch := range batch {
+			updateAdminPortal(patchDefer, "-13", patch.PatchID)
+		}
+		return nil
+	}
+	// Now the exact size is known, from the tar headers
+	if err := checkDiskSpace([]diskNeed{{tomcatDir, activePrefetch.extractedSize()}}); err != nil {
+		log.Error("Not stopping ", activeProfile.name(), ": ", err)
+		outputBuffer.WriteString("Not stopping the server, " + err.Error() + "\n")
+		stopHeartbeat()
+		for _, patch := range batch {
+			updateAdminPortal(patchDefer, "-15", patch.PatchID)
+		}
+		return nil
+	}
+	activeProfile.stop(tomcatDir)
+
+	// Kill Tomcat and exit for special scenario
+	for _, patch := range batch {
+		if strings.TrimSpace(patch.SakaiProps) == "die" {
+			log.Errorf("Killing Tomcat per patcher: %s", tomcatDir)
+			stopHeartbeat()
+			for _, other := range batch {
+				if other == patch {
+					updateAdminPortal(patchSuccess, "1", other.PatchID)
+				} else {
+					updateAdminPortal(patchDefer, "-5", other.PatchID)
+				}
 			}
+			return nil
+		}
+	}
 
-			// Exiting after patching!
-			os.Exit(0)
+	// Run every patch's properties, tarball, sql, hook and restart steps in one downtime
+	outcomes := runBatch(batch, tomcatDir)
+	stopHeartbeat()
+	rv, startup := tomcatDown, "-1"
+	results := map[string]string{}
+	for _, patch := range batch {
+		outcome := outcomes[patch.PatchID]
+		results[patch.PatchID] = outcome.rv
+		if outcome.rv == patchSuccess && len(patchedFiles[patch.PatchID]) > 0 {
+			hash, err := writeManifest(patch.PatchID, patchedFiles[patch.PatchID])
+			if err != nil {
+				log.Error("Could not write checksum manifest for patch ", patch.PatchID, ": ", err)
+			} else {
+				manifestHashes[patch.PatchID] = hash
+			}
 		}
-		time.Sleep(10 * 1000 * time.Millisecond)
-		log.Debug("Checking logs again. Seconds elapsed:", z)
+		updateAdminPortal(outcome.rv, outcome.startup, patch.PatchID)
+		rv, startup = outcome.rv, outcome.startup
 	}
+	exportMetrics(recordRun(strings.Join(patchIDs, ","), tomcatDir, rv, startup, results))
+	exportTrace(patchIDs, tomcatDir, rv, startup)
 
-	// Couldn't find success in Tomcat logs
-	updateAdminPortal(tomcatDown, "-1", patchID)
-	os.Exit(0)
+	return nil
+}
+
+// hostIPs is the JSON list of IPs the portal knows this host by
+func hostIPs() string {
+	ip, _ := externalIP()
+	if cloud := cloudMetadata(); cloud != nil {
+		ip = mergeIPs(ip, cloud.PrivateIP, cloud.PublicIP)
+	}
+	log.Debug("Auto-detected IPs on this server:" + ip)
+
+	// User is overriding the auto-detected IPs
+	if len(*localIP) > 3 {
+		var ipArray = [1]string{*localIP}
+		ipJSON, err := json.Marshal(ipArray)
+		if err != nil {
+			panic("Bad ip provided on command-line")
+		}
+		ip = string(ipJSON)
+		log.Debug("User-overridden IP:", ip)
+	}
+	return ip
 }
 
 func parseServerStartupTime(logLine string) int64 {
@@ -193,19 +752,87 @@ func updateAdminPortal(rv string, startup string, patchID string) {
 	// Unix time converted to a string
 	currentTime := strconv.FormatInt(time.Now().Unix(), 10)
 
-	postURL := "https://admin.longsight.com/longsight/remote/patch/update"
 	urlValues := url.Values{"result_value": {rv}, "start_uptime": {startup},
-		"last_attempt": {string(currentTime)}, "patch_id": {patchID}, "result": {resultText}}
+		"last_attempt": {string(currentTime)}, "patch_id": {patchID}, "result": {resultText}, "run_id": {runID},
+		"environment": {runtimeEnv}}
+	if applied := overrides.summary(); applied != "" {
+		urlValues.Set("overrides", applied)
+	}
+	if rv == inProgress {
+		urlValues.Set("lease_seconds", leaseSeconds())
+	}
+	if nonce := claimNonces[patchID]; nonce != "" {
+		urlValues.Set("claim_nonce", nonce)
+	}
+	if hash := manifestHashes[patchID]; hash != "" {
+		urlValues.Set("manifest_sha256", hash)
+	}
+	if steps := stepSummary(patchID); steps != "" {
+		urlValues.Set("steps", steps)
+	}
+	if report := startupErrorSummary(patchID); report != "" {
+		urlValues.Set("startup_errors", report)
+	}
+	if rv != inProgress {
+		if inventory := inventorySummary(); inventory != "" {
+			urlValues.Set("inventory", inventory)
+		}
+		if resources := resourceSummary(); resources != "" {
+			urlValues.Set("resources", resources)
+		}
+	}
+	if activePortal.richStatus {
+		urlValues.Set("status", statusFor(rv, startup, statusReasons[patchID]).String())
+	}
+	if rv != inProgress {
+		runResults[patchID] = patchOutcome{rv, startup}
+		saveRunLog()
+	}
+	urlValues = trimResult(urlValues, resultDetail)
+	truncated := false
+	if result := urlValues.Get("result"); result != "" {
+		urlValues.Set("result", capResult(result, *maxResultSize))
+		truncated = urlValues.Get("result") != result
+	}
 	log.Debug("Values being sent to admin portal: ", urlValues)
+	notifyWebhook(rv, startup, patchID)
+	notifySlack(rv, startup, patchID)
+	notifyEmail(rv, startup, patchID)
+	notifyPager(rv, startup, patchID)
 
-	resp, err := http.PostForm(postURL, urlValues)
-	log.Debug("Response from admin portal: ", resp)
+	err := postPortalUpdate(urlValues)
+	if err == nil {
+		// Only hosts that send full output anyway may send the rest of it
+		if truncated && *uploadFullResult && resultDetail == detailFull && rv != inProgress {
+			uploadFullOutput(patchID, resultText)
+		}
+		return
+	}
 
-	if err != nil {
-		panic("Could not POST update")
+	// We can't go ahead without claiming the patch
+	if rv == inProgress {
+		panic("Could not POST update: " + err.Error())
+	}
+
+	// Keep the outcome so the portal eventually learns it instead of leaving the patch inProgress
+	log.Error("Could not POST update, spooling result: ", err)
+	if err := spoolUpdate(urlValues); err != nil {
+		panic("Could not POST or spool update: " + err.Error())
 	}
 }
 
+func postPortalUpdate(urlValues url.Values) error {
+	return retryPortal("Portal update", func() error {
+		resp, err := postPortalForm(updatePath, urlValues)
+		log.Debug("Response from admin portal: ", resp)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		return checkResponse(resp)
+	})
+}
+
 func checkForUnnecessaryJars(tomcatDir string) {
 	catalinaHome := ""
 
@@ -345,156 +972,142 @@ func startTomcat(patchID string) {
 }
 
 func stopTomcat(tomcatDir string) {
+	defer trackPhase("stop")()
+
 	out, err := exec.Command("bin/catalina.sh", "stop", "32", "-force").CombinedOutput()
 	if err != nil {
 		log.Warning("Error when shutting down Tomcat: ", err)
 	}
 	log.Debug("stopTomcat: ", string(out))
 
-	time.Sleep(20 * 1000 * time.Millisecond)
+	time.Sleep(time.Duration(overrides.shutdownWait(20)) * time.Second)
 	hardKillProcess(tomcatDir)
 	time.Sleep(10 * 1000 * time.Millisecond)
 	hardKillProcess(tomcatDir)
 	outputBuffer.Write(out)
 }
 
-func fetchTarball(tarball string) string {
+func fetchTarball(tarball string, patchID string) string {
+	return fetchPatchFile(tarball, patchID, true)
+}
+
+// fetchPatchFile finds or downloads a file a patch ships, like fetchTarball,
+// but only reads it through as a tarball when isArchive is set
+func fetchPatchFile(tarball string, patchID string, isArchive bool) string {
 	fullPath := tarball
-	fileName := path.Base(tarball)
-	log.Debug("fetchTarball: ", fileName, fullPath)
+	fileName := path.Base(redactURL(tarball))
+	log.Debug("fetchTarball: ", fileName, redactURL(fullPath))
 
-	// See if the file exists in local patch directory
+	// See if the file exists in local patch directory, then in a shared -patch-repo,
+	// then in the cache of earlier downloads
+	fetchedFrom := ""
+	verified := false
 	if !pathExists(fullPath) {
-		fullPath = *patchDir + string(os.PathSeparator) + fileName
+		if found := findInPatchRepo(fileName); found != "" {
+			log.Info("Using ", found, " from the patch repository")
+			fullPath = found
+		} else if cached := cachedTarball(expectedChecksum(patchID, fileName)); cached != "" {
+			log.Info("Using ", fileName, " downloaded earlier, cached as ", cached)
+			fullPath = cached
+			verified = true
+		} else if revalidated := revalidatedCopy(tarball, patchID, fileName); revalidated != "" {
+			log.Info("Using ", fileName, " downloaded earlier, unchanged since, cached as ", revalidated)
+			fullPath = revalidated
+			verified = true
+		} else {
+			fullPath = *patchDir + string(os.PathSeparator) + fileName
 
-		// Delete old file in our tmp dir
-		if pathExists(fullPath) {
-			os.Remove(fullPath)
-			log.Debug("Deleted old temp file: ", fullPath)
+			// Delete old file in our tmp dir, including one an earlier run never finished
+			if pathExists(fullPath) {
+				os.Remove(fullPath)
+				log.Debug("Deleted old temp file: ", fullPath)
+			}
+			os.Remove(fullPath + ".part")
+			log.Debug("fetchTarball new path to try: ", fullPath)
 		}
-		log.Debug("fetchTarball new path to try: ", fullPath)
 	}
 
 	// See if we can pull file from S3
 	if !pathExists(fullPath) {
-		fileWriter, err := os.Create(fullPath)
-		if err != nil {
-			panic("Could not open file: " + fullPath)
-		}
-		defer fileWriter.Close()
-
-		// Try to correct the path
-		fileToFetch := *patchWeb + "sakai-builder/" + fileName
-		if strings.Contains(tarball, legacyPatchDir) {
-			fileToFetch = *patchWeb + strings.Replace(tarball, legacyPatchDir, "patches/", 1)
-		}
-
-		resp, err := http.Get(fileToFetch)
-		log.Debug("Trying to fetch patch: " + fileToFetch)
-		if err != nil {
-			panic("Could not download patch")
-		}
-		contentLength := resp.Header.Get("Content-Length")
-		if contentLength == "" {
-			log.Warn("No Content-Length header found on download")
+		// Another node of the cluster may have it, which beats the WAN, and
+		// failing that a cached tarball may have most of it
+		sources, alternates := tarballSources(tarball)
+		peers := peerSources(expectedChecksum(patchID, fileName))
+		var source string
+		if len(peers) == 0 && isArchive {
+			source = incrementalDownload(sources, fullPath, patchID)
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode == http.StatusOK {
-			n, err := io.Copy(fileWriter, resp.Body)
-			log.Debug("Copied remote file bytes: ", n)
-
-			if n > 0 && err != nil {
-				os.Remove(fullPath)
-				panic("Could not copy from web to local file system")
-			} else if n > 0 && contentLength != "" {
-				expectedSize, err := strconv.ParseInt(contentLength, 10, 64)
-				if err != nil {
-					log.Error("Error parsing Content-Length:", err)
-				} else if n != expectedSize {
-					panic("Downloaded bytes (" + strconv.FormatInt(n, 10) + ") is different from Content-Length: " + contentLength)
-				}
+		if source == "" {
+			var err error
+			source, err = downloadFromMirrors(append(peers, sources...), fullPath, patchID, isArchive)
+			if errors.Is(err, errTarballNotFound) && len(alternates) > 0 {
+				log.Warning("Patch ", fileName, " is on no mirror, trying the other patch tree: ", err)
+				source, err = downloadFromMirrors(alternates, fullPath, patchID, isArchive)
+			}
+			if err != nil {
+				panic("Could not download patch " + fileName + ": " + err.Error())
 			}
-		} else {
-			log.Error("Could not find patch.... proceeding", resp)
 		}
+		fetchedFrom = source
+		verified = true
+		downloaded := fullPath
+		fullPath = storeInCache(fullPath, expectedChecksum(patchID, fileName))
+		recordValidators(source, downloaded, fullPath)
 	}
 
 	if !pathExists(fullPath) {
 		panic("Could not find the patch file: " + fileName)
 	}
+	// A download was verified before it was moved into place, a cached one when it was found
+	if !verified {
+		if err := verifyChecksum(fullPath, expectedChecksum(patchID, fileName)); err != nil {
+			panic("Refusing patch " + fileName + ": " + err.Error())
+		}
+	}
+	if err := verifyTarballSignature(fullPath, fetchedFrom, patchID); err != nil {
+		if fetchedFrom != "" {
+			os.Remove(fullPath)
+		}
+		panic("Refusing patch " + fileName + ": " + err.Error())
+	}
 
 	log.Debug("Final patch path: " + fullPath)
 	return fullPath
 }
 
-func applyTarballPatch(tarball string) {
-	filePath := fetchTarball(tarball)
-
-	// Unroll the tarball one time to see what to clean out
-	fileMap := unrollTarball(filePath)
-
-	// Clean out old directories
-	for fileMapPath, cnt := range fileMap {
-		isWebapp := strings.HasPrefix(fileMapPath, "webapps")
-		isWarFile := strings.HasSuffix(fileMapPath, ".war")
-		isComponents := strings.HasPrefix(fileMapPath, "components")
-		isSharedJar := isLibJar(fileMapPath)
-		isProvidersDir := strings.Contains(fileMapPath, "sakai-provider-pack")
-		pathArray := strings.Split(fileMapPath, "/")
-		pathToDelete := pathArray[0] + "/" + pathArray[1]
-
-		if cnt > 3 && isComponents && !isProvidersDir {
-			err := os.RemoveAll(pathToDelete)
-			if err != nil {
-				panic("Could not remove components path: " + pathToDelete)
-			}
-			log.Debug("Deleting components path: ", pathToDelete)
-
-			// Special case with content-review
-			if strings.Contains(pathToDelete, "sakai-content-review-pack-federated") {
-				err := os.RemoveAll("components/sakai-content-review-pack")
-				if err != nil {
-					panic("Could not remove special path: components/sakai-content-review-pack")
-				}
-				log.Debug("Special path delete: components/sakai-content-review-pack")
-			}
-		} else if isWebapp && isWarFile {
-			webappFolder := trimSuffix(pathToDelete, ".war")
-			err := os.RemoveAll(webappFolder)
-			if err != nil {
-				panic("Could not remove webapp path: " + webappFolder)
-			}
-			log.Debug("Deleting webapp path: ", webappFolder)
-		} else if isSharedJar {
-			// Need to wildcard the name to remove old versions
-			wildcardedFilename := replaceNumbers(fileMapPath)
-			if strings.Contains(fileMapPath, "gradebook2") {
-				wildcardedFilename = fileMapPath
-			}
-			wildcardedFilename = strings.Replace(wildcardedFilename, "-SNAPSHOT", "", 1)
-			err := removeFiles(wildcardedFilename)
-			if err != nil {
-				panic("Could not delete wildcarded path: " + wildcardedFilename)
-			}
+// tarballSources are the URLs to try for a tarball. The path is corrected onto
+// each mirror, but the portal may also send a full (presigned) URL. Tarballs
+// have moved between the sakai-builder/ and patches/ trees, alternates are
+// the same tarball in the other tree, for when no mirror has it where expected.
+func tarballSources(tarball string) (sources []string, alternates []string) {
+	if strings.HasPrefix(tarball, "https://") || strings.HasPrefix(tarball, "http://") || isS3URL(tarball) || isSFTPURL(tarball) {
+		return []string{tarball}, nil
+	}
+	fileName := path.Base(tarball)
+	for _, mirror := range patchMirrors() {
+		if strings.Contains(tarball, legacyPatchDir) {
+			sources = append(sources, mirror+strings.Replace(tarball, legacyPatchDir, "patches/", 1))
+			alternates = append(alternates, mirror+"sakai-builder/"+fileName)
+		} else {
+			sources = append(sources, mirror+"sakai-builder/"+fileName)
+			alternates = append(alternates, mirror+"patches/"+fileName)
 		}
 	}
-
-	// Unroll the tarball again after cleaning out old directories
-	unrollTarball(filePath)
+	return sources, alternates
 }
 
-func isLibJar(filename string) bool {
-	isSharedJar := strings.HasPrefix(filename, "shared/lib/")
-	isCommonJar := strings.HasPrefix(filename, "common/lib/")
-	isLibDirJar := strings.HasPrefix(filename, "lib/")
-	isJarFile := strings.HasSuffix(filename, ".jar")
-	return (isSharedJar || isCommonJar || isLibDirJar) && isJarFile
-}
-
-func unrollTarball(filePath string) map[string]int {
-	var m map[string]int
-	m = make(map[string]int)
+// applyTarballPatch downloads a tarball if needed and applies it to the current directory
+func applyTarballPatch(tarball string, patchID string) {
+	filePath, prefetched, err := activePrefetch.tarball(tarball)
+	if err != nil {
+		panic(err.Error())
+	}
+	if !prefetched {
+		if streamTarballPatch(tarball, patchID) {
+			return
+		}
+		filePath = fetchTarball(tarball, patchID)
+	}
 
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -502,106 +1115,36 @@ func unrollTarball(filePath string) map[string]int {
 	}
 	defer file.Close()
 
-	var fileReader io.ReadCloser = file
-
-	if strings.HasSuffix(filePath, ".zst") {
-		decoder, err := zstd.NewReader(file)
-		if err != nil {
-			panic("Could not create zstd reader")
-		}
-		defer decoder.Close()
-		fileReader = io.NopCloser(decoder)
-	} else if strings.HasSuffix(filePath, ".gz") {
-		if fileReader, err = gzip.NewReader(file); err != nil {
-			panic("Could not read GZIP")
-		}
-		defer fileReader.Close()
+	// Cleans out old directories and JARs, extracts and verifies the result
+	doneExtracting := trackPhase("extract")
+	report, err := archive.Apply(".", file, archive.Options{StagingDir: *patchDir, Sync: *fsyncExtracted, Streaming: *streamingExtract,
+		Owner: serverOwner, TarOwner: useTarOwner(), ModTimes: *keepModTimes, Xattrs: *keepXattrs, Atomic: *atomicExtract,
+		Workers: extractionWorkers()})
+	doneExtracting()
+	if err != nil {
+		panic("Could not apply patch " + filePath + ": " + err.Error())
 	}
+	log.Debugf("Applied %s: %d written, %d skipped, %d removed", filePath, len(report.Written), len(report.Skipped), len(report.Removed))
+	patchedFiles[patchID] = append(patchedFiles[patchID], report.Written...)
+}
 
-	tarBallReader := tar.NewReader(fileReader)
-	for {
-		header, err := tarBallReader.Next()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			panic("Could not read tarball")
-		}
-
-		// get the individual filename and extract to the current directory
-		filename := header.Name
-
-		switch header.Typeflag {
-		case tar.TypeDir:
-			// handle directory
-			if !pathExists(filename) {
-				err = os.MkdirAll(filename, os.FileMode(header.Mode)) // or use 0755 if you prefer
-				log.Debug("Creating directory: ", filename)
-
-				if err != nil {
-					panic("Could not create directory: " + filename)
-				}
-			}
-
-		case tar.TypeReg:
-			// handle normal file
-
-			// Strip files that start with dot slash
-			startsWithDot := strings.HasPrefix(filename, "./")
-			if startsWithDot {
-				filename = strings.Replace(filename, "./", "", 1)
-				log.Debug("Tar file started with a dot: ", filename)
-			}
-
-			// Do not overwrite an existing jldap-beans.xml or unboundid-ldap.xml or components.xml
-			if shouldSkipFile(filename) && pathExists(filename) {
-				log.Debug("Skipping file: ", filename)
-				continue
-			}
-
-			// See if there are any dirs we should wipe out
-			if len(filename) > len("components/a") {
-				splitPaths := strings.Split(filename, "/")
-				if len(splitPaths) > 1 {
-					firstTwoPaths := splitPaths[0] + "/" + splitPaths[1]
-
-					_, ok := m[firstTwoPaths]
-					if isLibJar(filename) {
-						m[filename] = 1
-					} else if ok {
-						m[firstTwoPaths]++
-					} else {
-						m[firstTwoPaths] = 1
-					}
-				}
-			}
-
-			writer, err := os.Create(filename)
-			log.Debug("Unrolled tarball file: ", filename)
-
-			if err != nil {
-				log.Error("Could not create file from tarball: ", filename, err)
-			}
-
-			io.Copy(writer, tarBallReader)
-
-			err = os.Chmod(filename, os.FileMode(header.Mode))
-
-			if err != nil {
-				log.Error("Could not chmod file: ", filename, err)
-			}
-
-			writer.Close()
-		default:
-			log.Errorf("Unable to untar type : %c in file %s", header.Typeflag, filename)
-		}
+// unrollTarball extracts a local patch file into the current directory without cleanup
+func unrollTarball(filePath string) map[string]int {
+	file, err := os.Open(filePath)
+	if err != nil {
+		panic("Could not open patch: " + filePath)
 	}
+	defer file.Close()
 
-	return m
+	report, err := archive.Extract(".", file, archive.Options{})
+	if err != nil {
+		panic("Could not unroll patch " + filePath + ": " + err.Error())
+	}
+	return report.Counts
 }
 
 func shouldSkipFile(filename string) bool {
-	return skipPattern.MatchString(filename)
+	return archive.ShouldSkip(filename)
 }
 
 func checkForProcess(tomcatDir string) bool {
@@ -620,6 +1163,10 @@ func checkForProcess(tomcatDir string) bool {
 }
 
 func hardKillProcess(tomcatDir string) {
+	if !hostKillAllowed() {
+		log.Debug("Not hunting for leftover processes inside a container")
+		return
+	}
 	alive := checkForProcess(tomcatDir)
 
 	if alive {
@@ -635,36 +1182,74 @@ func hardKillProcess(tomcatDir string) {
 	}
 }
 
-func checkForPatchesFromPortal(ip string) map[string]interface{} {
-	data := map[string]interface{}{}
-	url := patcherURL + "?ips=" + ip
+func checkForPatchesFromPortal(ip string) ([]*PatchResponse, error) {
+	query := patchQuery()
 
-	req, err := http.NewRequest("GET", url, nil)
-	req.Header.Set("X-Auth-Token", *token)
-	req.Header.Set("Content-Type", "text/plain")
-	req.Header.Set("User-Agent", patcherUserAgent)
+	var body []byte
+	var signature string
+	err := retryPortal("Patch check", func() error {
+		req, err := http.NewRequest("GET", activePortal.endpoint(patchesPath)+"?ips="+ip+query, nil)
+		if err != nil {
+			return permanentError{err}
+		}
+		setPortalHeaders(req)
+		req.Header.Set("Content-Type", "text/plain")
+
+		client := &http.Client{}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+		if err := checkResponse(resp); err != nil {
+			return err
+		}
+		signature = resp.Header.Get(signatureHeader)
+		activePortal.acceptStatusModel(resp.Header.Get(statusModelHeader))
+		if err := activePortal.grantScope(resp.Header.Get(scopeHeader)); err != nil {
+			log.Warning(err)
+		}
+		body, err = io.ReadAll(resp.Body)
+		return err
+	})
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("bad HTTP fetch from portal %s: %w", activePortal.Name, err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
+	// A tampered response must not reach the tarball URLs or property changes
+	if err := verifySignature(activePortal.HMACSecret, body, signature); err != nil {
+		return nil, err
+	}
 
-		// We have a real patch
-		if len(body) > 5 {
-			json.Unmarshal(body, &data)
-			log.Debug("Raw data from admin portal: ", data)
-		}
-	} else {
-		log.Errorf("Bad HTTP fetch: %v \n", resp.Status)
-		os.Exit(1)
+	// Anything shorter is the portal saying there is nothing to do
+	if len(body) <= 5 {
+		return nil, nil
 	}
 
-	return data
+	// We have a real patch
+	log.Debug("Raw data from admin portal: ", string(body))
+	return decodePatchResponses(body)
+}
+
+// patchQuery adds the hostname, node ID and cloud instance ID to the patch check,
+// so the portal can match hosts whose IPs are hidden behind NAT or a cloud load balancer
+func patchQuery() string {
+	query := url.Values{}
+	if hostname, err := os.Hostname(); err == nil {
+		query.Set("hostname", hostname)
+	}
+	if *nodeID != "" {
+		query.Set("node_id", *nodeID)
+	}
+	if cloud := cloudMetadata(); cloud != nil {
+		query.Set("cloud", cloud.Provider)
+		query.Set("instance_id", cloud.InstanceID)
+	}
+	if len(query) == 0 {
+		return ""
+	}
+	return "&" + query.Encode()
 }
 
 func checkTomcatDirExists(tomcatDir string) {
@@ -675,66 +1260,32 @@ func checkTomcatDirExists(tomcatDir string) {
 }
 
 func checkTomcatOwnership(tomcatDir string) {
-	file, err := os.Open(tomcatDir + "/bin/catalina.sh")
+	ownerFile := tomcatDir + "/" + activeProfile.ownerFile()
+	file, err := os.Open(ownerFile)
 	if err != nil {
-		panic("Could not open file: " + tomcatDir + "/bin/catalina.sh")
+		panic("Could not open file: " + ownerFile)
 	}
 	fi, _ := file.Stat()
-	tomcatUID := fi.Sys().(*syscall.Stat_t).Uid
+	stat := fi.Sys().(*syscall.Stat_t)
+	tomcatUID := stat.Uid
 	log.Debug("Tomcat ownership uid: ", tomcatUID)
+	serverOwner = nil
+	if patcherUID == 0 && tomcatUID != 0 {
+		// Run by root, e.g. from an orchestrator: what's extracted must still be the server's
+		log.Info("Running as root, extracted files will belong to uid ", tomcatUID, " gid ", stat.Gid, " like ", ownerFile)
+		serverOwner = &archive.Owner{UID: int(tomcatUID), GID: int(stat.Gid)}
+		return
+	}
 	if tomcatUID != patcherUID {
 		log.Debug("Patcher UID is different from Tomcat UID", tomcatUID, patcherUID)
-		os.Exit(1)
+		panic("Patcher does not own " + ownerFile)
 	}
 }
 
-func externalIP() (string, error) {
-	var ips [5]string
-	counter := 0
-
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		return "", err
-	}
-
-	for _, iface := range ifaces {
-		if iface.Flags&net.FlagUp == 0 {
-			continue // interface down
-		}
-		if iface.Flags&net.FlagLoopback != 0 {
-			continue // loopback interface
-		}
-		addrs, addrerr := iface.Addrs()
-		if addrerr != nil {
-			return "", addrerr
-		}
-		for _, addr := range addrs {
-			var ip net.IP
-			switch v := addr.(type) {
-			case *net.IPNet:
-				ip = v.IP
-			case *net.IPAddr:
-				ip = v.IP
-			}
-			if ip == nil || ip.IsLoopback() {
-				continue
-			}
-			ip = ip.To4()
-			if ip == nil {
-				continue // not an ipv4 address
-			}
-			ips[counter] = ip.String()
-			counter++
-		}
-	}
-
-	// Conver the IP array into a JSON string
-	b, err := json.Marshal(ips)
-	if err != nil {
-		panic(err)
-	}
-
-	return string(b), errors.New("Are you connected to the network?")
+// useTarOwner is whether extracted files keep the owners in the tarball, only
+// root can give files to them
+func useTarOwner() bool {
+	return *tarOwner && patcherUID == 0
 }
 
 func modifyPropertyFiles(rawProperties string, patchID string) {
@@ -747,6 +1298,9 @@ func modifyPropertyFiles(rawProperties string, patchID string) {
 			newPropertyArray := strings.Split(newPropertyLine, "=")
 			newPropertyKey = newPropertyArray[0]
 			log.Debug("New property key=" + newPropertyKey)
+			if overrides.skipsProperty(newPropertyKey) {
+				continue
+			}
 		}
 		addedTheNewProperty := false
 
@@ -754,7 +1308,7 @@ func modifyPropertyFiles(rawProperties string, patchID string) {
 		lastValidPropertyFile := ""
 		for _, propertyFile := range propertyFiles {
 			fileModified := false
-			propertyFilePath := "sakai/" + propertyFile
+			propertyFilePath := activeProfile.propertyDir() + "/" + propertyFile
 			if pathExists(propertyFilePath) {
 				log.Debug("Found property file: " + propertyFilePath)
 				input, err := os.ReadFile(propertyFilePath)
@@ -764,25 +1318,24 @@ func modifyPropertyFiles(rawProperties string, patchID string) {
 				}
 				lastValidPropertyFile = propertyFilePath
 
-				lines := strings.Split(string(input), "\n")
-				for i, line := range lines {
-					if strings.Contains(line, newPropertyKey) {
-						if !strings.Contains(line, "#"+newPropertyKey) {
-							log.Debug("Found property key: " + line)
-							lines[i] = "#" + line
-							lines = append(lines[:i+1], append([]string{newPropertyLine}, lines[i+1:]...)...)
-							fileModified = true
-							addedTheNewProperty = true
+				// Comment out every active occurrence, the new line goes after the first
+				var lines []string
+				for _, line := range strings.Split(string(input), "\n") {
+					if strings.Contains(line, newPropertyKey) && !strings.Contains(line, "#"+newPropertyKey) {
+						log.Debug("Found property key: " + line)
+						lines = append(lines, "#"+line)
+						if !fileModified {
+							lines = append(lines, newPropertyLine)
 						}
+						fileModified = true
+						addedTheNewProperty = true
+						continue
 					}
+					lines = append(lines, line)
 				}
 
 				if fileModified {
-					output := strings.Join(lines, "\n")
-					err = os.WriteFile(propertyFilePath, []byte(output), 0644)
-					if err != nil {
-						log.Error("Could not write revised file: " + propertyFilePath)
-					}
+					writePropertyFile(propertyFilePath, input, strings.Join(lines, "\n"), newPropertyLine)
 				}
 			}
 		}
@@ -799,44 +1352,15 @@ func modifyPropertyFiles(rawProperties string, patchID string) {
 			lines = append(lines, "# Longsight patch ID: "+patchID+" ("+time.Now().Format("2006-01-02 15:04:05")+")")
 			lines = append(lines, newPropertyLine)
 
-			output := strings.Join(lines, "\n")
-			err = os.WriteFile(lastValidPropertyFile, []byte(output), 0644)
-			if err != nil {
-				log.Error("Could not write new property to file: " + lastValidPropertyFile)
-			} else {
-				log.Debug("Added new line to file: "+lastValidPropertyFile, newPropertyLine)
-			}
+			writePropertyFile(lastValidPropertyFile, input, strings.Join(lines, "\n"), newPropertyLine)
+			log.Debug("Added new line to file: "+lastValidPropertyFile, newPropertyLine)
 		}
 	}
 }
 
 // replaceNumbers replaces consecutive digits in a string with a single asterisk.
 func replaceNumbers(s string) string {
-	// Initialize an output slice of runes to store the transformed characters.
-	// The length is estimated based on the input string length.
-	outputRunes := make([]rune, 0, len(s))
-
-	// Track whether the last rune was a digit to handle consecutive digits.
-	lastWasDigit := false
-
-	// Iterate over each rune in the input string.
-	for _, currentRune := range s {
-		// Check if the current rune is a digit.
-		if currentRune >= '0' && currentRune <= '9' {
-			// If the last rune was not a digit, add an asterisk to the output.
-			if !lastWasDigit {
-				outputRunes = append(outputRunes, '*')
-				lastWasDigit = true
-			}
-			// Skip adding the digit itself.
-			continue
-		}
-		// For non-digit runes, add them to the output and set lastWasDigit to false.
-		outputRunes = append(outputRunes, currentRune)
-		lastWasDigit = false
-	}
-	// Convert the output runes back to a string and return it.
-	return string(outputRunes)
+	return archive.ReplaceNumbers(s)
 }
 
 // exists returns whether the given file or directory exists or not
@@ -853,75 +1377,141 @@ func pathExists(path string) bool {
 	return false // Treat other errors as if the file does not exist
 }
 
-// Shortcut to check if the path is a directory
-func isDir(path string) (bool, error) {
-	fi, err := os.Lstat(path)
-	if err != nil {
-		return false, err
-	}
-	return fi.IsDir(), nil
-}
-
-func removeFiles(wildcardedPath string) error {
-	files, err := filepath.Glob(wildcardedPath)
-	if err != nil {
-		log.Errorf("Failed to glob %s", wildcardedPath)
-		return err
-	}
-	log.Debugf("Found files matching %s: %v", wildcardedPath, files)
-
-	toSkip := make(map[string]bool)
-	for _, file := range files {
-		dir, derr := isDir(file)
-		if derr != nil {
-			return derr
-		}
-		if dir {
-			toSkip[file] = true
-		} else {
-			realFile, symerr := filepath.EvalSymlinks(file)
-			if symerr != nil {
-				log.Error("Failed to eval symlink", file, symerr)
-				return symerr
-			}
-			if realFile != file {
-				toSkip[file] = true
-				toSkip[realFile] = true
-			}
-		}
-	}
-
-	for _, file := range files {
-		if toSkip[file] {
-			log.Debugf("Skipping file: %s", file)
-		} else {
-			log.Debugf("Removing: %s", file)
-			err = os.Remove(file)
-			if err != nil {
-				log.Errorf("Failed to remove %s: %s", file, err)
-				return err
-			}
-		}
-	}
-	return nil
-}
-
-func trimSuffix(s, suffix string) string {
-	if strings.HasSuffix(s, suffix) {
-		s = s[:len(s)-len(suffix)]
-	}
-	return s
-}
-
 func initParseCommandLineFlags() {
 	token = flag.String("token", "test-token", "the custom security token")
+	tokenFile = flag.String("token-file", "", "read the security token from this file (mode 600) instead of -token")
 	logLevel = flag.String("log", "info", "Log level (debug, info, warn, error, fatal, panic)")
 	patchDir = flag.String("dir", "/tmp", "directory to store downloaded patches")
-	patchWeb = flag.String("web", "https://s3.amazonaws.com/longsight-patches/", "website with patch files")
+	patchWeb = flag.String("web", "https://s3.amazonaws.com/longsight-patches/", "website with patch files, or a comma-separated list of mirrors to try in order")
 	localIP = flag.String("ip", "", "override automatic ip detection")
+	ipFamily = flag.String("ip-family", ipFamilyV4, "detected addresses to report: v4 or v6 to list that family first, v4-only or v6-only to drop the other")
+	ifaceInclude = flag.String("iface", "", "comma-separated globs of the only interfaces to detect IPs on, e.g. eth*,ens*")
+	ifaceExclude = flag.String("exclude-iface", "", "comma-separated globs of interfaces to ignore when detecting IPs, e.g. docker0,br-*,veth*,tun*")
+	useCloudMetadata = flag.Bool("cloud-metadata", true, "ask the EC2, GCP or Azure metadata service for this instance's IPs and ID")
 	startupWaitSeconds = flag.Int("waitTime", 280, "amount of time to wait for Tomcat to startup")
-
-	flag.Parse()
+	overridesFile = flag.String("overrides", defaultOverridesFile, "host-local file to pin or veto patches, skip properties and adjust timeouts")
+	hookDir = flag.String("hook-dir", defaultHookDir, "directory holding scripts that hook steps may run")
+	mysqlClient = flag.String("mysql", "mysql", "mysql client used by sql steps")
+	instancesFile = flag.String("instances", defaultInstancesFile, "instance registry mapping server directories to deployment profiles")
+	stateDir = flag.String("state-dir", defaultStateDir, "directory for run history and other local state")
+	retryAttempts = flag.Int("retries", 5, "maximum attempts for each portal request")
+	retryDelay = flag.Duration("retry-delay", 2*time.Second, "initial delay between portal retries, doubled each attempt")
+	leaseInterval = flag.Duration("lease-interval", time.Minute, "how often to renew the claim on in-progress patches, 0 to disable")
+	portalURL = flag.String("portal", defaultPortalURL, "admin portal base URL, or comma-separated URLs to fail over between, when there is no portals file")
+	portalsFile = flag.String("portals", defaultPortalsFile, "portal accounts and the instances each one manages")
+	tarballPubkey = flag.String("tarball-pubkey", "", "minisign public key file; every tarball then needs a good detached .minisig signature next to it")
+	hmacSecretFile = flag.String("hmac-secret-file", "", "shared secret for verifying signed patch JSON, when there is no portals file")
+	allowedDirs = flag.String("allowed-dirs", "", "comma-separated globs the portal's tomcat_dir must match, e.g. /opt/tomcats/*, when there is no portals file")
+	allowedPatchIDs = flag.String("allowed-patch-ids", "", "regular expression every patch ID from the portal must match, when there is no portals file")
+	tokenScopeFlag = flag.String("token-scope", "", "limit what the token may do on this host: check-only, tags=a|b, no-properties; when there is no portals file")
+	pinSHA256 = flag.String("pin-sha256", "", "comma-separated base64 SPKI hashes the portal certificate chain must match, when there is no portals file")
+	sandboxMode = flag.String("sandbox", sandboxOff, "confine property and tarball writes to the server, patch and state directories: off, auto (Landlock where available) or landlock")
+	peerListen = flag.String("peer-listen", "", "host:port the daemon or agent serves its cached tarballs on to -peers, e.g. :8091")
+	peerList = flag.String("peers", "", "comma-separated base URLs of other cluster nodes' -peer-listen, asked for a tarball before the mirrors, e.g. http://10.0.0.2:8091")
+	peerTokenFile = flag.String("peer-token-file", "", "file with the token shared by every node of the cluster for -peer-listen and -peers")
+	minFreeSpace = flag.String("min-free-space", "512M", "space the patch dir and server filesystems must have left once a patch is downloaded and extracted, or the patch is deferred; 0 to only check the patch fits")
+	expansionRatio = flag.Float64("expansion-ratio", 3, "how many times its size a tarball is expected to take once extracted, for the disk space check before download")
+	tarOwner = flag.Bool("tar-owner", false, "when running as root, give extracted files the uid and gid recorded in the tarball instead of the server's owner")
+	keepModTimes = flag.Bool("keep-mtime", true, "give extracted files the modification times in the tarball, so backups and file comparisons only see what changed")
+	keepXattrs = flag.Bool("keep-xattrs", false, "restore the extended attributes recorded in the tarball on extracted files")
+	atomicExtract = flag.Bool("atomic-extract", true, "extract each tarball in full inside the server dir before moving it into place, so a crash or full disk mid-extraction leaves the server untouched")
+	extractWorkers = flag.Int("extract-workers", 4, "how many files of a tarball are written at once; 1 writes them one by one")
+	incrementalSync = flag.Bool("incremental-sync", false, "reuse the blocks a new tarball shares with recently cached ones and download only the rest, from mirrors that publish a .blocks map next to it")
+	streamDownload = flag.Bool("stream-download", false, "extract tarballs as they download instead of keeping a copy in -dir, for hosts whose /tmp is smaller than a patch; tarballs are no longer fetched ahead while the server stops")
+	streamingExtract = flag.Bool("streaming-extract", false, "extract with bounded buffers and a single zstd decoder thread, for hosts short on memory")
+	slackWebhookFile = flag.String("slack-webhook-file", "", "file (mode 600) holding a Slack incoming webhook URL to post the final status of every patch to")
+	pagerDutyKeyFile = flag.String("pagerduty-routing-key-file", "", "file (mode 600) holding a PagerDuty Events API v2 routing key to page when a patch leaves the server down")
+	opsgenieKeyFile = flag.String("opsgenie-api-key-file", "", "file (mode 600) holding an Opsgenie API key to alert when a patch leaves the server down")
+	metricsTextfileDir = flag.String("metrics-textfile-dir", "", "node_exporter textfile collector directory to write Prometheus metrics of each run to")
+	pushgatewayURL = flag.String("pushgateway-url", "", "Prometheus pushgateway to push the metrics of each run to")
+	otlpEndpoint = flag.String("otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector to export each patch run to as a trace, e.g. http://localhost:4318")
+	templatesDir = flag.String("templates-dir", "", "directory of <locale>.yaml language packs overriding the built-in notification text (en, fr, es)")
+	smtpServer = flag.String("smtp-server", "", "host:port of an SMTP server to email failed patches through, with the server log and patcher output attached")
+	smtpFrom = flag.String("smtp-from", "", "sender address for -smtp-server mail, go-patcher@<hostname> by default")
+	smtpTo = flag.String("smtp-to", "", "comma-separated recipients of -smtp-server mail")
+	smtpUser = flag.String("smtp-user", "", "user to authenticate to -smtp-server as, with the password in -smtp-password-file")
+	smtpPasswordFile = flag.String("smtp-password-file", "", "file (mode 600) holding the password for -smtp-user")
+	webhookURL = flag.String("webhook-url", "", "POST a JSON event with the final status of every patch to this URL")
+	startupJitter = flag.Duration("startup-jitter", 0, "wait a random time up to this long before the first portal call, e.g. 2m when a fleet shares a cron minute")
+	pollInterval = flag.Duration("interval", 5*time.Minute, "how often the daemon checks each portal for patches")
+	nodeID = flag.String("node-id", "", "stable ID for this node, sent with the IPs and hostname when checking for patches")
+	environment = flag.String("environment", "auto", "runtime environment: auto, container, vm or bare-metal")
+	heartbeatInterval = flag.Duration("heartbeat-interval", time.Minute, "how often the daemon reports this node to each portal, 0 to disable")
+	proxyURL = flag.String("proxy", "", "proxy for portal calls and downloads, overriding HTTP_PROXY/HTTPS_PROXY (NO_PROXY still applies)")
+	dialTimeout = flag.Duration("dial-timeout", 30*time.Second, "how long connecting to the portal, a mirror or a peer may take, 0 for no limit")
+	tlsHandshakeTimeout = flag.Duration("tls-handshake-timeout", 10*time.Second, "how long a TLS handshake may take, 0 for no limit")
+	responseHeaderTimeout = flag.Duration("response-header-timeout", 2*time.Minute, "how long to wait for a response once a request is sent, so a stalled S3 connection can't hang a run; 0 for no limit")
+	idleConnTimeout = flag.Duration("idle-conn-timeout", 90*time.Second, "how long an idle connection is kept for the next request, 0 to close every connection after its request")
+	tcpKeepAlive = flag.Duration("tcp-keepalive", 30*time.Second, "interval of the TCP keep-alive probes that find a dead connection mid-download, negative to disable")
+	caCert = flag.String("ca-cert", "", "PEM bundle of extra CAs to trust, for portals behind an internal CA")
+	clientCert = flag.String("client-cert", "", "PEM client certificate for mutual TLS with the portal")
+	clientKey = flag.String("client-key", "", "PEM private key for -client-cert")
+	agentListen = flag.String("agent-listen", "127.0.0.1:7443", "host:port the agent command serves its gRPC API on")
+	agentTokenFile = flag.String("agent-token-file", "", "file (mode 600) holding the bearer token agent API callers must send")
+	agentTLSCert = flag.String("agent-tls-cert", "", "PEM certificate for the agent API, required beyond loopback")
+	agentTLSKey = flag.String("agent-tls-key", "", "PEM private key for -agent-tls-cert")
+	controlListen = flag.String("control-listen", "", "Unix socket path or localhost:port for the daemon's control API to check now, show status and cancel a run")
+	mockPatchJSON = flag.String("patch-json", "", "patch JSON, one patch or a list, the mockportal command offers")
+	mockListen = flag.String("mock-listen", "127.0.0.1:8089", "host:port the mockportal command listens on")
+	mockTarballDir = flag.String("tarball-dir", "", "directory the mockportal command serves tarballs from, the -patch-json directory by default")
+	streamToPortal = flag.Bool("stream-to-portal", false, "stream patcher and server output to the portal while a patch runs, for the admin UI")
+	recordDir = flag.String("record", "", "save every portal request and response to this directory, keep it private as it holds portal responses")
+	replayDir = flag.String("replay", "", "answer portal requests from a -record directory instead of the network, to reproduce a run offline")
+	streamSocket = flag.String("stream-socket", "", "Unix socket that streams live patcher and server output during the run")
+	s3Region = flag.String("s3-region", "", "AWS region of the buckets behind s3:// patch URLs, AWS_REGION or the shared config by default")
+	s3Endpoint = flag.String("s3-endpoint", "", "endpoint of an S3-compatible store to use for s3:// patch URLs instead of AWS")
+	cacheMaxAge = flag.Duration("cache-max-age", 30*24*time.Hour, "remove cached tarballs unused for this long, 0 keeps them whatever their age")
+	cacheKeep = flag.Int("cache-keep", 0, "keep at most this many cached tarballs, removing the least recently used first; 0 for no limit")
+	cacheMaxSize = flag.String("cache-max-size", "", "largest the tarball cache in the patch dir may grow, e.g. 5G, removing the least recently used first")
+	patchRepo = flag.String("patch-repo", "", "comma-separated directories or globs, such as an NFS mount, searched for tarballs before any download")
+	sftpKey = flag.String("sftp-key", "", "SSH private key for sftp:// patch URLs")
+	sftpKnownHosts = flag.String("sftp-known-hosts", "", "known_hosts file with the host keys of sftp:// patch servers, ~/.ssh/known_hosts by default")
+	maxDownloadRate = flag.String("max-download-rate", "", "cap on tarball downloads in bytes per second, e.g. 500K or 20M, so prefetching doesn't starve live traffic")
+	progressInterval = flag.Duration("progress-interval", 10*time.Second, "how often to log progress and time left of a tarball download, 0 for never")
+	downloadChunks = flag.Int("download-chunks", 1, "download large tarballs in this many concurrent ranged requests, for high-latency links")
+	maxResultSize = flag.Int("max-result-size", defaultMaxResultSize, "largest result text in bytes sent with a portal update; longer output keeps its start and end")
+	fsyncExtracted = flag.Bool("fsync", false, "fsync extracted files and their directories before reporting a patch as extracted")
+	uploadFullResult = flag.Bool("upload-full-output", false, "upload the complete output, gzipped, when the result sent to the portal was truncated")
+	conflictingProcs = flag.String("conflicting-procs", defaultConflictingProcesses, "comma-separated regexps of processes (backups, scans, package managers) that defer patching")
+
+	// Allow "go-patcher stats -state-dir ..." as well as flags before the subcommand
+	args := flag.Args()
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		subcommand = os.Args[1]
+		flag.CommandLine.Usage = func() { printUsage(flag.CommandLine.Output(), subcommand) }
+		flag.CommandLine.Parse(os.Args[2:])
+		args = flag.Args()
+		// Flags may follow an action too, as in "go-patcher cache clean -dir ..."
+		if subcommand == "cache" && len(args) > 0 {
+			action := args[0]
+			flag.CommandLine.Parse(args[1:])
+			args = append([]string{action}, flag.Args()...)
+		}
+	} else {
+		flag.CommandLine.Usage = func() { printUsage(flag.CommandLine.Output(), "") }
+		flag.Parse()
+		subcommand = flag.Arg(0)
+		if len(flag.Args()) > 0 {
+			args = flag.Args()[1:]
+		}
+	}
+	commandArgs = args
+	// Help, the man page and completions work on hosts without a token
+	if handled, err := runHelpCommand(os.Stdout, subcommand, args); handled {
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+	if *tokenFile != "" {
+		secret, err := readSecretFile(*tokenFile)
+		if err != nil {
+			fmt.Println("Could not read token file: " + err.Error())
+			os.Exit(1)
+		}
+		*token = secret
+	}
 	if len(*token) < 1 {
 		fmt.Println("Please provide a valid security token")
 		os.Exit(1)
@@ -7,11 +7,15 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/ottenhoff/go-patcher/v2/archive"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestMain(m *testing.M) {
+	initParseCommandLineFlags()
 	flag.Set("token", "your-test-token")
+	// CI runners live in a cloud, keep their metadata out of the patch checks
+	flag.Set("cloud-metadata", "false")
 	os.Exit(m.Run())
 }
 
@@ -115,6 +119,22 @@ func TestUnrollTarball(t *testing.T) {
 				"components/sakai-provider-pack": 4,
 			},
 		},
+		{
+			name:    "XZ tarball",
+			tarball: "test.tar.xz",
+			format:  "xz",
+			expected: map[string]int{
+				"components/sakai-provider-pack": 4,
+			},
+		},
+		{
+			name:    "Bzip2 tarball",
+			tarball: "test.tar.bz2",
+			format:  "bzip2",
+			expected: map[string]int{
+				"components/sakai-provider-pack": 4,
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -210,3 +230,31 @@ func TestModifyPropertyFiles(t *testing.T) {
 	assert.Contains(t, string(localContent), "smtp.test=java")
 	assert.NotContains(t, string(localContent), "portal.cdn.version")
 }
+
+func TestCheckTomcatOwnership(t *testing.T) {
+	dir := t.TempDir()
+	catalina := filepath.Join(dir, "bin/catalina.sh")
+	os.MkdirAll(filepath.Dir(catalina), 0755)
+	os.WriteFile(catalina, []byte("#!/bin/sh\n"), 0755)
+	if err := os.Chown(catalina, 1234, 5678); err != nil {
+		t.Skip("needs root to give catalina.sh away: ", err)
+	}
+	defer func(uid uint32) { patcherUID, serverOwner = uid, nil }(patcherUID)
+
+	// Root patches on behalf of the server's user
+	patcherUID = 0
+	checkTomcatOwnership(dir)
+	assert.Equal(t, &archive.Owner{UID: 1234, GID: 5678}, serverOwner)
+
+	flag.Set("tar-owner", "true")
+	defer flag.Set("tar-owner", "false")
+	assert.True(t, useTarOwner())
+
+	// Anyone else must be the server's user
+	patcherUID = 1000
+	assert.Panics(t, func() { checkTomcatOwnership(dir) })
+	assert.False(t, useTarOwner())
+	patcherUID = 1234
+	checkTomcatOwnership(dir)
+	assert.Nil(t, serverOwner)
+}
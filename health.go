@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Health check types run once the server reports a clean startup.
+// JMX and smoke tests are operator scripts run as command checks.
+const (
+	checkLog     = "log"
+	checkHTTP    = "http"
+	checkCommand = "command"
+)
+
+// Ways to turn individual check results into one verdict
+const (
+	aggregateAll      = "all"      // every check must pass
+	aggregateWeighted = "weighted" // passing weight / total weight must reach the threshold
+	aggregateQuorum   = "quorum"   // at least threshold checks must pass (N of M)
+)
+
+var healthHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// healthCheck is one post-start check from the patch JSON
+type healthCheck struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Target   string  `json:"target"`            // log file, URL, or hook script name
+	Pattern  string  `json:"pattern,omitempty"` // regexp the log or HTTP body must contain
+	Weight   float64 `json:"weight,omitempty"`  // defaults to 1
+	Required bool    `json:"required,omitempty"`
+}
+
+// healthPolicy is the per-patch "health" object
+type healthPolicy struct {
+	Aggregation string        `json:"aggregation"`
+	Threshold   float64       `json:"threshold"`
+	Checks      []healthCheck `json:"checks"`
+}
+
+func (c healthCheck) label() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Type + " " + c.Target
+}
+
+func (c healthCheck) weight() float64 {
+	if c.Weight > 0 {
+		return c.Weight
+	}
+	return 1
+}
+
+// validate checks the policy when the patch is decoded, before anything is stopped
+func (p *healthPolicy) validate() []string {
+	var problems []string
+	switch p.Aggregation {
+	case "", aggregateAll:
+	case aggregateWeighted:
+		if p.Threshold <= 0 || p.Threshold > 1 {
+			problems = append(problems, "health.threshold must be between 0 and 1 for weighted aggregation")
+		}
+	case aggregateQuorum:
+		if p.Threshold < 1 || int(p.Threshold) > len(p.Checks) {
+			problems = append(problems, fmt.Sprintf("health.threshold must be between 1 and %d for quorum aggregation", len(p.Checks)))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("health.aggregation %q is unknown", p.Aggregation))
+	}
+	for i, check := range p.Checks {
+		switch check.Type {
+		case checkLog, checkHTTP, checkCommand:
+		default:
+			problems = append(problems, fmt.Sprintf("health.checks[%d].type %q is unknown", i, check.Type))
+		}
+		if check.Target == "" {
+			problems = append(problems, fmt.Sprintf("health.checks[%d].target is missing", i))
+		}
+		if _, err := regexp.Compile(check.Pattern); err != nil {
+			problems = append(problems, fmt.Sprintf("health.checks[%d].pattern is invalid: %v", i, err))
+		}
+	}
+	return problems
+}
+
+// healthVerdict aggregates check results. Required checks must pass whatever the policy.
+func healthVerdict(policy *healthPolicy, passed []bool) (bool, string) {
+	var passing, total, passingWeight, totalWeight float64
+	for i, check := range policy.Checks {
+		total++
+		totalWeight += check.weight()
+		if passed[i] {
+			passing++
+			passingWeight += check.weight()
+		} else if check.Required {
+			return false, "required check " + check.label() + " failed"
+		}
+	}
+
+	switch policy.Aggregation {
+	case aggregateWeighted:
+		score := passingWeight / totalWeight
+		return score >= policy.Threshold, fmt.Sprintf("weighted score %.2f, need %.2f", score, policy.Threshold)
+	case aggregateQuorum:
+		return passing >= policy.Threshold, fmt.Sprintf("%.0f of %.0f checks passed, need %.0f", passing, total, policy.Threshold)
+	}
+	return passing == total, fmt.Sprintf("%.0f of %.0f checks passed", passing, total)
+}
+
+// runHealthCheck runs one check from inside the server directory
+func runHealthCheck(check healthCheck, patchID string) error {
+	pattern := regexp.MustCompile(check.Pattern)
+	switch check.Type {
+	case checkLog:
+		input, err := os.ReadFile(check.Target)
+		if err != nil {
+			return err
+		}
+		if !pattern.Match(input) {
+			return errors.New("pattern not found in " + check.Target)
+		}
+	case checkHTTP:
+		resp, err := healthHTTPClient.Get(check.Target)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+		if resp.StatusCode >= 400 {
+			return errors.New("HTTP status " + resp.Status)
+		}
+		if !pattern.Match(body) {
+			return errors.New("pattern not found in response")
+		}
+	case checkCommand:
+		return runHookStep(check.Target, patchID)
+	}
+	return nil
+}
+
+// checkBatchHealth evaluates the health policy of every patch that shares a restart
+func checkBatchHealth(patches []*PatchResponse, patchIDs []string) error {
+	defer trackPhase("health")()
+
+	for _, patch := range patches {
+		if patch.Health == nil || len(patch.Health.Checks) == 0 || !containsString(patchIDs, patch.PatchID) {
+			continue
+		}
+
+		passed := make([]bool, len(patch.Health.Checks))
+		for i, check := range patch.Health.Checks {
+			err := runHealthCheck(check, patch.PatchID)
+			passed[i] = err == nil
+			if err != nil {
+				log.Warning("Health check ", check.label(), " for patch ", patch.PatchID, " failed: ", err)
+				outputBuffer.WriteString("Health check " + check.label() + " failed: " + err.Error() + "\n")
+			}
+		}
+
+		healthy, detail := healthVerdict(patch.Health, passed)
+		log.Info("Health verdict for patch ", patch.PatchID, ": ", detail)
+		outputBuffer.WriteString("Health verdict for patch " + patch.PatchID + ": " + detail + "\n")
+		if !healthy {
+			return errors.New("unhealthy after restart: " + strings.TrimSpace(detail))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthVerdict(t *testing.T) {
+	checks := []healthCheck{
+		{Name: "startup", Type: checkLog, Target: "logs/catalina.out", Required: true},
+		{Name: "portal", Type: checkHTTP, Target: "http://localhost:8080/portal", Weight: 3},
+		{Name: "jmx", Type: checkCommand, Target: "jmx-heap"},
+	}
+
+	testCases := []struct {
+		name    string
+		policy  healthPolicy
+		passed  []bool
+		healthy bool
+		detail  string
+	}{
+		{"All pass", healthPolicy{Checks: checks}, []bool{true, true, true}, true, "3 of 3 checks passed"},
+		{"All with one failure", healthPolicy{Checks: checks}, []bool{true, true, false}, false, "2 of 3 checks passed"},
+		{"Weighted ignores flaky optional check", healthPolicy{Aggregation: aggregateWeighted, Threshold: 0.75, Checks: checks}, []bool{true, true, false}, true, "weighted score 0.80, need 0.75"},
+		{"Weighted below threshold", healthPolicy{Aggregation: aggregateWeighted, Threshold: 0.75, Checks: checks}, []bool{true, false, true}, false, "weighted score 0.40, need 0.75"},
+		{"Quorum", healthPolicy{Aggregation: aggregateQuorum, Threshold: 2, Checks: checks}, []bool{true, false, true}, true, "2 of 3 checks passed, need 2"},
+		{"Required always wins", healthPolicy{Aggregation: aggregateQuorum, Threshold: 2, Checks: checks}, []bool{false, true, true}, false, "required check startup failed"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			healthy, detail := healthVerdict(&tc.policy, tc.passed)
+			assert.Equal(t, tc.healthy, healthy)
+			assert.Equal(t, tc.detail, detail)
+		})
+	}
+}
+
+func TestHealthPolicyValidate(t *testing.T) {
+	policy := healthPolicy{Aggregation: aggregateQuorum, Threshold: 3, Checks: []healthCheck{
+		{Type: "jmx", Target: "heap"},
+		{Type: checkLog, Pattern: "("},
+	}}
+	assert.Equal(t, []string{
+		"health.threshold must be between 1 and 2 for quorum aggregation",
+		`health.checks[0].type "jmx" is unknown`,
+		"health.checks[1].target is missing",
+		"health.checks[1].pattern is invalid: error parsing regexp: missing closing ): `(`",
+	}, policy.validate())
+}
+
+func TestRunHealthCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/portal" {
+			w.Write([]byte("<title>Sakai : Gateway</title>"))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	logFile := filepath.Join(t.TempDir(), "catalina.out")
+	os.WriteFile(logFile, []byte("INFO: Server startup in [95000] milliseconds\n"), 0644)
+
+	assert.NoError(t, runHealthCheck(healthCheck{Type: checkHTTP, Target: server.URL + "/portal", Pattern: "Gateway"}, "63547"))
+	assert.EqualError(t, runHealthCheck(healthCheck{Type: checkHTTP, Target: server.URL + "/direct"}, "63547"), "HTTP status 503 Service Unavailable")
+	assert.NoError(t, runHealthCheck(healthCheck{Type: checkLog, Target: logFile, Pattern: `startup in \[\d+\]`}, "63547"))
+	assert.Error(t, runHealthCheck(healthCheck{Type: checkLog, Target: logFile, Pattern: "SEVERE"}, "63547"))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const heartbeatPath = "/longsight/remote/agent/heartbeat"
+
+// serverBaseProperties are the system properties that give away a server's directory on its command line
+var serverBaseProperties = []string{"-Dcatalina.base=", "-Djetty.base=", "-Djboss.home.dir="}
+
+type heartbeatInstance struct {
+	Dir     string `json:"dir"`
+	Profile string `json:"profile"`
+	Running bool   `json:"running"`
+}
+
+// heartbeat tells the portal this node is alive and what it runs, between patch cycles
+type heartbeat struct {
+	Hostname        string              `json:"hostname"`
+	NodeID          string              `json:"node_id,omitempty"`
+	IPs             []string            `json:"ips"`
+	Version         string              `json:"version"`
+	Instances       []heartbeatInstance `json:"instances"`
+	IntervalSeconds int                 `json:"interval_seconds"`
+	Started         int64               `json:"started"`
+	Environment     string              `json:"environment"`
+}
+
+// daemonStarted is sent with heartbeats so the portal can spot restarts
+var daemonStarted = time.Now()
+
+// runHeartbeats posts a heartbeat to every portal each -heartbeat-interval until ctx ends.
+// It runs beside the patch cycles, so it never touches the per-run globals.
+func runHeartbeats(ctx context.Context, portals []*portalConfig) {
+	for {
+		for _, portal := range portals {
+			if err := sendHeartbeat(portal); err != nil {
+				log.Warning("Could not send heartbeat to portal ", portal.Name, ": ", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(*heartbeatInterval):
+		}
+	}
+}
+
+func sendHeartbeat(portal *portalConfig) error {
+	body, err := json.Marshal(buildHeartbeat(portal, runningServerDirs("/proc")))
+	if err != nil {
+		return err
+	}
+	return portal.withFailover(func() error {
+		req, err := http.NewRequest("POST", portal.endpoint(heartbeatPath), bytes.NewReader(body))
+		if err != nil {
+			return permanentError{err}
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", portal.authToken())
+		req.Header.Set("User-Agent", userAgent())
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return checkResponse(resp)
+	})
+}
+
+// buildHeartbeat lists the instances this portal manages here, see managedDirs
+func buildHeartbeat(portal *portalConfig, running map[string]bool) heartbeat {
+	hostname, _ := os.Hostname()
+	beat := heartbeat{Hostname: hostname, NodeID: *nodeID, Version: patcherVersion, IntervalSeconds: int(heartbeatInterval.Seconds()), Started: daemonStarted.Unix(), Environment: runtimeEnv}
+
+	if len(*localIP) > 3 {
+		beat.IPs = []string{*localIP}
+	} else if ips, err := externalIP(); err == nil {
+		var detected []string
+		json.Unmarshal([]byte(ips), &detected)
+		for _, ip := range detected {
+			if ip != "" {
+				beat.IPs = append(beat.IPs, ip)
+			}
+		}
+	}
+
+	registry := loadInstanceRegistry(*instancesFile)
+	for _, dir := range managedDirs(portal, registry, running) {
+		profile := registry.lookup(dir).Profile
+		beat.Instances = append(beat.Instances, heartbeatInstance{Dir: dir, Profile: profile, Running: running[dir]})
+	}
+	return beat
+}
+
+// managedDirs are the server directories this portal manages here: those in the
+// instance registry or the portal's instance list, plus any server found running
+func managedDirs(portal *portalConfig, registry *instanceRegistry, running map[string]bool) []string {
+	dirs := map[string]bool{}
+	for _, instance := range registry.Instances {
+		dirs[filepath.Clean(instance.Dir)] = true
+	}
+	for _, dir := range portal.Instances {
+		dirs[filepath.Clean(dir)] = true
+	}
+	for dir := range running {
+		dirs[dir] = true
+	}
+
+	var managed []string
+	for dir := range dirs {
+		if portal.servesInstance(dir) {
+			managed = append(managed, dir)
+		}
+	}
+	sort.Strings(managed)
+	return managed
+}
+
+// runningServerDirs finds the base directories of running Java servers from their command lines
+func runningServerDirs(procDir string) map[string]bool {
+	dirs := map[string]bool{}
+	cmdlines, _ := filepath.Glob(filepath.Join(procDir, "[0-9]*", "cmdline"))
+	for _, cmdline := range cmdlines {
+		raw, err := os.ReadFile(cmdline)
+		if err != nil {
+			continue
+		}
+		for _, arg := range strings.Split(string(raw), "\x00") {
+			for _, property := range serverBaseProperties {
+				if strings.HasPrefix(arg, property) && len(arg) > len(property) {
+					dirs[filepath.Clean(strings.TrimPrefix(arg, property))] = true
+				}
+			}
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunningServerDirs(t *testing.T) {
+	proc := t.TempDir()
+	os.MkdirAll(filepath.Join(proc, "101"), 0755)
+	os.WriteFile(filepath.Join(proc, "101", "cmdline"), []byte("/usr/bin/java\x00-Dcatalina.base=/opt/tomcat/\x00org.apache.catalina.startup.Bootstrap\x00start\x00"), 0644)
+	os.MkdirAll(filepath.Join(proc, "102"), 0755)
+	os.WriteFile(filepath.Join(proc, "102", "cmdline"), []byte("/usr/sbin/sshd\x00-D\x00"), 0644)
+	os.MkdirAll(filepath.Join(proc, "self"), 0755)
+
+	assert.Equal(t, map[string]bool{"/opt/tomcat": true}, runningServerDirs(proc))
+}
+
+func TestBuildHeartbeat(t *testing.T) {
+	registryPath := filepath.Join(t.TempDir(), "instances.yaml")
+	os.WriteFile(registryPath, []byte("instances:\n  - dir: /opt/jetty\n    profile: jetty\n  - dir: /opt/other\n"), 0644)
+	oldInstances, oldIP := *instancesFile, *localIP
+	*instancesFile, *localIP = registryPath, "10.0.0.5"
+	defer func() { *instancesFile, *localIP = oldInstances, oldIP }()
+
+	portal := &portalConfig{Name: "a", Instances: []string{"/opt/jetty", "/opt/tomcat"}}
+	beat := buildHeartbeat(portal, map[string]bool{"/opt/tomcat": true})
+	assert.Equal(t, []string{"10.0.0.5"}, beat.IPs)
+	assert.Equal(t, patcherVersion, beat.Version)
+	assert.Equal(t, []heartbeatInstance{
+		{Dir: "/opt/jetty", Profile: "jetty"},
+		{Dir: "/opt/tomcat", Profile: "tomcat", Running: true},
+	}, beat.Instances)
+}
+
+func TestSendHeartbeat(t *testing.T) {
+	var beat heartbeat
+	var token string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, heartbeatPath, r.URL.Path)
+		token = r.Header.Get("X-Auth-Token")
+		json.NewDecoder(r.Body).Decode(&beat)
+	}))
+	defer server.Close()
+
+	assert.NoError(t, sendHeartbeat(&portalConfig{Name: "a", URL: server.URL, Token: "secret"}))
+	assert.Equal(t, "secret", token)
+	hostname, _ := os.Hostname()
+	assert.Equal(t, hostname, beat.Hostname)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultStateDir = "/var/lib/go-patcher"
+const historyFileName = "history.jsonl"
+
+// runRecord is one line in the local run history
+type runRecord struct {
+	RunID         string                `json:"run_id,omitempty"`
+	Portal        string                `json:"portal,omitempty"`
+	PatchID       string                `json:"patch_id"`
+	TomcatDir     string                `json:"tomcat_dir"`
+	Started       time.Time             `json:"started"`
+	Result        string                `json:"result"`
+	StartupMillis int64                 `json:"startup_ms"`
+	DownloadBytes int64                 `json:"download_bytes"`
+	FilesWritten  int                   `json:"files_written,omitempty"`
+	Phases        map[string]float64    `json:"phases"`
+	Resources     map[string]phaseUsage `json:"resources,omitempty"`
+
+	// Results are each patch's own result, a batch's Result is its last patch's
+	Results map[string]string `json:"results,omitempty"`
+}
+
+// Timings for the current run, in seconds per phase
+var phaseTimings = map[string]float64{}
+
+// downloadedBytes is updated atomically, downloads run alongside the shutdown
+var downloadedBytes int64
+
+// phaseMu guards phaseTimings and phaseUsages, phases can overlap, see prefetchBatch
+var phaseMu sync.Mutex
+var runStarted = time.Now()
+
+// trackPhase starts timing a phase and measuring its footprint, see trackUsage.
+// Call the returned func when the phase is done.
+func trackPhase(phase string) func() {
+	start := time.Now()
+	doneUsage := trackUsage(phase)
+	doneSpan := startSpan(phase)
+	return func() {
+		doneSpan()
+		doneUsage()
+		phaseMu.Lock()
+		phaseTimings[phase] += time.Since(start).Seconds()
+		phaseMu.Unlock()
+		log.Debugf("Phase %s took %.1fs", phase, time.Since(start).Seconds())
+	}
+}
+
+func historyPath() string {
+	return filepath.Join(*stateDir, historyFileName)
+}
+
+// recordRun appends the current run to the local history and returns the
+// record. results are the result of each patch of a batch, if it had several.
+func recordRun(patchID string, tomcatDir string, rv string, startup string, results map[string]string) runRecord {
+	startupMillis, _ := strconv.ParseInt(startup, 10, 64)
+	filesWritten := 0
+	for _, written := range patchedFiles {
+		filesWritten += len(written)
+	}
+	record := runRecord{
+		RunID:         runID,
+		Portal:        activePortal.Name,
+		PatchID:       patchID,
+		TomcatDir:     tomcatDir,
+		Started:       runStarted,
+		Result:        rv,
+		Results:       results,
+		StartupMillis: startupMillis,
+		DownloadBytes: atomic.LoadInt64(&downloadedBytes),
+		FilesWritten:  filesWritten,
+		Phases:        phaseTimings,
+		Resources:     phaseUsages,
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Error("Could not encode run history: ", err)
+		return record
+	}
+	if err := os.MkdirAll(*stateDir, 0755); err != nil {
+		log.Error("Could not create state directory: ", *stateDir, err)
+		return record
+	}
+	file, err := os.OpenFile(historyPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Error("Could not open run history: ", err)
+		return record
+	}
+	defer file.Close()
+	file.Write(append(line, '\n'))
+	return record
+}
+
+// loadHistory reads every recorded run, oldest first
+func loadHistory(historyFile string) ([]runRecord, error) {
+	file, err := os.Open(historyFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []runRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record runRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Warning("Skipping unreadable history line: ", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Started.Before(records[j].Started) })
+	return records, scanner.Err()
+}
+
+// runTrend summarizes a set of runs
+type runTrend struct {
+	Runs            int
+	MedianStartup   float64 // seconds
+	MedianDownload  float64 // MB/s
+	FailureRate     float64 // percent
+	MedianPhaseSecs map[string]float64
+}
+
+func summarizeRuns(records []runRecord) runTrend {
+	trend := runTrend{Runs: len(records), MedianPhaseSecs: map[string]float64{}}
+	if len(records) == 0 {
+		return trend
+	}
+
+	var startups, speeds []float64
+	phases := map[string][]float64{}
+	failures := 0
+	for _, record := range records {
+		if record.Result == tomcatDown || record.Result == tomcatNoShutdown {
+			failures++
+		}
+		if record.StartupMillis > 0 {
+			startups = append(startups, float64(record.StartupMillis)/1000)
+		}
+		if downloadSecs := record.Phases["download"]; record.DownloadBytes > 0 && downloadSecs > 0 {
+			speeds = append(speeds, float64(record.DownloadBytes)/downloadSecs/1024/1024)
+		}
+		for phase, secs := range record.Phases {
+			phases[phase] = append(phases[phase], secs)
+		}
+	}
+
+	trend.MedianStartup = median(startups)
+	trend.MedianDownload = median(speeds)
+	trend.FailureRate = float64(failures) * 100 / float64(len(records))
+	for phase, secs := range phases {
+		trend.MedianPhaseSecs[phase] = median(secs)
+	}
+	return trend
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// printStats writes the trends for the stats subcommand
+func printStats(w io.Writer, records []runRecord, window int) {
+	if len(records) == 0 {
+		fmt.Fprintln(w, "No patch runs recorded in", historyPath())
+		return
+	}
+
+	fmt.Fprintf(w, "Runs recorded: %d (%s .. %s)\n\n", len(records),
+		records[0].Started.Format("2006-01-02"), records[len(records)-1].Started.Format("2006-01-02"))
+
+	// Compare the most recent runs against the ones before them
+	recent := records[max(0, len(records)-window):]
+	prior := records[max(0, len(records)-2*window):max(0, len(records)-window)]
+	columns := []runTrend{summarizeRuns(records), summarizeRuns(recent), summarizeRuns(prior)}
+	fmt.Fprintf(w, "%-24s %10s %10s %10s\n", "", "all", "last "+strconv.Itoa(window), "prior "+strconv.Itoa(window))
+	fmt.Fprintf(w, "%-24s %10d %10d %10d\n", "Runs", columns[0].Runs, columns[1].Runs, columns[2].Runs)
+	fmt.Fprintf(w, "%-24s %10.1f %10.1f %10.1f\n", "Median startup (s)", columns[0].MedianStartup, columns[1].MedianStartup, columns[2].MedianStartup)
+	fmt.Fprintf(w, "%-24s %10.2f %10.2f %10.2f\n", "Median download (MB/s)", columns[0].MedianDownload, columns[1].MedianDownload, columns[2].MedianDownload)
+	fmt.Fprintf(w, "%-24s %9.1f%% %9.1f%% %9.1f%%\n", "Failure rate", columns[0].FailureRate, columns[1].FailureRate, columns[2].FailureRate)
+
+	var phaseNames []string
+	for phase := range columns[0].MedianPhaseSecs {
+		phaseNames = append(phaseNames, phase)
+	}
+	sort.Strings(phaseNames)
+	for _, phase := range phaseNames {
+		fmt.Fprintf(w, "%-24s %10.1f %10.1f %10.1f\n", "Median "+phase+" (s)",
+			columns[0].MedianPhaseSecs[phase], columns[1].MedianPhaseSecs[phase], columns[2].MedianPhaseSecs[phase])
+	}
+
+	// Month by month so slow degradation stands out
+	fmt.Fprintf(w, "\n%-10s %6s %10s %12s %14s\n", "Month", "Runs", "Failures", "Startup (s)", "Download MB/s")
+	var month []runRecord
+	for i, record := range records {
+		month = append(month, record)
+		if i == len(records)-1 || records[i+1].Started.Format("2006-01") != record.Started.Format("2006-01") {
+			trend := summarizeRuns(month)
+			fmt.Fprintf(w, "%-10s %6d %9.1f%% %12.1f %14.2f\n", record.Started.Format("2006-01"),
+				trend.Runs, trend.FailureRate, trend.MedianStartup, trend.MedianDownload)
+			month = nil
+		}
+	}
+}
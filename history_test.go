@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordAndLoadHistory(t *testing.T) {
+	*stateDir = t.TempDir()
+	defer func() { *stateDir = defaultStateDir }()
+
+	phaseTimings = map[string]float64{"download": 4, "stop": 30}
+	downloadedBytes = 8 * 1024 * 1024
+	defer func() { phaseTimings, downloadedBytes = map[string]float64{}, 0 }()
+
+	recordRun("63547", "/opt/tomcat", patchSuccess, "95000", nil)
+	recordRun("63548,63549", "/opt/tomcat", tomcatDown, "-1", map[string]string{"63548": patchSuccess, "63549": tomcatDown})
+
+	records, err := loadHistory(historyPath())
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "63547", records[0].PatchID)
+	assert.Equal(t, int64(95000), records[0].StartupMillis)
+	assert.Equal(t, 30.0, records[1].Phases["stop"])
+	assert.Equal(t, map[string]string{"63548": patchSuccess, "63549": tomcatDown}, records[1].Results)
+
+	trend := summarizeRuns(records)
+	assert.Equal(t, 95.0, trend.MedianStartup)
+	assert.Equal(t, 2.0, trend.MedianDownload)
+	assert.Equal(t, 50.0, trend.FailureRate)
+}
+
+func TestPrintStats(t *testing.T) {
+	jan := time.Date(2024, 1, 15, 3, 0, 0, 0, time.UTC)
+	feb := time.Date(2024, 2, 15, 3, 0, 0, 0, time.UTC)
+	records := []runRecord{
+		{Started: jan, Result: patchSuccess, StartupMillis: 90000},
+		{Started: jan.Add(time.Hour), Result: patchSuccess, StartupMillis: 100000},
+		{Started: feb, Result: tomcatDown, StartupMillis: -1},
+		{Started: feb.Add(time.Hour), Result: patchSuccess, StartupMillis: 200000},
+	}
+
+	var out bytes.Buffer
+	printStats(&out, records, 2)
+	assert.Contains(t, out.String(), "Runs recorded: 4 (2024-01-15 .. 2024-02-15)")
+	assert.Regexp(t, `Median startup \(s\)\s+100.0\s+200.0\s+95.0`, out.String())
+	assert.Regexp(t, `Failure rate\s+25.0%\s+50.0%\s+0.0%`, out.String())
+	assert.Regexp(t, `2024-02\s+2\s+50.0%\s+200.0`, out.String())
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultInstancesFile = "/etc/go-patcher/instances.yaml"
+
+// instanceConfig describes one Java server on this host
+type instanceConfig struct {
+	Dir           string   `yaml:"dir"`
+	Profile       string   `yaml:"profile"`
+	Service       string   `yaml:"service"`
+	Script        string   `yaml:"script"`
+	Log           string   `yaml:"log"`
+	PropertiesDir string   `yaml:"properties_dir"`
+	Controller    string   `yaml:"controller"`
+	ResultDetail  string   `yaml:"result_detail"`
+	Tags          []string `yaml:"tags"`
+	ReadinessURL  string   `yaml:"readiness_url"`
+
+	// ConfigURL takes feature flags at runtime, authenticated with the token in ConfigTokenFile
+	ConfigURL       string `yaml:"config_url"`
+	ConfigTokenFile string `yaml:"config_token_file"`
+}
+
+// activeInstance is the registry entry of the instance being patched
+var activeInstance instanceConfig
+
+// instanceRegistry maps server directories to deployment profiles.
+// Directories missing from the registry are treated as Tomcat.
+type instanceRegistry struct {
+	Instances []instanceConfig `yaml:"instances"`
+}
+
+func loadInstanceRegistry(registryPath string) *instanceRegistry {
+	registry := &instanceRegistry{}
+	input, err := os.ReadFile(registryPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning("Could not read instance registry: ", registryPath, err)
+		}
+		return registry
+	}
+	if err := yaml.Unmarshal(input, registry); err != nil {
+		panic("Could not parse instance registry " + registryPath + ": " + err.Error())
+	}
+	return registry
+}
+
+// lookup finds the registry entry for a server directory
+func (r *instanceRegistry) lookup(dir string) instanceConfig {
+	for _, instance := range r.Instances {
+		if filepath.Clean(instance.Dir) == filepath.Clean(dir) {
+			return instance
+		}
+	}
+	return instanceConfig{Dir: dir, Profile: "tomcat"}
+}
+
+// profileFor builds the deployment profile for an instance
+func profileFor(instance instanceConfig) (serverProfile, error) {
+	switch instance.Profile {
+	case "", "tomcat":
+		return tomcatProfile{}, nil
+	case "jetty":
+		return newJettyProfile(instance), nil
+	case "wildfly", "jboss":
+		return newWildflyProfile(instance), nil
+	}
+	return nil, fmt.Errorf("unknown profile %q for %s", instance.Profile, instance.Dir)
+}
@@ -0,0 +1,149 @@
+//go:build integration
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestIntegration applies a sample patch to a real Tomcat in Docker through the
+// whole pipeline: claim, stop, properties, extract, start, verify, report.
+// Run it with "make integration"; it needs Docker and takes a couple of minutes.
+func TestIntegration(t *testing.T) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is not installed")
+	}
+
+	// Build the patcher for the container and the image around it
+	context := t.TempDir()
+	build := exec.Command("go", "build", "-o", filepath.Join(context, "go-patcher"), ".")
+	build.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS=linux")
+	dockerRun(t, build)
+	image := "go-patcher-integration"
+	dockerRun(t, exec.Command("docker", "build", "-t", image, "-f", "integration/Dockerfile", context))
+
+	portal := newIntegrationPortal(t)
+	defer portal.Close()
+
+	container := fmt.Sprintf("go-patcher-integration-%d", time.Now().UnixNano())
+	dockerRun(t, exec.Command("docker", "run", "-d", "--rm", "--network", "host", "--name", container, image))
+	defer exec.Command("docker", "rm", "-f", container).Run()
+
+	out, err := exec.Command("docker", "exec", container, "go-patcher",
+		"-portal", portal.URL, "-token", "integration-token", "-ip", "10.9.8.7", "-log", "debug",
+		"-retries", "1", "-dir", "/tmp", "-state-dir", "/var/lib/go-patcher").CombinedOutput()
+	t.Log(string(out))
+	assert.NoError(t, err, "patcher exited with an error")
+
+	// The portal heard about the claim and the success, in that order
+	assert.Equal(t, []string{inProgress, patchSuccess}, portal.results("90001"))
+
+	extracted, err := exec.Command("docker", "exec", container, "cat", "/usr/local/tomcat/webapps/ROOT/integration.txt").Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "patched by the integration test\n", string(extracted))
+
+	properties, err := exec.Command("docker", "exec", container, "cat", "/usr/local/tomcat/sakai/sakai.properties").Output()
+	assert.NoError(t, err)
+	assert.Contains(t, string(properties), "\nintegration.test=yes")
+	assert.Contains(t, string(properties), "\nportal.cdn.version=001")
+
+	served, err := exec.Command("docker", "exec", container, "curl", "-sf", "http://127.0.0.1:8080/integration.txt").Output()
+	assert.NoError(t, err, "Tomcat serves the patched webapp")
+	assert.Equal(t, string(extracted), string(served))
+}
+
+func dockerRun(t *testing.T, cmd *exec.Cmd) {
+	t.Helper()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s failed: %v\n%s", strings.Join(cmd.Args, " "), err, out)
+	}
+}
+
+// integrationPortal offers one patch, then records what the patcher reports back
+type integrationPortal struct {
+	*httptest.Server
+	mu      sync.Mutex
+	offered bool
+	updates []url.Values
+}
+
+func newIntegrationPortal(t *testing.T) *integrationPortal {
+	tarball := sampleTarball(t)
+	portal := &integrationPortal{}
+	portal.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		portal.mu.Lock()
+		defer portal.mu.Unlock()
+
+		switch r.URL.Path {
+		case patchesPath:
+			if portal.offered {
+				return
+			}
+			portal.offered = true
+			fmt.Fprintf(w, `{"patch_id": "90001", "tomcat_dir": "/usr/local/tomcat", "files": "%s/patch.tar.gz", "sakaiprops": "integration.test=yes"}`, portal.URL)
+		case updatePath:
+			r.ParseForm()
+			portal.updates = append(portal.updates, r.PostForm)
+		case "/patch.tar.gz":
+			w.Write(tarball)
+		case leasePath:
+		default:
+			// Kill switch and anything newer than this test
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	// The container shares the host network, so loopback reaches the test
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	portal.Listener = listener
+	portal.Start()
+	return portal
+}
+
+func (p *integrationPortal) results(patchID string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var results []string
+	for _, update := range p.updates {
+		if update.Get("patch_id") == patchID {
+			results = append(results, update.Get("result_value"))
+		}
+	}
+	return results
+}
+
+// sampleTarball is a one-file webapp
+func sampleTarball(t *testing.T) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	content := []byte("patched by the integration test\n")
+	for _, dir := range []string{"webapps/", "webapps/ROOT/"} {
+		tw.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755})
+	}
+	tw.WriteHeader(&tar.Header{Name: "webapps/ROOT/integration.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+	tw.Write(content)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const inventoryPath = "/longsight/remote/agent/inventory"
+
+// javaVersionPattern matches the first line of java -version: openjdk version "17.0.9" 2023-10-17
+var javaVersionPattern = regexp.MustCompile(`version "([^"]+)"`)
+
+// hostInventory is what the portal needs to target patches at compatible hosts
+type hostInventory struct {
+	Hostname          string              `json:"hostname"`
+	OSRelease         string              `json:"os_release"`
+	MemTotalBytes     uint64              `json:"mem_total_bytes"`
+	MemAvailableBytes uint64              `json:"mem_available_bytes"`
+	Instances         []instanceInventory `json:"instances"`
+}
+
+type instanceInventory struct {
+	Dir           string `json:"dir"`
+	Profile       string `json:"profile"`
+	JavaVersion   string `json:"java_version"`
+	TomcatVersion string `json:"tomcat_version,omitempty"`
+	SakaiVersion  string `json:"sakai_version"`
+	DiskFreeBytes uint64 `json:"disk_free_bytes"`
+}
+
+// collectInventory describes this host and the given server directories
+func collectInventory(dirs []string) hostInventory {
+	hostname, _ := os.Hostname()
+	inventory := hostInventory{Hostname: hostname, OSRelease: osRelease("/etc/os-release")}
+	inventory.MemTotalBytes, inventory.MemAvailableBytes = memoryInfo("/proc/meminfo")
+
+	registry := loadInstanceRegistry(*instancesFile)
+	for _, dir := range dirs {
+		instance := registry.lookup(dir)
+		profile, err := profileFor(instance)
+		if err != nil {
+			log.Warning(err)
+			continue
+		}
+		inventory.Instances = append(inventory.Instances, inspectInstance(dir, profile))
+	}
+	return inventory
+}
+
+func inspectInstance(dir string, profile serverProfile) instanceInventory {
+	found := instanceInventory{Dir: dir, Profile: profile.name()}
+
+	javaHome := setenvValue(dir, "JAVA_HOME")
+	java := "java"
+	if javaHome != "" {
+		java = filepath.Join(javaHome, "bin", "java")
+	}
+	found.JavaVersion = javaVersion(java)
+
+	if profile.name() == "tomcat" {
+		catalinaHome := setenvValue(dir, "CATALINA_HOME")
+		if catalinaHome == "" {
+			catalinaHome = dir
+		}
+		found.TomcatVersion = tomcatVersion(filepath.Join(catalinaHome, "lib", "catalina.jar"))
+	}
+
+	for _, propertyFile := range propertyFiles {
+		input, err := os.ReadFile(filepath.Join(dir, profile.propertyDir(), propertyFile))
+		if err != nil {
+			continue
+		}
+		if values := parseProperties(string(input))["version.sakai"]; len(values) > 0 {
+			found.SakaiVersion = values[len(values)-1]
+		}
+	}
+
+	if free, err := diskFree(dir); err == nil {
+		found.DiskFreeBytes = uint64(free)
+	}
+	return found
+}
+
+// setenvValue reads a variable from bin/setenv.sh, like checkForUnnecessaryJars does for CATALINA_HOME
+func setenvValue(dir string, name string) string {
+	input, err := os.ReadFile(filepath.Join(dir, "bin", "setenv.sh"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(input), "\n") {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "export ")
+		if value, ok := strings.CutPrefix(line, name+"="); ok {
+			return strings.Trim(value, "\"' ")
+		}
+	}
+	return ""
+}
+
+func javaVersion(java string) string {
+	out, err := exec.Command(java, "-version").CombinedOutput()
+	if err != nil {
+		return ""
+	}
+	if match := javaVersionPattern.FindSubmatch(out); match != nil {
+		return string(match[1])
+	}
+	return ""
+}
+
+// tomcatVersion reads server.number from ServerInfo.properties inside catalina.jar
+func tomcatVersion(catalinaJar string) string {
+	reader, err := zip.OpenReader(catalinaJar)
+	if err != nil {
+		return ""
+	}
+	defer reader.Close()
+	for _, file := range reader.File {
+		if file.Name != "org/apache/catalina/util/ServerInfo.properties" {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return ""
+		}
+		defer rc.Close()
+		input, err := io.ReadAll(io.LimitReader(rc, 64*1024))
+		if err != nil {
+			return ""
+		}
+		if values := parseProperties(string(input))["server.number"]; len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// osRelease is PRETTY_NAME from os-release, e.g. "Ubuntu 22.04.3 LTS"
+func osRelease(path string) string {
+	input, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(input), "\n") {
+		if value, ok := strings.CutPrefix(line, "PRETTY_NAME="); ok {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// memoryInfo returns MemTotal and MemAvailable in bytes
+func memoryInfo(path string) (total uint64, available uint64) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb * 1024
+		case "MemAvailable:":
+			available = kb * 1024
+		}
+	}
+	return total, available
+}
+
+// inventorySummary encodes the inventory of the instance being patched for the portal result
+func inventorySummary() string {
+	if activeInstance.Dir == "" {
+		return ""
+	}
+	encoded, err := json.Marshal(collectInventory([]string{activeInstance.Dir}))
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// runInventory is the inventory subcommand: it prints the inventory of every
+// portal's instances and sends it to that portal
+func runInventory(portals []*portalConfig) error {
+	running := runningServerDirs("/proc")
+	registry := loadInstanceRegistry(*instancesFile)
+	var failed error
+	for _, portal := range portals {
+		inventory := collectInventory(managedDirs(portal, registry, running))
+		body, err := json.MarshalIndent(inventory, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("# portal %s\n%s\n", portal.Name, body)
+
+		err = portal.withFailover(func() error {
+			req, err := http.NewRequest("POST", portal.endpoint(inventoryPath), bytes.NewReader(body))
+			if err != nil {
+				return permanentError{err}
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Auth-Token", portal.authToken())
+			req.Header.Set("User-Agent", userAgent())
+			client := &http.Client{Timeout: 30 * time.Second}
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			return checkResponse(resp)
+		})
+		if err != nil {
+			log.Error("Could not send inventory to portal ", portal.Name, ": ", err)
+			failed = err
+		}
+	}
+	return failed
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspectInstance(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "bin"), 0755)
+	os.MkdirAll(filepath.Join(dir, "lib"), 0755)
+	os.MkdirAll(filepath.Join(dir, "sakai"), 0755)
+	os.WriteFile(filepath.Join(dir, "bin/setenv.sh"), []byte("export JAVA_HOME=\""+filepath.Join(dir, "jdk")+"\"\n"), 0755)
+	os.WriteFile(filepath.Join(dir, "sakai/sakai.properties"), []byte("version.sakai=23.1\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "sakai/local.properties"), []byte("version.sakai=23.2\n"), 0644)
+
+	// A fake java that prints like OpenJDK does
+	os.MkdirAll(filepath.Join(dir, "jdk/bin"), 0755)
+	os.WriteFile(filepath.Join(dir, "jdk/bin/java"), []byte("#!/bin/sh\necho 'openjdk version \"17.0.9\" 2023-10-17' >&2\n"), 0755)
+
+	jar, _ := os.Create(filepath.Join(dir, "lib/catalina.jar"))
+	writer := zip.NewWriter(jar)
+	info, _ := writer.Create("org/apache/catalina/util/ServerInfo.properties")
+	info.Write([]byte("server.info=Apache Tomcat/9.0.80\nserver.number=9.0.80.0\n"))
+	writer.Close()
+	jar.Close()
+
+	found := inspectInstance(dir, tomcatProfile{})
+	assert.Equal(t, "17.0.9", found.JavaVersion)
+	assert.Equal(t, "9.0.80.0", found.TomcatVersion)
+	assert.Equal(t, "23.2", found.SakaiVersion)
+	assert.NotZero(t, found.DiskFreeBytes)
+}
+
+func TestHostInfo(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "os-release"), []byte("NAME=\"Ubuntu\"\nPRETTY_NAME=\"Ubuntu 22.04.3 LTS\"\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "meminfo"), []byte("MemTotal:       16314204 kB\nMemFree:         1024 kB\nMemAvailable:    8157102 kB\n"), 0644)
+
+	assert.Equal(t, "Ubuntu 22.04.3 LTS", osRelease(filepath.Join(dir, "os-release")))
+	total, available := memoryInfo(filepath.Join(dir, "meminfo"))
+	assert.Equal(t, uint64(16314204*1024), total)
+	assert.Equal(t, uint64(8157102*1024), available)
+}
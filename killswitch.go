@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const pausePath = "/longsight/json/patches/paused"
+
+// pauseStatus is the portal's fleet-wide kill switch
+type pauseStatus struct {
+	Paused bool   `json:"paused"`
+	Reason string `json:"reason"`
+}
+
+// patchingPaused checks the kill switch right before anything destructive happens.
+// A pause can arrive in the patch JSON or from the pause endpoint. If the endpoint
+// can't be reached we stay paused, since the switch only matters in an emergency;
+// portals that don't have the endpoint yet answer 404 and don't pause anything.
+func patchingPaused(patches []*PatchResponse) (bool, string) {
+	for _, patch := range patches {
+		if patch.Paused {
+			return true, "patch " + patch.PatchID + " was sent with paused set"
+		}
+	}
+
+	var status *pauseStatus
+	err := activePortal.withFailover(func() (err error) {
+		status, err = fetchPauseStatus()
+		return err
+	})
+	if err != nil {
+		log.Warning("Could not check the portal kill switch: ", err)
+		return true, "could not check the portal kill switch: " + err.Error()
+	}
+	if status.Paused {
+		return true, "portal has paused all patching: " + status.Reason
+	}
+	return false, ""
+}
+
+func fetchPauseStatus() (*pauseStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", activePortal.endpoint(pausePath), nil)
+	if err != nil {
+		return nil, err
+	}
+	setPortalHeaders(req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &pauseStatus{}, nil
+	}
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	status := &pauseStatus{}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, status); err != nil {
+		return nil, errors.New("kill switch response is not JSON: " + err.Error())
+	}
+	return status, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatchingPaused(t *testing.T) {
+	var status int
+	var body string
+	var down bool
+	http.DefaultClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if down {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+	})
+	defer func() { http.DefaultClient.Transport = nil }()
+	batch := []*PatchResponse{{PatchID: "63547"}}
+
+	status, body = http.StatusOK, `{"paused": false}`
+	paused, _ := patchingPaused(batch)
+	assert.False(t, paused)
+
+	status, body = http.StatusOK, `{"paused": true, "reason": "bad release 23.4"}`
+	paused, reason := patchingPaused(batch)
+	assert.True(t, paused)
+	assert.Equal(t, "portal has paused all patching: bad release 23.4", reason)
+
+	status, body = http.StatusNotFound, ""
+	paused, _ = patchingPaused(batch)
+	assert.False(t, paused, "older portals without the endpoint")
+
+	down = true
+	paused, _ = patchingPaused(batch)
+	assert.True(t, paused, "unreachable kill switch stays paused")
+
+	paused, reason = patchingPaused([]*PatchResponse{{PatchID: "63548", Paused: true}})
+	assert.True(t, paused)
+	assert.Equal(t, "patch 63548 was sent with paused set", reason)
+}
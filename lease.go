@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const leasePath = "/longsight/remote/patch/lease"
+
+// leaseSeconds is how long the portal should trust an inProgress claim
+// without hearing from us. Missing two renewals in a row still leaves slack.
+func leaseSeconds() string {
+	return strconv.Itoa(int((3 * *leaseInterval).Seconds()))
+}
+
+// startLeaseHeartbeat renews the claim on the patches every -lease-interval
+// until the returned func is called, so the portal can tell a slow Tomcat
+// restart from a patcher that crashed and reassign abandoned patches.
+func startLeaseHeartbeat(patchIDs []string) func() {
+	if *leaseInterval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(*leaseInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				renewLease(patchIDs)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+// renewLease sends a single renewal. A missed one is only logged, the next tick tries again.
+func renewLease(patchIDs []string) {
+	hostname, _ := os.Hostname()
+	urlValues := url.Values{"patch_id": {strings.Join(patchIDs, ",")}, "lease_seconds": {leaseSeconds()},
+		"host": {hostname}, "pid": {strconv.Itoa(os.Getpid())}, "run_id": {runID},
+		"last_attempt": {strconv.FormatInt(time.Now().Unix(), 10)}}
+
+	err := activePortal.withFailover(func() error {
+		resp, err := postPortalForm(leasePath, urlValues)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return checkResponse(resp)
+	})
+	if err != nil {
+		log.Warning("Could not renew lease on patches ", urlValues.Get("patch_id"), ": ", err)
+		return
+	}
+	log.Debug("Renewed lease on patches ", urlValues.Get("patch_id"))
+}
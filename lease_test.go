@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaseHeartbeat(t *testing.T) {
+	*leaseInterval = 10 * time.Millisecond
+	defer func() { *leaseInterval = time.Minute }()
+
+	var mu sync.Mutex
+	var renewals []string
+	http.DefaultClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req.ParseForm()
+		mu.Lock()
+		renewals = append(renewals, req.URL.String()+" "+req.PostForm.Get("patch_id")+" "+req.PostForm.Get("lease_seconds"))
+		mu.Unlock()
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+	})
+	defer func() { http.DefaultClient.Transport = nil }()
+
+	stop := startLeaseHeartbeat([]string{"63547", "63548"})
+	time.Sleep(55 * time.Millisecond)
+	stop()
+	stop()
+
+	mu.Lock()
+	sent := len(renewals)
+	assert.GreaterOrEqual(t, sent, 2)
+	assert.Equal(t, activePortal.endpoint(leasePath)+" 63547,63548 0", renewals[0])
+	mu.Unlock()
+
+	time.Sleep(30 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, sent, len(renewals), "no renewals after stop")
+	mu.Unlock()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// manifestHashes is sent to the portal with a successful result, per patch ID
+var manifestHashes = map[string]string{}
+
+func manifestPath(patchID string) string {
+	return filepath.Join(*stateDir, "manifests", patchID+".sha256")
+}
+
+// writeManifest records a checksum of every file a patch's tarballs wrote, in
+// sha256sum format so `sha256sum -c` works from the server dir. Property files
+// are left out since operators legitimately edit them between patches.
+// It returns the hash of the manifest itself as the host's fingerprint of the patch.
+func writeManifest(patchID string, files []string) (string, error) {
+	unique := map[string]bool{}
+	for _, file := range files {
+		unique[filepath.ToSlash(filepath.Clean(file))] = true
+	}
+	sorted := make([]string, 0, len(unique))
+	for file := range unique {
+		sorted = append(sorted, file)
+	}
+	sort.Strings(sorted)
+
+	var manifest strings.Builder
+	for _, file := range sorted {
+		sum, err := fileChecksum(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&manifest, "%s  %s\n", sum, file)
+	}
+
+	path := manifestPath(patchID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path+".tmp", []byte(manifest.String()), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(manifest.String()))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func fileChecksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
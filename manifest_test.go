@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteManifest(t *testing.T) {
+	*stateDir = t.TempDir()
+	defer func() { *stateDir = defaultStateDir }()
+
+	serverDir := t.TempDir()
+	originalWd, _ := os.Getwd()
+	os.Chdir(serverDir)
+	defer os.Chdir(originalWd)
+
+	os.MkdirAll("webapps", 0755)
+	os.WriteFile("webapps/portal.war", []byte("portal"), 0644)
+	os.WriteFile("webapps/lessonbuilder.war", []byte("lessons"), 0644)
+
+	hash, err := writeManifest("63547", []string{"webapps/portal.war", "webapps/lessonbuilder.war", "./webapps/portal.war"})
+	assert.NoError(t, err)
+	assert.Len(t, hash, 64)
+
+	manifest, _ := os.ReadFile(filepath.Join(*stateDir, "manifests", "63547.sha256"))
+	assert.Equal(t, "314a6b49660562c305aaf89d981ea92f18a3437a693de65b674b6dacfcebfbe1  webapps/lessonbuilder.war\n"+
+		"d0960501f8971be812f2e5494426e08cdbb2cbc3b3190ba60075f14b8da7178a  webapps/portal.war\n", string(manifest))
+
+	again, _ := writeManifest("63547", []string{"webapps/lessonbuilder.war", "webapps/portal.war"})
+	assert.Equal(t, hash, again, "fingerprint does not depend on order")
+
+	_, err = writeManifest("63548", []string{"webapps/missing.war"})
+	assert.Error(t, err)
+}
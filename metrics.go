@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// metricsContentType is the Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4"
+
+// exportMetrics publishes a finished run for dashboards of patch durations and
+// failure rates: as a node_exporter textfile, to a pushgateway, or both
+func exportMetrics(record runRecord) {
+	if *metricsTextfileDir == "" && *pushgatewayURL == "" {
+		return
+	}
+	metrics := formatMetrics(record)
+	if *metricsTextfileDir != "" {
+		if err := writeMetricsTextfile(*metricsTextfileDir, record.TomcatDir, metrics); err != nil {
+			log.Warning("Could not write metrics textfile: ", err)
+		}
+	}
+	if *pushgatewayURL != "" {
+		if err := pushMetrics(*pushgatewayURL, record.TomcatDir, metrics); err != nil {
+			log.Warning("Could not push metrics: ", err)
+		}
+	}
+}
+
+// formatMetrics renders the run in the text exposition format. Every series
+// carries the server dir and portal, so one host with several servers works.
+func formatMetrics(record runRecord) []byte {
+	var out bytes.Buffer
+	labels := `tomcat_dir="` + labelValue(record.TomcatDir) + `",portal="` + labelValue(record.Portal) + `"`
+	gauge := func(name string, help string, series ...[2]string) {
+		fmt.Fprintf(&out, "# HELP go_patcher_%s %s\n# TYPE go_patcher_%s gauge\n", name, help, name)
+		for _, s := range series {
+			fmt.Fprintf(&out, "go_patcher_%s{%s%s} %s\n", name, labels, s[0], s[1])
+		}
+	}
+	number := func(value float64) string { return strconv.FormatFloat(value, 'g', -1, 64) }
+
+	var phases []string
+	for phase := range record.Phases {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	var phaseSeries [][2]string
+	for _, phase := range phases {
+		phaseSeries = append(phaseSeries, [2]string{`,phase="` + labelValue(phase) + `"`, number(record.Phases[phase])})
+	}
+	if len(phaseSeries) > 0 {
+		gauge("phase_seconds", "Seconds spent in each phase of the last run.", phaseSeries...)
+	}
+
+	gauge("download_bytes", "Bytes downloaded by the last run.", [2]string{"", strconv.FormatInt(record.DownloadBytes, 10)})
+	gauge("files_extracted", "Files written from tarballs by the last run.", [2]string{"", strconv.Itoa(record.FilesWritten)})
+	if record.StartupMillis > 0 {
+		gauge("startup_seconds", "Seconds the server took to start in the last run.", [2]string{"", number(float64(record.StartupMillis) / 1000)})
+	}
+	// The legacy result value: 0 deferred, 1 succeeded, 2 server down, 4 server would not stop
+	gauge("result_code", "Result value of the last run.", [2]string{"", record.Result})
+	success := "0"
+	if record.Result == patchSuccess {
+		success = "1"
+	}
+	gauge("last_run_success", "1 if the last run succeeded.", [2]string{"", success})
+	gauge("last_run_timestamp_seconds", "When the last run started.", [2]string{"", strconv.FormatInt(record.Started.Unix(), 10)})
+	gauge("run_duration_seconds", "Wall clock time of the last run.", [2]string{"", number(time.Since(record.Started).Round(time.Millisecond).Seconds())})
+	return out.Bytes()
+}
+
+// labelValue escapes a label value for the text format
+func labelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// writeMetricsTextfile replaces the server's .prom file atomically, so
+// node_exporter never reads half a file
+func writeMetricsTextfile(dir string, tomcatDir string, metrics []byte) error {
+	name := "go_patcher" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, tomcatDir) + ".prom"
+
+	tmp, err := os.CreateTemp(dir, ".go_patcher-*.prom.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(metrics); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
+// pushMetrics replaces this server's group on a pushgateway. The server dir
+// goes into the grouping key base64 encoded since it holds slashes.
+func pushMetrics(gateway string, tomcatDir string, metrics []byte) error {
+	hostname, _ := os.Hostname()
+	endpoint := strings.TrimSuffix(gateway, "/") + "/metrics/job/go-patcher/instance/" + hostname +
+		"/tomcat_dir@base64/" + base64.RawURLEncoding.EncodeToString([]byte(tomcatDir))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "PUT", endpoint, bytes.NewReader(metrics))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", metricsContentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("pushgateway responded " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatMetrics(t *testing.T) {
+	record := runRecord{TomcatDir: "/opt/tomcat", Portal: "default", Started: time.Unix(1700000000, 0),
+		Result: patchSuccess, StartupMillis: 95500, DownloadBytes: 1024, FilesWritten: 12,
+		Phases: map[string]float64{"extract": 4.5, "download": 12}}
+	metrics := string(formatMetrics(record))
+
+	assert.Contains(t, metrics, "# TYPE go_patcher_phase_seconds gauge\n"+
+		`go_patcher_phase_seconds{tomcat_dir="/opt/tomcat",portal="default",phase="download"} 12`+"\n"+
+		`go_patcher_phase_seconds{tomcat_dir="/opt/tomcat",portal="default",phase="extract"} 4.5`+"\n")
+	assert.Contains(t, metrics, `go_patcher_download_bytes{tomcat_dir="/opt/tomcat",portal="default"} 1024`)
+	assert.Contains(t, metrics, `go_patcher_files_extracted{tomcat_dir="/opt/tomcat",portal="default"} 12`)
+	assert.Contains(t, metrics, `go_patcher_startup_seconds{tomcat_dir="/opt/tomcat",portal="default"} 95.5`)
+	assert.Contains(t, metrics, `go_patcher_result_code{tomcat_dir="/opt/tomcat",portal="default"} 1`)
+	assert.Contains(t, metrics, `go_patcher_last_run_success{tomcat_dir="/opt/tomcat",portal="default"} 1`)
+	assert.Contains(t, metrics, `go_patcher_last_run_timestamp_seconds{tomcat_dir="/opt/tomcat",portal="default"} 1700000000`)
+
+	// No startup time for a server that never came up
+	record.Result, record.StartupMillis = tomcatDown, -1
+	metrics = string(formatMetrics(record))
+	assert.NotContains(t, metrics, "startup_seconds")
+	assert.Contains(t, metrics, `go_patcher_last_run_success{tomcat_dir="/opt/tomcat",portal="default"} 0`)
+
+	assert.Equal(t, `C:\\tomcat \"a\"`, labelValue(`C:\tomcat "a"`))
+}
+
+func TestExportMetrics(t *testing.T) {
+	var pushedTo, contentType, pushed string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "PUT", r.Method)
+		pushedTo, contentType = r.URL.Path, r.Header.Get("Content-Type")
+		body, _ := io.ReadAll(r.Body)
+		pushed = string(body)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	*metricsTextfileDir, *pushgatewayURL = dir, server.URL+"/"
+	defer func() { *metricsTextfileDir, *pushgatewayURL = "", "" }()
+
+	record := runRecord{TomcatDir: "/opt/tomcat", Portal: "default", Started: time.Now(), Result: patchSuccess}
+	exportMetrics(record)
+
+	textfile, err := os.ReadFile(filepath.Join(dir, "go_patcher_opt_tomcat.prom"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(textfile), "go_patcher_result_code")
+	leftovers, _ := filepath.Glob(filepath.Join(dir, ".go_patcher-*"))
+	assert.Empty(t, leftovers)
+
+	hostname, _ := os.Hostname()
+	assert.Equal(t, "/metrics/job/go-patcher/instance/"+hostname+"/tomcat_dir@base64/L29wdC90b21jYXQ", pushedTo)
+	assert.Equal(t, metricsContentType, contentType)
+	assert.True(t, strings.HasPrefix(pushed, "# HELP go_patcher_download_bytes"), pushed)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
+)
+
+// signatureSuffix names the detached minisign signature published next to each tarball
+const signatureSuffix = ".minisig"
+
+// tarballKey is the -tarball-pubkey key every tarball must be signed with, nil
+// when tarballs are trusted on their checksum alone
+var tarballKey *minisignKey
+
+type minisignKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// loadTarballKey reads a minisign public key file, as written by minisign -G
+func loadTarballKey(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	key, err := parseMinisignKey(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	tarballKey = key
+	log.Debug("Tarballs must be signed with minisign key ", key.idString())
+	return nil
+}
+
+// parseMinisignKey accepts the key file or just its base64 line
+func parseMinisignKey(data []byte) (*minisignKey, error) {
+	var encoded string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "untrusted comment:") {
+			encoded = line
+			break
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != "Ed" {
+		return nil, errors.New("not a minisign public key")
+	}
+	key := &minisignKey{key: ed25519.PublicKey(raw[10:])}
+	copy(key.id[:], raw[2:10])
+	return key, nil
+}
+
+// idString is the key ID the way minisign prints it
+func (k *minisignKey) idString() string {
+	id := k.id
+	for i, j := 0, len(id)-1; i < j; i, j = i+1, j-1 {
+		id[i], id[j] = id[j], id[i]
+	}
+	return strings.ToUpper(hex.EncodeToString(id[:]))
+}
+
+// verify checks a tarball against its .minisig file: the signature over the
+// file, prehashed or not, and the one over the trusted comment
+func (k *minisignKey) verify(path string, sigFile []byte) error {
+	lines := make([]string, 0, 4)
+	scanner := bufio.NewScanner(bytes.NewReader(sigFile))
+	for scanner.Scan() && len(lines) < 4 {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("not a minisign signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return errors.New("not a minisign signature")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return errors.New("not a minisign signature")
+	}
+	if !bytes.Equal(sig[2:10], k.id[:]) {
+		return errors.New("signed with a different key than -tarball-pubkey")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var message []byte
+	switch string(sig[:2]) {
+	case "ED":
+		hash, _ := blake2b.New512(nil)
+		if _, err := io.Copy(hash, file); err != nil {
+			return err
+		}
+		message = hash.Sum(nil)
+	case "Ed":
+		if message, err = io.ReadAll(file); err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown minisign signature algorithm")
+	}
+	if !ed25519.Verify(k.key, message, sig[10:]) {
+		return errors.New("bad signature")
+	}
+	trusted := strings.TrimPrefix(lines[2], "trusted comment: ")
+	signed := append(append([]byte{}, sig[10:]...), trusted...)
+	if !ed25519.Verify(k.key, signed, globalSig) {
+		return errors.New("bad signature on the trusted comment")
+	}
+	log.Debug("Signature good, trusted comment: ", trusted)
+	return nil
+}
+
+// verifyTarballSignature refuses a tarball without a good signature when
+// -tarball-pubkey is set. A downloaded tarball's signature is fetched from
+// next to where it came from, a local tarball's must sit next to it.
+func verifyTarballSignature(path string, fileURL string, patchID string) error {
+	if tarballKey == nil {
+		return nil
+	}
+	var sigFile []byte
+	var err error
+	if fileURL == "" {
+		sigFile, err = os.ReadFile(path + signatureSuffix)
+	} else {
+		sigFile, err = fetchSignature(fileURL, patchID)
+	}
+	if err != nil {
+		return fmt.Errorf("no signature: %w", err)
+	}
+	if err := tarballKey.verify(path, sigFile); err != nil {
+		return err
+	}
+	// Keep the signature, a cached tarball is checked again each time it's used
+	if fileURL != "" && filepath.Dir(path) == cacheDir() {
+		os.WriteFile(path+signatureSuffix, sigFile, 0644)
+	}
+	return nil
+}
+
+// fetchSignature downloads the .minisig for a tarball URL. A presigned URL's
+// signature doesn't cover the .minisig, so the portal signs one for it. It's
+// downloaded like the tarball, but isn't read through as one.
+func fetchSignature(fileURL string, patchID string) ([]byte, error) {
+	sigURL := redactURL(fileURL) + signatureSuffix
+	if !isSFTPURL(sigURL) && !isS3URL(sigURL) && sigURL != fileURL+signatureSuffix {
+		err := activePortal.withFailover(func() (err error) {
+			sigURL, err = refreshDownloadURL(patchID, sigURL)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(*patchDir, 0755); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(*patchDir, "signature-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, path.Base(redactURL(sigURL)))
+	if err := downloadFile(sigURL, dest, patchID, false); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(dest)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(io.LimitReader(file, 64*1024))
+}
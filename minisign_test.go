@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+)
+
+// testMinisignKey returns a key pair and its public key file as minisign -G writes it
+func testMinisignKey(t *testing.T) (ed25519.PrivateKey, []byte, []byte) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	id := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	keyFile := "untrusted comment: minisign public key 0807060504030201\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), id...), public...)) + "\n"
+	return private, id, []byte(keyFile)
+}
+
+// testMinisign signs the file at path the way minisign -S does
+func testMinisign(t *testing.T, private ed25519.PrivateKey, id []byte, path string) []byte {
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	hash := blake2b.Sum512(content)
+	sig := ed25519.Sign(private, hash[:])
+	trusted := "timestamp:1760000000\tfile:" + filepath.Base(path) + "\thashed"
+	global := ed25519.Sign(private, append(append([]byte{}, sig...), trusted...))
+	return []byte("untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("ED"), id...), sig...)) + "\n" +
+		"trusted comment: " + trusted + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+func TestMinisignVerify(t *testing.T) {
+	private, id, keyFile := testMinisignKey(t)
+	key, err := parseMinisignKey(keyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "0807060504030201", key.idString())
+
+	sigFile := testMinisign(t, private, id, "test.tar.gz")
+	assert.NoError(t, key.verify("test.tar.gz", sigFile))
+
+	// Legacy signatures over the whole file are still accepted
+	content, _ := os.ReadFile("test.tar.gz")
+	sig := ed25519.Sign(private, content)
+	global := ed25519.Sign(private, append(append([]byte{}, sig...), "legacy"...))
+	legacy := "untrusted comment: x\n" + base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), id...), sig...)) +
+		"\ntrusted comment: legacy\n" + base64.StdEncoding.EncodeToString(global) + "\n"
+	assert.NoError(t, key.verify("test.tar.gz", []byte(legacy)))
+
+	other := filepath.Join(t.TempDir(), "other.tar.gz")
+	os.WriteFile(other, append(content, 0), 0644)
+	assert.Error(t, key.verify(other, sigFile), "signature is for another file")
+
+	tampered := bytes.Replace(sigFile, []byte("timestamp:1760000000"), []byte("timestamp:1760000001"), 1)
+	assert.Error(t, key.verify("test.tar.gz", tampered), "trusted comment was changed")
+
+	otherPrivate, _, _ := testMinisignKey(t)
+	err = key.verify("test.tar.gz", testMinisign(t, otherPrivate, []byte{8, 7, 6, 5, 4, 3, 2, 1}, "test.tar.gz"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "different key")
+
+	_, err = parseMinisignKey([]byte("untrusted comment: nothing\nbm90IGEga2V5\n"))
+	assert.Error(t, err)
+}
+
+func TestFetchTarballRequiresSignature(t *testing.T) {
+	private, id, keyFile := testMinisignKey(t)
+	key, _ := parseMinisignKey(keyFile)
+	tarballKey = key
+	defer func() { tarballKey = nil }()
+
+	dir := t.TempDir()
+	local := filepath.Join(dir, "local.tar.gz")
+	content, _ := os.ReadFile("test.tar.gz")
+	os.WriteFile(local, content, 0644)
+	assert.Panics(t, func() { fetchTarball(local, "63547") }, "unsigned")
+
+	os.WriteFile(local+signatureSuffix, testMinisign(t, private, id, "test.tar.gz"), 0644)
+	assert.Equal(t, local, fetchTarball(local, "63547"))
+
+	// Downloads fetch the signature from next to the tarball
+	var served []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = append(served, r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, signatureSuffix) {
+			http.ServeFile(w, r, local+signatureSuffix)
+		} else {
+			http.ServeFile(w, r, local)
+		}
+	}))
+	defer server.Close()
+	oldPatchDir := *patchDir
+	*patchDir = t.TempDir()
+	defer func() { *patchDir = oldPatchDir }()
+	fetched := fetchTarball(server.URL+"/patches/signed.tar.gz", "63547")
+	assert.True(t, pathExists(fetched))
+	assert.Equal(t, []string{"/patches/signed.tar.gz", "/patches/signed.tar.gz.minisig"}, served)
+}
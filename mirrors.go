@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// patchMirrors are the -web base URLs in the order to try them, so a regional
+// mirror or an on-prem cache can stand in when S3 is unreachable or slow
+func patchMirrors() []string {
+	var mirrors []string
+	for _, mirror := range strings.Split(*patchWeb, ",") {
+		mirror = strings.TrimSpace(mirror)
+		if mirror == "" {
+			continue
+		}
+		if !strings.HasSuffix(mirror, "/") {
+			mirror += "/"
+		}
+		mirrors = append(mirrors, mirror)
+	}
+	return mirrors
+}
+
+// errTarballNotFound means every source answered 404
+var errTarballNotFound = errors.New("not found on any mirror")
+
+// downloadFromMirrors tries each source in turn and returns the one that served
+// the file, or the last error when none did
+func downloadFromMirrors(sources []string, dest string, patchID string, isArchive bool) (string, error) {
+	var err error
+	missing := 0
+	for i, source := range sources {
+		log.Debug("Trying to fetch patch: " + redactURL(source))
+		if err = downloadFile(source, dest, patchID, isArchive); err == nil {
+			return source, nil
+		}
+		if isNotFound(err) {
+			missing++
+		}
+		// A partial file from one mirror isn't trusted to match the next
+		os.Remove(dest + ".part")
+		if i < len(sources)-1 {
+			log.Warning("Could not download from ", redactURL(source), ", trying the next mirror: ", err)
+		}
+	}
+	if missing > 0 && missing == len(sources) {
+		return "", fmt.Errorf("%w: %w", errTarballNotFound, err)
+	}
+	return "", err
+}
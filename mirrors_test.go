@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatchMirrors(t *testing.T) {
+	old := *patchWeb
+	defer func() { *patchWeb = old }()
+
+	*patchWeb = "https://s3.amazonaws.com/longsight-patches/"
+	assert.Equal(t, []string{"https://s3.amazonaws.com/longsight-patches/"}, patchMirrors())
+	*patchWeb = "https://cache.example.edu/patches, https://s3.amazonaws.com/longsight-patches/,"
+	assert.Equal(t, []string{"https://cache.example.edu/patches/", "https://s3.amazonaws.com/longsight-patches/"}, patchMirrors())
+}
+
+func TestFetchTarballFallsBackToNextMirror(t *testing.T) {
+	oldWeb, oldDir := *patchWeb, *patchDir
+	defer func() { *patchWeb, *patchDir = oldWeb, oldDir }()
+	*patchDir = t.TempDir()
+
+	tarball, _ := os.ReadFile("test.tar.gz")
+	var asked []string
+	missing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked = append(asked, "cache "+r.URL.Path)
+		http.NotFound(w, r)
+	}))
+	defer missing.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked = append(asked, "origin "+r.URL.Path)
+		w.Write(tarball)
+	}))
+	defer origin.Close()
+
+	*patchWeb = missing.URL + "/," + origin.URL + "/"
+	fetched := fetchTarball("patch-63547.tar.gz", "63547")
+	assert.Equal(t, []string{"cache /sakai-builder/patch-63547.tar.gz", "origin /sakai-builder/patch-63547.tar.gz"}, asked)
+	downloaded, _ := os.ReadFile(fetched)
+	assert.Equal(t, tarball, downloaded)
+
+	// Nothing left to try
+	*patchWeb = missing.URL + "/"
+	assert.Panics(t, func() { fetchTarball("patch-63548.tar.gz", "63548") })
+}
+
+func TestFetchTarballTriesOtherPatchTree(t *testing.T) {
+	oldWeb, oldDir := *patchWeb, *patchDir
+	defer func() { *patchWeb, *patchDir = oldWeb, oldDir }()
+	*patchDir = t.TempDir()
+	fastRetries(t, 2)
+
+	tarball, _ := os.ReadFile("test.tar.gz")
+	var asked []string
+	moved := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked = append(asked, r.URL.Path)
+		if r.URL.Path != "/patches/patch-63547.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(tarball)
+	}))
+	defer moved.Close()
+	*patchWeb = moved.URL + "/"
+
+	fetched := fetchTarball("patch-63547.tar.gz", "63547")
+	assert.Equal(t, []string{"/sakai-builder/patch-63547.tar.gz", "/patches/patch-63547.tar.gz"}, asked)
+	downloaded, _ := os.ReadFile(fetched)
+	assert.Equal(t, tarball, downloaded)
+
+	// A mirror that's down isn't a reason to look elsewhere
+	asked = nil
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked = append(asked, r.URL.Path)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	*patchWeb = down.URL + "/"
+	assert.Panics(t, func() { fetchTarball("patch-63548.tar.gz", "63548") })
+	assert.Equal(t, []string{"/sakai-builder/patch-63548.tar.gz", "/sakai-builder/patch-63548.tar.gz"}, asked)
+
+	sources, alternates := tarballSources("/patches/23.x/patch-63549.tar.gz")
+	assert.Equal(t, []string{down.URL + "/patches/23.x/patch-63549.tar.gz"}, sources)
+	assert.Equal(t, []string{down.URL + "/sakai-builder/patch-63549.tar.gz"}, alternates)
+	_, alternates = tarballSources(down.URL + "/presigned/patch-63549.tar.gz?X-Amz-Signature=abc")
+	assert.Empty(t, alternates)
+}
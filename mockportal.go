@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mockPortal stands in for the admin portal during local development. It
+// offers the patches from -patch-json until each gets a final result, prints
+// every update, and serves tarballs from -tarball-dir the way S3 would.
+type mockPortal struct {
+	token  string
+	secret string
+	out    io.Writer
+	outMu  sync.Mutex
+
+	mu      sync.Mutex
+	pending []json.RawMessage
+	ids     []string
+	nonces  map[string]string
+}
+
+// newMockPortal loads the patches, checking them as the patcher would
+func newMockPortal(patchJSON []byte, token string, secret string, out io.Writer) (*mockPortal, error) {
+	patches, err := decodePatchResponses(patchJSON)
+	if err != nil {
+		return nil, err
+	}
+	m := &mockPortal{token: token, secret: secret, out: out, nonces: map[string]string{}}
+	trimmed := bytes.TrimSpace(patchJSON)
+	if trimmed[0] == '[' {
+		json.Unmarshal(trimmed, &m.pending)
+	} else {
+		m.pending = []json.RawMessage{trimmed}
+	}
+	for _, patch := range patches {
+		m.ids = append(m.ids, patch.PatchID)
+	}
+	return m, nil
+}
+
+// runMockPortal serves the mock portal on -mock-listen until SIGINT or SIGTERM
+func runMockPortal() error {
+	if *mockPatchJSON == "" {
+		return errors.New("mockportal needs -patch-json")
+	}
+	body, err := os.ReadFile(*mockPatchJSON)
+	if err != nil {
+		return err
+	}
+	secret := ""
+	if *hmacSecretFile != "" {
+		if secret, err = readSecretFile(*hmacSecretFile); err != nil {
+			return err
+		}
+	}
+	m, err := newMockPortal(body, *token, secret, os.Stdout)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *mockPatchJSON, err)
+	}
+	tarballs := *mockTarballDir
+	if tarballs == "" {
+		tarballs = filepath.Dir(*mockPatchJSON)
+	}
+
+	listener, err := net.Listen("tcp", *mockListen)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: m.handler(tarballs), ReadHeaderTimeout: 10 * time.Second}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	base := "http://" + listener.Addr().String()
+	m.printf("Mock portal on %s offering patches %v with tarballs from %s\n", base, m.ids, tarballs)
+	m.printf("Point a patcher at it with: go-patcher -portal %s -web %s/ -token %s\n", base, base, m.token)
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (m *mockPortal) handler(tarballs string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(patchesPath, m.handlePatches)
+	mux.HandleFunc(updatePath, m.handleUpdate)
+	mux.HandleFunc(claimPath, m.handleClaim)
+	mux.HandleFunc(pausePath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"paused": false}`))
+	})
+	mux.HandleFunc(logStreamPath, m.handleLogStream)
+	for _, path := range []string{leasePath, heartbeatPath, inventoryPath, attachmentPath} {
+		path := path
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			log.Debug("Mock portal: ", r.Method, " ", path)
+		})
+	}
+	// No retention policy and no signed URLs to refresh, as with older portals
+	for _, path := range []string{retentionPath, downloadPath} {
+		mux.HandleFunc(path, http.NotFound)
+	}
+
+	// Portal calls need the token, tarballs are public like the S3 bucket
+	files := http.FileServer(http.Dir(tarballs))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range []string{"/sakai-builder/", "/patches/"} {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				http.StripPrefix(prefix, files).ServeHTTP(w, r)
+				return
+			}
+		}
+		if r.Header.Get("X-Auth-Token") != m.token {
+			m.printf("Refused %s %s: wrong X-Auth-Token\n", r.Method, r.URL.Path)
+			http.Error(w, "wrong token", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set(statusModelHeader, r.Header.Get(statusModelHeader))
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// handlePatches offers every patch still waiting for a final result
+func (m *mockPortal) handlePatches(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	body, _ := json.Marshal(m.pending)
+	m.mu.Unlock()
+	if m.secret != "" {
+		w.Header().Set(signatureHeader, signBody(m.secret, body, time.Now()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (m *mockPortal) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	patchID, rv := r.PostForm.Get("patch_id"), r.PostForm.Get("result_value")
+	meaning := "unknown result"
+	for _, code := range resultCodes {
+		if code[0] == rv {
+			meaning = code[1]
+		}
+	}
+	line := fmt.Sprintf("Patch %s: result_value=%s (%s) start_uptime=%s", patchID, rv, meaning, r.PostForm.Get("start_uptime"))
+	if status := r.PostForm.Get("status"); status != "" {
+		line += " status=" + status
+	}
+	m.printf("%s\n", line)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch rv {
+	case inProgress:
+		m.nonces[patchID] = r.PostForm.Get("claim_nonce")
+		return
+	case patchDefer:
+		// The real portal offers deferred patches again
+		return
+	}
+	if result := r.PostForm.Get("result"); result != "" {
+		m.printf("%s\n", indent(result, "    "))
+	}
+	for i, id := range m.ids {
+		if id == patchID {
+			m.ids = append(m.ids[:i], m.ids[i+1:]...)
+			m.pending = append(m.pending[:i], m.pending[i+1:]...)
+			break
+		}
+	}
+	if len(m.ids) == 0 {
+		m.printf("Every patch has a result, nothing more to offer\n")
+	}
+}
+
+// handleClaim reads back the last claim, which is always this host's
+func (m *mockPortal) handleClaim(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	nonce, ok := m.nonces[r.URL.Query().Get("patch_id")]
+	m.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(claimRecord{Nonce: nonce})
+}
+
+func (m *mockPortal) handleLogStream(w http.ResponseWriter, r *http.Request) {
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		m.printf("  | %s\n", scanner.Text())
+	}
+}
+
+// printf keeps the output of concurrent requests apart
+func (m *mockPortal) printf(format string, args ...any) {
+	m.outMu.Lock()
+	defer m.outMu.Unlock()
+	fmt.Fprintf(m.out, format, args...)
+}
+
+func indent(text string, prefix string) string {
+	return prefix + strings.ReplaceAll(strings.TrimRight(text, "\n"), "\n", "\n"+prefix)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMockPortal(t *testing.T) {
+	dir := t.TempDir()
+	tarball, _ := os.ReadFile("test.tar.gz")
+	os.WriteFile(filepath.Join(dir, "sakai-23.1-63547.tar.gz"), tarball, 0644)
+	patchJSON := `[{"patch_id": "63547", "tomcat_dir": "/opt/tomcat", "files": "sakai-23.1-63547.tar.gz", "sakaiprops": ""},
+		{"patch_id": "63548", "tomcat_dir": "/opt/tomcat", "files": "", "sakaiprops": "auto.ddl=false"}]`
+
+	var out bytes.Buffer
+	m, err := newMockPortal([]byte(patchJSON), "test-token", "hmac-key", &out)
+	if !assert.NoError(t, err) {
+		return
+	}
+	server := httptest.NewServer(m.handler(dir))
+	defer server.Close()
+
+	call := func(method string, path string, form url.Values) (*http.Response, string) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(form.Encode()))
+		req.Header.Set("X-Auth-Token", "test-token")
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// The patches come signed and decode as the portal's would
+	resp, body := call("GET", patchesPath, nil)
+	assert.NoError(t, verifySignature("hmac-key", []byte(body), resp.Header.Get(signatureHeader)))
+	patches, err := decodePatchResponses([]byte(body))
+	assert.NoError(t, err)
+	assert.Len(t, patches, 2)
+
+	// A claim reads back as this host's
+	call("POST", updatePath, url.Values{"patch_id": {"63547"}, "result_value": {inProgress}, "claim_nonce": {"abc123"}})
+	_, body = call("GET", claimPath+"?patch_id=63547", nil)
+	assert.JSONEq(t, `{"claim_nonce": "abc123", "hostname": ""}`, body)
+
+	// Deferred patches are offered again, finished ones are not
+	call("POST", updatePath, url.Values{"patch_id": {"63548"}, "result_value": {patchDefer}, "start_uptime": {"-8"}})
+	call("POST", updatePath, url.Values{"patch_id": {"63547"}, "result_value": {patchSuccess}, "start_uptime": {"95000"},
+		"result": {"Extracted 3 files\nServer startup in [95000] milliseconds\n"}})
+	_, body = call("GET", patchesPath, nil)
+	patches, _ = decodePatchResponses([]byte(body))
+	if assert.Len(t, patches, 1) {
+		assert.Equal(t, "63548", patches[0].PatchID)
+	}
+	assert.Contains(t, out.String(), "Patch 63547: result_value=1 (applied and the server came back) start_uptime=95000\n"+
+		"    Extracted 3 files\n    Server startup in [95000] milliseconds\n")
+
+	// Tarballs need no token, portal calls do
+	resp, err = http.Get(server.URL + "/sakai-builder/sakai-23.1-63547.tar.gz")
+	if assert.NoError(t, err) {
+		served, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, tarball, served)
+	}
+	resp, err = http.Get(server.URL + patchesPath)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+func TestMockPortalRejectsBadPatchJSON(t *testing.T) {
+	_, err := newMockPortal([]byte(`{"patch_id": 63547}`), "test-token", "", io.Discard)
+	assert.Error(t, err)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultOverridesFile = "/etc/go-patcher/overrides.yaml"
+
+// hostOverrides holds the operator-maintained deviations for this host only
+type hostOverrides struct {
+	PinPatches     []string `yaml:"pin_patches"`
+	VetoPatches    []string `yaml:"veto_patches"`
+	SkipProperties []string `yaml:"skip_properties"`
+	Timeouts       struct {
+		StartupWaitSeconds  int `yaml:"startup_wait_seconds"`
+		ShutdownWaitSeconds int `yaml:"shutdown_wait_seconds"`
+	} `yaml:"timeouts"`
+
+	// applied records every override that changed this run so it can be reported
+	applied []string
+}
+
+var overrides = &hostOverrides{}
+
+// loadOverrides reads the overrides file. A missing file simply means no overrides.
+func loadOverrides(overridesPath string) *hostOverrides {
+	o := &hostOverrides{}
+	input, err := os.ReadFile(overridesPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning("Could not read overrides file: ", overridesPath, err)
+		}
+		return o
+	}
+
+	// A broken overrides file could silently un-veto a patch, so refuse to continue
+	if err := yaml.Unmarshal(input, o); err != nil {
+		panic("Could not parse overrides file " + overridesPath + ": " + err.Error())
+	}
+	log.Debug("Loaded host overrides from ", overridesPath, ": ", o)
+	return o
+}
+
+// allowsPatch checks the patch ID against the veto and pin lists
+func (o *hostOverrides) allowsPatch(patchID string) bool {
+	if o == nil {
+		return true
+	}
+	if containsString(o.VetoPatches, patchID) {
+		o.record("veto_patches=" + patchID)
+		return false
+	}
+	if len(o.PinPatches) > 0 && !containsString(o.PinPatches, patchID) {
+		o.record("pin_patches=" + strings.Join(o.PinPatches, ","))
+		return false
+	}
+	return true
+}
+
+// skipsProperty reports whether the operator asked us to never touch this property key
+func (o *hostOverrides) skipsProperty(key string) bool {
+	if o == nil || key == "" {
+		return false
+	}
+	if containsString(o.SkipProperties, strings.TrimSpace(key)) {
+		o.record("skip_properties=" + strings.TrimSpace(key))
+		return true
+	}
+	return false
+}
+
+// startupWait returns the number of seconds to wait for Tomcat to come back
+func (o *hostOverrides) startupWait(defaultSeconds int) int {
+	if o == nil || o.Timeouts.StartupWaitSeconds <= 0 {
+		return defaultSeconds
+	}
+	o.record("startup_wait_seconds=" + strconv.Itoa(o.Timeouts.StartupWaitSeconds))
+	return o.Timeouts.StartupWaitSeconds
+}
+
+// shutdownWait returns the number of seconds to give Tomcat before the first hard kill
+func (o *hostOverrides) shutdownWait(defaultSeconds int) int {
+	if o == nil || o.Timeouts.ShutdownWaitSeconds <= 0 {
+		return defaultSeconds
+	}
+	o.record("shutdown_wait_seconds=" + strconv.Itoa(o.Timeouts.ShutdownWaitSeconds))
+	return o.Timeouts.ShutdownWaitSeconds
+}
+
+func (o *hostOverrides) record(override string) {
+	if !containsString(o.applied, override) {
+		log.Info("Applying host override: ", override)
+		o.applied = append(o.applied, override)
+	}
+}
+
+// summary is sent to the portal so it knows this run deviated from the patch
+func (o *hostOverrides) summary() string {
+	if o == nil {
+		return ""
+	}
+	return strings.Join(o.applied, "; ")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadOverrides(t *testing.T) {
+	overridesPath := filepath.Join(t.TempDir(), "overrides.yaml")
+	content := `pin_patches: ["63547", "63548"]
+veto_patches: ["63548"]
+skip_properties: ["portal.cdn.version"]
+timeouts:
+  startup_wait_seconds: 600
+`
+	if err := os.WriteFile(overridesPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write overrides file: %v", err)
+	}
+
+	o := loadOverrides(overridesPath)
+	assert.True(t, o.allowsPatch("63547"))
+	assert.False(t, o.allowsPatch("63548"), "vetoed patch")
+	assert.False(t, o.allowsPatch("70000"), "patch not in pin list")
+	assert.True(t, o.skipsProperty("portal.cdn.version"))
+	assert.False(t, o.skipsProperty("version.sakai"))
+	assert.Equal(t, 600, o.startupWait(280))
+	assert.Equal(t, 20, o.shutdownWait(20))
+	assert.Equal(t, "veto_patches=63548; pin_patches=63547,63548; skip_properties=portal.cdn.version; startup_wait_seconds=600", o.summary())
+}
+
+func TestLoadOverridesMissingFile(t *testing.T) {
+	o := loadOverrides(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.True(t, o.allowsPatch("63547"))
+	assert.Equal(t, 280, o.startupWait(280))
+	assert.Equal(t, "", o.summary())
+}
+
+func TestModifyPropertyFilesSkipsOverriddenKeys(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.MkdirAll(tmpDir+"/sakai", 0755)
+	content, err := os.ReadFile("testdata/sakai.properties")
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+	os.WriteFile(tmpDir+"/sakai/sakai.properties", content, 0644)
+
+	originalWd, _ := os.Getwd()
+	os.Chdir(tmpDir)
+	defer os.Chdir(originalWd)
+
+	overrides = &hostOverrides{SkipProperties: []string{"portal.cdn.version"}}
+	defer func() { overrides = &hostOverrides{} }()
+
+	modifyPropertyFiles("portal.cdn.version=547\nversion.sakai=23.4", "63547")
+
+	sakaiContent, _ := os.ReadFile("sakai/sakai.properties")
+	assert.NotContains(t, string(sakaiContent), "portal.cdn.version=547")
+	assert.Contains(t, string(sakaiContent), "version.sakai=23.4")
+	assert.Equal(t, "skip_properties=portal.cdn.version", overrides.summary())
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Endpoints of the paging services, replaced in tests
+var (
+	pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+	opsgenieURL  = "https://api.opsgenie.com/v2/alerts"
+)
+
+// incident is what on-call needs to know about a server left down
+type incident struct {
+	summary string
+	// key deduplicates repeated pages for the same patch on the same server
+	key     string
+	details map[string]string
+}
+
+// notifyPager opens an incident when a patch leaves the server down, with the
+// failure classification from the status model and the server log. It is best
+// effort like the other notifications.
+func notifyPager(rv string, startup string, patchID string) {
+	if rv != tomcatDown || (*pagerDutyKeyFile == "" && *opsgenieKeyFile == "") {
+		return
+	}
+	event := newIncident(rv, startup, patchID)
+	if *pagerDutyKeyFile != "" {
+		if err := triggerPagerDuty(*pagerDutyKeyFile, event); err != nil {
+			log.Warning("Could not page PagerDuty for patch ", patchID, ": ", err)
+		}
+	}
+	if *opsgenieKeyFile != "" {
+		if err := triggerOpsgenie(*opsgenieKeyFile, event); err != nil {
+			log.Warning("Could not alert Opsgenie for patch ", patchID, ": ", err)
+		}
+	}
+}
+
+func newIncident(rv string, startup string, patchID string) incident {
+	hostname, _ := os.Hostname()
+	status := statusFor(rv, startup, statusReasons[patchID])
+	details := map[string]string{
+		"patch_id":       patchID,
+		"tomcat_dir":     activeInstance.Dir,
+		"host":           hostname,
+		"portal":         activePortal.Name,
+		"run_id":         runID,
+		"classification": status.reason,
+	}
+	// The loggers that failed the startup point at the broken component
+	if report, ok := startupErrors[patchID]; ok && len(report.Top) > 0 {
+		var loggers []string
+		for _, category := range report.Top {
+			loggers = append(loggers, category.Logger)
+		}
+		details["top_error_loggers"] = strings.Join(loggers, ", ")
+	}
+	return incident{
+		summary: renderNotification("summary", rv, startup, patchID),
+		key:     "go-patcher:" + hostname + ":" + activeInstance.Dir + ":" + patchID,
+		details: details,
+	}
+}
+
+// triggerPagerDuty sends an Events API v2 trigger to the routing key in keyFile
+func triggerPagerDuty(keyFile string, event incident) error {
+	routingKey, err := readSecretFile(keyFile)
+	if err != nil {
+		return err
+	}
+	return postAlert(pagerDutyURL, "", map[string]any{
+		"routing_key":  routingKey,
+		"event_action": "trigger",
+		"dedup_key":    event.key,
+		"payload": map[string]any{
+			"summary":        event.summary,
+			"source":         event.details["host"],
+			"severity":       "critical",
+			"component":      event.details["tomcat_dir"],
+			"class":          event.details["classification"],
+			"custom_details": event.details,
+		},
+	})
+}
+
+// triggerOpsgenie creates an alert with the API key in keyFile
+func triggerOpsgenie(keyFile string, event incident) error {
+	apiKey, err := readSecretFile(keyFile)
+	if err != nil {
+		return err
+	}
+	return postAlert(opsgenieURL, "GenieKey "+apiKey, map[string]any{
+		"message":  event.summary,
+		"alias":    event.key,
+		"source":   "go-patcher",
+		"priority": "P1",
+		"details":  event.details,
+	})
+}
+
+func postAlert(endpoint string, authorization string, alert map[string]any) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("alerting service responded " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifyPager(t *testing.T) {
+	type received struct {
+		path          string
+		authorization string
+		body          map[string]any
+	}
+	var alerts []received
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		alerts = append(alerts, received{r.URL.Path, r.Header.Get("Authorization"), body})
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	defer func(pd, og string) { pagerDutyURL, opsgenieURL = pd, og }(pagerDutyURL, opsgenieURL)
+	pagerDutyURL, opsgenieURL = server.URL+"/v2/enqueue", server.URL+"/v2/alerts"
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "pagerduty"), []byte("R0UTINGKEY\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "opsgenie"), []byte("genie-key\n"), 0600)
+	*pagerDutyKeyFile, *opsgenieKeyFile = filepath.Join(dir, "pagerduty"), filepath.Join(dir, "opsgenie")
+	defer func() { *pagerDutyKeyFile, *opsgenieKeyFile = "", "" }()
+
+	activeInstance = instanceConfig{Dir: "/opt/tomcat"}
+	defer func() { activeInstance = instanceConfig{} }()
+	statusReasons = map[string]string{"63547": reasonStartupFailed}
+	defer func() { statusReasons = map[string]string{} }()
+	startupErrors = map[string]startupErrorReport{"63547": {Total: 3, Top: []errorCategory{
+		{"org.apache.catalina.core.StandardContext", 2}, {"org.sakaiproject.db", 1}}}}
+	defer func() { startupErrors = map[string]startupErrorReport{} }()
+
+	// Only a server left down pages
+	notifyPager(tomcatNoShutdown, "0", "63547")
+	notifyPager(patchDefer, "-8", "63547")
+	assert.Empty(t, alerts)
+
+	notifyPager(tomcatDown, "-1", "63547")
+	if !assert.Len(t, alerts, 2) {
+		return
+	}
+	hostname, _ := os.Hostname()
+
+	pagerDuty := alerts[0]
+	assert.Equal(t, "/v2/enqueue", pagerDuty.path)
+	assert.Equal(t, "R0UTINGKEY", pagerDuty.body["routing_key"])
+	assert.Equal(t, "trigger", pagerDuty.body["event_action"])
+	assert.Equal(t, "go-patcher:"+hostname+":/opt/tomcat:63547", pagerDuty.body["dedup_key"])
+	payload := pagerDuty.body["payload"].(map[string]any)
+	assert.Equal(t, "critical", payload["severity"])
+	assert.Equal(t, "/opt/tomcat", payload["component"])
+	assert.Equal(t, reasonStartupFailed, payload["class"])
+	details := payload["custom_details"].(map[string]any)
+	assert.Equal(t, "63547", details["patch_id"])
+	assert.Equal(t, "org.apache.catalina.core.StandardContext, org.sakaiproject.db", details["top_error_loggers"])
+
+	opsgenie := alerts[1]
+	assert.Equal(t, "/v2/alerts", opsgenie.path)
+	assert.Equal(t, "GenieKey genie-key", opsgenie.authorization)
+	assert.Equal(t, pagerDuty.body["dedup_key"], opsgenie.body["alias"])
+	assert.Equal(t, payload["summary"], opsgenie.body["message"])
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PatchResponse is the patch JSON returned by the admin portal
+type PatchResponse struct {
+	PatchID     string        `json:"patch_id"`
+	TomcatDir   string        `json:"tomcat_dir"`
+	Files       string        `json:"files"`
+	SakaiProps  string        `json:"sakaiprops"`
+	Steps       []patchStep   `json:"steps"`
+	DependsOn   []string      `json:"depends_on"`
+	Health      *healthPolicy `json:"health"`
+	Paused      bool          `json:"paused"`
+	WindowStart string        `json:"window_start"`
+	WindowEnd   string        `json:"window_end"`
+	NewToken    string        `json:"new_token"`
+	// Locale overrides the portal account's locale for this patch's notifications
+	Locale string `json:"locale"`
+	// Checksums are hex SHA-256 sums of the tarballs, by file name
+	Checksums map[string]string `json:"checksums"`
+	// Sizes are the tarballs' sizes in bytes, by file name, so the disk can be
+	// checked for room before they're downloaded
+	Sizes map[string]int64 `json:"sizes"`
+	// PrefetchOnly asks for the tarballs to be downloaded and checked now and
+	// the patch applied in a later run, typically inside its window
+	PrefetchOnly bool `json:"prefetch_only"`
+
+	PropertyBase *propertyBase `json:"property_base"`
+}
+
+// decodePatchResponse parses and validates the portal JSON. Wrong types and
+// missing fields are errors; fields this patcher doesn't know yet only warn so
+// the portal can roll out new fields ahead of the fleet.
+func decodePatchResponse(body []byte) (*PatchResponse, error) {
+	patch := &PatchResponse{}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(patch)
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field") {
+		log.Warning("Patch JSON from portal has a field this patcher does not understand: ", err)
+		patch = &PatchResponse{}
+		err = json.Unmarshal(body, patch)
+	}
+	if err != nil {
+		return nil, describeJSONError(err)
+	}
+
+	return patch, patch.validate()
+}
+
+// decodePatchResponses accepts either a single patch object or a list of queued patches
+func decodePatchResponses(body []byte) ([]*PatchResponse, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		patch, err := decodePatchResponse(trimmed)
+		if err != nil {
+			return nil, err
+		}
+		return []*PatchResponse{patch}, nil
+	}
+
+	var rawPatches []json.RawMessage
+	if err := json.Unmarshal(trimmed, &rawPatches); err != nil {
+		return nil, describeJSONError(err)
+	}
+	var patches []*PatchResponse
+	seen := map[string]bool{}
+	for i, raw := range rawPatches {
+		patch, err := decodePatchResponse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("patch %d of %d: %w", i+1, len(rawPatches), err)
+		}
+		if seen[patch.PatchID] {
+			return nil, fmt.Errorf("patch %d of %d: patch_id %s is listed twice", i+1, len(rawPatches), patch.PatchID)
+		}
+		seen[patch.PatchID] = true
+		patches = append(patches, patch)
+	}
+	return patches, nil
+}
+
+// describeJSONError replaces encoding/json's Go-centric messages with ones that name the portal field
+func describeJSONError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return fmt.Errorf("patch JSON field %q must be %s, got %s", typeErr.Field, jsonTypeName(typeErr.Type.Kind().String()), typeErr.Value)
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Errorf("patch JSON is malformed at byte %d: %v", syntaxErr.Offset, err)
+	}
+	return fmt.Errorf("patch JSON could not be decoded: %w", err)
+}
+
+func jsonTypeName(kind string) string {
+	switch kind {
+	case "slice":
+		return "a list"
+	case "struct", "map":
+		return "an object"
+	}
+	return "a " + kind
+}
+
+// patchIDPattern is what a patch_id may look like, it ends up in file names
+var patchIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// validPatchID reports whether id is safe to use as a file name
+func validPatchID(id string) bool {
+	return patchIDPattern.MatchString(id) && id != "." && id != ".."
+}
+
+// validate checks the fields every patch needs
+func (p *PatchResponse) validate() error {
+	var problems []string
+	if p.PatchID == "" {
+		problems = append(problems, "patch_id is missing")
+	} else if len(p.PatchID) < 3 {
+		problems = append(problems, "patch_id must be at least 3 characters: "+p.PatchID)
+	} else if !validPatchID(p.PatchID) {
+		problems = append(problems, "patch_id may only have letters, digits, dots, dashes and underscores: "+p.PatchID)
+	}
+	if p.TomcatDir == "" {
+		problems = append(problems, "tomcat_dir is missing")
+	} else if !filepath.IsAbs(p.TomcatDir) {
+		problems = append(problems, "tomcat_dir must be an absolute path: "+p.TomcatDir)
+	}
+	for _, dependency := range p.DependsOn {
+		if dependency == p.PatchID {
+			problems = append(problems, "depends_on lists the patch itself: "+dependency)
+		}
+	}
+	for name, sum := range p.Checksums {
+		if !validChecksum(sum) {
+			problems = append(problems, fmt.Sprintf("checksums[%q] is not a SHA-256 hex digest: %s", name, sum))
+		}
+	}
+	for name, size := range p.Sizes {
+		if size < 0 {
+			problems = append(problems, fmt.Sprintf("sizes[%q] is negative: %d", name, size))
+		}
+	}
+	problems = append(problems, p.validateWindow()...)
+	if p.Health != nil {
+		problems = append(problems, p.Health.validate()...)
+	}
+	for i, step := range p.Steps {
+		switch step.Type {
+		case stepProperties, stepTarball, stepSQL, stepHook, stepRestart, stepFlag:
+		case stepGit:
+			if _, _, err := parseGitSource(step.Value); err != nil {
+				problems = append(problems, fmt.Sprintf("steps[%d]: %v", i, err))
+			}
+		case stepDelta:
+			if _, err := parseDeltaStep(step.Value); err != nil {
+				problems = append(problems, fmt.Sprintf("steps[%d]: %v", i, err))
+			}
+		case "":
+			problems = append(problems, fmt.Sprintf("steps[%d].type is missing", i))
+		default:
+			problems = append(problems, fmt.Sprintf("steps[%d].type %q is unknown", i, step.Type))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid patch from portal: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodePatchResponse(t *testing.T) {
+	patch, err := decodePatchResponse([]byte(`{"patch_id": "63547", "tomcat_dir": "/opt/tomcat",
+		"files": "/patches/a.tar.gz", "sakaiprops": "", "created_by": "someone"}`))
+	assert.NoError(t, err, "unknown fields only warn")
+	assert.Equal(t, &PatchResponse{PatchID: "63547", TomcatDir: "/opt/tomcat", Files: "/patches/a.tar.gz"}, patch)
+
+	testCases := []struct {
+		name string
+		json string
+		want string
+	}{
+		{"Wrong type", `{"patch_id": 63547, "tomcat_dir": "/opt/tomcat"}`, `patch JSON field "patch_id" must be a string, got number`},
+		{"Missing fields", `{"files": "/patches/a.tar.gz"}`, "invalid patch from portal: patch_id is missing; tomcat_dir is missing"},
+		{"Path in patch_id", `{"patch_id": "../../../etc/cron.d/x", "tomcat_dir": "/opt/tomcat"}`, "invalid patch from portal: patch_id may only have letters, digits, dots, dashes and underscores: ../../../etc/cron.d/x"},
+		{"Relative dir", `{"patch_id": "63547", "tomcat_dir": "tomcat"}`, "invalid patch from portal: tomcat_dir must be an absolute path: tomcat"},
+		{"Unknown step", `{"patch_id": "63547", "tomcat_dir": "/opt/tomcat", "steps": [{"type": "reboot"}]}`, `invalid patch from portal: steps[0].type "reboot" is unknown`},
+		{"Steps not a list", `{"patch_id": "63547", "tomcat_dir": "/opt/tomcat", "steps": "restart"}`, `patch JSON field "steps" must be a list, got string`},
+		{"Depends on itself", `{"patch_id": "63547", "tomcat_dir": "/opt/tomcat", "depends_on": ["63547"]}`, "invalid patch from portal: depends_on lists the patch itself: 63547"},
+		{"Malformed", `{"patch_id": "63547",`, "patch JSON could not be decoded: unexpected EOF"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := decodePatchResponse([]byte(tc.json))
+			assert.EqualError(t, err, tc.want)
+		})
+	}
+}
+
+func TestDecodePatchResponses(t *testing.T) {
+	patches, err := decodePatchResponses([]byte(`{"patch_id": "63547", "tomcat_dir": "/opt/tomcat"}`))
+	assert.NoError(t, err)
+	assert.Len(t, patches, 1)
+
+	patches, err = decodePatchResponses([]byte(` [{"patch_id": "63547", "tomcat_dir": "/opt/tomcat"},
+		{"patch_id": "63548", "tomcat_dir": "/opt/tomcat", "files": "/patches/b.tar.gz"}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, "63548", patches[1].PatchID)
+	assert.Equal(t, "/patches/b.tar.gz", patches[1].Files)
+
+	_, err = decodePatchResponses([]byte(`[{"patch_id": "63547", "tomcat_dir": "/opt/tomcat"}, {"patch_id": "63548"}]`))
+	assert.EqualError(t, err, "patch 2 of 2: invalid patch from portal: tomcat_dir is missing")
+
+	_, err = decodePatchResponses([]byte(`[{"patch_id": "63547", "tomcat_dir": "/opt/tomcat"}, {"patch_id": "63547", "tomcat_dir": "/opt/tomcat"}]`))
+	assert.EqualError(t, err, "patch 2 of 2: patch_id 63547 is listed twice")
+}
+
+func TestCheckForPatchesSendsHostname(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte(`{"patch_id": "63547", "tomcat_dir": "/opt/tomcat", "files": "https://example.com/patch.tar.gz"}`))
+	}))
+	defer server.Close()
+
+	oldPortal := activePortal
+	activePortal = &portalConfig{Name: "a", URL: server.URL}
+	defer func() { activePortal = oldPortal }()
+	*nodeID = "lms-node-3"
+	defer func() { *nodeID = "" }()
+
+	patches, err := checkForPatchesFromPortal(`["10.0.0.5","","","",""]`)
+	assert.NoError(t, err)
+	assert.Len(t, patches, 1)
+	hostname, _ := os.Hostname()
+	assert.Equal(t, hostname, query.Get("hostname"))
+	assert.Equal(t, "lms-node-3", query.Get("node_id"))
+	assert.Equal(t, `["10.0.0.5","","","",""]`, query.Get("ips"))
+}
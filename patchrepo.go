@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// patchRepoDepth is how far below a -patch-repo directory tarballs are looked
+// for, deep enough for sakai-builder/ or per-release folders without walking
+// a whole NFS share
+const patchRepoDepth = 3
+
+// findInPatchRepo looks for a tarball in the -patch-repo directories before
+// anything is downloaded. Entries are comma-separated and may be globs such
+// as /mnt/patches/*/; the first file with the tarball's name wins, compared
+// without regard to case. It returns "" when no repository has it.
+func findInPatchRepo(fileName string) string {
+	for _, pattern := range strings.Split(*patchRepo, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		dirs, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Warning("Bad -patch-repo pattern ", pattern, ": ", err)
+			continue
+		}
+		for _, dir := range dirs {
+			if found := findTarball(dir, fileName); found != "" {
+				return found
+			}
+		}
+	}
+	return ""
+}
+
+func findTarball(dir string, fileName string) string {
+	found := ""
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// An unreadable corner of the share shouldn't hide the rest
+			return nil
+		}
+		if entry.IsDir() {
+			if depth := strings.Count(strings.TrimPrefix(path, dir), string(filepath.Separator)); depth >= patchRepoDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.EqualFold(entry.Name(), fileName) && entry.Type().IsRegular() {
+			found = path
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found
+}
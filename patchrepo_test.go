@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindInPatchRepo(t *testing.T) {
+	old := *patchRepo
+	defer func() { *patchRepo = old }()
+
+	share := t.TempDir()
+	os.MkdirAll(filepath.Join(share, "23.x", "sakai-builder"), 0755)
+	os.MkdirAll(filepath.Join(share, "a", "b", "c", "d"), 0755)
+	os.WriteFile(filepath.Join(share, "23.x", "sakai-builder", "Patch-63547.tar.gz"), []byte("tarball"), 0644)
+	os.WriteFile(filepath.Join(share, "a", "b", "c", "d", "deep.tar.gz"), []byte("tarball"), 0644)
+
+	*patchRepo = filepath.Join(t.TempDir(), "missing") + "," + share
+	assert.Equal(t, filepath.Join(share, "23.x", "sakai-builder", "Patch-63547.tar.gz"), findInPatchRepo("patch-63547.tar.gz"))
+	assert.Equal(t, "", findInPatchRepo("deep.tar.gz"), "too deep to look")
+	assert.Equal(t, "", findInPatchRepo("patch-63548.tar.gz"))
+
+	*patchRepo = filepath.Join(share, "*", "sakai-builder")
+	assert.Equal(t, filepath.Join(share, "23.x", "sakai-builder", "Patch-63547.tar.gz"), findInPatchRepo("patch-63547.tar.gz"))
+
+	*patchRepo = ""
+	assert.Equal(t, "", findInPatchRepo("patch-63547.tar.gz"))
+}
+
+func TestFetchTarballPrefersPatchRepo(t *testing.T) {
+	oldRepo, oldWeb := *patchRepo, *patchWeb
+	defer func() { *patchRepo, *patchWeb = oldRepo, oldWeb }()
+	// Nothing to download from
+	*patchWeb = "http://127.0.0.1:1/"
+
+	share := t.TempDir()
+	tarball, _ := os.ReadFile("test.tar.gz")
+	os.WriteFile(filepath.Join(share, "patch-63547.tar.gz"), tarball, 0644)
+	*patchRepo = share
+
+	assert.Equal(t, filepath.Join(share, "patch-63547.tar.gz"), fetchTarball("sakai-builder/patch-63547.tar.gz", "63547"))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// peerPath is where a node serves its cached tarballs, by SHA-256
+const peerPath = "/tarballs/"
+
+// peerLookupTimeout bounds asking the peers, a node that's down must not hold up the download
+const peerLookupTimeout = 3 * time.Second
+
+// peerToken is the -peer-token-file secret every node of the cluster shares
+var peerToken string
+
+// peerServer shares this node's tarball cache with the rest of the cluster,
+// so a multi-GB patch crosses the WAN once and the LAN for every other node.
+// A nil *peerServer is a no-op so callers don't need to check -peer-listen.
+type peerServer struct {
+	server *http.Server
+	// dir is the cache being served
+	dir string
+}
+
+// startPeerServer serves the cache on address to peers holding the token
+func startPeerServer(address string) (*peerServer, error) {
+	if peerToken == "" {
+		return nil, errors.New("-peer-listen needs -peer-token-file")
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	p := &peerServer{dir: cacheDir()}
+	mux := http.NewServeMux()
+	mux.HandleFunc(peerPath, p.handleTarball)
+	p.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go p.server.Serve(listener)
+	log.Info("Serving cached tarballs to peers on ", address)
+	return p, nil
+}
+
+// handleTarball serves a cached tarball or its signature. Ranges are
+// supported so a peer can resume or download in chunks.
+func (p *peerServer) handleTarball(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "GET or HEAD only", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+peerToken)) != 1 {
+		http.Error(w, "missing or wrong peer token", http.StatusUnauthorized)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, peerPath)
+	if !validChecksum(strings.TrimSuffix(name, signatureSuffix)) || normalizeChecksum(name) != name {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := os.Open(filepath.Join(p.dir, name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodGet {
+		log.Info("Serving cached tarball ", name, " to peer ", r.RemoteAddr)
+	}
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
+
+// Close stops serving peers
+func (p *peerServer) Close() {
+	if p == nil {
+		return
+	}
+	p.server.Close()
+	log.Debug("Closed peer server")
+}
+
+// clusterPeers are the -peers base URLs
+func clusterPeers() []string {
+	var peers []string
+	for _, peer := range strings.Split(*peerList, ",") {
+		if peer = strings.TrimRight(strings.TrimSpace(peer), "/"); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// peerSources asks every peer at once whether it has the tarball with this
+// checksum and returns the URLs of those that do, to try before the mirrors
+func peerSources(sum string) []string {
+	peers := clusterPeers()
+	if sum == "" || len(peers) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), peerLookupTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	found := map[string]bool{}
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, peer+peerPath+sum, nil)
+			if err != nil {
+				log.Debug("Skipping peer ", peer, ": ", err)
+				return
+			}
+			setRunHeaders(req)
+			resp, err := downloadClient.Do(req)
+			if err != nil {
+				log.Debug("Peer ", peer, " did not answer: ", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				mu.Lock()
+				found[peer] = true
+				mu.Unlock()
+			}
+		}(peer)
+	}
+	wg.Wait()
+
+	// Keep the -peers order, the nearest peers are listed first
+	var sources []string
+	for _, peer := range peers {
+		if found[peer] {
+			sources = append(sources, peer+peerPath+sum)
+		}
+	}
+	if len(sources) > 0 {
+		log.Info("Found tarball ", sum, " on ", len(sources), " of ", len(peers), " peers")
+	}
+	return sources
+}
+
+// setPeerAuth adds the peer token to requests for a peer's tarballs, and
+// never sends it anywhere else
+func setPeerAuth(req *http.Request) {
+	if peerToken == "" {
+		return
+	}
+	for _, peer := range clusterPeers() {
+		if strings.HasPrefix(req.URL.String(), peer+peerPath) {
+			req.Header.Set("Authorization", "Bearer "+peerToken)
+			return
+		}
+	}
+}
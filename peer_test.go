@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerServer(t *testing.T) {
+	oldDir := *patchDir
+	defer func() { *patchDir = oldDir }()
+	*patchDir = t.TempDir()
+	peerToken = "cluster-secret"
+	defer func() { peerToken = "" }()
+
+	sum, _ := fileChecksum("test.tar.gz")
+	tarball, _ := os.ReadFile("test.tar.gz")
+	os.MkdirAll(cacheDir(), 0755)
+	os.WriteFile(filepath.Join(cacheDir(), sum), tarball, 0644)
+	os.WriteFile(filepath.Join(*patchDir, "secret.txt"), []byte("not shared"), 0644)
+
+	server := httptest.NewServer(http.HandlerFunc((&peerServer{dir: cacheDir()}).handleTarball))
+	defer server.Close()
+	get := func(path string, token string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get(peerPath+sum, "cluster-secret")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(tarball)), resp.ContentLength)
+	assert.Equal(t, http.StatusUnauthorized, get(peerPath+sum, "").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, get(peerPath+sum, "guess").StatusCode)
+	assert.Equal(t, http.StatusNotFound, get(peerPath+sum+signatureSuffix, "cluster-secret").StatusCode)
+	assert.Equal(t, http.StatusNotFound, get(peerPath+"../secret.txt", "cluster-secret").StatusCode)
+	assert.Equal(t, http.StatusNotFound, get(peerPath+"%2e%2e%2fsecret.txt", "cluster-secret").StatusCode)
+
+	peerToken = ""
+	_, err := startPeerServer("127.0.0.1:0")
+	assert.Error(t, err, "no serving without a token")
+}
+
+func TestFetchTarballFromPeer(t *testing.T) {
+	oldDir, oldWeb, oldPeers := *patchDir, *patchWeb, *peerList
+	defer func() { *patchDir, *patchWeb, *peerList = oldDir, oldWeb, oldPeers }()
+	defer func() { tarballChecksums = map[string]map[string]string{} }()
+	fastRetries(t, 3)
+	peerToken = "cluster-secret"
+	defer func() { peerToken = "" }()
+
+	// The node that downloaded the patch first
+	sum, _ := fileChecksum("test.tar.gz")
+	tarball, _ := os.ReadFile("test.tar.gz")
+	*patchDir = t.TempDir()
+	os.MkdirAll(cacheDir(), 0755)
+	os.WriteFile(filepath.Join(cacheDir(), sum), tarball, 0644)
+	seeded := httptest.NewServer(http.HandlerFunc((&peerServer{dir: cacheDir()}).handleTarball))
+	defer seeded.Close()
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) }))
+	defer empty.Close()
+
+	// This node, with S3 out of reach
+	*patchDir = t.TempDir()
+	*patchWeb = "http://127.0.0.1:1/"
+	*peerList = "http://127.0.0.1:1," + empty.URL + ", " + seeded.URL + "/"
+	tarballChecksums["63547"] = map[string]string{"patch-63547.tar.gz": sum}
+	assert.Equal(t, []string{seeded.URL + peerPath + sum}, peerSources(sum))
+	assert.Empty(t, peerSources(""), "a tarball is only found by its checksum")
+
+	path := fetchTarball("sakai-builder/patch-63547.tar.gz", "63547")
+	assert.Equal(t, filepath.Join(cacheDir(), sum), path)
+	assert.NoError(t, verifyChecksum(path, sum))
+}
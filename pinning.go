@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// pinnedHosts maps a portal host name to the base64 SHA-256 SPKI hashes one of
+// its certificates must match. It is filled in before the first request is made.
+var pinnedHosts = map[string][]string{}
+
+// registerPins pins every portal host that has pins configured. Pins are matched
+// on the TLS server name, so the portal URL must use a host name, not an IP.
+func registerPins(portals []*portalConfig) error {
+	for _, portal := range portals {
+		if len(portal.PinSHA256) == 0 {
+			continue
+		}
+		for _, pin := range portal.PinSHA256 {
+			if decoded, err := base64.StdEncoding.DecodeString(pin); err != nil || len(decoded) != sha256.Size {
+				return errors.New("portal " + portal.Name + " has a bad pin_sha256, want base64 of a SHA-256: " + pin)
+			}
+		}
+		for _, base := range portal.baseURLs() {
+			parsed, err := url.Parse(base)
+			if err != nil {
+				return err
+			}
+			host := strings.ToLower(parsed.Hostname())
+			if net.ParseIP(host) != nil {
+				return errors.New("portal " + portal.Name + " needs host names in its url to use pin_sha256")
+			}
+			pinnedHosts[host] = append(pinnedHosts[host], portal.PinSHA256...)
+		}
+	}
+	return nil
+}
+
+// spkiHash is the pin for a certificate, as printed by
+// openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func spkiHash(rawSubjectPublicKeyInfo []byte) string {
+	sum := sha256.Sum256(rawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyPins runs after normal certificate verification. A TLS-intercepting proxy
+// presents a chain from its own CA, which matches none of the portal's pins.
+func verifyPins(cs tls.ConnectionState) error {
+	pins, ok := pinnedHosts[strings.ToLower(cs.ServerName)]
+	if !ok {
+		return nil
+	}
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if containsString(pins, spkiHash(cert.RawSubjectPublicKeyInfo)) {
+				return nil
+			}
+		}
+	}
+	return errors.New("certificate for " + cs.ServerName + " matches no pinned key, refusing to talk to the portal through it")
+}
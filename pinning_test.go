@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertificatePinning(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	defer func() { pinnedHosts = map[string][]string{} }()
+
+	// Pins are per host name, and the test certificate is valid for example.com
+	portalURL := "https://example.com:" + server.URL[strings.LastIndex(server.URL, ":")+1:]
+	get := func() error {
+		config, _ := newTLSConfig("", "", "")
+		config.RootCAs = server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+		transport := &http.Transport{TLSClientConfig: config, DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		}}
+		resp, err := (&http.Client{Transport: transport}).Get(portalURL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	pin := spkiHash(server.Certificate().RawSubjectPublicKeyInfo)
+
+	assert.NoError(t, registerPins([]*portalConfig{{Name: "default", URL: portalURL, PinSHA256: []string{pin}}}))
+	assert.NoError(t, get(), "pinned key matches")
+
+	pinnedHosts = map[string][]string{}
+	other := "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+	assert.NoError(t, registerPins([]*portalConfig{{Name: "default", URL: portalURL, PinSHA256: []string{other}}}))
+	err := get()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "matches no pinned key")
+
+	assert.Error(t, registerPins([]*portalConfig{{Name: "default", URL: portalURL, PinSHA256: []string{"not-a-pin"}}}))
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ottenhoff/go-patcher/v2/archive"
+	log "github.com/sirupsen/logrus"
+)
+
+// Step types the portal can put in a patch pipeline
+const (
+	stepProperties = "properties"
+	stepTarball    = "tarball"
+	stepSQL        = "sql"
+	stepHook       = "hook"
+	stepRestart    = "restart"
+	stepFlag       = "flag"
+	stepGit        = "git"
+	stepDelta      = "delta"
+)
+
+// Per-step statuses reported back to the portal
+const (
+	stepOK      = "ok"
+	stepFailed  = "failed"
+	stepSkipped = "skipped"
+)
+
+const defaultHookDir = "/etc/go-patcher/hooks"
+
+type patchStep struct {
+	Type  string `json:"type"`
+	Value string `json:"value,omitempty"`
+}
+
+type stepResult struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// stepResults is sent to the portal with the final update, per patch ID
+var stepResults = map[string][]stepResult{}
+
+// patchOutcome is what gets reported to the portal for one patch
+type patchOutcome struct {
+	rv      string
+	startup string
+}
+
+// batchStep is a step together with the patch it came from
+type batchStep struct {
+	patchID string
+	step    patchStep
+}
+
+// patchSteps returns the steps for a patch. Portals that don't send steps
+// get the classic sequence: properties, then tarballs.
+func patchSteps(patch *PatchResponse) []patchStep {
+	steps := append([]patchStep(nil), patch.Steps...)
+
+	if len(steps) == 0 {
+		if len(patch.SakaiProps) > 0 {
+			steps = append(steps, patchStep{Type: stepProperties, Value: patch.SakaiProps})
+		}
+		if len(patch.Files) > 3 {
+			steps = append(steps, patchStep{Type: stepTarball, Value: patch.Files})
+		}
+	}
+	return steps
+}
+
+// batchSteps lines up every patch's steps so they share a single downtime.
+// A patch's closing restart is left to the next patch's, so the batch starts
+// the server once. Tomcat is always stopped before the batch, so make sure a
+// restart brings it back.
+func batchSteps(patches []*PatchResponse) []batchStep {
+	var steps []batchStep
+	for i, patch := range patches {
+		own := patchSteps(patch)
+		if n := len(own); i < len(patches)-1 && n > 0 && own[n-1].Type == stepRestart {
+			own = own[:n-1]
+		}
+		for _, step := range own {
+			steps = append(steps, batchStep{patchID: patch.PatchID, step: step})
+		}
+	}
+
+	if len(steps) == 0 || steps[len(steps)-1].step.Type != stepRestart {
+		steps = append(steps, batchStep{patchID: patches[len(patches)-1].PatchID, step: patchStep{Type: stepRestart}})
+	}
+	return steps
+}
+
+// runBatch executes the steps in order and stops at the first failure.
+// Patches applied before a restart share its result; patches that never
+// got to run are deferred so the portal offers them again.
+func runBatch(patches []*PatchResponse, tomcatDir string) map[string]patchOutcome {
+	outcomes := map[string]patchOutcome{}
+	stepResults = map[string][]stepResult{}
+	running := false
+
+	// Patches with steps applied since the last restart, and since the batch began
+	var pending, started []string
+
+	restart := func(patchID string) (rv string, startup string, reason string, err error) {
+		rv, startup = tomcatDown, "-1"
+		if running {
+			activeProfile.stop(tomcatDir)
+			running = false
+		}
+		// Broken archives only show up as a cryptic startup failure, so don't even try
+		if err = checkPatchedArchives(); err != nil {
+			return rv, startup, reasonBrokenArchive, err
+		}
+		doneStarting := trackPhase("startup")
+		rv, startup, err = runRestartStep(tomcatDir, patchID)
+		doneStarting()
+		running = true
+		// Reported even on success, a clean start can still log far more errors than before
+		recordStartupErrors(pending)
+		if err != nil {
+			return rv, startup, reasonStartupFailed, err
+		}
+		if err = checkBatchHealth(patches, pending); err != nil {
+			return tomcatDown, "-1", reasonHealthFailed, err
+		}
+		return rv, startup, "", nil
+	}
+
+	steps := batchSteps(patches)
+	for i, current := range steps {
+		step, patchID := current.step, current.patchID
+		// A cancel lets the patch in hand finish, then brings the server back without the rest
+		if !containsString(started, patchID) && currentRun.canceled() {
+			return cancelBatch(steps[i:], started, pending, outcomes, running, restart)
+		}
+		if !containsString(pending, patchID) {
+			pending = append(pending, patchID)
+		}
+		if !containsString(started, patchID) {
+			started = append(started, patchID)
+		}
+		log.Infof("Running step %d/%d for patch %s: %s", i+1, len(steps), patchID, step.Type)
+		// A restart within a patch's own steps leaves the server up, files aren't changed under it
+		if running && changesServerFiles(step.Type) {
+			log.Info("Stopping ", activeProfile.name(), " again for the steps after the restart")
+			activeProfile.stop(tomcatDir)
+			running = false
+		}
+
+		rv, startup := tomcatDown, "-1"
+		reason := stepFailureReason(step.Type)
+		var err error
+		if step.Type == stepRestart {
+			rv, startup, reason, err = restart(patchID)
+		} else if step.Type == stepTarball {
+			// Download and extract are timed separately
+			err = runStep(step, patchID)
+		} else if step.Type == stepFlag {
+			// Flags after a restart go straight to the running server
+			doneStep := trackPhase(step.Type)
+			err = runFlagStep(step.Value, patchID, running)
+			doneStep()
+		} else {
+			doneStep := trackPhase(step.Type)
+			err = runStep(step, patchID)
+			doneStep()
+		}
+
+		if err != nil {
+			log.Error("Step ", step.Type, " for patch ", patchID, " failed: ", err)
+			outputBuffer.WriteString("Step " + step.Type + " for patch " + patchID + " failed: " + err.Error() + "\n")
+			stepResults[patchID] = append(stepResults[patchID], stepResult{Type: step.Type, Status: stepFailed, Detail: err.Error()})
+
+			for _, id := range pending {
+				outcomes[id] = patchOutcome{rv, startup}
+				if rv != patchDefer {
+					statusReasons[id] = reason
+				}
+			}
+			for _, remaining := range steps[i+1:] {
+				stepResults[remaining.patchID] = append(stepResults[remaining.patchID], stepResult{Type: remaining.step.Type, Status: stepSkipped})
+				if _, ok := outcomes[remaining.patchID]; !ok {
+					outcomes[remaining.patchID] = patchOutcome{patchDefer, "-5"}
+				}
+			}
+			return outcomes
+		}
+
+		if step.Type != stepRestart {
+			stepResults[patchID] = append(stepResults[patchID], stepResult{Type: step.Type, Status: stepOK})
+			continue
+		}
+
+		// Every patch applied since the last restart shares this one
+		for _, id := range pending {
+			stepResults[id] = append(stepResults[id], stepResult{Type: stepRestart, Status: stepOK})
+			outcomes[id] = patchOutcome{rv, startup}
+		}
+		pending = nil
+	}
+
+	return outcomes
+}
+
+// cancelBatch defers the patches that had not started when the run was
+// canceled and restarts the server for the ones that had
+func cancelBatch(remaining []batchStep, started []string, pending []string, outcomes map[string]patchOutcome,
+	running bool, restart func(string) (string, string, string, error)) map[string]patchOutcome {
+	log.Warning("Run canceled through the control API, skipping patches not yet started")
+	outputBuffer.WriteString("Canceled through the control API, patches not yet started were skipped\n")
+	for _, step := range remaining {
+		if containsString(started, step.patchID) {
+			continue
+		}
+		stepResults[step.patchID] = append(stepResults[step.patchID], stepResult{Type: step.step.Type, Status: stepSkipped})
+		outcomes[step.patchID] = patchOutcome{patchDefer, "-5"}
+		statusReasons[step.patchID] = reasonCanceled
+	}
+	if running && len(pending) == 0 {
+		return outcomes
+	}
+
+	// The restart log is named after a patch, fall back to the first canceled one
+	restartFor := remaining[0].patchID
+	if len(pending) > 0 {
+		restartFor = pending[len(pending)-1]
+	}
+	rv, startup, reason, err := restart(restartFor)
+	if err != nil {
+		log.Error("Restart after cancel failed: ", err)
+		outputBuffer.WriteString("Restart after cancel failed: " + err.Error() + "\n")
+	}
+	for _, id := range pending {
+		status := stepOK
+		if err != nil {
+			status = stepFailed
+			statusReasons[id] = reason
+		}
+		stepResults[id] = append(stepResults[id], stepResult{Type: stepRestart, Status: status})
+		outcomes[id] = patchOutcome{rv, startup}
+	}
+	return outcomes
+}
+
+// changesServerFiles reports whether a step writes to the server directory,
+// which must not happen while the server runs
+func changesServerFiles(stepType string) bool {
+	switch stepType {
+	case stepProperties, stepTarball, stepGit, stepDelta:
+		return true
+	}
+	return false
+}
+
+// checkPatchedArchives sweeps the directories this batch's tarballs wrote to for
+// empty or truncated archives, then validates the zip structure of every archive written
+func checkPatchedArchives() error {
+	var files, dirs []string
+	for _, written := range patchedFiles {
+		for _, file := range written {
+			files = append(files, file)
+			dirs = append(dirs, filepath.Dir(file))
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	problems, err := archive.Sweep(".", dirs)
+	if err != nil {
+		return err
+	}
+	var broken, swept []string
+	for _, problem := range problems {
+		broken = append(broken, problem.String())
+		swept = append(swept, problem.Path)
+	}
+	for _, problem := range archive.Validate(".", files) {
+		if !containsString(swept, problem.Path) {
+			broken = append(broken, problem.String())
+		}
+	}
+	if len(broken) == 0 {
+		return nil
+	}
+	return errors.New("broken archives after extraction, not starting " + activeProfile.name() + ": " + strings.Join(broken, "; "))
+}
+
+// runStep runs a single non-restart step, turning panics from the older helpers into errors
+func runStep(step patchStep, patchID string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	// Properties and tarballs write to the server directory, -sandbox keeps them there
+	switch step.Type {
+	case stepProperties:
+		return confined(sandboxDirs(), func() error {
+			activeProfile.applyProperties(step.Value, patchID)
+			return nil
+		})
+	case stepTarball:
+		return confined(sandboxDirs(), func() error {
+			for _, patch := range strings.SplitN(step.Value, " ", 10) {
+				applyTarballPatch(patch, patchID)
+			}
+
+			// Update the version to better cache bust
+			// We are going to save bytes and just use the last two digits of the patch ID
+			activeProfile.applyProperties("portal.cdn.version="+patchID[len(patchID)-3:], patchID)
+			return nil
+		})
+	case stepSQL:
+		return runSQLStep(step.Value)
+	case stepHook:
+		return runHookStep(step.Value, patchID)
+	case stepGit:
+		return runGitStep(step.Value, patchID)
+	case stepDelta:
+		return confined(sandboxDirs(), func() error {
+			return runDeltaStep(step.Value, patchID)
+		})
+	}
+	return nil
+}
+
+// runRestartStep starts the server and waits for it to report a clean startup
+func runRestartStep(tomcatDir string, patchID string) (rv string, startup string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			rv, startup, err = tomcatDown, "-1", fmt.Errorf("%v", r)
+		}
+	}()
+
+	// Time to start up Tomcat
+	activeProfile.start(tomcatDir, patchID)
+
+	rv, startup = waitForStartup()
+	switch rv {
+	case patchSuccess:
+		if err := activeProfile.afterStartup(); err != nil {
+			return tomcatDown, "-1", err
+		}
+		return rv, startup, nil
+	case patchDefer:
+		return rv, startup, errors.New("ignite cache mismatch during startup")
+	}
+	return rv, startup, errors.New(activeProfile.name() + " did not start cleanly")
+}
+
+// waitForStartup checks the server log (logs/catalina.out for Tomcat) for the startup after 40 seconds
+func waitForStartup() (string, string) {
+	waitSeconds := overrides.startupWait(*startupWaitSeconds)
+	if useReadinessProbe() {
+		return waitForReadiness(activeInstance.ReadinessURL, waitSeconds)
+	}
+	defer startSpan("log_watch")()
+	time.Sleep(40 * 1000 * time.Millisecond)
+	for z := 40; z < waitSeconds; z += 10 {
+		serverStartupTime := activeProfile.checkStartup()
+		if strings.Contains(serverStartupTime, "ignite") {
+			log.Warning("Found ignite error in logs. Will try again later.")
+			return patchDefer, "-2"
+		} else if !strings.Contains(serverStartupTime, "false") {
+			return startupResult(serverStartupTime)
+		}
+		time.Sleep(10 * 1000 * time.Millisecond)
+		log.Debug("Checking logs again. Seconds elapsed:", z)
+	}
+
+	// Couldn't find success in Tomcat logs
+	return tomcatDown, "-1"
+}
+
+// startupResult is the outcome of a startup the server logged. A startup time
+// of 0 is a server known to be up without one.
+func startupResult(serverStartupTime string) (string, string) {
+	parsedTime := activeProfile.startupMillis(serverStartupTime)
+	if parsedTime < 0 {
+		return tomcatDown, "-1"
+	}
+	return patchSuccess, strconv.FormatInt(parsedTime, 10)
+}
+
+// runSQLStep feeds the SQL to the mysql client using the datasource from the property files
+func runSQLStep(sql string) error {
+	jdbcURL := readProperty("url@javax.sql.BaseDataSource")
+	if !strings.HasPrefix(jdbcURL, "jdbc:mysql://") && !strings.HasPrefix(jdbcURL, "jdbc:mariadb://") {
+		return errors.New("sql steps need a MySQL datasource, found: " + jdbcURL)
+	}
+
+	// jdbc:mysql://host:port/database?params
+	hostAndDB := jdbcURL[strings.Index(jdbcURL, "//")+2:]
+	hostAndDB = strings.SplitN(hostAndDB, "?", 2)[0]
+	parts := strings.SplitN(hostAndDB, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return errors.New("could not find the database name in " + jdbcURL)
+	}
+	host, port := parts[0], "3306"
+	if i := strings.LastIndex(host, ":"); i > 0 {
+		host, port = host[:i], host[i+1:]
+	}
+
+	cmd := exec.Command(*mysqlClient, "--batch", "--host="+host, "--port="+port,
+		"--user="+readProperty("username@javax.sql.BaseDataSource"), parts[1])
+	cmd.Env = append(os.Environ(), "MYSQL_PWD="+readProperty("password@javax.sql.BaseDataSource"))
+	cmd.Stdin = strings.NewReader(sql)
+	out, err := cmd.CombinedOutput()
+	log.Debug("sql step: ", string(out))
+	outputBuffer.Write(out)
+	return err
+}
+
+// runHookStep runs an operator-installed script from the hook directory
+func runHookStep(hook string, patchID string) error {
+	hook = strings.TrimSpace(hook)
+	if hook == "" || hook != filepath.Base(hook) || strings.HasPrefix(hook, ".") {
+		return errors.New("hook must be a script name inside " + *hookDir + ": " + hook)
+	}
+
+	tomcatDir, _ := os.Getwd()
+	cmd := exec.Command(filepath.Join(*hookDir, hook))
+	cmd.Env = append(os.Environ(), "PATCH_ID="+patchID, "TOMCAT_DIR="+tomcatDir, "RUN_ID="+runID)
+	out, err := cmd.CombinedOutput()
+	log.Debug("hook ", hook, ": ", string(out))
+	outputBuffer.Write(out)
+	return err
+}
+
+// readProperty returns the effective value of a key, later property files winning
+func readProperty(key string) string {
+	return effectiveProperty(activeProfile.propertyDir(), key)
+}
+
+// effectiveProperty reads a key from the property files in propertyDir, later files winning
+func effectiveProperty(propertyDir string, key string) string {
+	value := ""
+	for _, propertyFile := range propertyFiles {
+		input, err := os.ReadFile(propertyDir + "/" + propertyFile)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(input), "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, key+"=") {
+				value = strings.TrimSpace(strings.TrimPrefix(line, key+"="))
+			}
+		}
+	}
+	return value
+}
+
+// stepSummary encodes the per-step results of a patch for the portal
+func stepSummary(patchID string) string {
+	if len(stepResults[patchID]) == 0 {
+		return ""
+	}
+	encoded, err := json.Marshal(stepResults[patchID])
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
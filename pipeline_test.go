@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatchStepsLegacy(t *testing.T) {
+	patch := &PatchResponse{
+		PatchID:    "63547",
+		TomcatDir:  "/opt/tomcat",
+		Files:      "/patches/a.tar.gz /patches/b.tar.gz",
+		SakaiProps: "version.sakai=23.4",
+	}
+
+	assert.Equal(t, []batchStep{
+		{patchID: "63547", step: patchStep{Type: stepProperties, Value: "version.sakai=23.4"}},
+		{patchID: "63547", step: patchStep{Type: stepTarball, Value: "/patches/a.tar.gz /patches/b.tar.gz"}},
+		{patchID: "63547", step: patchStep{Type: stepRestart}},
+	}, batchSteps([]*PatchResponse{patch}))
+}
+
+func TestBatchStepsRestartOnce(t *testing.T) {
+	patches := []*PatchResponse{
+		{PatchID: "63547", Steps: []patchStep{{Type: stepTarball, Value: "/patches/a.tar.gz"}, {Type: stepRestart}}},
+		{PatchID: "63548", Steps: []patchStep{{Type: stepProperties, Value: "a=b"}, {Type: stepRestart}, {Type: stepFlag, Value: "x=y"}}},
+		{PatchID: "63549", Steps: []patchStep{{Type: stepDelta, Value: "/patches/c.json"}, {Type: stepRestart}}},
+	}
+
+	// Only a restart the patch's own later steps need stays in the middle
+	assert.Equal(t, []batchStep{
+		{patchID: "63547", step: patchStep{Type: stepTarball, Value: "/patches/a.tar.gz"}},
+		{patchID: "63548", step: patchStep{Type: stepProperties, Value: "a=b"}},
+		{patchID: "63548", step: patchStep{Type: stepRestart}},
+		{patchID: "63548", step: patchStep{Type: stepFlag, Value: "x=y"}},
+		{patchID: "63549", step: patchStep{Type: stepDelta, Value: "/patches/c.json"}},
+		{patchID: "63549", step: patchStep{Type: stepRestart}},
+	}, batchSteps(patches))
+	assert.True(t, changesServerFiles(stepDelta), "the server is stopped again before it")
+	assert.False(t, changesServerFiles(stepFlag))
+}
+
+func TestPatchStepsFromPortal(t *testing.T) {
+	raw := `{"patch_id": "63547", "tomcat_dir": "/opt/tomcat", "steps": [
+		{"type": "hook", "value": "drain-node"},
+		{"type": "sql", "value": "UPDATE SAKAI_SITE SET TITLE='x'"},
+		{"type": "restart"},
+		{"type": "hook", "value": "warm-caches"}
+	]}`
+	patch, err := decodePatchResponse([]byte(raw))
+	if err != nil {
+		t.Fatalf("Failed to decode patch JSON: %v", err)
+	}
+
+	steps := patchSteps(patch)
+	assert.Len(t, steps, 4)
+	assert.Equal(t, stepSQL, steps[1].Type)
+	assert.Equal(t, patchStep{Type: stepHook, Value: "warm-caches"}, steps[3])
+}
+
+func TestRunBatchStopsAtFirstFailure(t *testing.T) {
+	dir := t.TempDir()
+	*hookDir = dir
+	defer func() { *hookDir = defaultHookDir }()
+	os.WriteFile(filepath.Join(dir, "ok.sh"), []byte("#!/bin/sh\nexit 0\n"), 0755)
+	os.WriteFile(filepath.Join(dir, "fail.sh"), []byte("#!/bin/sh\nexit 3\n"), 0755)
+
+	patches := []*PatchResponse{
+		{PatchID: "63547", TomcatDir: dir, Steps: []patchStep{{Type: stepHook, Value: "ok.sh"}}},
+		{PatchID: "63548", TomcatDir: dir, Steps: []patchStep{{Type: stepHook, Value: "fail.sh"}, {Type: stepHook, Value: "ok.sh"}}},
+		{PatchID: "63549", TomcatDir: dir, Steps: []patchStep{{Type: stepHook, Value: "ok.sh"}}},
+	}
+	statusReasons = map[string]string{}
+	outcomes := runBatch(patches, dir)
+
+	// Tomcat was never started again, so the applied patches are down and the last one never ran
+	assert.Equal(t, map[string]patchOutcome{
+		"63547": {tomcatDown, "-1"},
+		"63548": {tomcatDown, "-1"},
+		"63549": {patchDefer, "-5"},
+	}, outcomes)
+	assert.Equal(t, []stepResult{{Type: stepHook, Status: stepOK}}, stepResults["63547"])
+	assert.Equal(t, []stepResult{
+		{Type: stepHook, Status: stepFailed, Detail: "exit status 3"},
+		{Type: stepHook, Status: stepSkipped},
+	}, stepResults["63548"])
+	assert.Equal(t, []stepResult{
+		{Type: stepHook, Status: stepSkipped},
+		{Type: stepRestart, Status: stepSkipped},
+	}, stepResults["63549"])
+	assert.Equal(t, map[string]string{"63547": reasonHookFailed, "63548": reasonHookFailed}, statusReasons)
+
+	assert.Error(t, runHookStep("../fail.sh", "63547"), "hooks outside the hook dir are refused")
+}
+
+func TestRunBatchSweepsBeforeRestart(t *testing.T) {
+	dir := t.TempDir()
+	*hookDir = dir
+	defer func() { *hookDir = defaultHookDir }()
+	os.WriteFile(filepath.Join(dir, "ok.sh"), []byte("#!/bin/sh\nexit 0\n"), 0755)
+	os.MkdirAll(filepath.Join(dir, "lib"), 0755)
+	os.WriteFile(filepath.Join(dir, "lib/sakai-kernel-api-23.1.jar"), nil, 0644)
+
+	originalWd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(originalWd)
+	patchedFiles = map[string][]string{"63547": {"lib/sakai-kernel-api-23.1.jar"}}
+	defer func() { patchedFiles = map[string][]string{} }()
+
+	// Never gets as far as starting Tomcat
+	statusReasons = map[string]string{}
+	outcomes := runBatch([]*PatchResponse{{PatchID: "63547", TomcatDir: dir, Steps: []patchStep{{Type: stepHook, Value: "ok.sh"}}}}, dir)
+	assert.Equal(t, map[string]patchOutcome{"63547": {tomcatDown, "-1"}}, outcomes)
+	assert.Equal(t, stepResult{Type: stepRestart, Status: stepFailed,
+		Detail: "broken archives after extraction, not starting tomcat: lib/sakai-kernel-api-23.1.jar is empty"}, stepResults["63547"][1])
+	assert.Equal(t, reasonBrokenArchive, statusReasons["63547"])
+}
+
+func TestReadProperty(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.MkdirAll(tmpDir+"/sakai", 0755)
+	os.WriteFile(tmpDir+"/sakai/sakai.properties", []byte("url@javax.sql.BaseDataSource=jdbc:hsqldb:mem:sakai\n"), 0644)
+	os.WriteFile(tmpDir+"/sakai/local.properties", []byte("url@javax.sql.BaseDataSource=jdbc:mysql://db:3306/sakai\n"), 0644)
+
+	originalWd, _ := os.Getwd()
+	os.Chdir(tmpDir)
+	defer os.Chdir(originalWd)
+
+	assert.Equal(t, "jdbc:mysql://db:3306/sakai", readProperty("url@javax.sql.BaseDataSource"))
+	assert.Equal(t, "", readProperty("missing.key"))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+)
+
+// Local expectations about what a portal may ask for. A compromised portal
+// account should not be able to point the patcher at arbitrary directories.
+
+// validatePolicy checks the allowed_dirs globs and the allowed_patch_ids pattern
+func (p *portalConfig) validatePolicy() error {
+	for _, pattern := range p.AllowedDirs {
+		if !filepath.IsAbs(pattern) {
+			return fmt.Errorf("portal %s: allowed_dirs entry %s must be an absolute path", p.Name, pattern)
+		}
+		if _, err := filepath.Match(pattern, "/"); err != nil {
+			return fmt.Errorf("portal %s: bad allowed_dirs entry %s: %w", p.Name, pattern, err)
+		}
+	}
+	if p.AllowedPatchIDs != "" {
+		if _, err := regexp.Compile(p.AllowedPatchIDs); err != nil {
+			return fmt.Errorf("portal %s: bad allowed_patch_ids: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// checkPolicy rejects patches whose tomcat_dir or patch ID fall outside what
+// this host expects from the portal. Without a policy everything is allowed.
+func (p *portalConfig) checkPolicy(patch *PatchResponse) error {
+	if len(p.AllowedDirs) > 0 {
+		// Clean first so /opt/tomcats/../../etc can't sneak past /opt/tomcats/*
+		dir := filepath.Clean(patch.TomcatDir)
+		allowed := false
+		for _, pattern := range p.AllowedDirs {
+			if matched, _ := filepath.Match(pattern, dir); matched {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errors.New("tomcat_dir " + patch.TomcatDir + " is not in allowed_dirs")
+		}
+	}
+	if p.AllowedPatchIDs != "" {
+		pattern := regexp.MustCompile("^(?:" + p.AllowedPatchIDs + ")$")
+		if !pattern.MatchString(patch.PatchID) {
+			return errors.New("patch ID " + patch.PatchID + " does not match allowed_patch_ids")
+		}
+	}
+	return nil
+}
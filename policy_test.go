@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPolicy(t *testing.T) {
+	portal := &portalConfig{Name: "a", AllowedDirs: []string{"/opt/tomcats/*"}, AllowedPatchIDs: `\d+`}
+	assert.NoError(t, portal.validatePolicy())
+
+	testCases := []struct {
+		dir, id string
+		allowed bool
+	}{
+		{"/opt/tomcats/sakai", "12345", true},
+		{"/opt/tomcats/sakai/", "12345", true},
+		{"/opt/tomcats/../../etc", "12345", false},
+		{"/opt/tomcats/sakai/webapps", "12345", false},
+		{"/var/lib/tomcat", "12345", false},
+		{"/opt/tomcats/sakai", "12345; rm", false},
+	}
+	for _, tc := range testCases {
+		err := portal.checkPolicy(&PatchResponse{TomcatDir: tc.dir, PatchID: tc.id})
+		assert.Equal(t, tc.allowed, err == nil, tc.dir+" "+tc.id)
+	}
+
+	// No policy, anything goes
+	assert.NoError(t, (&portalConfig{}).checkPolicy(&PatchResponse{TomcatDir: "/etc", PatchID: "x"}))
+}
+
+func TestValidatePolicy(t *testing.T) {
+	assert.Error(t, (&portalConfig{AllowedDirs: []string{"tomcats/*"}}).validatePolicy())
+	assert.Error(t, (&portalConfig{AllowedDirs: []string{"/opt/[tomcats"}}).validatePolicy())
+	assert.Error(t, (&portalConfig{AllowedPatchIDs: "("}).validatePolicy())
+}
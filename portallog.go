@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const logStreamPath = "/longsight/remote/patch/log"
+
+// streamLogToPortal sends the live stream to the portal as one chunked POST
+// for the run, so the admin UI can show a long startup as it happens. The
+// final update still carries the whole output. Call the returned func once
+// the run is over to end the request.
+func streamLogToPortal(patchIDs []string) func() {
+	// Hosts that keep log excerpts to themselves don't stream them either
+	if !*streamToPortal || live == nil || resultDetail != detailFull {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := net.Pipe()
+	query := url.Values{"patch_id": {strings.Join(patchIDs, ",")}, "run_id": {runID}}
+	req, err := http.NewRequestWithContext(ctx, "POST", activePortal.endpoint(logStreamPath)+"?"+query.Encode(), reader)
+	if err != nil {
+		cancel()
+		log.Warning("Could not stream output to the portal: ", err)
+		return func() {}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	setPortalHeaders(req)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.DefaultClient.Do(req)
+		// Without a reader the live stream drops this client on its next write
+		reader.Close()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warning("Streaming output to the portal failed: ", err)
+			}
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			log.Debug("Portal ", activePortal.Name, " does not take streamed output")
+		} else if resp.StatusCode >= 300 {
+			log.Warning("Portal responded ", resp.Status, " to streamed output")
+		}
+	}()
+	live.attach(writer)
+
+	return func() {
+		writer.Close()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+		}
+		cancel()
+		<-done
+	}
+}
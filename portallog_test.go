@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamLogToPortal(t *testing.T) {
+	lines := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, logStreamPath, r.URL.Path)
+		assert.Equal(t, "63547,63548", r.URL.Query().Get("patch_id"))
+		assert.Equal(t, []string{"chunked"}, r.TransferEncoding)
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}))
+	defer server.Close()
+
+	oldPortal, oldLive := activePortal, live
+	activePortal, live = &portalConfig{Name: "default", URL: server.URL}, newLiveStream()
+	*streamToPortal = true
+	defer func() {
+		live.Close()
+		activePortal, live, *streamToPortal = oldPortal, oldLive, false
+	}()
+
+	stop := streamLogToPortal([]string{"63547", "63548"})
+	live.Write([]byte("INFO: Server startup in [95000] milliseconds\n"))
+
+	// Lines arrive while the run is still going
+	select {
+	case line := <-lines:
+		assert.Equal(t, "INFO: Server startup in [95000] milliseconds", line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("streamed line never reached the portal")
+	}
+	live.Write([]byte("Patch 63548 done\n"))
+	stop()
+	assert.Equal(t, "Patch 63548 done", <-lines)
+	_, open := <-lines
+	assert.False(t, open, "request ends with the run")
+}
+
+func TestStreamLogToPortalRespectsResultDetail(t *testing.T) {
+	oldLive := live
+	live = newLiveStream()
+	*streamToPortal = true
+	resultDetail = detailSummary
+	defer func() {
+		live.Close()
+		live, *streamToPortal, resultDetail = oldLive, false, detailFull
+	}()
+
+	requests := 0
+	http.DefaultClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests++
+		return nil, http.ErrServerClosed
+	})
+	defer func() { http.DefaultClient.Transport = nil }()
+
+	streamLogToPortal([]string{"63547"})()
+	assert.Equal(t, 0, requests)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultPortalURL = "https://admin.longsight.com"
+const defaultPortalsFile = "/etc/go-patcher/portals.yaml"
+const defaultPortalName = "default"
+
+// portalConfig is one admin portal account. A host can serve Tomcats managed by
+// several portals; each only ever sees and patches its own instances.
+type portalConfig struct {
+	Name string `yaml:"name"`
+	// URL is one base URL, or several comma-separated ones to fail over between
+	URL       string   `yaml:"url"`
+	Token     string   `yaml:"token"`
+	TokenFile string   `yaml:"token_file"`
+	Instances []string `yaml:"instances"`
+
+	// HMACSecret verifies the signature on patch JSON and refreshed download
+	// URLs, see verifySignature
+	HMACSecret     string `yaml:"hmac_secret"`
+	HMACSecretFile string `yaml:"hmac_secret_file"`
+
+	// PinSHA256 are base64 SPKI hashes, one of which the portal's certificate chain must match
+	PinSHA256 []string `yaml:"pin_sha256"`
+
+	// AllowedDirs are globs the tomcat_dir of every patch must match, see checkPolicy
+	AllowedDirs []string `yaml:"allowed_dirs"`
+	// AllowedPatchIDs is a regular expression every patch ID must match in full
+	AllowedPatchIDs string `yaml:"allowed_patch_ids"`
+
+	// Locale picks the language pack for notifications, e.g. fr or es_MX, see languagePackFor
+	Locale string `yaml:"locale"`
+
+	// Scope is what this host lets the token do, see tokenScope
+	Scope string `yaml:"scope"`
+	// granted is the scope the portal sent with the last patch check
+	granted tokenScope
+	// richStatus is set when the portal accepts the status model, see statusFor
+	richStatus bool
+
+	// current indexes the base URL in use, see withFailover
+	current atomic.Int32
+	// tokenMu guards Token once the daemon's heartbeats run beside the patch cycles
+	tokenMu sync.RWMutex
+}
+
+type portalList struct {
+	Portals []*portalConfig `yaml:"portals"`
+}
+
+// activePortal is the portal the current patch cycle talks to
+var activePortal = &portalConfig{Name: defaultPortalName, URL: defaultPortalURL}
+
+// endpoint builds a portal URL from a path such as "/longsight/json/patches"
+func (p *portalConfig) endpoint(path string) string {
+	return p.currentURL() + path
+}
+
+// authToken is the portal token, which rotateToken may change at any time
+func (p *portalConfig) authToken() string {
+	p.tokenMu.RLock()
+	defer p.tokenMu.RUnlock()
+	return p.Token
+}
+
+// servesInstance reports whether patches from this portal may touch dir.
+// A portal without an instance list is the only portal and serves everything.
+func (p *portalConfig) servesInstance(dir string) bool {
+	if len(p.Instances) == 0 {
+		return true
+	}
+	for _, instance := range p.Instances {
+		if filepath.Clean(instance) == filepath.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadPortals reads the portal accounts for this host. Without a portals file
+// the host talks to a single portal given by -portal and -token.
+func loadPortals(portalsPath string) ([]*portalConfig, error) {
+	input, err := os.ReadFile(portalsPath)
+	if os.IsNotExist(err) {
+		portal := &portalConfig{Name: defaultPortalName, URL: *portalURL, Token: *token, TokenFile: *tokenFile, HMACSecretFile: *hmacSecretFile}
+		if *pinSHA256 != "" {
+			portal.PinSHA256 = strings.Split(*pinSHA256, ",")
+		}
+		if *allowedDirs != "" {
+			portal.AllowedDirs = strings.Split(*allowedDirs, ",")
+		}
+		portal.AllowedPatchIDs = *allowedPatchIDs
+		portal.Scope = *tokenScopeFlag
+		if _, err := parseScope(portal.Scope); err != nil {
+			return nil, fmt.Errorf("bad -token-scope: %w", err)
+		}
+		if err := portal.validateURLs(); err != nil {
+			return nil, err
+		}
+		if err := portal.validatePolicy(); err != nil {
+			return nil, err
+		}
+		if err := portal.readHMACSecret(); err != nil {
+			return nil, err
+		}
+		return []*portalConfig{portal}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config := &portalList{}
+	if err := yaml.Unmarshal(input, config); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", portalsPath, err)
+	}
+	if len(config.Portals) == 0 {
+		return nil, errors.New("no portals listed in " + portalsPath)
+	}
+
+	names := map[string]bool{}
+	owners := map[string]string{}
+	for i, portal := range config.Portals {
+		if portal.Name == "" {
+			return nil, fmt.Errorf("portals[%d].name is missing", i)
+		}
+		if names[portal.Name] {
+			return nil, fmt.Errorf("portal %s is listed twice", portal.Name)
+		}
+		names[portal.Name] = true
+
+		if portal.URL == "" {
+			portal.URL = defaultPortalURL
+		}
+		if err := portal.validateURLs(); err != nil {
+			return nil, err
+		}
+		if portal.TokenFile != "" {
+			if portal.Token, err = readSecretFile(portal.TokenFile); err != nil {
+				return nil, fmt.Errorf("portal %s: %w", portal.Name, err)
+			}
+		}
+		if portal.Token == "" {
+			return nil, fmt.Errorf("portal %s has no token or token_file", portal.Name)
+		}
+		if err := portal.readHMACSecret(); err != nil {
+			return nil, err
+		}
+		if err := portal.validatePolicy(); err != nil {
+			return nil, err
+		}
+		if _, err := parseScope(portal.Scope); err != nil {
+			return nil, fmt.Errorf("portal %s has a bad scope: %w", portal.Name, err)
+		}
+
+		if len(config.Portals) > 1 && len(portal.Instances) == 0 {
+			return nil, fmt.Errorf("portal %s must list its instances when several portals share this host", portal.Name)
+		}
+		for _, instance := range portal.Instances {
+			dir := filepath.Clean(instance)
+			if owner, ok := owners[dir]; ok {
+				return nil, fmt.Errorf("instance %s belongs to both %s and %s", dir, owner, portal.Name)
+			}
+			owners[dir] = portal.Name
+		}
+	}
+	log.Debug("Loaded ", len(config.Portals), " portals from ", portalsPath)
+	return config.Portals, nil
+}
+
+func (p *portalConfig) readHMACSecret() error {
+	if p.HMACSecretFile == "" {
+		return nil
+	}
+	secret, err := readSecretFile(p.HMACSecretFile)
+	if err != nil {
+		return fmt.Errorf("portal %s: %w", p.Name, err)
+	}
+	p.HMACSecret = secret
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPortals(t *testing.T) {
+	dir := t.TempDir()
+	portals, err := loadPortals(filepath.Join(dir, "missing.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, []*portalConfig{{Name: defaultPortalName, URL: defaultPortalURL, Token: *token}}, portals)
+
+	tokenFile := filepath.Join(dir, "tenant-b.token")
+	os.WriteFile(tokenFile, []byte("secret-b\n"), 0600)
+	portalsPath := filepath.Join(dir, "portals.yaml")
+	os.WriteFile(portalsPath, []byte(`portals:
+  - name: longsight
+    token: secret-a
+    instances: [/opt/tomcat-a]
+  - name: tenant-b
+    url: https://patches.tenant-b.example.edu
+    token_file: `+tokenFile+`
+    instances: [/opt/tomcat-b/]
+`), 0644)
+	portals, err = loadPortals(portalsPath)
+	assert.NoError(t, err)
+	assert.Len(t, portals, 2)
+	assert.Equal(t, "https://admin.longsight.com/longsight/json/patches", portals[0].endpoint(patchesPath))
+	assert.Equal(t, "secret-b", portals[1].Token)
+	assert.True(t, portals[1].servesInstance("/opt/tomcat-b"))
+	assert.False(t, portals[1].servesInstance("/opt/tomcat-a"), "tenants never patch each other's instances")
+
+	testCases := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{"No token", "portals:\n  - name: a\n", "portal a has no token or token_file"},
+		{"Duplicate", "portals:\n  - {name: a, token: x, instances: [/opt/a]}\n  - {name: a, token: y, instances: [/opt/b]}\n", "portal a is listed twice"},
+		{"Unscoped", "portals:\n  - {name: a, token: x}\n  - {name: b, token: y, instances: [/opt/b]}\n", "portal a must list its instances when several portals share this host"},
+		{"Shared instance", "portals:\n  - {name: a, token: x, instances: [/opt/t]}\n  - {name: b, token: y, instances: [/opt/t/]}\n", "instance /opt/t belongs to both a and b"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			os.WriteFile(portalsPath, []byte(tc.yaml), 0644)
+			_, err := loadPortals(portalsPath)
+			assert.EqualError(t, err, tc.want)
+		})
+	}
+}
+
+func TestPortalIsolation(t *testing.T) {
+	defer func() { activePortal = &portalConfig{Name: defaultPortalName, URL: defaultPortalURL} }()
+
+	records := []runRecord{
+		{PatchID: "63540", Result: patchSuccess},
+		{Portal: "tenant-b", PatchID: "900", Result: patchSuccess},
+	}
+	assert.Equal(t, "/var/lib/go-patcher/spool", spoolDir())
+	assert.Equal(t, map[string]bool{"63540": true}, appliedPatches(records))
+
+	activePortal = &portalConfig{Name: "tenant-b"}
+	assert.Equal(t, "/var/lib/go-patcher/spool/tenant-b", spoolDir())
+	assert.Equal(t, map[string]bool{"900": true}, appliedPatches(records))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// propertyBackupsKept is how many runs' property backups stay in the state dir
+const propertyBackupsKept = 10
+
+// prefetch is the work done before and while the server shuts down: every
+// tarball of the batch is downloaded and read through before the server is
+// stopped, so a corrupt one never costs any downtime, and the property files
+// are backed up during the shutdown wait.
+type prefetch struct {
+	wg       sync.WaitGroup
+	tarballs map[string]*prefetchedTarball
+}
+
+type prefetchedTarball struct {
+	// name is what errors call it
+	name string
+	done chan struct{}
+	path string
+	err  error
+	// size is what the tarball extracts to
+	size int64
+}
+
+// activePrefetch is the prefetch of the batch being applied, nil outside one
+var activePrefetch *prefetch
+
+// prefetchBatch starts fetching the batch's tarballs in the background and
+// backing up the property files. Call wait before the next batch.
+func prefetchBatch(batch []*PatchResponse) *prefetch {
+	p := &prefetch{tarballs: map[string]*prefetchedTarball{}}
+	type download struct {
+		tarball, patchID string
+		delta            bool
+	}
+	var downloads []download
+	for _, current := range batchSteps(batch) {
+		// Deltas are built next to the running server, the step only swaps the file in
+		if current.step.Type == stepDelta {
+			if _, ok := p.tarballs[current.step.Value]; !ok {
+				p.tarballs[current.step.Value] = &prefetchedTarball{name: "delta " + strings.Fields(current.step.Value)[0], done: make(chan struct{})}
+				downloads = append(downloads, download{current.step.Value, current.patchID, true})
+			}
+			continue
+		}
+		// Streamed tarballs are downloaded by their step, straight into the server directory
+		if current.step.Type != stepTarball || *streamDownload {
+			continue
+		}
+		for _, tarball := range strings.SplitN(current.step.Value, " ", 10) {
+			if _, ok := p.tarballs[tarball]; ok {
+				continue
+			}
+			p.tarballs[tarball] = &prefetchedTarball{name: "tarball " + path.Base(redactURL(tarball)), done: make(chan struct{})}
+			downloads = append(downloads, download{tarball, current.patchID, false})
+		}
+	}
+
+	// Downloads share the bandwidth, so one after the other in the order the steps need them
+	p.wg.Add(2)
+	go func() {
+		defer p.wg.Done()
+		if err := os.MkdirAll(*patchDir, 0755); err != nil {
+			log.Warning("Could not prepare the patch dir: ", err)
+		}
+		for _, d := range downloads {
+			fetched := p.tarballs[d.tarball]
+			if d.delta {
+				fetched.path, fetched.err = buildFromDelta(d.tarball, ".", d.patchID)
+				if info, err := os.Stat(fetched.path); fetched.err == nil && err == nil {
+					fetched.size = info.Size()
+				}
+			} else {
+				fetched.path, fetched.err = fetchTarballSafely(d.tarball, d.patchID)
+				if fetched.err == nil {
+					fetched.size, fetched.err = checkFetchedTarball(fetched.path)
+				}
+			}
+			close(fetched.done)
+		}
+	}()
+	go func() {
+		defer p.wg.Done()
+		if dir, err := backupPropertyFiles(activeProfile.propertyDir()); err != nil {
+			log.Warning("Could not back up property files: ", err)
+		} else if dir != "" {
+			log.Info("Backed up property files to ", dir)
+		}
+	}()
+	return p
+}
+
+// tarball waits for a prefetched tarball. It reports false for tarballs the
+// prefetch didn't cover, which the caller then fetches itself.
+func (p *prefetch) tarball(tarball string) (string, bool, error) {
+	if p == nil {
+		return "", false, nil
+	}
+	fetched, ok := p.tarballs[tarball]
+	if !ok {
+		return "", false, nil
+	}
+	<-fetched.done
+	return fetched.path, true, fetched.err
+}
+
+// tarballsReady waits for every tarball and returns the first that couldn't be
+// fetched or read, the point where the run can still be called off
+func (p *prefetch) tarballsReady() error {
+	if p == nil {
+		return nil
+	}
+	tarballs := make([]string, 0, len(p.tarballs))
+	for tarball := range p.tarballs {
+		tarballs = append(tarballs, tarball)
+	}
+	sort.Strings(tarballs)
+	for _, tarball := range tarballs {
+		fetched := p.tarballs[tarball]
+		<-fetched.done
+		if fetched.err != nil {
+			return fmt.Errorf("%s: %w", fetched.name, fetched.err)
+		}
+	}
+	return nil
+}
+
+// extractedSize is what the batch's tarballs add up to once extracted. Call
+// it after tarballsReady.
+func (p *prefetch) extractedSize() int64 {
+	if p == nil {
+		return 0
+	}
+	var size int64
+	for _, fetched := range p.tarballs {
+		size += fetched.size
+	}
+	return size
+}
+
+// checkFetchedTarball reads a tarball through, gzip or zstd checksums, tar
+// headers and all, and returns what it extracts to. A bad copy in the cache is
+// removed so the next run downloads it again; any other is left for an
+// operator to look at.
+func checkFetchedTarball(fetchedPath string) (int64, error) {
+	size, err := measureArchiveFile(fetchedPath)
+	if err == nil {
+		return size, nil
+	}
+	if filepath.Dir(fetchedPath) == cacheDir() {
+		os.Remove(fetchedPath)
+		os.Remove(fetchedPath + signatureSuffix)
+	}
+	return 0, fmt.Errorf("%s is corrupt: %w", fetchedPath, err)
+}
+
+// wait blocks until the prefetch is done, so a batch that ends early doesn't
+// leave a download running into the next one
+func (p *prefetch) wait() {
+	if p != nil {
+		p.wg.Wait()
+	}
+}
+
+// fetchTarballSafely is fetchTarball with its panics as errors
+func fetchTarballSafely(tarball string, patchID string) (string, error) {
+	return fetchPatchFileSafely(tarball, patchID, true)
+}
+
+// fetchPatchFileSafely is fetchPatchFile with its panics as errors
+func fetchPatchFileSafely(file string, patchID string, isArchive bool) (path string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return fetchPatchFile(file, patchID, isArchive), nil
+}
+
+// backupPropertyFiles copies the property files into a fresh directory under
+// the state dir, keeping the last propertyBackupsKept runs. It returns the
+// directory, or "" if there was nothing to back up.
+func backupPropertyFiles(propertyDir string) (string, error) {
+	root := filepath.Join(*stateDir, "property-backups")
+	dir := filepath.Join(root, time.Now().Format("20060102-150405")+"-"+runID)
+	copied := 0
+	for _, propertyFile := range propertyFiles {
+		input, err := os.ReadFile(filepath.Join(propertyDir, propertyFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(filepath.Join(dir, propertyFile), input, 0600); err != nil {
+			return "", err
+		}
+		copied++
+	}
+	if copied == 0 {
+		return "", nil
+	}
+
+	// Names start with the time, so the oldest sort first
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return dir, err
+	}
+	var backups []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			backups = append(backups, entry.Name())
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > propertyBackupsKept {
+		os.RemoveAll(filepath.Join(root, backups[0]))
+		backups = backups[1:]
+	}
+	return dir, nil
+}
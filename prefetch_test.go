@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefetchBatch(t *testing.T) {
+	tarball, _ := os.ReadFile("test.tar.gz")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(tarball)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	defer func(patch, state string) { *patchDir, *stateDir = patch, state }(*patchDir, *stateDir)
+	*patchDir, *stateDir = filepath.Join(dir, "patches"), filepath.Join(dir, "state")
+	tomcatDir := filepath.Join(dir, "tomcat")
+	os.MkdirAll(filepath.Join(tomcatDir, "sakai"), 0755)
+	os.WriteFile(filepath.Join(tomcatDir, "sakai", "sakai.properties"), []byte("portal.cdn.version=123\n"), 0644)
+	originalWd, _ := os.Getwd()
+	os.Chdir(tomcatDir)
+	defer os.Chdir(originalWd)
+
+	url := server.URL + "/sakai-builder/patch.tar.gz"
+	batch := []*PatchResponse{
+		{PatchID: "63547", TomcatDir: tomcatDir, Files: url},
+		// The same tarball is only downloaded once
+		{PatchID: "63548", TomcatDir: tomcatDir, Steps: []patchStep{{Type: stepTarball, Value: url}}},
+	}
+	p := prefetchBatch(batch)
+	path, prefetched, err := p.tarball(url)
+	assert.NoError(t, err)
+	assert.True(t, prefetched)
+	assert.Equal(t, cacheDir(), filepath.Dir(path))
+
+	_, prefetched, _ = p.tarball(server.URL + "/other.tar.gz")
+	assert.False(t, prefetched, "tarballs outside the batch are fetched by the step")
+	p.wait()
+	assert.Equal(t, 1, requests)
+
+	backups, _ := filepath.Glob(filepath.Join(*stateDir, "property-backups", "*", "sakai.properties"))
+	if assert.Len(t, backups, 1) {
+		backup, _ := os.ReadFile(backups[0])
+		assert.Equal(t, "portal.cdn.version=123\n", string(backup))
+	}
+}
+
+func TestBackupPropertyFilesPrunes(t *testing.T) {
+	dir := t.TempDir()
+	defer func(state string) { *stateDir = state }(*stateDir)
+	*stateDir = dir
+	root := filepath.Join(dir, "property-backups")
+	for i := 0; i < propertyBackupsKept+2; i++ {
+		os.MkdirAll(filepath.Join(root, fmt.Sprintf("20200101-0000%02d-old", i)), 0700)
+	}
+
+	// Nothing to back up leaves the old backups alone
+	backup, err := backupPropertyFiles(filepath.Join(dir, "missing"))
+	assert.NoError(t, err)
+	assert.Empty(t, backup)
+
+	propertyDir := filepath.Join(dir, "sakai")
+	os.MkdirAll(propertyDir, 0755)
+	os.WriteFile(filepath.Join(propertyDir, "local.properties"), []byte("a=b\n"), 0644)
+	backup, err = backupPropertyFiles(propertyDir)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(backup, "local.properties"))
+
+	entries, _ := os.ReadDir(root)
+	assert.Len(t, entries, propertyBackupsKept)
+	assert.Equal(t, "20200101-000003-old", entries[0].Name(), "the oldest go first")
+}
+
+func TestPrefetchChecksTarballsBeforeShutdown(t *testing.T) {
+	dir := t.TempDir()
+	defer func(patch, state string) { *patchDir, *stateDir = patch, state }(*patchDir, *stateDir)
+	*patchDir, *stateDir = filepath.Join(dir, "patches"), filepath.Join(dir, "state")
+	defer func() { tarballChecksums = map[string]map[string]string{} }()
+
+	// Right checksum, but cut off inside the gzip stream
+	tarball, _ := os.ReadFile("test.tar.gz")
+	truncated := tarball[:len(tarball)-20]
+	sum := sha256.Sum256(truncated)
+	cached := filepath.Join(cacheDir(), hex.EncodeToString(sum[:]))
+	os.MkdirAll(cacheDir(), 0755)
+	os.WriteFile(cached, truncated, 0644)
+	tarballChecksums["63547"] = map[string]string{"patch.tar.gz": hex.EncodeToString(sum[:])}
+
+	p := prefetchBatch([]*PatchResponse{{PatchID: "63547", TomcatDir: dir, Files: "sakai-builder/patch.tar.gz"}})
+	err := p.tarballsReady()
+	p.wait()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tarball patch.tar.gz: "+cached+" is corrupt")
+	}
+	assert.False(t, pathExists(cached), "downloaded again next time")
+
+	var none *prefetch
+	assert.NoError(t, none.tarballsReady())
+}
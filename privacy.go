@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How much of a run is uploaded to the portal, set per instance with result_detail
+const (
+	detailFull    = "full"    // everything, including Tomcat and script output
+	detailSummary = "summary" // step results and overrides, no log excerpts
+	detailStatus  = "status"  // result codes only
+)
+
+// resultDetail applies to the instance being patched
+var resultDetail = detailFull
+
+// statusFields are the only fields a status-only host sends
+var statusFields = []string{"run_id", "patch_id", "result_value", "start_uptime", "last_attempt", "lease_seconds", "manifest_sha256", "status"}
+
+func resultDetailFor(instance instanceConfig) (string, error) {
+	switch instance.ResultDetail {
+	case "":
+		return detailFull, nil
+	case detailFull, detailSummary, detailStatus:
+		return instance.ResultDetail, nil
+	}
+	return "", fmt.Errorf("unknown result_detail %q for %s", instance.ResultDetail, instance.Dir)
+}
+
+// deferPatch reports a patch put off before the run settles on an instance,
+// at the detail the patch's own instance allows. A result_detail that can't
+// be read sends only the status.
+func deferPatch(registry *instanceRegistry, startup string, patch *PatchResponse) {
+	detail, err := resultDetailFor(registry.lookup(patch.TomcatDir))
+	if err != nil {
+		log.Warning(err)
+		detail = detailStatus
+	}
+	resultDetail = detail
+	updateAdminPortal(patchDefer, startup, patch.PatchID)
+}
+
+// trimResult removes what the host doesn't allow off-host. The full text stays in the local run log.
+func trimResult(urlValues url.Values, detail string) url.Values {
+	switch detail {
+	case detailSummary:
+		trimmed := url.Values{}
+		for key, values := range urlValues {
+			trimmed[key] = values
+		}
+		trimmed.Set("result", "Output withheld by host policy, see "+runLogPath()+" on the server")
+		return trimmed
+	case detailStatus:
+		trimmed := url.Values{}
+		for _, key := range statusFields {
+			if value := urlValues.Get(key); value != "" {
+				trimmed.Set(key, value)
+			}
+		}
+		return trimmed
+	}
+	return urlValues
+}
+
+func runLogPath() string {
+	return filepath.Join(*stateDir, "runs", fmt.Sprintf("%d-%s.log", runStarted.Unix(), runID))
+}
+
+// saveRunLog keeps the complete output of this run on the host
+func saveRunLog() {
+	if err := os.MkdirAll(filepath.Dir(runLogPath()), 0700); err != nil {
+		log.Error("Could not create run log directory: ", err)
+		return
+	}
+	if err := os.WriteFile(runLogPath(), outputBuffer.Bytes(), 0600); err != nil {
+		log.Error("Could not write run log: ", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrimResult(t *testing.T) {
+	urlValues := url.Values{"patch_id": {"63547"}, "result_value": {patchSuccess}, "start_uptime": {"95000"},
+		"last_attempt": {"1700000000"}, "result": {"SEVERE: jdbc:mysql://db/sakai refused"}, "steps": {`[{"type":"restart","status":"ok"}]`}}
+
+	assert.Equal(t, urlValues, trimResult(urlValues, detailFull))
+
+	summary := trimResult(urlValues, detailSummary)
+	assert.Equal(t, "Output withheld by host policy, see "+runLogPath()+" on the server", summary.Get("result"))
+	assert.Equal(t, urlValues.Get("steps"), summary.Get("steps"))
+	assert.Equal(t, "SEVERE: jdbc:mysql://db/sakai refused", urlValues.Get("result"), "original is untouched")
+
+	assert.Equal(t, url.Values{"patch_id": {"63547"}, "result_value": {patchSuccess}, "start_uptime": {"95000"},
+		"last_attempt": {"1700000000"}}, trimResult(urlValues, detailStatus))
+}
+
+func TestResultDetailFor(t *testing.T) {
+	detail, err := resultDetailFor(instanceConfig{Dir: "/opt/tomcat"})
+	assert.NoError(t, err)
+	assert.Equal(t, detailFull, detail)
+
+	_, err = resultDetailFor(instanceConfig{Dir: "/opt/tomcat", ResultDetail: "none"})
+	assert.EqualError(t, err, `unknown result_detail "none" for /opt/tomcat`)
+}
+
+func TestDeferralsUseInstanceDetail(t *testing.T) {
+	dir := t.TempDir()
+	defer func(state, instances string, portal *portalConfig) {
+		*stateDir, *instancesFile, activePortal, resultDetail = state, instances, portal, detailFull
+	}(*stateDir, *instancesFile, activePortal)
+	*stateDir, *instancesFile = filepath.Join(dir, "state"), filepath.Join(dir, "instances.yaml")
+	os.WriteFile(*instancesFile, []byte("instances:\n  - dir: /opt/tomcat\n    result_detail: status\n"), 0644)
+
+	var posted []url.Values
+	http.DefaultClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodPost {
+			req.ParseForm()
+			posted = append(posted, req.PostForm)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}")), Request: req}, nil
+	})
+	defer func() { http.DefaultClient.Transport = nil }()
+
+	// Refused before the run gets to setting up /opt/tomcat
+	portal := &portalConfig{Name: "other", URL: "https://portal.example.edu", Instances: []string{"/opt/other"}}
+	err := runCycle(portal, func() ([]*PatchResponse, error) {
+		return []*PatchResponse{{PatchID: "63547", TomcatDir: "/opt/tomcat"}}, nil
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, posted, 1) {
+		assert.Equal(t, "-9", posted[0].Get("start_uptime"))
+		assert.NotContains(t, posted[0], "result", "status-only host sends no output")
+	}
+}
+
+func TestSaveRunLog(t *testing.T) {
+	*stateDir = t.TempDir()
+	defer func() { *stateDir = defaultStateDir }()
+	outputBuffer.WriteString("Tomcat output\n")
+	defer outputBuffer.Reset()
+
+	saveRunLog()
+	saved, err := os.ReadFile(runLogPath())
+	assert.NoError(t, err)
+	assert.Contains(t, string(saved), "Tomcat output\n")
+}
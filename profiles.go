@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// serverProfile covers everything that differs between the Java servers we patch.
+// The patcher always runs from inside the server directory.
+type serverProfile interface {
+	// name is used in logs and reports
+	name() string
+	// ownerFile is the file, relative to the server dir, whose owner must match the patcher
+	ownerFile() string
+	// propertyDir holds the property files the patch may modify
+	propertyDir() string
+	// logFile is the server log, relative to the server dir
+	logFile() string
+	// stop shuts the server down, hard killing it if needed
+	stop(dir string)
+	// start launches the server in the background
+	start(dir string, patchID string)
+	// checkStartup returns the startup log line, "ignite" on a cache mismatch, or "false" if not started yet
+	checkStartup() string
+	// startupMillis parses the startup time from the line checkStartup returned, -1 if it can't
+	// and 0 if the server is up but didn't say how long it took
+	startupMillis(logLine string) int64
+	// applyProperties writes a properties step to wherever this server reads its configuration
+	applyProperties(rawProperties string, patchID string)
+	// afterStartup runs once the server reports a clean startup
+	afterStartup() error
+}
+
+// activeProfile is the profile for the instance being patched
+var activeProfile serverProfile = tomcatProfile{}
+
+// tomcatProfile is the classic Sakai on Tomcat layout
+type tomcatProfile struct{}
+
+func (tomcatProfile) name() string        { return "tomcat" }
+func (tomcatProfile) ownerFile() string   { return "bin/catalina.sh" }
+func (tomcatProfile) propertyDir() string { return "sakai" }
+func (tomcatProfile) logFile() string     { return "logs/catalina.out" }
+func (tomcatProfile) stop(dir string)     { stopTomcat(dir) }
+func (tomcatProfile) checkStartup() string {
+	return checkServerStartup()
+}
+func (tomcatProfile) startupMillis(logLine string) int64 {
+	return parseServerStartupTime(logLine)
+}
+func (tomcatProfile) applyProperties(rawProperties string, patchID string) {
+	modifyPropertyFiles(rawProperties, patchID)
+}
+func (tomcatProfile) afterStartup() error { return nil }
+
+func (tomcatProfile) start(dir string, patchID string) {
+	// Clean up the lib so we don't have dupe mysql-connector JARs
+	checkForUnnecessaryJars(dir)
+	startTomcat(patchID)
+}
+
+// jettyProfile runs Jetty either through jetty.sh or a systemd unit.
+// Webapps and lib/ext JARs are laid out like Tomcat's, so the archive
+// cleanup heuristics apply unchanged.
+type jettyProfile struct {
+	script     string // jetty.sh, relative to the Jetty base
+	service    string // systemd unit, preferred over the script when set
+	log        string // log that receives the "Started" line
+	properties string
+}
+
+// jettyStartedPattern matches "Started @1234ms" (9.x) and "Started Server@5e9f23b4{STARTING}[10.0.18,sto=0] @1234ms" (10+)
+var jettyStartedPattern = regexp.MustCompile(`Started .*@(\d+)ms`)
+
+func newJettyProfile(instance instanceConfig) jettyProfile {
+	j := jettyProfile{script: "bin/jetty.sh", service: instance.Service, log: "logs/jetty.log", properties: "resources"}
+	if instance.Script != "" {
+		j.script = instance.Script
+	}
+	if instance.Log != "" {
+		j.log = instance.Log
+	}
+	if instance.PropertiesDir != "" {
+		j.properties = instance.PropertiesDir
+	}
+	return j
+}
+
+func (j jettyProfile) name() string        { return "jetty" }
+func (j jettyProfile) propertyDir() string { return j.properties }
+func (j jettyProfile) logFile() string     { return j.log }
+
+func (j jettyProfile) afterStartup() error { return nil }
+
+func (j jettyProfile) applyProperties(rawProperties string, patchID string) {
+	modifyPropertyFiles(rawProperties, patchID)
+}
+
+func (j jettyProfile) ownerFile() string {
+	if j.service != "" {
+		return "."
+	}
+	return j.script
+}
+
+func (j jettyProfile) lifecycle(action string) *exec.Cmd {
+	if j.service != "" {
+		return exec.Command("systemctl", action, j.service)
+	}
+	return exec.Command(j.script, action)
+}
+
+func (j jettyProfile) stop(dir string) {
+	defer trackPhase("stop")()
+
+	out, err := j.lifecycle("stop").CombinedOutput()
+	if err != nil {
+		log.Warning("Error when shutting down Jetty: ", err)
+	}
+	log.Debug("stopJetty: ", string(out))
+
+	time.Sleep(time.Duration(overrides.shutdownWait(20)) * time.Second)
+	hardKillProcess(dir)
+	time.Sleep(10 * 1000 * time.Millisecond)
+	hardKillProcess(dir)
+	outputBuffer.Write(out)
+}
+
+func (j jettyProfile) start(dir string, patchID string) {
+	// Move the old log so we can look for the startup line cleanly
+	os.Rename(j.log, j.log+"-pre-patch-"+patchID)
+
+	out, _ := j.lifecycle("start").CombinedOutput()
+	log.Debug("startJetty: ", string(out))
+	outputBuffer.Write(out)
+}
+
+func (j jettyProfile) checkStartup() string {
+	file, err := os.Open(j.log)
+	if err != nil {
+		// jetty.sh may not have created the log yet
+		log.Debug("Could not open ", j.log, ": ", err)
+		return "false"
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), igniteMismatchPattern) {
+			return "ignite"
+		}
+		if jettyStartedPattern.MatchString(scanner.Text()) {
+			return scanner.Text()
+		}
+	}
+	return "false"
+}
+
+func (j jettyProfile) startupMillis(logLine string) int64 {
+	match := jettyStartedPattern.FindStringSubmatch(logLine)
+	if match == nil {
+		return -1
+	}
+	k, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil || k <= 0 {
+		return -1
+	}
+	log.Debug("Found 'Started' in ", filepath.Base(j.log), ": ", k)
+	return k
+}
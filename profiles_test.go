@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstanceRegistry(t *testing.T) {
+	registryPath := filepath.Join(t.TempDir(), "instances.yaml")
+	content := `instances:
+  - dir: /opt/jetty-lti/
+    profile: jetty
+    service: jetty-lti
+  - dir: /opt/tomcat-sakai
+    profile: tomcat
+  - dir: /opt/weird
+    profile: glassfish
+`
+	os.WriteFile(registryPath, []byte(content), 0644)
+	registry := loadInstanceRegistry(registryPath)
+
+	profile, err := profileFor(registry.lookup("/opt/jetty-lti"))
+	assert.NoError(t, err)
+	assert.Equal(t, jettyProfile{script: "bin/jetty.sh", service: "jetty-lti", log: "logs/jetty.log", properties: "resources"}, profile)
+	assert.Equal(t, ".", profile.ownerFile())
+
+	profile, err = profileFor(registry.lookup("/opt/tomcat-unregistered"))
+	assert.NoError(t, err)
+	assert.Equal(t, tomcatProfile{}, profile)
+
+	_, err = profileFor(registry.lookup("/opt/weird"))
+	assert.EqualError(t, err, `unknown profile "glassfish" for /opt/weird`)
+}
+
+func TestJettyStartupDetection(t *testing.T) {
+	tmpDir := t.TempDir()
+	originalWd, _ := os.Getwd()
+	os.Chdir(tmpDir)
+	defer os.Chdir(originalWd)
+
+	jetty := newJettyProfile(instanceConfig{Log: "logs/server.log"})
+	assert.Equal(t, "false", jetty.checkStartup(), "no log yet")
+
+	os.MkdirAll("logs", 0755)
+	os.WriteFile("logs/server.log", []byte("2024-03-01 02:10:11.123:INFO:oejs.Server:main: jetty-10.0.18\n"+
+		"2024-03-01 02:10:19.456:INFO:oejs.Server:main: Started Server@5e9f23b4{STARTING}[10.0.18,sto=0] @8512ms\n"), 0644)
+	line := jetty.checkStartup()
+	assert.Contains(t, line, "Started Server@")
+	assert.Equal(t, int64(8512), jetty.startupMillis(line))
+
+	// Jetty 9.x
+	assert.Equal(t, int64(4321), jetty.startupMillis("2019-05-01 10:00:00.000:INFO:oejs.Server:main: Started @4321ms"))
+	assert.Equal(t, int64(-1), jetty.startupMillis("Server startup in 1234 ms"))
+}
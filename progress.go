@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// downloadProgress logs how far a download has got every -progress-interval,
+// so a slow transfer can be told apart from a hung one. Writes count bytes,
+// making it a tee target for the response body.
+type downloadProgress struct {
+	name string
+	done int64 // updated atomically, chunks write concurrently
+
+	mu      sync.Mutex
+	total   int64
+	base    int64
+	started time.Time
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// startProgress logs progress until Stop, nothing when -progress-interval is 0
+func startProgress(name string) *downloadProgress {
+	p := &downloadProgress{name: name, total: -1, started: time.Now(), stop: make(chan struct{})}
+	if *progressInterval <= 0 {
+		return p
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(*progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.Info("Downloading ", p.name, ": ", p)
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// restart begins an attempt that resumes at offset; total is -1 when unknown
+func (p *downloadProgress) restart(offset int64, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	atomic.StoreInt64(&p.done, offset)
+	p.base, p.total, p.started = offset, total, time.Now()
+}
+
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	atomic.AddInt64(&p.done, int64(len(b)))
+	return len(b), nil
+}
+
+// discard takes back bytes of a chunk that has to be fetched again
+func (p *downloadProgress) discard(n int64) {
+	atomic.AddInt64(&p.done, -n)
+}
+
+func (p *downloadProgress) Stop() {
+	close(p.stop)
+	p.wg.Wait()
+}
+
+// String is e.g. "120.0 of 400.0 MB (30%) at 5.2 MB/s, about 54s left"
+func (p *downloadProgress) String() string {
+	p.mu.Lock()
+	total, base, elapsed := p.total, p.base, time.Since(p.started)
+	p.mu.Unlock()
+	done := atomic.LoadInt64(&p.done)
+
+	rate := float64(done-base) / elapsed.Seconds()
+	text := fmt.Sprintf("%.1f MB", megabytes(done))
+	if total > 0 {
+		text = fmt.Sprintf("%.1f of %.1f MB (%d%%)", megabytes(done), megabytes(total), done*100/total)
+	}
+	text += fmt.Sprintf(" at %.1f MB/s", megabytes(int64(rate)))
+	if total > 0 && rate > 0 {
+		left := time.Duration(float64(total-done) / rate * float64(time.Second))
+		text += ", about " + left.Round(time.Second).String() + " left"
+	}
+	return text
+}
+
+func megabytes(n int64) float64 {
+	return float64(n) / 1024 / 1024
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadProgressString(t *testing.T) {
+	*progressInterval = 0
+	defer func() { *progressInterval = 10 * time.Second }()
+
+	p := startProgress("patch.tar.gz")
+	defer p.Stop()
+	p.restart(100<<20, 400<<20)
+	p.started = time.Now().Add(-10 * time.Second)
+	p.Write(make([]byte, 50<<20))
+	assert.Equal(t, "150.0 of 400.0 MB (37%) at 5.0 MB/s, about 50s left", p.String())
+
+	// Size unknown, no percentage or time left
+	p.restart(0, -1)
+	p.started = time.Now().Add(-2 * time.Second)
+	p.Write(make([]byte, 4<<20))
+	assert.Equal(t, "4.0 MB at 2.0 MB/s", p.String())
+
+	p.discard(4 << 20)
+	assert.Contains(t, p.String(), "0.0 MB at 0.0 MB/s")
+}
+
+func TestDownloadProgressLogs(t *testing.T) {
+	*progressInterval = 5 * time.Millisecond
+	defer func() { *progressInterval = 10 * time.Second }()
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	p := startProgress("patch.tar.gz")
+	p.restart(0, 1<<20)
+	p.Write(make([]byte, 512<<10))
+	time.Sleep(30 * time.Millisecond)
+	p.Stop()
+	assert.Contains(t, out.String(), "Downloading patch.tar.gz: 0.5 of 1.0 MB (50%)")
+}
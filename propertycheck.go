@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// propertyWriteAttempts is how often a property file is rewritten from its backup
+// before the step gives up
+const propertyWriteAttempts = 3
+
+// writePropertyFile writes a property file and reads it back to make sure the
+// new property landed exactly once. On a bad read-back the original content is
+// put back and the write retried; if it never sticks the original is left in
+// place and the step fails rather than letting Sakai boot on a broken file.
+func writePropertyFile(path string, backup []byte, output string, propertyLine string) {
+	var err error
+	for attempt := 1; attempt <= propertyWriteAttempts; attempt++ {
+		if err = os.WriteFile(path, []byte(output), 0644); err == nil {
+			if err = verifyPropertyFile(path, output, propertyLine); err == nil {
+				return
+			}
+		}
+		log.Warningf("Write to %s did not verify (attempt %d of %d): %v", path, attempt, propertyWriteAttempts, err)
+		if restoreErr := os.WriteFile(path, backup, 0644); restoreErr != nil {
+			log.Error("Could not restore ", path, " from backup: ", restoreErr)
+		}
+	}
+	panic("Could not write " + path + ": " + err.Error())
+}
+
+// verifyPropertyFile re-reads a property file and checks that it is what was
+// written and that the property is set exactly once, to the intended value
+func verifyPropertyFile(path string, expected string, propertyLine string) error {
+	input, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if string(input) != expected {
+		return fmt.Errorf("read back %d bytes, wrote %d", len(input), len(expected))
+	}
+
+	// Lines modifyPropertyFiles doesn't treat as properties are appended as they are
+	key, value, ok := strings.Cut(propertyLine, "=")
+	if !ok || strings.Contains(propertyLine, "#") {
+		return nil
+	}
+	key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+	values := parseProperties(string(input))[key]
+	if len(values) != 1 {
+		return fmt.Errorf("%s is set %d times", key, len(values))
+	}
+	if values[0] != value {
+		return errors.New(key + " does not have the patched value")
+	}
+	return nil
+}
+
+// parseProperties returns every value set for each key, joining backslash
+// continuation lines. Keys are split on the first "=" like readProperty does.
+func parseProperties(content string) map[string][]string {
+	properties := map[string][]string{}
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		for strings.HasSuffix(line, `\`) && !strings.HasSuffix(line, `\\`) && i+1 < len(lines) {
+			i++
+			line = strings.TrimSuffix(line, `\`) + strings.TrimSpace(lines[i])
+		}
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		properties[key] = append(properties[key], strings.TrimSpace(value))
+	}
+	return properties
+}
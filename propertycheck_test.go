@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProperties(t *testing.T) {
+	properties := parseProperties("# comment\n! also a comment\na=1\n b = 2 \nc=one,\\\n  two\na=3\nnot a property\n")
+	assert.Equal(t, []string{"1", "3"}, properties["a"])
+	assert.Equal(t, []string{"2"}, properties["b"])
+	assert.Equal(t, []string{"one,two"}, properties["c"])
+	assert.Len(t, properties, 3)
+}
+
+func TestVerifyPropertyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sakai.properties")
+
+	os.WriteFile(path, []byte("#a=1\na=2\n"), 0644)
+	assert.NoError(t, verifyPropertyFile(path, "#a=1\na=2\n", "a=2"))
+	assert.NoError(t, verifyPropertyFile(path, "#a=1\na=2\n", "# just a comment"))
+
+	// Truncated write
+	assert.Error(t, verifyPropertyFile(path, "#a=1\na=2\nb=3\n", "a=2"))
+
+	os.WriteFile(path, []byte("a=1\na=2\n"), 0644)
+	assert.Error(t, verifyPropertyFile(path, "a=1\na=2\n", "a=2"))
+
+	os.WriteFile(path, []byte("a=1\n"), 0644)
+	assert.Error(t, verifyPropertyFile(path, "a=1\n", "a=2"))
+}
+
+func TestModifyPropertyFilesDuplicateKey(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.MkdirAll(tmpDir+"/sakai", 0755)
+	os.WriteFile(tmpDir+"/sakai/sakai.properties", []byte("a=1\nb=2\na=3\n"), 0644)
+
+	originalWd, _ := os.Getwd()
+	os.Chdir(tmpDir)
+	defer os.Chdir(originalWd)
+
+	modifyPropertyFiles("a=4", "63547")
+	content, _ := os.ReadFile("sakai/sakai.properties")
+	assert.Equal(t, "#a=1\na=4\nb=2\n#a=3\n", string(content))
+}
+
+func TestWritePropertyFileGivesUp(t *testing.T) {
+	// A directory in place of the file makes every write fail
+	path := filepath.Join(t.TempDir(), "sakai.properties")
+	os.Mkdir(path, 0755)
+	assert.Panics(t, func() { writePropertyFile(path, []byte("a=1\n"), "a=2\n", "a=2") })
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// propertyBase is what the property files looked like when the portal created
+// the patch, so edits made on the host since then can be told apart
+type propertyBase struct {
+	// SHA256 maps a property file name to the hex SHA-256 it had, "" if it did not exist
+	SHA256 map[string]string `json:"sha256"`
+
+	// Values holds each patched key's value at creation, "" if it was unset
+	Values map[string]string `json:"values"`
+}
+
+// changedPropertyFiles lists the property files below propertyDir whose content
+// no longer matches the base hashes
+func (b *propertyBase) changedPropertyFiles(propertyDir string) []string {
+	var changed []string
+	for name, expected := range b.SHA256 {
+		actual := ""
+		if content, err := os.ReadFile(filepath.Join(propertyDir, name)); err == nil {
+			sum := sha256.Sum256(content)
+			actual = hex.EncodeToString(sum[:])
+		}
+		if !strings.EqualFold(actual, expected) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// propertyConflicts does a three-way merge of a patch's property changes against
+// edits made on the host since the patch was created. A key is only rewritten
+// in place, so a local edit to any other key survives the patch untouched. A
+// key that was edited locally as well conflicts, unless it already holds the
+// value the patch sets.
+func propertyConflicts(tomcatDir string, patch *PatchResponse) []string {
+	base := patch.PropertyBase
+	if base == nil {
+		return nil
+	}
+	propertyDir := filepath.Join(tomcatDir, activeProfile.propertyDir())
+	changed := base.changedPropertyFiles(propertyDir)
+	if len(changed) == 0 {
+		return nil
+	}
+	log.Info("Property files changed since patch ", patch.PatchID, " was created: ", strings.Join(changed, ", "))
+
+	var conflicts []string
+	for _, step := range patchSteps(patch) {
+		if step.Type != stepProperties {
+			continue
+		}
+		for _, line := range strings.Split(step.Value, "\n") {
+			key, value, ok := strings.Cut(line, "=")
+			if !ok || strings.Contains(line, "#") || overrides.skipsProperty(key) {
+				continue
+			}
+			key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+			local, was := effectiveProperty(propertyDir, key), base.Values[key]
+			if local == value || local == was {
+				continue
+			}
+			conflicts = append(conflicts, fmt.Sprintf("%s is %q on this host, was %q when the patch was created, patch sets %q", key, local, was, value))
+		}
+	}
+	return conflicts
+}
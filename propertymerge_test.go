@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPropertyConflicts(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "sakai"), 0755)
+	created := "version.sakai=23.3\nmail.smtp=mx1\n"
+	sum := sha256.Sum256([]byte(created))
+	base := &propertyBase{
+		SHA256: map[string]string{"sakai.properties": hex.EncodeToString(sum[:]), "local.properties": ""},
+		Values: map[string]string{"version.sakai": "23.3", "mail.smtp": "mx1"},
+	}
+	patch := &PatchResponse{PatchID: "63547", TomcatDir: dir, SakaiProps: "version.sakai=23.4", PropertyBase: base}
+	write := func(content string) {
+		os.WriteFile(filepath.Join(dir, "sakai/sakai.properties"), []byte(content), 0644)
+	}
+
+	// Untouched since the patch was created
+	write(created)
+	assert.Empty(t, propertyConflicts(dir, patch))
+	assert.Empty(t, base.changedPropertyFiles(filepath.Join(dir, "sakai")))
+
+	// An emergency edit to another key merges cleanly
+	write("version.sakai=23.3\nmail.smtp=mx2\n")
+	assert.Equal(t, []string{"sakai.properties"}, base.changedPropertyFiles(filepath.Join(dir, "sakai")))
+	assert.Empty(t, propertyConflicts(dir, patch))
+
+	// The same key already carries the patched value
+	write("version.sakai=23.4\nmail.smtp=mx1\n")
+	assert.Empty(t, propertyConflicts(dir, patch))
+
+	// The key was changed locally to something else
+	write("version.sakai=23.3-hotfix\nmail.smtp=mx1\n")
+	conflicts := propertyConflicts(dir, patch)
+	if assert.Len(t, conflicts, 1) {
+		assert.Contains(t, conflicts[0], `version.sakai is "23.3-hotfix" on this host, was "23.3"`)
+	}
+
+	// A later property file overriding the key counts as a local edit too
+	write(created)
+	os.WriteFile(filepath.Join(dir, "sakai/local.properties"), []byte("version.sakai=local\n"), 0644)
+	assert.Len(t, propertyConflicts(dir, patch), 1)
+
+	// Portals that don't send a base keep the old behavior
+	patch.PropertyBase = nil
+	assert.Empty(t, propertyConflicts(dir, patch))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// exchange is one recorded request and its response. The response body sits
+// next to it in <seq>.body, since tarballs can be large.
+type exchange struct {
+	Seq            int         `json:"seq"`
+	Time           time.Time   `json:"time"`
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	RequestHeader  http.Header `json:"request_header"`
+	RequestBody    string      `json:"request_body,omitempty"`
+	Status         int         `json:"status,omitempty"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	// Error is what the transport returned instead of a response
+	Error string `json:"error,omitempty"`
+}
+
+// redactedHeaders never reach a recording, URLs lose their query for the same reason
+var redactedHeaders = []string{"X-Auth-Token", "Authorization", "Cookie", "Set-Cookie"}
+
+func redactHeader(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range redactedHeaders {
+		if header.Get(name) != "" {
+			header.Set(name, "REDACTED")
+		}
+	}
+	return header
+}
+
+// recordingTransport saves every request made through http.DefaultTransport,
+// portal calls and downloads alike, so a failed run can be replayed offline.
+// Response bodies, new tokens included, are kept as sent.
+type recordingTransport struct {
+	next http.RoundTripper
+	dir  string
+
+	mu  sync.Mutex
+	seq int
+}
+
+func newRecordingTransport(next http.RoundTripper, dir string) (*recordingTransport, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// Carry on numbering after an earlier run recorded to the same dir
+	exchanges, err := loadExchanges(dir)
+	if err != nil {
+		return nil, err
+	}
+	t := &recordingTransport{next: next, dir: dir}
+	if len(exchanges) > 0 {
+		t.seq = exchanges[len(exchanges)-1].Seq
+	}
+	return t, nil
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.seq++
+	ex := &exchange{Seq: t.seq, Time: time.Now(), Method: req.Method, URL: redactURL(req.URL.String()), RequestHeader: redactHeader(req.Header)}
+	t.mu.Unlock()
+
+	// Only bodies that can be read twice are kept, a streamed body is the caller's alone
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			copied, _ := io.ReadAll(body)
+			body.Close()
+			ex.RequestBody = string(copied)
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		ex.Error = err.Error()
+		t.save(ex)
+		return nil, err
+	}
+	ex.Status, ex.ResponseHeader = resp.StatusCode, redactHeader(resp.Header)
+	t.save(ex)
+
+	file, err := os.OpenFile(exchangeBodyPath(t.dir, ex.Seq), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Warning("Could not record response body: ", err)
+		return resp, nil
+	}
+	resp.Body = &recordedBody{ReadCloser: resp.Body, file: file}
+	return resp, nil
+}
+
+func (t *recordingTransport) save(ex *exchange) {
+	data, err := json.MarshalIndent(ex, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(t.dir, fmt.Sprintf("%04d.json", ex.Seq)), data, 0600)
+	}
+	if err != nil {
+		log.Warning("Could not record ", ex.Method, " ", ex.URL, ": ", err)
+	}
+}
+
+func exchangeBodyPath(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%04d.body", seq))
+}
+
+// recordedBody copies the response into the recording as the caller reads it.
+// What the caller leaves unread is recorded on Close, so a replay sees it all.
+type recordedBody struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (b *recordedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.file.Write(p[:n])
+	return n, err
+}
+
+func (b *recordedBody) Close() error {
+	io.Copy(b.file, b.ReadCloser)
+	b.file.Close()
+	return b.ReadCloser.Close()
+}
+
+// replayTransport answers requests from a recording instead of the network.
+// Each request gets the next unused exchange with the same method, host and
+// path; queries are not recorded, so they don't count.
+type replayTransport struct {
+	dir string
+
+	mu        sync.Mutex
+	exchanges []*exchange
+}
+
+func newReplayTransport(dir string) (*replayTransport, error) {
+	exchanges, err := loadExchanges(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(exchanges) == 0 {
+		return nil, errors.New("no recorded requests in " + dir)
+	}
+	return &replayTransport{dir: dir, exchanges: exchanges}, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	url := redactURL(req.URL.String())
+
+	t.mu.Lock()
+	var ex *exchange
+	for i, candidate := range t.exchanges {
+		if candidate.Method == req.Method && candidate.URL == url {
+			ex = candidate
+			t.exchanges = append(t.exchanges[:i:i], t.exchanges[i+1:]...)
+			break
+		}
+	}
+	t.mu.Unlock()
+
+	if ex == nil {
+		return nil, errors.New("no recorded response left for " + req.Method + " " + url)
+	}
+	log.Debug("Replaying exchange ", ex.Seq, ": ", ex.Method, " ", ex.URL)
+	if ex.Error != "" {
+		return nil, errors.New(ex.Error)
+	}
+	body, err := os.Open(exchangeBodyPath(t.dir, ex.Seq))
+	if err != nil {
+		return nil, err
+	}
+	header := ex.ResponseHeader.Clone()
+	contentLength := int64(-1)
+	if info, err := body.Stat(); err == nil {
+		contentLength = info.Size()
+		header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+	return &http.Response{StatusCode: ex.Status, Status: fmt.Sprintf("%d %s", ex.Status, http.StatusText(ex.Status)),
+		Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1, Header: header, Body: body, ContentLength: contentLength, Request: req}, nil
+}
+
+// loadExchanges reads a recording in the order it was made
+func loadExchanges(dir string) ([]*exchange, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var exchanges []*exchange
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		ex := &exchange{}
+		if err := json.Unmarshal(data, ex); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		exchanges = append(exchanges, ex)
+	}
+	sort.Slice(exchanges, func(i, j int) bool { return exchanges[i].Seq < exchanges[j].Seq })
+	return exchanges, nil
+}
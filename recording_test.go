@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	checks := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case patchesPath:
+			checks++
+			fmt.Fprintf(w, `{"patch_id": "%d"}`, 63546+checks)
+		case updatePath:
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	dir := filepath.Join(t.TempDir(), "recording")
+
+	recorder, err := newRecordingTransport(http.DefaultTransport, dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	client := &http.Client{Transport: recorder}
+	get := func(client *http.Client, path string) (int, string) {
+		req, _ := http.NewRequest("GET", server.URL+path+"?ips=10.0.0.5", nil)
+		req.Header.Set("X-Auth-Token", "s3cret")
+		resp, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	get(client, patchesPath)
+	get(client, patchesPath)
+	resp, err := client.PostForm(server.URL+updatePath, url.Values{"patch_id": {"63547"}, "result_value": {patchSuccess}})
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+	}
+	server.Close()
+
+	// Tokens stay out of the recording, the form posted stays in
+	exchanges, err := loadExchanges(dir)
+	assert.NoError(t, err)
+	if assert.Len(t, exchanges, 3) {
+		assert.Equal(t, "REDACTED", exchanges[0].RequestHeader.Get("X-Auth-Token"))
+		assert.Equal(t, server.URL+patchesPath, exchanges[0].URL)
+		assert.Equal(t, "patch_id=63547&result_value=1", exchanges[2].RequestBody)
+	}
+	raw, _ := os.ReadFile(filepath.Join(dir, "0001.json"))
+	assert.NotContains(t, string(raw), "s3cret")
+	info, _ := os.Stat(filepath.Join(dir, "0001.body"))
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The server is gone, the replay answers in the recorded order
+	replayer, err := newReplayTransport(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	client = &http.Client{Transport: replayer}
+	resp, err = client.PostForm(server.URL+updatePath, url.Values{"patch_id": {"63547"}})
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	}
+	code, body := get(client, patchesPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"patch_id": "63547"}`, body)
+	_, body = get(client, patchesPath)
+	assert.Equal(t, `{"patch_id": "63548"}`, body)
+
+	_, err = client.Get(server.URL + patchesPath)
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "no recorded response left for GET"), err.Error())
+	}
+
+	// A second recording to the same dir carries on numbering
+	recorder, err = newRecordingTransport(http.DefaultTransport, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, recorder.seq)
+}
+
+func TestReplayNeedsRecording(t *testing.T) {
+	_, err := newReplayTransport(t.TempDir())
+	assert.Error(t, err)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// rssSampleInterval is how often the resident set is sampled during a phase
+var rssSampleInterval = 100 * time.Millisecond
+
+// phaseUsage is the patcher's own footprint during one phase. Extracting
+// multi-GB tarballs has OOM-killed the patcher on small hosts.
+type phaseUsage struct {
+	PeakRSSBytes int64   `json:"peak_rss_bytes"`
+	CPUSeconds   float64 `json:"cpu_seconds"`
+}
+
+// phaseUsages are the peak memory and CPU time of the current run, per phase
+var phaseUsages = map[string]phaseUsage{}
+
+// trackUsage starts measuring a phase. The returned func stops the sampler and
+// records the peak and the CPU time used, adding to earlier runs of the phase.
+func trackUsage(phase string) func() {
+	startCPU := cpuSeconds()
+	var mu sync.Mutex
+	peak := currentRSS()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(rssSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				rss := currentRSS()
+				mu.Lock()
+				peak = max(peak, rss)
+				mu.Unlock()
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+		phaseMu.Lock()
+		defer phaseMu.Unlock()
+		usage := phaseUsages[phase]
+		usage.PeakRSSBytes = max(usage.PeakRSSBytes, peak, currentRSS())
+		usage.CPUSeconds += cpuSeconds() - startCPU
+		phaseUsages[phase] = usage
+	}
+}
+
+// cpuSeconds is the user and system CPU time of this process so far
+func cpuSeconds() float64 {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()).Seconds()
+}
+
+// currentRSS reads the resident set from /proc, or what the Go runtime holds
+// from the OS where there is no /proc
+func currentRSS() int64 {
+	if statm, err := os.ReadFile("/proc/self/statm"); err == nil {
+		if fields := strings.Fields(string(statm)); len(fields) > 1 {
+			if pages, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				return pages * int64(os.Getpagesize())
+			}
+		}
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.Sys)
+}
+
+// peakRSS is the high-water mark of the whole process, VmHWM on Linux
+func peakRSS() int64 {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "VmHWM:"); ok {
+			kb, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// resourceSummary encodes the run's footprint for the portal report
+func resourceSummary() string {
+	if len(phaseUsages) == 0 {
+		return ""
+	}
+	encoded, err := json.Marshal(struct {
+		PeakRSSBytes int64                 `json:"peak_rss_bytes,omitempty"`
+		CPUSeconds   float64               `json:"cpu_seconds"`
+		Phases       map[string]phaseUsage `json:"phases"`
+	}{peakRSS(), cpuSeconds(), phaseUsages})
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
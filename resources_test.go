@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackUsage(t *testing.T) {
+	phaseUsages = map[string]phaseUsage{}
+	defer func() { phaseUsages = map[string]phaseUsage{} }()
+	rssSampleInterval = time.Millisecond
+	defer func() { rssSampleInterval = 100 * time.Millisecond }()
+
+	done := trackUsage("extract")
+	buf := make([]byte, 32<<20)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	time.Sleep(5 * time.Millisecond)
+	done()
+
+	usage := phaseUsages["extract"]
+	assert.Greater(t, usage.PeakRSSBytes, int64(32<<20))
+	assert.Greater(t, usage.CPUSeconds, 0.0)
+	assert.Equal(t, byte(255), buf[255], "keep buf alive")
+
+	// Phases that run again add up their CPU time
+	done = trackUsage("extract")
+	done()
+	assert.GreaterOrEqual(t, phaseUsages["extract"].CPUSeconds, usage.CPUSeconds)
+	assert.LessOrEqual(t, usage.PeakRSSBytes, phaseUsages["extract"].PeakRSSBytes)
+
+	var summary struct {
+		Phases map[string]phaseUsage `json:"phases"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(resourceSummary()), &summary))
+	assert.Contains(t, summary.Phases, "extract")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// attachmentPath receives the complete, gzipped output of a run whose result was truncated
+const attachmentPath = "/longsight/remote/patch/attachment"
+
+// defaultMaxResultSize is the largest result text sent in a portal update.
+// A chatty catalina.sh can otherwise produce multi-megabyte form posts.
+const defaultMaxResultSize = 256 * 1024
+
+// capResult keeps the first quarter and the rest from the end of an oversized
+// result, cut at line breaks. The end has the startup or the failure, the start
+// shows what the run set out to do.
+func capResult(text string, maxSize int) string {
+	if maxSize <= 0 || len(text) <= maxSize {
+		return text
+	}
+	marker := "\n... %d bytes omitted, the full output is in " + runLogPath() + " on the server ...\n"
+	budget := maxSize - len(fmt.Sprintf(marker, len(text)))
+	if budget <= 0 {
+		return strings.ToValidUTF8(text[len(text)-maxSize:], "")
+	}
+
+	head := text[:budget/4]
+	if i := strings.LastIndex(head, "\n"); i > 0 {
+		head = head[:i+1]
+	}
+	tail := text[len(text)-(budget-len(head)):]
+	if i := strings.Index(tail, "\n"); i >= 0 && i < len(tail)-1 {
+		tail = tail[i+1:]
+	}
+	omitted := len(text) - len(head) - len(tail)
+	return strings.ToValidUTF8(head+fmt.Sprintf(marker, omitted)+tail, "")
+}
+
+// uploadFullOutput sends the complete run output gzipped to the attachment
+// endpoint. The update has already gone out, so a failure only gets logged.
+func uploadFullOutput(patchID string, text string) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(text))
+	writer.Close()
+
+	query := url.Values{"patch_id": {patchID}, "run_id": {runID}}
+	err := activePortal.withFailover(func() error {
+		req, err := http.NewRequest("POST", activePortal.endpoint(attachmentPath)+"?"+query.Encode(), bytes.NewReader(compressed.Bytes()))
+		if err != nil {
+			return permanentError{err}
+		}
+		setPortalHeaders(req)
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		req.Header.Set("Content-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return checkResponse(resp)
+	})
+	if err != nil {
+		log.Warning("Could not upload the full output for patch ", patchID, ": ", err)
+		return
+	}
+	log.Debug("Uploaded ", compressed.Len(), " gzipped bytes of output for patch ", patchID)
+}
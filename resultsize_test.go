@@ -0,0 +1,57 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapResult(t *testing.T) {
+	assert.Equal(t, "short", capResult("short", 100))
+	assert.Equal(t, "no limit", capResult("no limit", 0))
+
+	var lines []string
+	for i := 0; i < 2000; i++ {
+		lines = append(lines, strings.Repeat("x", 40))
+	}
+	text := "Stopping Tomcat\n" + strings.Join(lines, "\n") + "\nServer startup in [12345] milliseconds\n"
+
+	capped := capResult(text, 4096)
+	assert.LessOrEqual(t, len(capped), 4096)
+	assert.True(t, strings.HasPrefix(capped, "Stopping Tomcat\n"))
+	assert.True(t, strings.HasSuffix(capped, "Server startup in [12345] milliseconds\n"))
+	assert.Contains(t, capped, "bytes omitted, the full output is in "+runLogPath())
+	for _, line := range strings.Split(capped, "\n") {
+		if strings.HasPrefix(line, "x") {
+			assert.Len(t, line, 40, "lines are only cut whole")
+		}
+	}
+}
+
+func TestUploadFullOutput(t *testing.T) {
+	var received, encoding, patchID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		patchID = r.URL.Query().Get("patch_id")
+		reader, err := gzip.NewReader(r.Body)
+		if assert.NoError(t, err) {
+			body, _ := io.ReadAll(reader)
+			received = string(body)
+		}
+	}))
+	defer server.Close()
+
+	oldPortal := activePortal
+	activePortal = &portalConfig{Name: "a", URL: server.URL}
+	defer func() { activePortal = oldPortal }()
+
+	uploadFullOutput("63547", "the whole catalina.out")
+	assert.Equal(t, "gzip", encoding)
+	assert.Equal(t, "63547", patchID)
+	assert.Equal(t, "the whole catalina.out", received)
+}
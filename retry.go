@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxRetryDelay caps the exponential backoff between attempts
+const maxRetryDelay = 2 * time.Minute
+
+// permanentError stops retry immediately, e.g. for a 4xx from the portal
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// retry calls fn until it succeeds, returns a permanentError, or runs out of attempts
+func retry(description string, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+
+		var permanent permanentError
+		if errors.As(err, &permanent) {
+			return err
+		}
+		if attempt >= *retryAttempts {
+			return fmt.Errorf("%s failed after %d attempts: %w", description, attempt, err)
+		}
+
+		delay := backoffDelay(attempt)
+		log.Warnf("%s failed (attempt %d of %d), retrying in %v: %v", description, attempt, *retryAttempts, delay.Round(time.Millisecond), err)
+		time.Sleep(delay)
+	}
+}
+
+// backoffDelay doubles the base delay every attempt and picks a random point
+// in the upper half so a fleet of patchers doesn't retry in lockstep
+func backoffDelay(attempt int) time.Duration {
+	delay := *retryDelay
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// jitter picks a random duration below max, 0 when max is not positive
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// waitStartupJitter spreads out a fleet that cron starts in the same minute,
+// waiting up to -startup-jitter before the first portal call. It returns false
+// if ctx ends first.
+func waitStartupJitter(ctx context.Context) bool {
+	delay := jitter(*startupJitter)
+	if delay == 0 {
+		return true
+	}
+	log.Info("Waiting ", delay.Round(time.Second), " before contacting the portal")
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+// statusError is an unsuccessful HTTP response
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e statusError) Error() string { return "portal responded " + e.status }
+
+// isNotFound reports whether err comes from a 404
+func isNotFound(err error) bool {
+	var status statusError
+	return errors.As(err, &status) && status.code == http.StatusNotFound
+}
+
+// checkResponse turns a portal response status into an error for retry.
+// Server errors and throttling are worth retrying, other client errors are not.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	err := statusError{code: resp.StatusCode, status: resp.Status}
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return err
+	}
+	return permanentError{err}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fastRetries makes the test retry attempts times without waiting on
+// -retry-delay, the flags are restored when it ends
+func fastRetries(t *testing.T, attempts int) {
+	t.Helper()
+	savedAttempts, savedDelay := *retryAttempts, *retryDelay
+	t.Cleanup(func() { *retryAttempts, *retryDelay = savedAttempts, savedDelay })
+	*retryAttempts, *retryDelay = attempts, time.Millisecond
+}
+
+func TestBackoffDelay(t *testing.T) {
+	defer func(delay time.Duration) { *retryDelay = delay }(*retryDelay)
+	*retryDelay = time.Second
+
+	for attempt, base := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 20: maxRetryDelay} {
+		delay := backoffDelay(attempt)
+		assert.GreaterOrEqual(t, delay, base/2, "attempt %d", attempt)
+		assert.LessOrEqual(t, delay, base, "attempt %d", attempt)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	fastRetries(t, 5)
+
+	calls := 0
+	err := retry("flaky", func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("connection reset")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = retry("down", func() error {
+		calls++
+		return errors.New("connection refused")
+	})
+	assert.EqualError(t, err, "down failed after 5 attempts: connection refused")
+	assert.Equal(t, *retryAttempts, calls)
+
+	calls = 0
+	err = retry("forbidden", func() error {
+		calls++
+		return permanentError{errors.New("portal responded 403 Forbidden")}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestCheckResponse(t *testing.T) {
+	for status, retryable := range map[int]bool{http.StatusBadGateway: true, http.StatusTooManyRequests: true, http.StatusUnauthorized: false} {
+		recorder := httptest.NewRecorder()
+		recorder.WriteHeader(status)
+		err := checkResponse(recorder.Result())
+		var permanent permanentError
+		assert.Error(t, err)
+		assert.Equal(t, !retryable, errors.As(err, &permanent), "status %d", status)
+	}
+	assert.NoError(t, checkResponse(&http.Response{StatusCode: http.StatusOK}))
+}
+
+func TestStartupJitter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), jitter(0))
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second)
+		assert.True(t, d >= 0 && d < time.Second, d)
+	}
+
+	// Off by default
+	start := time.Now()
+	assert.True(t, waitStartupJitter(context.Background()))
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	// A stopping daemon doesn't sit out the delay
+	*startupJitter = time.Hour
+	defer func() { *startupJitter = 0 }()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, waitStartupJitter(ctx))
+}
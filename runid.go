@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runIDHeader carries the run ID on every portal and download request.
+// Portal POSTs also send it as the run_id field.
+const runIDHeader = "X-Patcher-Run-Id"
+
+// patcherVersion is set by release builds with -ldflags "-X main.patcherVersion=v2.1.0"
+var patcherVersion = "v1.0"
+
+// runID identifies one patch cycle across portal records, host logs, hooks and the run history
+var runID string
+
+// newRunID returns a random (version 4) UUID
+func newRunID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("Could not generate a run ID: " + err.Error())
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// userAgent names the patcher version and host, e.g. "GoPatcher v1.0 (lms1.example.edu; linux/amd64)"
+func userAgent() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return "GoPatcher " + patcherVersion + " (" + hostname + "; " + runtime.GOOS + "/" + runtime.GOARCH + ")"
+}
+
+// setRunHeaders adds the User-Agent and run ID, safe for any host including CDNs
+func setRunHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", userAgent())
+	if runID != "" {
+		req.Header.Set(runIDHeader, runID)
+	}
+	setPeerAuth(req)
+}
+
+// setPortalHeaders adds authentication and the run ID to a request for the active portal
+func setPortalHeaders(req *http.Request) {
+	req.Header.Set("X-Auth-Token", activePortal.authToken())
+	req.Header.Set(statusModelHeader, statusModelVersion)
+	setRunHeaders(req)
+}
+
+// postPortalForm posts form values to the active portal with the portal headers
+func postPortalForm(path string, urlValues url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("POST", activePortal.endpoint(path), strings.NewReader(urlValues.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	setPortalHeaders(req)
+	return http.DefaultClient.Do(req)
+}
+
+// runIDHook adds run_id to every log line written during a cycle
+type runIDHook struct{}
+
+func (runIDHook) Levels() []log.Level { return log.AllLevels }
+
+func (runIDHook) Fire(entry *log.Entry) error {
+	if runID != "" {
+		entry.Data["run_id"] = runID
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunID(t *testing.T) {
+	id := newRunID()
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), id)
+	assert.NotEqual(t, id, newRunID())
+
+	runID = id
+	defer func() { runID = "" }()
+
+	req, _ := http.NewRequest("GET", activePortal.endpoint(patchesPath), nil)
+	setPortalHeaders(req)
+	assert.Equal(t, id, req.Header.Get(runIDHeader))
+
+	var out bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&out)
+	logger.AddHook(runIDHook{})
+	logger.Info("Running step 1/2 for patch 63547: tarball")
+	assert.Contains(t, out.String(), "run_id="+id)
+}
+
+func TestPortalRequestHeaders(t *testing.T) {
+	runID = newRunID()
+	defer func() { runID = "" }()
+
+	var got http.Header
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		r.ParseForm()
+		form = r.PostForm
+	}))
+	defer server.Close()
+
+	oldPortal := activePortal
+	activePortal = &portalConfig{Name: "a", URL: server.URL, Token: "secret"}
+	defer func() { activePortal = oldPortal }()
+
+	resp, err := postPortalForm(updatePath, url.Values{"patch_id": {"63547"}})
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "63547", form.Get("patch_id"))
+	assert.Equal(t, runID, got.Get(runIDHeader))
+	assert.Equal(t, "secret", got.Get("X-Auth-Token"))
+
+	hostname, _ := os.Hostname()
+	assert.Contains(t, got.Get("User-Agent"), "GoPatcher "+patcherVersion)
+	assert.Contains(t, got.Get("User-Agent"), hostname)
+
+	// Downloads get the run ID but never the portal token
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	setRunHeaders(req)
+	assert.Equal(t, runID, req.Header.Get(runIDHeader))
+	assert.Empty(t, req.Header.Get("X-Auth-Token"))
+}
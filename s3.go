@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3PresignExpiry is how long a URL signed for an s3:// download lasts; an
+// expired one is simply signed again
+const s3PresignExpiry = 15 * time.Minute
+
+func isS3URL(fileURL string) bool {
+	return strings.HasPrefix(fileURL, "s3://")
+}
+
+// presignS3 turns s3://bucket/key into a presigned https URL with this host's
+// AWS credentials: the environment, the shared config files or the instance
+// profile. Private buckets then download like any other presigned URL, with
+// resume, chunks and checks.
+func presignS3(s3URL string) (string, error) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(s3URL, "s3://"), "/")
+	if bucket == "" || key == "" {
+		return "", permanentError{errors.New("not an s3://bucket/key URL: " + s3URL)}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var options []func(*config.LoadOptions) error
+	if *s3Region != "" {
+		options = append(options, config.WithRegion(*s3Region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return "", permanentError{err}
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		// S3-compatible stores such as an on-prem MinIO want path-style URLs
+		if *s3Endpoint != "" {
+			o.BaseEndpoint = aws.String(*s3Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	signed, err := s3.NewPresignClient(client).PresignGetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)},
+		s3.WithPresignExpires(s3PresignExpiry))
+	if err != nil {
+		return "", err
+	}
+	return signed.URL, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setTestAWSCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-west-2")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+}
+
+func TestPresignS3(t *testing.T) {
+	setTestAWSCredentials(t)
+
+	signed, err := presignS3("s3://longsight-private/sakai-builder/patch.tar.gz")
+	assert.NoError(t, err)
+	assert.Contains(t, signed, "https://longsight-private.s3.us-west-2.amazonaws.com/sakai-builder/patch.tar.gz?")
+	assert.Contains(t, signed, "X-Amz-Signature=")
+	assert.Contains(t, signed, "X-Amz-Credential=AKIAEXAMPLE")
+
+	for _, bad := range []string{"s3://", "s3://bucket", "s3://bucket/"} {
+		_, err := presignS3(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestDownloadFileFromS3Endpoint(t *testing.T) {
+	setTestAWSCredentials(t)
+	tarball, _ := os.ReadFile("test.tar.gz")
+	var path, signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, signature = r.URL.Path, r.URL.Query().Get("X-Amz-Signature")
+		w.Write(tarball)
+	}))
+	defer server.Close()
+	*s3Endpoint = server.URL
+	defer func() { *s3Endpoint = "" }()
+
+	dest := filepath.Join(t.TempDir(), "patch.tar.gz")
+	assert.NoError(t, downloadFile("s3://patches/sakai-builder/patch.tar.gz", dest, "63547", true))
+	assert.Equal(t, "/patches/sakai-builder/patch.tar.gz", path, "path-style for S3-compatible stores")
+	assert.NotEmpty(t, signature)
+	downloaded, _ := os.ReadFile(dest)
+	assert.Equal(t, tarball, downloaded)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Values for -sandbox
+const (
+	sandboxOff      = "off"
+	sandboxAuto     = "auto"     // Landlock where the kernel has it
+	sandboxLandlock = "landlock" // refuse to touch files without it
+)
+
+var errLandlockUnsupported = errors.New("landlock is not available")
+
+func validateSandbox(mode string) error {
+	switch mode {
+	case sandboxOff, sandboxAuto, sandboxLandlock:
+		return nil
+	}
+	return errors.New("-sandbox must be off, auto or landlock: " + mode)
+}
+
+// sandboxDirs are where properties and tarball steps may write: the server
+// directory, downloaded patches, local state and temp files
+func sandboxDirs() []string {
+	dirs := []string{*patchDir, *stateDir, os.TempDir()}
+	if wd, err := os.Getwd(); err == nil {
+		dirs = append(dirs, wd)
+	}
+	if propertyDir := activeProfile.propertyDir(); filepath.IsAbs(propertyDir) {
+		dirs = append(dirs, propertyDir)
+	}
+	return dirs
+}
+
+// extractionWorkers is -extract-workers, or 1 under -sandbox: Landlock holds
+// only for the thread confined locks, a pool's goroutines write from others
+func extractionWorkers() int {
+	if *sandboxMode != sandboxOff {
+		return 1
+	}
+	return *extractWorkers
+}
+
+// confined runs fn on its own OS thread with file writes and deletes limited
+// to dirs by Landlock, so even a bug in the cleanup heuristics physically
+// can't touch the rest of the host. Landlock can't be lifted, so the thread
+// is never unlocked and exits with the goroutine; nothing else, least of all
+// the server started later, inherits the restriction.
+func confined(dirs []string, fn func() error) error {
+	if *sandboxMode == sandboxOff {
+		return fn()
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		defer func() {
+			if r := recover(); r != nil {
+				result <- fmt.Errorf("%v", r)
+			}
+		}()
+
+		if err := restrictThread(dirs); err != nil {
+			if *sandboxMode == sandboxLandlock {
+				result <- fmt.Errorf("could not sandbox file operations: %w", err)
+				return
+			}
+			log.Debug("Running without a sandbox: ", err)
+		}
+		result <- fn()
+	}()
+	return <-result
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// restrictThread has nothing to restrict with outside Linux
+func restrictThread(dirs []string) error {
+	return errLandlockUnsupported
+}
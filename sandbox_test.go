@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ottenhoff/go-patcher/v2/archive"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfined(t *testing.T) {
+	allowed, outside := t.TempDir(), t.TempDir()
+	*sandboxMode = sandboxLandlock
+	defer func() { *sandboxMode = sandboxOff }()
+
+	err := confined([]string{allowed}, func() error {
+		return os.WriteFile(filepath.Join(allowed, "catalina.properties"), []byte("x=1\n"), 0644)
+	})
+	if errors.Is(err, errLandlockUnsupported) {
+		t.Skip("kernel has no Landlock")
+	}
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(allowed, "catalina.properties"))
+
+	// Writes and deletes outside the allowed dirs are refused by the kernel
+	os.WriteFile(filepath.Join(outside, "keep"), nil, 0644)
+	err = confined([]string{allowed}, func() error {
+		if err := os.Remove(filepath.Join(outside, "keep")); err == nil {
+			return errors.New("removed a file outside the sandbox")
+		}
+		return os.WriteFile(filepath.Join(outside, "escaped"), nil, 0644)
+	})
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.FileExists(t, filepath.Join(outside, "keep"))
+	assert.NoFileExists(t, filepath.Join(outside, "escaped"))
+
+	// The rest of the process is not restricted
+	assert.NoError(t, os.WriteFile(filepath.Join(outside, "after"), nil, 0644))
+
+	err = confined([]string{allowed}, func() error { panic("Could not apply patch") })
+	if assert.Error(t, err) {
+		assert.Equal(t, "Could not apply patch", err.Error())
+	}
+	assert.Error(t, validateSandbox("chroot"))
+}
+
+func TestConfinedExtraction(t *testing.T) {
+	allowed, outside := t.TempDir(), t.TempDir()
+	*sandboxMode = sandboxLandlock
+	defer func() { *sandboxMode = sandboxOff }()
+	defer func(workers int) { *extractWorkers = workers }(*extractWorkers)
+	*extractWorkers = 4
+
+	files := map[string][]byte{}
+	var order []string
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("components/sakai-foo-pack/WEB-INF/lib/foo-%d.jar", i)
+		files[name], order = []byte(name), append(order, name)
+	}
+	tarball := buildTestTar(t, files, order)
+
+	// Small files go to the worker pool, which must not escape the sandbox
+	err := confined([]string{allowed}, func() error {
+		_, err := archive.Extract(outside, bytes.NewReader(tarball), archive.Options{Compression: archive.CompressionNone, Workers: extractionWorkers()})
+		return err
+	})
+	if errors.Is(err, errLandlockUnsupported) {
+		t.Skip("kernel has no Landlock")
+	}
+	assert.ErrorIs(t, err, os.ErrPermission)
+	for _, name := range order {
+		assert.NoFileExists(t, filepath.Join(outside, name))
+	}
+
+	*sandboxMode = sandboxOff
+	assert.Equal(t, 4, extractionWorkers())
+}
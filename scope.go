@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// scopeHeader is how the portal tells the patcher what the token it was called with may do
+const scopeHeader = "X-Token-Scope"
+
+// tokenScope limits what a portal token may make this host do. A scope is written
+// as a comma-separated list, the same in portals.yaml and in the portal header:
+//
+//	check-only          look for patches but never apply them
+//	tags=dev|staging    only patch instances with one of these tags in the instance registry
+//	no-properties       refuse patches that change properties
+//
+// An empty scope allows everything.
+type tokenScope struct {
+	checkOnly    bool
+	instanceTags []string
+	noProperties bool
+}
+
+func parseScope(scope string) (tokenScope, error) {
+	parsed := tokenScope{}
+	for _, part := range strings.Split(scope, ",") {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "":
+		case part == "check-only":
+			parsed.checkOnly = true
+		case part == "no-properties":
+			parsed.noProperties = true
+		case strings.HasPrefix(part, "tags="):
+			for _, tag := range strings.Split(strings.TrimPrefix(part, "tags="), "|") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					parsed.instanceTags = append(parsed.instanceTags, tag)
+				}
+			}
+			if len(parsed.instanceTags) == 0 {
+				return parsed, errors.New("tags= lists no tags")
+			}
+		default:
+			return parsed, fmt.Errorf("unknown scope %q", part)
+		}
+	}
+	return parsed, nil
+}
+
+// narrow combines the scope configured on this host with the one the portal
+// granted, keeping whatever is stricter
+func (s tokenScope) narrow(granted tokenScope) tokenScope {
+	narrowed := tokenScope{checkOnly: s.checkOnly || granted.checkOnly, noProperties: s.noProperties || granted.noProperties}
+	switch {
+	case len(s.instanceTags) == 0:
+		narrowed.instanceTags = granted.instanceTags
+	case len(granted.instanceTags) == 0:
+		narrowed.instanceTags = s.instanceTags
+	default:
+		for _, tag := range s.instanceTags {
+			if containsString(granted.instanceTags, tag) {
+				narrowed.instanceTags = append(narrowed.instanceTags, tag)
+			}
+		}
+		// Nothing in common, no instance is in scope
+		if len(narrowed.instanceTags) == 0 {
+			narrowed.checkOnly = true
+		}
+	}
+	return narrowed
+}
+
+// allows reports why a patch for the given instance is out of scope, or nil
+func (s tokenScope) allows(patch *PatchResponse, instance instanceConfig) error {
+	if s.checkOnly {
+		return errors.New("token is check-only")
+	}
+	if len(s.instanceTags) > 0 {
+		inScope := false
+		for _, tag := range instance.Tags {
+			if containsString(s.instanceTags, tag) {
+				inScope = true
+			}
+		}
+		if !inScope {
+			return errors.New("instance " + patch.TomcatDir + " has none of the tags " + strings.Join(s.instanceTags, "|"))
+		}
+	}
+	if s.noProperties {
+		for _, step := range patchSteps(patch) {
+			if step.Type == stepProperties || step.Type == stepFlag {
+				return errors.New("token may not change properties")
+			}
+		}
+	}
+	return nil
+}
+
+// effectiveScope is the host's scope for the active portal narrowed by what the portal granted
+func (p *portalConfig) effectiveScope() tokenScope {
+	local, _ := parseScope(p.Scope)
+	return local.narrow(p.granted)
+}
+
+// grantScope records the scope the portal sent with a patch check. A scope the
+// patcher can't parse could be wider than intended, so it becomes check-only.
+func (p *portalConfig) grantScope(header string) error {
+	granted, err := parseScope(header)
+	if err != nil {
+		p.granted = tokenScope{checkOnly: true}
+		return fmt.Errorf("portal %s sent a bad %s, treating the token as check-only: %w", p.Name, scopeHeader, err)
+	}
+	p.granted = granted
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScope(t *testing.T) {
+	scope, err := parseScope("tags=dev|staging, no-properties")
+	assert.NoError(t, err)
+	assert.Equal(t, tokenScope{instanceTags: []string{"dev", "staging"}, noProperties: true}, scope)
+
+	scope, err = parseScope("")
+	assert.NoError(t, err)
+	assert.Equal(t, tokenScope{}, scope)
+
+	_, err = parseScope("apply-everything")
+	assert.Error(t, err)
+	_, err = parseScope("tags=")
+	assert.Error(t, err)
+}
+
+func TestScopeNarrow(t *testing.T) {
+	local := tokenScope{instanceTags: []string{"dev", "staging"}}
+	assert.Equal(t, local, local.narrow(tokenScope{}))
+	assert.Equal(t, tokenScope{instanceTags: []string{"dev"}, noProperties: true},
+		local.narrow(tokenScope{instanceTags: []string{"dev", "prod"}, noProperties: true}))
+	assert.True(t, local.narrow(tokenScope{instanceTags: []string{"prod"}}).checkOnly)
+	assert.True(t, tokenScope{checkOnly: true}.narrow(tokenScope{}).checkOnly)
+}
+
+func TestScopeAllows(t *testing.T) {
+	dev := instanceConfig{Dir: "/opt/tomcat-dev", Tags: []string{"dev"}}
+	prod := instanceConfig{Dir: "/opt/tomcat", Tags: []string{"prod"}}
+	tarball := &PatchResponse{PatchID: "63547", TomcatDir: "/opt/tomcat-dev", Files: "https://example.com/patch.tar.gz"}
+	properties := &PatchResponse{PatchID: "63548", TomcatDir: "/opt/tomcat-dev", SakaiProps: "a=1"}
+
+	assert.NoError(t, tokenScope{}.allows(properties, prod))
+	assert.Error(t, tokenScope{checkOnly: true}.allows(tarball, dev))
+
+	devOnly := tokenScope{instanceTags: []string{"dev"}}
+	assert.NoError(t, devOnly.allows(tarball, dev))
+	assert.Error(t, devOnly.allows(tarball, prod))
+	assert.Error(t, devOnly.allows(tarball, instanceConfig{Dir: "/opt/untagged"}))
+
+	noProperties := tokenScope{noProperties: true}
+	assert.NoError(t, noProperties.allows(tarball, dev))
+	assert.Error(t, noProperties.allows(properties, dev))
+	assert.Error(t, noProperties.allows(&PatchResponse{PatchID: "63549", Steps: []patchStep{{Type: stepProperties, Value: "a=1"}}}, dev))
+}
+
+func TestGrantScope(t *testing.T) {
+	portal := &portalConfig{Name: "a", Scope: "tags=dev"}
+	assert.NoError(t, portal.grantScope("no-properties"))
+	assert.Equal(t, tokenScope{instanceTags: []string{"dev"}, noProperties: true}, portal.effectiveScope())
+
+	// Anything the patcher doesn't understand locks the token down
+	assert.Error(t, portal.grantScope("tags=dev,superuser"))
+	assert.True(t, portal.effectiveScope().checkOnly)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// readSecretFile reads a token or shared secret, refusing files other users can
+// read. Keeping secrets off the command line keeps them out of ps listings.
+func readSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("%s is accessible by group or others (mode %04o), chmod 600 it", path, info.Mode().Perm())
+	}
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	trimmed := strings.TrimSpace(string(secret))
+	if trimmed == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return trimmed, nil
+}
+
+// writeSecretFile replaces a secret file atomically, so a crash mid-write never
+// leaves a host with a truncated token it can no longer authenticate with
+func writeSecretFile(path string, secret string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// CreateTemp already uses 0600, but be explicit since this is the whole point
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.WriteString(secret + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// rotateToken switches the portal to a token it handed out with the patch JSON.
+// The new token is used right away; persisting it needs a token file.
+func (p *portalConfig) rotateToken(newToken string) error {
+	newToken = strings.TrimSpace(newToken)
+	if newToken == "" || newToken == p.authToken() {
+		return nil
+	}
+	p.tokenMu.Lock()
+	p.Token = newToken
+	p.tokenMu.Unlock()
+	if p.TokenFile == "" {
+		return fmt.Errorf("portal %s rotated its token but there is no token file to save it to", p.Name)
+	}
+	if err := writeSecretFile(p.TokenFile, newToken); err != nil {
+		return fmt.Errorf("portal %s rotated its token but it could not be saved: %w", p.Name, err)
+	}
+	log.Info("Saved rotated token for portal ", p.Name, " to ", p.TokenFile)
+	return nil
+}
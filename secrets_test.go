@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadSecretFile(t *testing.T) {
+	dir := t.TempDir()
+
+	private := filepath.Join(dir, "token")
+	os.WriteFile(private, []byte("  s3cret\n"), 0600)
+	secret, err := readSecretFile(private)
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", secret)
+
+	readable := filepath.Join(dir, "readable")
+	os.WriteFile(readable, []byte("s3cret"), 0644)
+	_, err = readSecretFile(readable)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "accessible by group or others")
+	}
+
+	empty := filepath.Join(dir, "empty")
+	os.WriteFile(empty, []byte("\n"), 0600)
+	_, err = readSecretFile(empty)
+	assert.Error(t, err)
+
+	_, err = readSecretFile(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestRotateToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("old\n"), 0600)
+	portal := &portalConfig{Name: "a", Token: "old", TokenFile: tokenFile}
+
+	assert.NoError(t, portal.rotateToken(""))
+	assert.NoError(t, portal.rotateToken("old"))
+	assert.Equal(t, "old", portal.Token)
+
+	assert.NoError(t, portal.rotateToken("new\n"))
+	assert.Equal(t, "new", portal.Token)
+	saved, err := readSecretFile(tokenFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "new", saved)
+
+	// No leftover temp files next to the token
+	entries, _ := os.ReadDir(filepath.Dir(tokenFile))
+	assert.Len(t, entries, 1)
+
+	// Without a token file the new token is still used for this process
+	portal = &portalConfig{Name: "b", Token: "old"}
+	assert.Error(t, portal.rotateToken("new"))
+	assert.Equal(t, "new", portal.Token)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func isSFTPURL(fileURL string) bool {
+	return strings.HasPrefix(fileURL, "sftp://")
+}
+
+// sftpSession closes the SSH connection along with the SFTP client
+type sftpSession struct {
+	*sftp.Client
+	conn *ssh.Client
+}
+
+func (s *sftpSession) Close() error {
+	s.Client.Close()
+	return s.conn.Close()
+}
+
+// dialSFTP logs in with the -sftp-key key as the URL's user, or the user the
+// patcher runs as. The host key must already be in -sftp-known-hosts, there
+// is nobody to ask about a new one.
+func dialSFTP(target *url.URL) (*sftpSession, error) {
+	if *sftpKey == "" {
+		return nil, permanentError{errors.New("sftp:// patch URLs need -sftp-key")}
+	}
+	keyFile, err := os.ReadFile(*sftpKey)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	signer, err := ssh.ParsePrivateKey(keyFile)
+	if err != nil {
+		return nil, permanentError{fmt.Errorf("%s: %w", *sftpKey, err)}
+	}
+	knownHosts := *sftpKnownHosts
+	if knownHosts == "" {
+		home, _ := os.UserHomeDir()
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+
+	username := target.User.Username()
+	if username == "" {
+		if current, err := user.Current(); err == nil {
+			username = current.Username
+		}
+	}
+	address := target.Host
+	if target.Port() == "" {
+		address = net.JoinHostPort(target.Hostname(), "22")
+	}
+	conn, err := ssh.Dial("tcp", address, &ssh.ClientConfig{User: username, Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeys, Timeout: 30 * time.Second})
+	if err != nil {
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			return nil, permanentError{fmt.Errorf("host key of %s is not in %s: %w", target.Hostname(), knownHosts, err)}
+		}
+		// The key won't be any more welcome next time
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, permanentError{err}
+		}
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &sftpSession{Client: client, conn: conn}, nil
+}
+
+// downloadSFTP fetches an sftp:// URL into dest, resuming from the partial
+// file like an HTTP download and checked the same way before it's moved into place
+func downloadSFTP(fileURL string, dest string, patchID string, isArchive bool) error {
+	target, err := url.Parse(fileURL)
+	if err != nil {
+		return err
+	}
+	partial := dest + ".part"
+	checksum := expectedChecksum(patchID, filepath.Base(dest))
+	defer trackPhase("download")()
+	progress := startProgress(filepath.Base(dest))
+	defer progress.Stop()
+
+	return retry("Download "+fileURL, func() error {
+		client, err := dialSFTP(target)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		remote, err := openSFTP(client, target.Path)
+		if err != nil {
+			return err
+		}
+		defer remote.Close()
+		info, err := remote.Stat()
+		if err != nil {
+			return err
+		}
+
+		file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return permanentError{err}
+		}
+		defer file.Close()
+		offset, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return permanentError{err}
+		}
+		if offset > info.Size() {
+			// Not a partial copy of this file, start over
+			file.Truncate(0)
+			offset, _ = file.Seek(0, io.SeekStart)
+		}
+		if offset > 0 {
+			log.Info("Resuming download of ", fileURL, " at byte ", offset)
+			if _, err := remote.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+		}
+
+		progress.restart(offset, info.Size())
+		n, err := io.Copy(file, io.TeeReader(downloadLimiter.reader(remote), progress))
+		atomic.AddInt64(&downloadedBytes, n)
+		if err != nil {
+			// Keep the partial file so the next attempt resumes
+			return err
+		}
+		return finishDownload(partial, dest, info.Size(), !isArchive, checksum)
+	})
+}
+
+// openSFTP gives up at once on a file that's missing or off limits
+func openSFTP(client *sftpSession, path string) (*sftp.File, error) {
+	remote, err := client.Open(path)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+		return nil, permanentError{fmt.Errorf("%s: %w", path, err)}
+	}
+	return remote, err
+}
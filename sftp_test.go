@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startTestSFTPServer serves this host's files over SFTP to the one client
+// key it writes to -sftp-key, and puts its host key in -sftp-known-hosts
+func startTestSFTPServer(t *testing.T) string {
+	_, hostPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, _ := ssh.NewSignerFromKey(hostPrivate)
+	clientPublic, clientPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	authorized, _ := ssh.NewPublicKey(clientPublic)
+
+	config := &ssh.ServerConfig{PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if conn.User() == "patches" && string(key.Marshal()) == string(authorized.Marshal()) {
+			return nil, nil
+		}
+		return nil, assert.AnError
+	}}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSFTP(conn, config)
+		}
+	}()
+
+	dir := t.TempDir()
+	block, _ := ssh.MarshalPrivateKey(clientPrivate, "")
+	os.WriteFile(filepath.Join(dir, "id_ed25519"), pem.EncodeToMemory(block), 0600)
+	address := listener.Addr().String()
+	os.WriteFile(filepath.Join(dir, "known_hosts"), []byte(knownhosts.Line([]string{knownhosts.Normalize(address)}, hostSigner.PublicKey())+"\n"), 0600)
+	*sftpKey, *sftpKnownHosts = filepath.Join(dir, "id_ed25519"), filepath.Join(dir, "known_hosts")
+	t.Cleanup(func() { *sftpKey, *sftpKnownHosts = "", "" })
+	return address
+}
+
+func serveTestSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}()
+		server, _ := sftp.NewServer(channel, sftp.ReadOnly())
+		go func() {
+			server.Serve()
+			channel.Close()
+		}()
+	}
+}
+
+func TestDownloadFileOverSFTP(t *testing.T) {
+	address := startTestSFTPServer(t)
+	source, _ := filepath.Abs("test.tar.gz")
+	tarball, _ := os.ReadFile(source)
+
+	dest := filepath.Join(t.TempDir(), "patch.tar.gz")
+	// Resume from where an earlier attempt stopped
+	os.WriteFile(dest+".part", tarball[:100], 0644)
+	assert.NoError(t, downloadFile("sftp://patches@"+address+source, dest, "63547", true))
+	downloaded, _ := os.ReadFile(dest)
+	assert.Equal(t, tarball, downloaded)
+
+	err := downloadFile("sftp://patches@"+address+source+".missing", dest+"2", "63547", true)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not exist")
+
+	err = downloadFile("sftp://intruder@"+address+source, dest+"3", "63547", true)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to authenticate")
+}
+
+func TestSFTPRefusesUnknownHostKey(t *testing.T) {
+	address := startTestSFTPServer(t)
+	os.WriteFile(*sftpKnownHosts, nil, 0600)
+	source, _ := filepath.Abs("test.tar.gz")
+
+	err := downloadFile("sftp://patches@"+address+source, filepath.Join(t.TempDir(), "patch.tar.gz"), "63547", true)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "host key")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signatureHeader carries "t=<unix time>,sha256=<hex HMAC-SHA256>" on portal
+// responses, the HMAC of the time, a dot and the body
+const signatureHeader = "X-Patch-Signature-256"
+
+// signatureMaxAge is how far the time of a signature may be from ours, so a
+// captured response can't be replayed later on
+const signatureMaxAge = 5 * time.Minute
+
+// signBody signs body with the shared secret as the portal does, at the given time
+func signBody(secret string, body []byte, at time.Time) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + timestamp + ",sha256=" + hex.EncodeToString(bodyMAC(secret, timestamp, body))
+}
+
+func bodyMAC(secret string, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// verifySignature checks the portal signed a response with the shared secret,
+// and recently. Without a secret configured every response is accepted, as before.
+func verifySignature(secret string, body []byte, header string) error {
+	if secret == "" {
+		return nil
+	}
+	if header == "" {
+		return errors.New("portal response is not signed but an HMAC secret is configured")
+	}
+	var timestamp, digest string
+	for _, field := range strings.Split(header, ",") {
+		if value, ok := strings.CutPrefix(field, "t="); ok {
+			timestamp = value
+		} else if value, ok := strings.CutPrefix(field, "sha256="); ok {
+			digest = value
+		}
+	}
+	signature, err := hex.DecodeString(digest)
+	seconds, err2 := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || err2 != nil || digest == "" {
+		return errors.New("portal signature is malformed: " + header)
+	}
+
+	if !hmac.Equal(signature, bodyMAC(secret, timestamp, body)) {
+		return errors.New("portal signature does not match, refusing to act on the patch")
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > signatureMaxAge || age < -signatureMaxAge {
+		return errors.New("portal signature is dated " + time.Unix(seconds, 0).UTC().Format(time.RFC3339) + ", too far from now to be trusted")
+	}
+	return nil
+}
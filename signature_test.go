@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"patch_id": "63547", "tomcat_dir": "/opt/tomcat"}`)
+	// printf '%s' "1700000000.$body" | openssl dgst -sha256 -hmac s3cret
+	assert.Equal(t, "t=1700000000,sha256=8d4eb2d4e44325905b24f46cedfa43ace1ed3c00be70c54f901ae2e190d57744",
+		signBody("s3cret", body, time.Unix(1700000000, 0)))
+	signed := signBody("s3cret", body, time.Now())
+
+	assert.NoError(t, verifySignature("", body, ""), "no secret, no check")
+	assert.NoError(t, verifySignature("s3cret", body, signed))
+	assert.EqualError(t, verifySignature("s3cret", body, ""), "portal response is not signed but an HMAC secret is configured")
+	assert.EqualError(t, verifySignature("s3cret", []byte(`{"patch_id": "63548", "tomcat_dir": "/opt/tomcat"}`), signed),
+		"portal signature does not match, refusing to act on the patch")
+	assert.EqualError(t, verifySignature("s3cret", body, "md5=abc"), "portal signature is malformed: md5=abc")
+
+	// A signature without a time, or an old one, could be a captured response played back
+	assert.Error(t, verifySignature("s3cret", body, signed[strings.Index(signed, ",")+1:]))
+	assert.EqualError(t, verifySignature("s3cret", body, signBody("s3cret", body, time.Unix(1700000000, 0))),
+		"portal signature is dated 2023-11-14T22:13:20Z, too far from now to be trusted")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// slackTailLines is how much of the output goes into a Slack message
+const slackTailLines = 15
+
+// notifySlack posts how a patch ended to the Slack incoming webhook in
+// -slack-webhook-file. Like notifyWebhook it is best effort.
+func notifySlack(rv string, startup string, patchID string) {
+	if *slackWebhookFile == "" || rv == inProgress {
+		return
+	}
+	webhook, err := readSecretFile(*slackWebhookFile)
+	if err != nil {
+		log.Warning("Could not read Slack webhook: ", err)
+		return
+	}
+	if err := postSlack(webhook, slackMessage(rv, startup, patchID)); err != nil {
+		log.Warning("Could not notify Slack for patch ", patchID, ": ", err)
+	}
+}
+
+// slackMessage is e.g. ":x: Patch 63547 failed/startup_failed on lms1 (portal default) after 6m2s",
+// in the patch's locale, followed by the tail of the output unless the host withholds output
+func slackMessage(rv string, startup string, patchID string) string {
+	status := statusFor(rv, startup, statusReasons[patchID])
+	icon := ":x:"
+	switch status.state {
+	case stateSucceeded:
+		icon = ":white_check_mark:"
+	case stateDeferred:
+		icon = ":double_vertical_bar:"
+	}
+	text := icon + " " + renderNotification("summary", rv, startup, patchID)
+
+	if resultDetail != detailFull {
+		return text
+	}
+	tail := lastLines(outputBuffer.String(), slackTailLines)
+	// A server that didn't come back explains itself in its own log, relative to the server dir
+	if rv == tomcatDown {
+		if serverLog, err := readTail(activeProfile.logFile(), 64*1024); err == nil {
+			tail = lastLines(serverLog, slackTailLines)
+		}
+	}
+	if tail != "" {
+		text += "\n```" + strings.ReplaceAll(tail, "```", "'''") + "```"
+	}
+	return text
+}
+
+// lastLines returns up to n trailing non-empty lines of text
+func lastLines(text string, n int) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// readTail reads at most the last max bytes of a file, catalina.out can be huge
+func readTail(path string, max int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err == nil && info.Size() > max {
+		file.Seek(-max, io.SeekEnd)
+	}
+	tail, err := io.ReadAll(io.LimitReader(file, max))
+	return string(tail), err
+}
+
+func postSlack(webhook string, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("Slack responded " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifySlack(t *testing.T) {
+	var texts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message struct{ Text string }
+		json.NewDecoder(r.Body).Decode(&message)
+		texts = append(texts, message.Text)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	webhookFile := filepath.Join(dir, "slack")
+	os.WriteFile(webhookFile, []byte(server.URL+"\n"), 0600)
+	*slackWebhookFile = webhookFile
+	defer func() { *slackWebhookFile = "" }()
+
+	outputBuffer.Reset()
+	defer outputBuffer.Reset()
+	outputBuffer.WriteString("Stopping Tomcat\nStep restart for patch 63547 failed\n")
+	statusReasons = map[string]string{"63547": reasonStartupFailed}
+	defer func() { statusReasons = map[string]string{} }()
+
+	notifySlack(inProgress, "0", "63547")
+	assert.Empty(t, texts)
+
+	notifySlack(patchSuccess, "84211", "63548")
+	hostname, _ := os.Hostname()
+	if assert.Len(t, texts, 1) {
+		assert.True(t, strings.HasPrefix(texts[0], ":white_check_mark: Patch 63548 succeeded on "+hostname), texts[0])
+		assert.Contains(t, texts[0], "```Stopping Tomcat\nStep restart for patch 63547 failed```")
+	}
+
+	// A server that stayed down shows the tail of its own log
+	originalWd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(originalWd)
+	os.MkdirAll("logs", 0755)
+	os.WriteFile("logs/catalina.out", []byte(strings.Repeat("INFO noise\n", 100)+"SEVERE: Context [/portal] startup failed\n"), 0644)
+	notifySlack(tomcatDown, "-1", "63547")
+	if assert.Len(t, texts, 2) {
+		assert.True(t, strings.HasPrefix(texts[1], ":x: Patch 63547 failed/startup_failed"), texts[1])
+		assert.Contains(t, texts[1], "startup failed```")
+		assert.Equal(t, slackTailLines, strings.Count(texts[1], "\n"))
+	}
+
+	// Hosts that keep output to themselves only send the status
+	resultDetail = detailStatus
+	defer func() { resultDetail = detailFull }()
+	assert.NotContains(t, slackMessage(tomcatDown, "-1", "63547"), "```")
+
+	tail, err := readTail("logs/catalina.out", 20)
+	assert.NoError(t, err)
+	assert.Equal(t, "tal] startup failed\n", tail)
+}
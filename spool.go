@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// spoolDir keeps each portal's undelivered results apart so they reach the right portal
+func spoolDir() string {
+	if activePortal.Name == defaultPortalName {
+		return filepath.Join(*stateDir, "spool")
+	}
+	return filepath.Join(*stateDir, "spool", activePortal.Name)
+}
+
+// spoolUpdate saves a result the portal never received so a later run can deliver it
+func spoolUpdate(urlValues url.Values) error {
+	if err := os.MkdirAll(spoolDir(), 0700); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(urlValues)
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a flush never sees a half-written file
+	name := fmt.Sprintf("%d-%s.json", time.Now().UnixNano(), urlValues.Get("patch_id"))
+	tmp := filepath.Join(spoolDir(), "."+name)
+	if err := os.WriteFile(tmp, encoded, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(spoolDir(), name))
+}
+
+// rejectedSpoolDir keeps spooled results the portal refused for good, for an
+// operator to look at. The dot keeps it apart from other portals' spools.
+func rejectedSpoolDir() string {
+	return filepath.Join(spoolDir(), ".rejected")
+}
+
+// flushSpool sends spooled results oldest first, stopping at the first failure
+// that may go away. A result the portal refuses is set aside instead, or it
+// would hold up every result after it for good.
+func flushSpool() {
+	entries, err := os.ReadDir(spoolDir())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Could not read spool directory: ", err)
+		}
+		return
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		spooled := filepath.Join(spoolDir(), name)
+		input, err := os.ReadFile(spooled)
+		if err != nil {
+			log.Error("Could not read spooled result: ", spooled, err)
+			continue
+		}
+		var urlValues url.Values
+		if err := json.Unmarshal(input, &urlValues); err != nil {
+			log.Error("Discarding corrupt spooled result: ", spooled, err)
+			os.Remove(spooled)
+			continue
+		}
+
+		err = postPortalUpdate(urlValues)
+		var permanent permanentError
+		if errors.As(err, &permanent) {
+			log.Error("Portal refused spooled result for patch ", urlValues.Get("patch_id"), ", moving it to ", rejectedSpoolDir(), ": ", err)
+			if err := os.MkdirAll(rejectedSpoolDir(), 0700); err != nil || os.Rename(spooled, filepath.Join(rejectedSpoolDir(), name)) != nil {
+				os.Remove(spooled)
+			}
+			continue
+		}
+		if err != nil {
+			log.Warning("Portal still unreachable, keeping spooled results: ", err)
+			return
+		}
+		log.Info("Delivered spooled result for patch ", urlValues.Get("patch_id"))
+		os.Remove(spooled)
+	}
+}
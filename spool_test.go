@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestSpoolAndFlush(t *testing.T) {
+	*stateDir = t.TempDir()
+	fastRetries(t, 1)
+	defer func() { *stateDir = defaultStateDir }()
+
+	portalUp := false
+	var delivered []string
+	http.DefaultClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if !portalUp {
+			return nil, errors.New("connection refused")
+		}
+		req.ParseForm()
+		delivered = append(delivered, req.PostForm.Get("patch_id"))
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+	})
+	defer func() { http.DefaultClient.Transport = nil }()
+
+	updateAdminPortal(patchSuccess, "95000", "63547")
+	updateAdminPortal(tomcatDown, "-1", "63548")
+	assert.Panics(t, func() { updateAdminPortal(inProgress, "0", "63549") }, "claims are never spooled")
+
+	spooled, _ := os.ReadDir(spoolDir())
+	assert.Len(t, spooled, 2)
+
+	// Still down, nothing is lost
+	flushSpool()
+	spooled, _ = os.ReadDir(spoolDir())
+	assert.Len(t, spooled, 2)
+
+	portalUp = true
+	flushSpool()
+	assert.Equal(t, []string{"63547", "63548"}, delivered)
+	spooled, _ = os.ReadDir(spoolDir())
+	assert.Empty(t, spooled)
+}
+
+func TestFlushSpoolSetsAsideRejected(t *testing.T) {
+	*stateDir = t.TempDir()
+	fastRetries(t, 1)
+	defer func() { *stateDir = defaultStateDir }()
+
+	spoolUpdate(url.Values{"patch_id": {"63547"}})
+	spoolUpdate(url.Values{"patch_id": {"63548"}})
+	var delivered []string
+	http.DefaultClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req.ParseForm()
+		status := http.StatusOK
+		if req.PostForm.Get("patch_id") == "63547" {
+			status = http.StatusUnprocessableEntity
+		} else {
+			delivered = append(delivered, req.PostForm.Get("patch_id"))
+		}
+		return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+	})
+	defer func() { http.DefaultClient.Transport = nil }()
+
+	// The refused result doesn't hold up the one after it
+	flushSpool()
+	assert.Equal(t, []string{"63548"}, delivered)
+	rejected, _ := os.ReadDir(rejectedSpoolDir())
+	if assert.Len(t, rejected, 1) {
+		assert.Contains(t, rejected[0].Name(), "63547")
+	}
+
+	flushSpool()
+	assert.Equal(t, []string{"63548"}, delivered, "set aside for good")
+}
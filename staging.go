@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stagedFileName records the checksums of tarballs staged ahead of their
+// maintenance window, so the run that applies them finds them in the cache
+// even when the portal sends no checksums
+const stagedFileName = "staged-tarballs.json"
+
+// stageOnly makes every patch prefetch_only, for "go-patcher prefetch"
+var stageOnly bool
+
+// stagedChecksums are by patch ID and then tarball file name, like tarballChecksums
+type stagedChecksums map[string]map[string]string
+
+func stagedPath() string {
+	return filepath.Join(*stateDir, stagedFileName)
+}
+
+func loadStagedChecksums() stagedChecksums {
+	staged := stagedChecksums{}
+	data, err := os.ReadFile(stagedPath())
+	if err != nil {
+		return staged
+	}
+	if err := json.Unmarshal(data, &staged); err != nil {
+		log.Warning("Ignoring unreadable ", stagedPath(), ": ", err)
+		return stagedChecksums{}
+	}
+	return staged
+}
+
+// save drops tarballs that have left the cache since, then writes the record
+func (s stagedChecksums) save() error {
+	for patchID, sums := range s {
+		for fileName, sum := range sums {
+			if !pathExists(filepath.Join(cacheDir(), sum)) {
+				delete(sums, fileName)
+			}
+		}
+		if len(sums) == 0 {
+			delete(s, patchID)
+		}
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*stateDir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(stagedPath()+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(stagedPath()+".tmp", stagedPath())
+}
+
+// stageTarballs downloads and reads through every tarball of a patch, leaving
+// the server alone, so its maintenance window covers only extraction and the
+// restart
+func stageTarballs(patch *PatchResponse) error {
+	if err := os.MkdirAll(*patchDir, 0755); err != nil {
+		return err
+	}
+	staged := loadStagedChecksums()
+	var failed []string
+	for _, step := range patchSteps(patch) {
+		if step.Type == stepDelta {
+			// Found again by the new file's checksum, which the step carries
+			if built, err := buildFromDelta(step.Value, patch.TomcatDir, patch.PatchID); err != nil {
+				failed = append(failed, err.Error())
+			} else {
+				log.Info("Staged ", strings.Fields(step.Value)[0], " for patch ", patch.PatchID, " at ", built)
+			}
+			continue
+		}
+		if step.Type != stepTarball {
+			continue
+		}
+		for _, tarball := range strings.SplitN(step.Value, " ", 10) {
+			fetched, err := fetchTarballSafely(tarball, patch.PatchID)
+			if err == nil {
+				_, err = checkFetchedTarball(fetched)
+			}
+			if err != nil {
+				failed = append(failed, tarball+": "+err.Error())
+				continue
+			}
+			log.Info("Staged ", redactURL(tarball), " for patch ", patch.PatchID, " at ", fetched)
+			if filepath.Dir(fetched) == cacheDir() {
+				if staged[patch.PatchID] == nil {
+					staged[patch.PatchID] = map[string]string{}
+				}
+				staged[patch.PatchID][path.Base(redactURL(tarball))] = filepath.Base(fetched)
+			}
+		}
+	}
+	if err := staged.save(); err != nil {
+		log.Warning("Could not record staged tarballs: ", err)
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// useStagedChecksums fills in the checksums of staged tarballs the portal
+// sent none for, a checksum the portal did send always wins
+func useStagedChecksums(patches []*PatchResponse) {
+	staged := loadStagedChecksums()
+	for _, patch := range patches {
+		for fileName, sum := range staged[patch.PatchID] {
+			if expectedChecksum(patch.PatchID, fileName) != "" {
+				continue
+			}
+			if tarballChecksums[patch.PatchID] == nil {
+				tarballChecksums[patch.PatchID] = map[string]string{}
+			}
+			tarballChecksums[patch.PatchID][fileName] = sum
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStageTarballs(t *testing.T) {
+	dir := t.TempDir()
+	defer func(patch, state, web string) { *patchDir, *stateDir, *patchWeb = patch, state, web }(*patchDir, *stateDir, *patchWeb)
+	*patchDir, *stateDir = filepath.Join(dir, "patches"), filepath.Join(dir, "state")
+	defer func() { tarballChecksums = map[string]map[string]string{} }()
+	fastRetries(t, 2)
+
+	tarball, _ := os.ReadFile("test.tar.gz")
+	sum, _ := fileChecksum("test.tar.gz")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/sakai-builder/broken.tar.gz" {
+			w.Write(tarball[:100])
+			return
+		}
+		w.Write(tarball)
+	}))
+	defer server.Close()
+	*patchWeb = server.URL + "/"
+
+	// No checksums from the portal, the staged copy is found by the one recorded
+	patch := &PatchResponse{PatchID: "63547", TomcatDir: dir, Files: "sakai-builder/patch-63547.tar.gz", PrefetchOnly: true}
+	assert.NoError(t, stageTarballs(patch))
+	assert.Equal(t, stagedChecksums{"63547": {"patch-63547.tar.gz": sum}}, loadStagedChecksums())
+
+	useStagedChecksums([]*PatchResponse{patch})
+	assert.Equal(t, sum, expectedChecksum("63547", "patch-63547.tar.gz"))
+	assert.Equal(t, filepath.Join(cacheDir(), sum), fetchTarball("sakai-builder/patch-63547.tar.gz", "63547"))
+	assert.Equal(t, 1, requests, "applied from the staged copy")
+
+	// The portal's own checksum wins
+	tarballChecksums["63547"] = map[string]string{"patch-63547.tar.gz": "abc"}
+	useStagedChecksums([]*PatchResponse{patch})
+	assert.Equal(t, "abc", expectedChecksum("63547", "patch-63547.tar.gz"))
+
+	err := stageTarballs(&PatchResponse{PatchID: "63548", TomcatDir: dir, Files: "sakai-builder/broken.tar.gz"})
+	assert.Error(t, err)
+
+	// Tarballs pruned from the cache are forgotten
+	os.Remove(filepath.Join(cacheDir(), sum))
+	assert.NoError(t, loadStagedChecksums().save())
+	assert.Empty(t, loadStagedChecksums())
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// topErrorCategories is how many loggers the portal report lists
+const topErrorCategories = 5
+
+// errorLevelPattern matches the level of log4j/logback (ERROR) and java.util.logging (SEVERE) lines
+var errorLevelPattern = regexp.MustCompile(`\b(ERROR|SEVERE)\b`)
+
+// loggerPattern is the first dotted name after the level: org.apache.catalina.core.StandardContext,
+// [org.jboss.as.controller], or Jetty's abbreviated oejw.WebAppContext
+var loggerPattern = regexp.MustCompile(`[A-Za-z_$][\w$]*(\.[A-Za-z_$][\w$]*)+`)
+
+type errorCategory struct {
+	Logger string `json:"logger"`
+	Count  int    `json:"count"`
+}
+
+// startupErrorReport summarizes the errors a startup logged, so a patch that
+// succeeded but tripled the error volume is visible in the portal
+type startupErrorReport struct {
+	Total int             `json:"total"`
+	Top   []errorCategory `json:"top"`
+}
+
+// startupErrors is sent to the portal with the final update, per patch ID
+var startupErrors = map[string]startupErrorReport{}
+
+// countStartupErrors categorizes the ERROR and SEVERE lines in a server log by logger
+func countStartupErrors(logFile string) (startupErrorReport, error) {
+	report := startupErrorReport{}
+	file, err := os.Open(logFile)
+	if err != nil {
+		return report, err
+	}
+	defer file.Close()
+
+	counts := map[string]int{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		level := errorLevelPattern.FindStringIndex(line)
+		if level == nil {
+			continue
+		}
+		logger := loggerPattern.FindString(line[level[1]:])
+		if logger == "" {
+			logger = "unknown"
+		}
+		counts[logger]++
+		report.Total++
+	}
+	if err := scanner.Err(); err != nil {
+		return report, err
+	}
+
+	for logger, count := range counts {
+		report.Top = append(report.Top, errorCategory{Logger: logger, Count: count})
+	}
+	sort.Slice(report.Top, func(i, j int) bool {
+		if report.Top[i].Count != report.Top[j].Count {
+			return report.Top[i].Count > report.Top[j].Count
+		}
+		return report.Top[i].Logger < report.Top[j].Logger
+	})
+	if len(report.Top) > topErrorCategories {
+		report.Top = report.Top[:topErrorCategories]
+	}
+	return report, nil
+}
+
+// recordStartupErrors counts the errors of the startup that just ran for the patches it covers
+func recordStartupErrors(patchIDs []string) {
+	report, err := countStartupErrors(activeProfile.logFile())
+	if err != nil {
+		log.Warning("Could not count startup errors: ", err)
+		return
+	}
+	for _, id := range patchIDs {
+		startupErrors[id] = report
+	}
+	if report.Total == 0 {
+		return
+	}
+
+	var top []string
+	for _, category := range report.Top {
+		top = append(top, fmt.Sprintf("%s (%d)", category.Logger, category.Count))
+	}
+	summary := fmt.Sprintf("Startup logged %d ERROR/SEVERE lines, top loggers: %s", report.Total, strings.Join(top, ", "))
+	log.Info(summary)
+	outputBuffer.WriteString(summary + "\n")
+}
+
+// startupErrorSummary encodes the startup error report of a patch for the portal
+func startupErrorSummary(patchID string) string {
+	report, ok := startupErrors[patchID]
+	if !ok {
+		return ""
+	}
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
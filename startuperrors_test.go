@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountStartupErrors(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "catalina.out")
+	os.WriteFile(logFile, []byte(strings.Join([]string{
+		"16-Oct-2026 10:00:00.123 INFO [main] org.apache.catalina.startup.Catalina.load Server initialized",
+		"16-Oct-2026 10:00:01.123 SEVERE [main] org.apache.catalina.core.StandardContext.startInternal One or more listeners failed",
+		"16-Oct-2026 10:00:02.123 SEVERE [main] org.apache.catalina.core.StandardContext.startInternal One or more listeners failed",
+		"2026-10-16 10:00:03,123 ERROR main org.sakaiproject.event.impl.UsageSessionServiceAdaptor - No session",
+		"java.lang.NullPointerException: null",
+		"\tat org.sakaiproject.Foo.bar(Foo.java:12)",
+		"10:00:04,123 ERROR [org.jboss.as.controller] (Controller Boot Thread) WFLYCTL0013",
+		"2026-10-16 10:00:05.123:ERROR:oejw.WebAppContext:main: Failed startup",
+		"ERROR something without a logger",
+		"16-Oct-2026 10:00:06.123 INFO [main] org.apache.catalina.startup.Catalina.start Server startup in [12345] milliseconds",
+	}, "\n")), 0644)
+
+	report, err := countStartupErrors(logFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, report.Total)
+	assert.Equal(t, errorCategory{"org.apache.catalina.core.StandardContext.startInternal", 2}, report.Top[0])
+	assert.Len(t, report.Top, 5)
+	assert.Contains(t, report.Top, errorCategory{"org.jboss.as.controller", 1})
+	assert.Contains(t, report.Top, errorCategory{"oejw.WebAppContext", 1})
+	assert.Contains(t, report.Top, errorCategory{"unknown", 1})
+
+	_, err = countStartupErrors(filepath.Join(t.TempDir(), "missing.out"))
+	assert.Error(t, err)
+}
+
+func TestStartupErrorSummary(t *testing.T) {
+	startupErrors = map[string]startupErrorReport{"63547": {Total: 2, Top: []errorCategory{{"org.example.Foo", 2}}}}
+	defer func() { startupErrors = map[string]startupErrorReport{} }()
+
+	assert.Equal(t, `{"total":2,"top":[{"logger":"org.example.Foo","count":2}]}`, startupErrorSummary("63547"))
+	assert.Equal(t, "", startupErrorSummary("12345"))
+}
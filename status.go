@@ -0,0 +1,130 @@
+package main
+
+import "strings"
+
+// statusModelHeader negotiates the richer status model: the patcher announces
+// the version it speaks, and portals that understand it answer with the same header
+const statusModelHeader = "X-Patcher-Status-Model"
+const statusModelVersion = "2"
+
+// Result states of the richer status model
+const (
+	stateInProgress = "in_progress"
+	stateSucceeded  = "succeeded"
+	stateDeferred   = "deferred"
+	stateFailed     = "failed"
+)
+
+// Reasons qualify a state. The legacy startup codes map onto the first group.
+const (
+	reasonIgniteMismatch = "ignite_mismatch"
+	reasonHostOverride   = "host_override"
+	reasonConflicts      = "conflicting_processes"
+	reasonNotAttempted   = "not_attempted"
+	reasonDependsOn      = "depends_on_unmet"
+	reasonPaused         = "paused"
+	reasonOutsideWindow  = "outside_window"
+	reasonNotManaged     = "instance_not_managed"
+	reasonLocalPolicy    = "local_policy"
+	reasonTokenScope     = "token_scope"
+	reasonPropertyEdits  = "property_conflict"
+	reasonTarballMissing = "tarball_unavailable"
+	reasonPrefetched     = "prefetched"
+	reasonDiskSpace      = "insufficient_disk_space"
+	reasonServerDown     = "server_down"
+	reasonNoShutdown     = "no_shutdown"
+	reasonStepFailed     = "step_failed"
+	reasonBrokenArchive  = "broken_archive"
+	reasonStartupFailed  = "startup_failed"
+	reasonHealthFailed   = "health_check_failed"
+	reasonPropertyWrite  = "property_write_failed"
+	reasonTarballFailed  = "tarball_failed"
+	reasonHookFailed     = "hook_failed"
+	reasonSQLFailed      = "sql_failed"
+	reasonFlagFailed     = "feature_flag_failed"
+	reasonGitFailed      = "git_failed"
+	reasonDeltaFailed    = "delta_failed"
+	reasonCanceled       = "canceled"
+)
+
+// legacyReasons are what the negative start_uptime codes mean for a deferred patch
+var legacyReasons = map[string]string{
+	"-2":  reasonIgniteMismatch,
+	"-3":  reasonHostOverride,
+	"-4":  reasonConflicts,
+	"-5":  reasonNotAttempted,
+	"-6":  reasonDependsOn,
+	"-7":  reasonPaused,
+	"-8":  reasonOutsideWindow,
+	"-9":  reasonNotManaged,
+	"-10": reasonLocalPolicy,
+	"-11": reasonTokenScope,
+	"-12": reasonPropertyEdits,
+	"-13": reasonTarballMissing,
+	"-14": reasonPrefetched,
+	"-15": reasonDiskSpace,
+}
+
+// patchStatus is a result in the richer model
+type patchStatus struct {
+	state  string
+	reason string
+}
+
+func (s patchStatus) String() string {
+	if s.reason == "" {
+		return s.state
+	}
+	return s.state + "/" + s.reason
+}
+
+// statusReasons hold the specific reason for failures the legacy codes can't
+// express, per patch ID, e.g. a failed hook rather than just "Tomcat down"
+var statusReasons = map[string]string{}
+
+// statusFor lifts a legacy result value and start_uptime into the richer model
+func statusFor(rv string, startup string, reason string) patchStatus {
+	switch rv {
+	case inProgress:
+		return patchStatus{stateInProgress, ""}
+	case patchSuccess:
+		return patchStatus{stateSucceeded, ""}
+	case patchDefer:
+		if reason == "" {
+			reason = legacyReasons[startup]
+		}
+		return patchStatus{stateDeferred, reason}
+	case tomcatNoShutdown:
+		return patchStatus{stateFailed, reasonNoShutdown}
+	}
+	if reason == "" {
+		reason = reasonServerDown
+	}
+	return patchStatus{stateFailed, reason}
+}
+
+// stepFailureReason names the reason for a failed step
+func stepFailureReason(stepType string) string {
+	switch stepType {
+	case stepProperties:
+		return reasonPropertyWrite
+	case stepTarball:
+		return reasonTarballFailed
+	case stepHook:
+		return reasonHookFailed
+	case stepSQL:
+		return reasonSQLFailed
+	case stepFlag:
+		return reasonFlagFailed
+	case stepGit:
+		return reasonGitFailed
+	case stepDelta:
+		return reasonDeltaFailed
+	}
+	return reasonStepFailed
+}
+
+// acceptStatusModel records whether the portal answered the status model negotiation
+func (p *portalConfig) acceptStatusModel(header string) {
+	p.richStatus = strings.TrimSpace(header) == statusModelVersion
+}
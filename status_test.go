@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusFor(t *testing.T) {
+	testCases := []struct {
+		rv, startup, reason string
+		expected            string
+	}{
+		{patchSuccess, "12345", "", "succeeded"},
+		{inProgress, "0", "", "in_progress"},
+		{patchDefer, "-2", "", "deferred/ignite_mismatch"},
+		{patchDefer, "-8", "", "deferred/outside_window"},
+		{patchDefer, "-11", "", "deferred/token_scope"},
+		{tomcatDown, "-1", "", "failed/server_down"},
+		{tomcatDown, "-1", reasonHealthFailed, "failed/health_check_failed"},
+		{tomcatNoShutdown, "-1", "", "failed/no_shutdown"},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, statusFor(tc.rv, tc.startup, tc.reason).String())
+	}
+}
+
+func TestAcceptStatusModel(t *testing.T) {
+	portal := &portalConfig{Name: "a"}
+	portal.acceptStatusModel(statusModelVersion)
+	assert.True(t, portal.richStatus)
+	portal.acceptStatusModel("")
+	assert.False(t, portal.richStatus)
+}
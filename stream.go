@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// liveStream broadcasts the patcher log and the server log to anyone
+// connected to a Unix socket, e.g. `nc -U /run/go-patcher.sock`.
+// A nil *liveStream is a no-op so callers don't need to check -stream-socket.
+type liveStream struct {
+	mu       sync.Mutex
+	listener net.Listener
+	clients  []net.Conn
+	done     chan struct{}
+
+	tailOnce  sync.Once
+	following string // server log being tailed, switched by each patch cycle
+	offset    int64
+	file      os.FileInfo // what following was when offset was read, to notice it's replaced
+}
+
+// startLiveStream listens on socketPath, replacing a socket left by an earlier run
+func startLiveStream(socketPath string) (*liveStream, error) {
+	if info, err := os.Lstat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(socketPath)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	// Server logs can hold secrets, so only the patcher's user may connect
+	os.Chmod(socketPath, 0600)
+
+	s := newLiveStream()
+	s.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.attach(conn)
+		}
+	}()
+	return s, nil
+}
+
+// newLiveStream is a stream without a socket, clients are attached directly
+func newLiveStream() *liveStream {
+	return &liveStream{done: make(chan struct{})}
+}
+
+// attach adds a client, which gets everything written from now on
+func (s *liveStream) attach(conn net.Conn) {
+	s.mu.Lock()
+	s.clients = append(s.clients, conn)
+	s.mu.Unlock()
+}
+
+// Write sends p to every connected client, dropping slow or closed ones.
+// It never fails so it is safe to use in an io.MultiWriter with the real log.
+func (s *liveStream) Write(p []byte) (int, error) {
+	if s == nil {
+		return len(p), nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var alive []net.Conn
+	for _, conn := range s.clients {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write(p); err != nil {
+			conn.Close()
+			continue
+		}
+		alive = append(alive, conn)
+	}
+	s.clients = alive
+	return len(p), nil
+}
+
+// follow copies what the server appends to logFile into the stream every second,
+// replacing the log followed so far. What's in it already, possibly gigabytes,
+// isn't sent. The file is reopened each time since start() moves the old log
+// aside; a new or truncated log is sent from its start.
+func (s *liveStream) follow(logFile string) {
+	if s == nil {
+		return
+	}
+	info, _ := os.Stat(logFile)
+	s.mu.Lock()
+	s.following, s.offset, s.file = logFile, 0, info
+	if info != nil {
+		s.offset = info.Size()
+	}
+	s.mu.Unlock()
+
+	s.tailOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-s.done:
+					return
+				case <-ticker.C:
+					s.tail()
+				}
+			}
+		}()
+	})
+}
+
+func (s *liveStream) tail() {
+	s.mu.Lock()
+	logFile, offset, previous := s.following, s.offset, s.file
+	s.mu.Unlock()
+
+	file, err := os.Open(logFile)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	if previous == nil || !os.SameFile(previous, info) || info.Size() < offset {
+		offset = 0
+	}
+	file.Seek(offset, io.SeekStart)
+	copied, _ := io.Copy(s, file)
+
+	s.mu.Lock()
+	if s.following == logFile {
+		s.offset, s.file = offset+copied, info
+	}
+	s.mu.Unlock()
+}
+
+// Close disconnects every client and removes the socket
+func (s *liveStream) Close() {
+	if s == nil {
+		return
+	}
+	close(s.done)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.clients {
+		conn.Close()
+	}
+	s.clients = nil
+	log.Debug("Closed live output stream")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiveStream(t *testing.T) {
+	var nilStream *liveStream
+	nilStream.Write([]byte("ignored"))
+	nilStream.follow("logs/catalina.out")
+	nilStream.Close()
+
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "patcher.sock")
+	stream, err := startLiveStream(socketPath)
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	conn, err := net.Dial("unix", socketPath)
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// Wait for the accept loop to pick up the client
+	assert.Eventually(t, func() bool {
+		stream.mu.Lock()
+		defer stream.mu.Unlock()
+		return len(stream.clients) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	stream.Write([]byte("Running step 1/2 for patch 63547: tarball\n"))
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "Running step 1/2 for patch 63547: tarball\n", line)
+
+	// What the log had before isn't sent, only what's appended
+	logFile := filepath.Join(dir, "catalina.out")
+	os.WriteFile(logFile, []byte("INFO: Server startup in [90000] milliseconds\n"), 0644)
+	stream.follow(logFile)
+	appendLog := func(text string) {
+		file, _ := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0644)
+		file.WriteString(text)
+		file.Close()
+	}
+	appendLog("INFO: Stopping service [Catalina]\n")
+	line, err = reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "INFO: Stopping service [Catalina]\n", line)
+
+	// The log moved aside by start() is followed by a new one, read from its start
+	os.Rename(logFile, logFile+"-pre-patch-63547")
+	os.WriteFile(logFile, []byte("INFO: Server startup in [95000] milliseconds, a line longer than before\n"), 0644)
+	line, err = reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "INFO: Server startup in [95000] milliseconds, a line longer than before\n", line)
+}
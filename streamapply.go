@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sync/atomic"
+
+	"github.com/ottenhoff/go-patcher/v2/archive"
+	log "github.com/sirupsen/logrus"
+)
+
+// streamTarballPatch applies a tarball as it downloads, without a copy in
+// patchDir, when -stream-download is set. It reports false when the tarball
+// goes through fetchTarball instead: it's already on disk, its signature has
+// to be checked before it's used, or no mirror served it whole.
+func streamTarballPatch(tarball string, patchID string) bool {
+	if !*streamDownload || tarballKey != nil || pathExists(tarball) {
+		return false
+	}
+	fileName := path.Base(redactURL(tarball))
+	if findInPatchRepo(fileName) != "" || cachedTarball(expectedChecksum(patchID, fileName)) != "" ||
+		revalidatedCopy(tarball, patchID, fileName) != "" {
+		return false
+	}
+
+	sources, alternates := tarballSources(tarball)
+	applied, missing := streamFromAny(sources, fileName, patchID)
+	if !applied && missing && len(alternates) > 0 {
+		applied, _ = streamFromAny(alternates, fileName, patchID)
+	}
+	if !applied {
+		log.Warning("Downloading ", fileName, " to ", *patchDir, " instead of streaming it")
+	}
+	return applied
+}
+
+// streamFromAny tries each source in turn. missing reports that every one
+// answered 404, so the tarball may be in the other patch tree.
+func streamFromAny(sources []string, fileName string, patchID string) (applied bool, missing bool) {
+	notFound := 0
+	for _, source := range sources {
+		if isSFTPURL(source) {
+			continue
+		}
+		err := streamFrom(source, fileName, patchID)
+		if err == nil {
+			return true, false
+		}
+		if !errors.Is(err, archive.ErrNotApplied) {
+			panic("Could not apply patch " + fileName + ": " + err.Error())
+		}
+		if isNotFound(err) {
+			notFound++
+		}
+		log.Warning("Could not stream ", redactURL(source), ": ", err)
+	}
+	return false, notFound > 0 && notFound == len(sources)
+}
+
+// streamFrom extracts one source into the current directory. The server is
+// left alone until the whole tarball has arrived and matches its checksum.
+func streamFrom(source string, fileName string, patchID string) error {
+	fileURL := source
+	if isS3URL(source) {
+		signed, err := presignS3(source)
+		if err != nil {
+			return fmt.Errorf("%w: could not sign %s: %w", archive.ErrNotApplied, source, err)
+		}
+		fileURL = signed
+	}
+	// A stream can't resume, so a URL about to expire is replaced up front
+	fileURL = renewSignedURL(source, fileURL, patchID)
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %w", archive.ErrNotApplied, err)
+	}
+	setRunHeaders(req)
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", archive.ErrNotApplied, err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return fmt.Errorf("%w: %w", archive.ErrNotApplied, err)
+	}
+
+	defer trackPhase("download")()
+	defer trackPhase("extract")()
+	progress := startProgress(fileName)
+	defer progress.Stop()
+	progress.restart(0, resp.ContentLength)
+	hash := sha256.New()
+	var read int64
+	body := io.TeeReader(downloadLimiter.reader(resp.Body), io.MultiWriter(progress, hash, writeCounter{&read}))
+	defer func() { atomic.AddInt64(&downloadedBytes, read) }()
+
+	checksum := expectedChecksum(patchID, fileName)
+	accept := func() error {
+		if resp.ContentLength >= 0 && read != resp.ContentLength {
+			return fmt.Errorf("got %d of %d bytes", read, resp.ContentLength)
+		}
+		if actual := hex.EncodeToString(hash.Sum(nil)); checksum != "" && actual != checksum {
+			return fmt.Errorf("SHA-256 mismatch: portal sent %s, file has %s", checksum, actual)
+		}
+		return nil
+	}
+
+	log.Info("Streaming ", redactURL(source), " into place")
+	return confined(sandboxDirs(), func() error {
+		report, err := archive.ApplyStaged(".", body, archive.Options{Sync: *fsyncExtracted, Streaming: *streamingExtract, Owner: serverOwner, TarOwner: useTarOwner(),
+			ModTimes: *keepModTimes, Xattrs: *keepXattrs, Workers: extractionWorkers()}, accept)
+		if err != nil {
+			return err
+		}
+		log.Debugf("Applied %s: %d written, %d skipped, %d removed", fileName, len(report.Written), len(report.Skipped), len(report.Removed))
+		patchedFiles[patchID] = append(patchedFiles[patchID], report.Written...)
+		return nil
+	})
+}
+
+// writeCounter adds up the bytes written through it
+type writeCounter struct {
+	n *int64
+}
+
+func (c writeCounter) Write(p []byte) (int, error) {
+	*c.n += int64(len(p))
+	return len(p), nil
+}
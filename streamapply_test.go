@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamTarballPatch(t *testing.T) {
+	oldDir, oldWeb, oldStream := *patchDir, *patchWeb, *streamDownload
+	defer func() { *patchDir, *patchWeb, *streamDownload = oldDir, oldWeb, oldStream }()
+	defer func() { patchedFiles = map[string][]string{} }()
+	defer func() { tarballChecksums = map[string]map[string]string{} }()
+	*patchDir = t.TempDir()
+
+	tarball, _ := os.ReadFile("test.tar.gz")
+	sum, _ := fileChecksum("test.tar.gz")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(tarball)
+	}))
+	defer server.Close()
+	*patchWeb = "http://127.0.0.1:1/," + server.URL + "/"
+
+	originalWd, _ := os.Getwd()
+	tomcat := t.TempDir()
+	os.Chdir(tomcat)
+	defer os.Chdir(originalWd)
+
+	*streamDownload = false
+	assert.False(t, streamTarballPatch("sakai-builder/patch-63547.tar.gz", "63547"))
+	assert.Equal(t, 0, requests)
+
+	// A bad checksum leaves the server directory alone
+	*streamDownload = true
+	tarballChecksums["63547"] = map[string]string{"patch-63547.tar.gz": strings.Repeat("0", 64)}
+	assert.False(t, streamTarballPatch("sakai-builder/patch-63547.tar.gz", "63547"))
+	entries, _ := os.ReadDir(tomcat)
+	assert.Empty(t, entries)
+
+	// The first mirror is down, the second streams straight into place
+	tarballChecksums["63547"] = map[string]string{"patch-63547.tar.gz": sum}
+	assert.True(t, streamTarballPatch("sakai-builder/patch-63547.tar.gz", "63547"))
+	assert.True(t, pathExists(filepath.Join(tomcat, "components", "sakai-provider-pack", "WEB-INF", "components.xml")))
+	assert.Len(t, patchedFiles["63547"], 5)
+	assert.Equal(t, 2, requests)
+	entries, _ = os.ReadDir(*patchDir)
+	assert.Empty(t, entries, "nothing kept in the patch dir")
+}
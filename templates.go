@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultLocale = "en"
+
+// languagePack is the text of the notifications in one language. Templates see
+// a notification; States translates the status model states.
+type languagePack struct {
+	States  map[string]string `yaml:"states"`
+	Summary string            `yaml:"summary"` // Slack and similar one-liners
+	Subject string            `yaml:"subject"` // email subject, after "[go-patcher] "
+	Body    string            `yaml:"body"`    // email body, before the attachments
+}
+
+// builtinPacks ship with the patcher. A <locale>.yaml in -templates-dir
+// replaces any of their templates or adds a language.
+var builtinPacks = map[string]languagePack{
+	"en": {
+		States: map[string]string{stateInProgress: "in progress", stateSucceeded: "succeeded",
+			stateDeferred: "deferred", stateFailed: "failed"},
+		Summary: "Patch {{.PatchID}} {{.Status}} on {{.Host}} (portal {{.Portal}}) after {{.Duration}}",
+		Subject: "Patch {{.PatchID}} {{.Status}} on {{.Host}}",
+		Body:    "Patch {{.PatchID}} {{.Status}} on {{.Host}}.\n\nPortal: {{.Portal}}\nServer: {{.Server}}\nRun: {{.Run}}\nDuration: {{.Duration}}\n",
+	},
+	"fr": {
+		States: map[string]string{stateInProgress: "en cours", stateSucceeded: "appliqué",
+			stateDeferred: "reporté", stateFailed: "en échec"},
+		Summary: "Correctif {{.PatchID}} {{.Status}} sur {{.Host}} (portail {{.Portal}}) après {{.Duration}}",
+		Subject: "Correctif {{.PatchID}} {{.Status}} sur {{.Host}}",
+		Body:    "Correctif {{.PatchID}} {{.Status}} sur {{.Host}}.\n\nPortail : {{.Portal}}\nServeur : {{.Server}}\nExécution : {{.Run}}\nDurée : {{.Duration}}\n",
+	},
+	"es": {
+		States: map[string]string{stateInProgress: "en curso", stateSucceeded: "aplicado",
+			stateDeferred: "aplazado", stateFailed: "fallido"},
+		Summary: "Parche {{.PatchID}} {{.Status}} en {{.Host}} (portal {{.Portal}}) tras {{.Duration}}",
+		Subject: "Parche {{.PatchID}} {{.Status}} en {{.Host}}",
+		Body:    "Parche {{.PatchID}} {{.Status}} en {{.Host}}.\n\nPortal: {{.Portal}}\nServidor: {{.Server}}\nEjecución: {{.Run}}\nDuración: {{.Duration}}\n",
+	},
+}
+
+// patchLocales are the locales the portal asked for, by patch ID
+var patchLocales = map[string]string{}
+
+// notification is what the templates can use
+type notification struct {
+	PatchID string
+	// Status is the translated state, followed by the reason code if any
+	Status   string
+	State    string
+	Reason   string
+	Host     string
+	Portal   string
+	Server   string
+	Run      string
+	Duration time.Duration
+}
+
+func newNotification(rv string, startup string, patchID string) notification {
+	status := statusFor(rv, startup, statusReasons[patchID])
+	hostname, _ := os.Hostname()
+	return notification{
+		PatchID:  patchID,
+		State:    status.state,
+		Reason:   status.reason,
+		Host:     hostname,
+		Portal:   activePortal.Name,
+		Server:   activeInstance.Dir,
+		Run:      runID,
+		Duration: time.Since(runStarted).Round(time.Second),
+	}
+}
+
+// localeFor picks the portal's locale for the patch, then the portal account's, then English
+func localeFor(patchID string) string {
+	if locale := patchLocales[patchID]; locale != "" {
+		return locale
+	}
+	if activePortal.Locale != "" {
+		return activePortal.Locale
+	}
+	return defaultLocale
+}
+
+// languagePackFor finds the pack for a locale such as fr_CA.UTF-8, falling
+// back to the language and then to English for anything missing
+func languagePackFor(locale string) languagePack {
+	locale, _, _ = strings.Cut(locale, ".")
+	locale = strings.ReplaceAll(locale, "-", "_")
+	language, _, _ := strings.Cut(locale, "_")
+
+	pack := loadLanguagePack(defaultLocale)
+	for _, name := range []string{language, locale} {
+		if name != defaultLocale {
+			pack.overlay(loadLanguagePack(name))
+		}
+	}
+	return pack
+}
+
+// overlay replaces the templates and states other has
+func (p *languagePack) overlay(other languagePack) {
+	for state, text := range other.States {
+		p.States[state] = text
+	}
+	if other.Summary != "" {
+		p.Summary = other.Summary
+	}
+	if other.Subject != "" {
+		p.Subject = other.Subject
+	}
+	if other.Body != "" {
+		p.Body = other.Body
+	}
+}
+
+// loadLanguagePack is the built-in pack with the -templates-dir file for the locale laid over it
+func loadLanguagePack(locale string) languagePack {
+	pack := languagePack{States: map[string]string{}}
+	pack.overlay(builtinPacks[locale])
+	if *templatesDir == "" || strings.ContainsAny(locale, `/\`) {
+		return pack
+	}
+	input, err := os.ReadFile(filepath.Join(*templatesDir, locale+".yaml"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning("Could not read language pack: ", err)
+		}
+		return pack
+	}
+	var custom languagePack
+	if err := yaml.Unmarshal(input, &custom); err != nil {
+		log.Warning("Could not parse language pack ", locale, ": ", err)
+		return pack
+	}
+	pack.overlay(custom)
+	return pack
+}
+
+// renderNotification renders one of summary, subject or body for a patch in
+// its locale. A broken template falls back to the built-in English one.
+func renderNotification(part string, rv string, startup string, patchID string) string {
+	data := newNotification(rv, startup, patchID)
+	text, err := languagePackFor(localeFor(patchID)).render(part, data)
+	if err != nil {
+		log.Warning("Could not render the ", part, " notification template: ", err)
+		text, _ = builtinPacks[defaultLocale].render(part, data)
+	}
+	return text
+}
+
+// render fills one of the pack's templates, translating the state
+func (p languagePack) render(part string, data notification) (string, error) {
+	data.Status = p.States[data.State]
+	if data.Status == "" {
+		data.Status = data.State
+	}
+	if data.Reason != "" {
+		data.Status += "/" + data.Reason
+	}
+	return renderTemplate(p.templateFor(part), data)
+}
+
+func (p languagePack) templateFor(part string) string {
+	switch part {
+	case "subject":
+		return p.Subject
+	case "body":
+		return p.Body
+	}
+	return p.Summary
+}
+
+func renderTemplate(text string, data notification) (string, error) {
+	tmpl, err := template.New("notification").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLanguagePackFor(t *testing.T) {
+	pack := languagePackFor("fr_CA.UTF-8")
+	assert.Equal(t, "en échec", pack.States[stateFailed])
+	assert.True(t, strings.HasPrefix(pack.Summary, "Correctif"))
+
+	// Unknown languages get English
+	assert.Equal(t, builtinPacks["en"].Summary, languagePackFor("de").Summary)
+
+	// A pack on disk overrides single templates, the rest stays built in
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "es_MX.yaml"), []byte("summary: \"Mantenimiento: parche {{.PatchID}} {{.Status}}\"\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "de.yaml"), []byte("states:\n  failed: fehlgeschlagen\nsubject: \"Patch {{.PatchID}} {{.Status}}\"\n"), 0644)
+	*templatesDir = dir
+	defer func() { *templatesDir = "" }()
+
+	pack = languagePackFor("es-MX")
+	assert.Equal(t, "Mantenimiento: parche {{.PatchID}} {{.Status}}", pack.Summary)
+	assert.Equal(t, builtinPacks["es"].Subject, pack.Subject)
+	assert.Equal(t, "aplazado", pack.States[stateDeferred])
+
+	pack = languagePackFor("de_DE")
+	assert.Equal(t, "fehlgeschlagen", pack.States[stateFailed])
+	assert.Equal(t, "succeeded", pack.States[stateSucceeded])
+	assert.Equal(t, builtinPacks["en"].Body, pack.Body)
+}
+
+func TestRenderNotification(t *testing.T) {
+	hostname, _ := os.Hostname()
+	statusReasons = map[string]string{"63547": reasonStartupFailed}
+	defer func() { statusReasons = map[string]string{} }()
+
+	assert.Equal(t, "Patch 63547 failed/startup_failed on "+hostname,
+		renderNotification("subject", tomcatDown, "-1", "63547"))
+
+	// The portal account's locale, unless the portal asks for another with the patch
+	activePortal.Locale = "fr"
+	defer func() { activePortal.Locale = "" }()
+	assert.Equal(t, "Correctif 63547 en échec/startup_failed sur "+hostname,
+		renderNotification("subject", tomcatDown, "-1", "63547"))
+
+	patchLocales = map[string]string{"63548": "es"}
+	defer func() { patchLocales = map[string]string{} }()
+	assert.Equal(t, "Parche 63548 aplazado/outside_window en "+hostname,
+		renderNotification("subject", patchDefer, "-8", "63548"))
+
+	// A broken pack falls back to English rather than dropping the notification
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "es.yaml"), []byte("subject: \"Parche {{.Nope}}\"\n"), 0644)
+	*templatesDir = dir
+	defer func() { *templatesDir = "" }()
+	assert.Equal(t, "Patch 63548 deferred/outside_window on "+hostname,
+		renderNotification("subject", patchDefer, "-8", "63548"))
+}
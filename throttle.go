@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// downloadLimiter holds all tarball downloads together, prefetches and chunks
+// included, to -max-download-rate. nil means no limit.
+var downloadLimiter *rateLimiter
+
+// rateLimiter paces reads to a number of bytes per second
+type rateLimiter struct {
+	rate float64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// parseDownloadRate reads bytes per second with an optional K, M or G suffix,
+// e.g. "500K" or "20M"; "" and "0" mean no limit
+func parseDownloadRate(rate string) (*rateLimiter, error) {
+	value, err := parseByteSize(strings.TrimSuffix(strings.TrimSpace(strings.ToUpper(rate)), "/S"))
+	if err != nil {
+		return nil, errors.New("-max-download-rate must be bytes per second like 500K or 20M")
+	}
+	if value == 0 {
+		return nil, nil
+	}
+	return &rateLimiter{rate: value}, nil
+}
+
+// parseByteSize reads a number of bytes with an optional K, M or G suffix,
+// "" being 0
+func parseByteSize(size string) (float64, error) {
+	size = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	if size == "" || size == "0" {
+		return 0, nil
+	}
+	multiplier := 1.0
+	switch size[len(size)-1] {
+	case 'K':
+		multiplier = 1024
+	case 'M':
+		multiplier = 1024 * 1024
+	case 'G':
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		size = size[:len(size)-1]
+	}
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil || value <= 0 {
+		return 0, errors.New("not a size like 500K or 20M: " + size)
+	}
+	return value * multiplier, nil
+}
+
+// wait blocks until n more bytes fit in the rate
+func (l *rateLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// reader throttles r, which is returned as is when there is no limit
+func (l *rateLimiter) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &throttledReader{r: r, limiter: l}
+}
+
+type throttledReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Small reads keep the pace smooth at low rates
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := t.r.Read(p)
+	t.limiter.wait(n)
+	return n, err
+}
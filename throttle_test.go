@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDownloadRate(t *testing.T) {
+	for rate, want := range map[string]float64{"500K": 500 * 1024, "20M": 20 * 1024 * 1024, "1.5mb/s": 1.5 * 1024 * 1024, "1G": 1 << 30, "4096": 4096} {
+		limiter, err := parseDownloadRate(rate)
+		if assert.NoError(t, err, rate) {
+			assert.Equal(t, want, limiter.rate, rate)
+		}
+	}
+	for _, rate := range []string{"", "0"} {
+		limiter, err := parseDownloadRate(rate)
+		assert.NoError(t, err)
+		assert.Nil(t, limiter)
+	}
+	for _, rate := range []string{"fast", "-5M", "M"} {
+		_, err := parseDownloadRate(rate)
+		assert.Error(t, err, rate)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for size, want := range map[string]float64{"": 0, "5G": 5 << 30, "512mb": 512 << 20, "100": 100} {
+		value, err := parseByteSize(size)
+		assert.NoError(t, err, size)
+		assert.Equal(t, want, value, size)
+	}
+	_, err := parseByteSize("lots")
+	assert.Error(t, err)
+}
+
+func TestRateLimiterPacesReads(t *testing.T) {
+	limiter := &rateLimiter{rate: 100 * 1024}
+	started := time.Now()
+	n, err := io.Copy(io.Discard, limiter.reader(bytes.NewReader(make([]byte, 30*1024))))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(30*1024), n)
+	// io.Discard reads 8 KB at a time, the fourth read waits 240ms for the first three
+	assert.GreaterOrEqual(t, time.Since(started), 200*time.Millisecond)
+
+	var none *rateLimiter
+	source := bytes.NewReader(nil)
+	assert.Equal(t, io.Reader(source), none.reader(source))
+}
+
+func TestDownloadFileThrottled(t *testing.T) {
+	downloadLimiter = &rateLimiter{rate: 1024}
+	defer func() { downloadLimiter = nil }()
+
+	tarball, _ := os.ReadFile("test.tar.gz")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(tarball) }))
+	defer server.Close()
+
+	// 285 bytes at 1 KB/s, the next read would wait over a quarter second
+	dest := filepath.Join(t.TempDir(), "patch.tar.gz")
+	assert.NoError(t, downloadFile(server.URL+"/patch.tar.gz", dest, "63547", true))
+	assert.True(t, downloadLimiter.next.After(time.Now().Add(200*time.Millisecond)))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// traceSpan is one timed piece of a run. Every span is a child of the run's
+// root span; download runs alongside stop, so there is no single stack.
+type traceSpan struct {
+	id    string
+	name  string
+	start time.Time
+	end   time.Time
+}
+
+var (
+	traceMu    sync.Mutex
+	runSpans   []traceSpan
+	rootSpanID string
+)
+
+func newSpanID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("Could not generate a span ID: " + err.Error())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// startSpan times a span of the current run. Call the returned func when it ends.
+func startSpan(name string) func() {
+	span := traceSpan{id: newSpanID(), name: name, start: time.Now()}
+	return func() {
+		span.end = time.Now()
+		traceMu.Lock()
+		runSpans = append(runSpans, span)
+		traceMu.Unlock()
+	}
+}
+
+// traceID is the run ID without dashes, so a trace is found from the run history or the portal
+func traceID() string {
+	return strings.ReplaceAll(runID, "-", "")
+}
+
+// exportTrace sends the run as a trace to -otlp-endpoint over OTLP/HTTP JSON.
+// Check-ins that found nothing to do are not exported.
+func exportTrace(patchIDs []string, tomcatDir string, rv string, startup string) {
+	if *otlpEndpoint == "" {
+		return
+	}
+	traceMu.Lock()
+	spans := append([]traceSpan(nil), runSpans...)
+	traceMu.Unlock()
+
+	body, err := json.Marshal(otlpTrace(spans, patchIDs, tomcatDir, rv, startup, time.Now()))
+	if err != nil {
+		log.Warning("Could not encode trace: ", err)
+		return
+	}
+	if err := postTrace(*otlpEndpoint, body); err != nil {
+		log.Warning("Could not export trace for run ", runID, ": ", err)
+	}
+}
+
+// otlpAttribute is a KeyValue in the OTLP JSON encoding
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func attribute(key string, value string) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	a.Value.StringValue = value
+	return a
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpSpanKindInternal and otlpStatusError are from the OTLP trace protos
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusError      = 2
+)
+
+// otlpTrace builds an ExportTraceServiceRequest: a root span for the run with
+// the phases beneath it
+func otlpTrace(spans []traceSpan, patchIDs []string, tomcatDir string, rv string, startup string, end time.Time) map[string]any {
+	nanos := func(t time.Time) string { return strconv.FormatInt(t.UnixNano(), 10) }
+	trace := traceID()
+	reason := ""
+	if len(patchIDs) > 0 {
+		reason = statusReasons[patchIDs[len(patchIDs)-1]]
+	}
+	status := statusFor(rv, startup, reason)
+
+	root := otlpSpan{TraceID: trace, SpanID: rootSpanID, Name: "patch run", Kind: otlpSpanKindInternal,
+		StartTimeUnixNano: nanos(runStarted), EndTimeUnixNano: nanos(end),
+		Attributes: []otlpAttribute{
+			attribute("patcher.patch_ids", strings.Join(patchIDs, ",")),
+			attribute("patcher.tomcat_dir", tomcatDir),
+			attribute("patcher.portal", activePortal.Name),
+			attribute("patcher.result", rv),
+			attribute("patcher.status", status.String()),
+		}}
+	if status.state == stateFailed {
+		root.Status = &otlpStatus{Code: otlpStatusError, Message: status.String()}
+	}
+	otlpSpans := []otlpSpan{root}
+	for _, span := range spans {
+		otlpSpans = append(otlpSpans, otlpSpan{TraceID: trace, SpanID: span.id, ParentSpanID: rootSpanID,
+			Name: span.name, Kind: otlpSpanKindInternal, StartTimeUnixNano: nanos(span.start), EndTimeUnixNano: nanos(span.end)})
+	}
+
+	hostname, _ := os.Hostname()
+	return map[string]any{"resourceSpans": []any{map[string]any{
+		"resource": map[string]any{"attributes": []otlpAttribute{
+			attribute("service.name", "go-patcher"),
+			attribute("service.version", patcherVersion),
+			attribute("host.name", hostname),
+		}},
+		"scopeSpans": []any{map[string]any{
+			"scope": map[string]string{"name": "go-patcher", "version": patcherVersion},
+			"spans": otlpSpans,
+		}},
+	}}}
+}
+
+// postTrace sends to the collector's traces path, as OTEL_EXPORTER_OTLP_ENDPOINT does
+func postTrace(endpoint string, body []byte) error {
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("OTLP collector responded " + resp.Status)
+	}
+	return nil
+}
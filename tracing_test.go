@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportTrace(t *testing.T) {
+	var path, contentType string
+	var exported struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, contentType = r.URL.Path, r.Header.Get("Content-Type")
+		body, _ := io.ReadAll(r.Body)
+		assert.NoError(t, json.Unmarshal(body, &exported))
+	}))
+	defer server.Close()
+
+	*otlpEndpoint = server.URL
+	defer func() { *otlpEndpoint = "" }()
+	resetRunState()
+	startSpan("portal_check")()
+	trackPhase("download")()
+	exportTrace([]string{"63547"}, "/opt/tomcat", tomcatDown, "-1")
+
+	assert.Equal(t, "/v1/traces", path)
+	assert.Equal(t, "application/json", contentType)
+	if !assert.Len(t, exported.ResourceSpans, 1) || !assert.Len(t, exported.ResourceSpans[0].ScopeSpans, 1) {
+		return
+	}
+	spans := exported.ResourceSpans[0].ScopeSpans[0].Spans
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+	root := spans[0]
+	assert.Equal(t, "patch run", root.Name)
+	assert.Equal(t, strings.ReplaceAll(runID, "-", ""), root.TraceID)
+	assert.Empty(t, root.ParentSpanID)
+	assert.Contains(t, root.Attributes, attribute("patcher.patch_ids", "63547"))
+	assert.Contains(t, root.Attributes, attribute("patcher.tomcat_dir", "/opt/tomcat"))
+	if assert.NotNil(t, root.Status) {
+		assert.Equal(t, otlpStatusError, root.Status.Code)
+	}
+	for i, name := range []string{"portal_check", "download"} {
+		assert.Equal(t, name, spans[i+1].Name)
+		assert.Equal(t, root.TraceID, spans[i+1].TraceID)
+		assert.Equal(t, root.SpanID, spans[i+1].ParentSpanID)
+		assert.NotEqual(t, root.SpanID, spans[i+1].SpanID)
+	}
+}
+
+func TestExportTraceDisabled(t *testing.T) {
+	requests := 0
+	http.DefaultClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests++
+		return nil, io.EOF
+	})
+	defer func() { http.DefaultClient.Transport = nil }()
+
+	exportTrace([]string{"63547"}, "/opt/tomcat", patchSuccess, "95000")
+	assert.Equal(t, 0, requests)
+}
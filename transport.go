@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// initHTTPTransport replaces http.DefaultTransport so portal calls, downloads
+// and every other client share the proxy and TLS settings
+func initHTTPTransport() {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	proxy, err := proxyFunc(*proxyURL, os.Getenv("NO_PROXY")+","+os.Getenv("no_proxy"))
+	if err != nil {
+		log.Fatal("Bad -proxy: ", err)
+	}
+	transport.Proxy = proxy
+
+	tlsConfig, err := newTLSConfig(*caCert, *clientCert, *clientKey)
+	if err != nil {
+		log.Fatal("Bad TLS settings: ", err)
+	}
+	transport.TLSClientConfig = tlsConfig
+	tuneTransport(transport)
+	http.DefaultTransport = transport
+
+	switch {
+	case *recordDir != "" && *replayDir != "":
+		log.Fatal("-record and -replay can't be used together")
+	case *recordDir != "":
+		recorder, err := newRecordingTransport(transport, *recordDir)
+		if err != nil {
+			log.Fatal("Bad -record: ", err)
+		}
+		log.Warning("Recording every request and response to ", *recordDir)
+		http.DefaultTransport = recorder
+	case *replayDir != "":
+		replayer, err := newReplayTransport(*replayDir)
+		if err != nil {
+			log.Fatal("Bad -replay: ", err)
+		}
+		log.Warning("Replaying requests from ", *replayDir, ", nothing goes to the network")
+		http.DefaultTransport = replayer
+	}
+}
+
+// tuneTransport applies the timeout and keep-alive flags, the defaults wait
+// forever for a response that never comes
+func tuneTransport(transport *http.Transport) {
+	dialer := &net.Dialer{Timeout: *dialTimeout, KeepAlive: *tcpKeepAlive}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = *tlsHandshakeTimeout
+	transport.ResponseHeaderTimeout = *responseHeaderTimeout
+	transport.IdleConnTimeout = *idleConnTimeout
+	transport.DisableKeepAlives = *idleConnTimeout == 0
+}
+
+// newTLSConfig trusts the system roots plus an optional CA bundle for portals
+// behind an internal CA, and presents a client certificate to servers that ask for one
+func newTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, VerifyConnection: verifyPins}
+
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		bundle, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, errors.New("no PEM certificates found in " + caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("-client-cert and -client-key must be used together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// proxyFunc honours HTTP_PROXY/HTTPS_PROXY/NO_PROXY, unless -proxy names a proxy
+// for everything. NO_PROXY still applies then so local health checks go direct.
+func proxyFunc(proxy string, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	if proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	parsed, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("Using proxy ", parsed.Redacted())
+
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), noProxy) {
+			return nil, nil
+		}
+		return parsed, nil
+	}, nil
+}
+
+// bypassProxy matches a host against loopback and NO_PROXY entries: "*", hosts,
+// and domains that also cover subdomains ("example.edu" or ".example.edu")
+func bypassProxy(host string, noProxy string) bool {
+	if host == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.TrimPrefix(entry, ".")
+		host = strings.ToLower(host)
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
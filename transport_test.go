@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyFunc(t *testing.T) {
+	proxy, err := proxyFunc("proxy.example.edu:3128", "internal.example.edu,.lan")
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		url  string
+		want string
+	}{
+		{"https://admin.longsight.com/longsight/json/patches", "http://proxy.example.edu:3128"},
+		{"https://s3.amazonaws.com/longsight-patches/a.tar.gz", "http://proxy.example.edu:3128"},
+		{"https://portal.internal.example.edu/", ""},
+		{"http://tomcat.lan:8080/portal", ""},
+		{"http://localhost:8080/portal", ""},
+		{"http://127.0.0.1:8080/portal", ""},
+	}
+	for _, tc := range testCases {
+		req, _ := http.NewRequest("GET", tc.url, nil)
+		got, err := proxy(req)
+		assert.NoError(t, err)
+		if tc.want == "" {
+			assert.Nil(t, got, tc.url)
+		} else {
+			assert.Equal(t, tc.want, got.String(), tc.url)
+		}
+	}
+
+	assert.True(t, bypassProxy("anything.example.com", "*"))
+	assert.False(t, bypassProxy("notexample.edu", "example.edu"))
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+
+	config, err := newTLSConfig(caFile, "", "")
+	assert.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := client.Get(server.URL)
+	assert.NoError(t, err, "internal CA is trusted")
+	resp.Body.Close()
+
+	config, _ = newTLSConfig("", "", "")
+	_, err = (&http.Client{Transport: &http.Transport{TLSClientConfig: config}}).Get(server.URL)
+	assert.Error(t, err, "unknown CA without the bundle")
+
+	_, err = newTLSConfig("", caFile, "")
+	assert.EqualError(t, err, "-client-cert and -client-key must be used together")
+	_, err = newTLSConfig(filepath.Join(t.TempDir(), "missing.pem"), "", "")
+	assert.Error(t, err)
+}
+
+func TestTuneTransport(t *testing.T) {
+	defer func(header, idle time.Duration) { *responseHeaderTimeout, *idleConnTimeout = header, idle }(*responseHeaderTimeout, *idleConnTimeout)
+	*responseHeaderTimeout, *idleConnTimeout = 50*time.Millisecond, 0
+
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	transport := &http.Transport{}
+	tuneTransport(transport)
+	assert.True(t, transport.DisableKeepAlives)
+	_, err := (&http.Client{Transport: transport}).Get(server.URL)
+	assert.Error(t, err, "a server that never answers doesn't hang the client")
+	assert.Contains(t, err.Error(), "timeout awaiting response headers")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// validatorsFileName maps tarball URLs to the cached copy they last served,
+// with its ETag and Last-Modified, so a tarball the portal sends no checksum
+// for is only downloaded again once it has changed
+const validatorsFileName = "validators.json"
+
+// tarballValidator is what a URL last served and how to ask if it changed
+type tarballValidator struct {
+	Checksum     string `json:"checksum"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// validatorsMu guards the validators file, prefetches and steps both fetch
+var validatorsMu sync.Mutex
+
+// fetchedValidators hold the validators of finished downloads by destination
+// until fetchTarball knows which cached copy they belong to. Chunked and SFTP
+// downloads have none.
+var fetchedValidators = struct {
+	sync.Mutex
+	byDest map[string]tarballValidator
+}{byDest: map[string]tarballValidator{}}
+
+func validatorsPath() string {
+	return filepath.Join(cacheDir(), validatorsFileName)
+}
+
+// validatorKey drops the query string, a presigned URL is signed anew every time
+func validatorKey(source string) string {
+	return strings.SplitN(source, "?", 2)[0]
+}
+
+func loadValidators() map[string]tarballValidator {
+	validators := map[string]tarballValidator{}
+	data, err := os.ReadFile(validatorsPath())
+	if err != nil {
+		return validators
+	}
+	if err := json.Unmarshal(data, &validators); err != nil {
+		log.Warning("Ignoring unreadable ", validatorsPath(), ": ", err)
+		return map[string]tarballValidator{}
+	}
+	return validators
+}
+
+// rememberValidators keeps the ETag and Last-Modified of a finished download
+func rememberValidators(dest string, header http.Header) {
+	validator := tarballValidator{ETag: header.Get("ETag"), LastModified: header.Get("Last-Modified")}
+	if validator.ETag == "" && validator.LastModified == "" {
+		return
+	}
+	fetchedValidators.Lock()
+	defer fetchedValidators.Unlock()
+	fetchedValidators.byDest[dest] = validator
+}
+
+// recordValidators files the validators of the download at dest under the
+// source it came from, once the download is in the cache as cached
+func recordValidators(source string, dest string, cached string) {
+	fetchedValidators.Lock()
+	validator, ok := fetchedValidators.byDest[dest]
+	delete(fetchedValidators.byDest, dest)
+	fetchedValidators.Unlock()
+	if !ok || filepath.Dir(cached) != cacheDir() {
+		return
+	}
+	validator.Checksum = filepath.Base(cached)
+
+	validatorsMu.Lock()
+	defer validatorsMu.Unlock()
+	validators := loadValidators()
+	validators[validatorKey(source)] = validator
+	// Tarballs pruned from the cache can't be reused, whatever their URL says
+	for key, known := range validators {
+		if !pathExists(filepath.Join(cacheDir(), known.Checksum)) {
+			delete(validators, key)
+		}
+	}
+	data, err := json.MarshalIndent(validators, "", "  ")
+	if err == nil {
+		if err = os.WriteFile(validatorsPath()+".tmp", data, 0644); err == nil {
+			err = os.Rename(validatorsPath()+".tmp", validatorsPath())
+		}
+	}
+	if err != nil {
+		log.Warning("Could not record validators of ", redactURL(source), ": ", err)
+	}
+}
+
+// revalidatedCopy is the cached copy of a tarball the portal sent no
+// checksum for, if its mirror says it hasn't changed. With a checksum the
+// cache is searched by it instead.
+func revalidatedCopy(tarball string, patchID string, fileName string) string {
+	if expectedChecksum(patchID, fileName) != "" {
+		return ""
+	}
+	sources, _ := tarballSources(tarball)
+	return revalidatedTarball(sources)
+}
+
+// revalidatedTarball asks the first source with a cached copy on record
+// whether the tarball changed since, and returns that copy on a 304. It
+// returns "" when the tarball has to be downloaded.
+func revalidatedTarball(sources []string) string {
+	validatorsMu.Lock()
+	validators := loadValidators()
+	validatorsMu.Unlock()
+	for _, source := range sources {
+		validator, ok := validators[validatorKey(source)]
+		if !ok || isSFTPURL(source) || !pathExists(filepath.Join(cacheDir(), validator.Checksum)) {
+			continue
+		}
+		notModified, err := askNotModified(source, validator)
+		if err != nil {
+			log.Debug("Could not revalidate ", redactURL(source), ": ", err)
+			continue
+		}
+		if !notModified {
+			log.Info(redactURL(source), " changed since it was cached, downloading it again")
+			return ""
+		}
+		return cachedTarball(validator.Checksum)
+	}
+	return ""
+}
+
+// askNotModified sends a conditional GET and reports a 304. A changed
+// tarball's body is left unread, it's downloaded through the mirrors.
+func askNotModified(source string, validator tarballValidator) (bool, error) {
+	fileURL := source
+	if isS3URL(source) {
+		signed, err := presignS3(source)
+		if err != nil {
+			return false, err
+		}
+		fileURL = signed
+	}
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return false, err
+	}
+	setRunHeaders(req)
+	if validator.ETag != "" {
+		req.Header.Set("If-None-Match", validator.ETag)
+	}
+	if validator.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validator.LastModified)
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return true, nil
+	}
+	return false, checkResponse(resp)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevalidatedTarball(t *testing.T) {
+	defer func(dir, web string) { *patchDir, *patchWeb = dir, web }(*patchDir, *patchWeb)
+	*patchDir = t.TempDir()
+	fastRetries(t, 2)
+
+	tarball, _ := os.ReadFile("test.tar.gz")
+	sum, _ := fileChecksum("test.tar.gz")
+	etag := `"v1"`
+	downloads, notModified := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		http.ServeContent(w, r, "patch.tar.gz", time.Time{}, bytes.NewReader(tarball))
+	}))
+	defer server.Close()
+	*patchWeb = server.URL + "/"
+
+	// No checksum from the portal, the first run downloads and records the ETag
+	cached := filepath.Join(cacheDir(), sum)
+	assert.Equal(t, cached, fetchTarball("sakai-builder/patch-63547.tar.gz", "63547"))
+	assert.Equal(t, tarballValidator{Checksum: sum, ETag: etag}, loadValidators()[server.URL+"/sakai-builder/patch-63547.tar.gz"])
+
+	// The next only asks whether it changed
+	assert.Equal(t, cached, fetchTarball("sakai-builder/patch-63547.tar.gz", "63547"))
+	assert.Equal(t, 1, downloads)
+	assert.Equal(t, 1, notModified)
+
+	// A new build on the mirror is downloaded again
+	etag = `"v2"`
+	assert.Equal(t, cached, fetchTarball("sakai-builder/patch-63547.tar.gz", "63547"))
+	assert.Equal(t, 3, downloads, "the conditional GET that found it changed, then the download")
+
+	// Nothing to reuse once the cached copy is gone
+	os.Remove(cached)
+	assert.Empty(t, revalidatedTarball([]string{server.URL + "/sakai-builder/patch-63547.tar.gz"}))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// webhookEvent is posted to -webhook-url when a patch reaches its final status
+type webhookEvent struct {
+	PatchID     string `json:"patch_id"`
+	Portal      string `json:"portal"`
+	Host        string `json:"host"`
+	RunID       string `json:"run_id"`
+	ResultValue string `json:"result_value"`
+	Status      string `json:"status"`
+	StartUptime string `json:"start_uptime"`
+	Timestamp   int64  `json:"timestamp"`
+}
+
+// notifyWebhook tells the operator's own automation how a patch ended. It is
+// best effort: a slow or broken receiver never holds up or fails the run.
+func notifyWebhook(rv string, startup string, patchID string) {
+	if *webhookURL == "" || rv == inProgress {
+		return
+	}
+	hostname, _ := os.Hostname()
+	event := webhookEvent{PatchID: patchID, Portal: activePortal.Name, Host: hostname, RunID: runID,
+		ResultValue: rv, Status: statusFor(rv, startup, statusReasons[patchID]).String(),
+		StartUptime: startup, Timestamp: time.Now().Unix()}
+	if err := postWebhook(*webhookURL, event); err != nil {
+		log.Warning("Could not notify webhook for patch ", patchID, ": ", err)
+	}
+}
+
+func postWebhook(webhook string, event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setRunHeaders(req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("webhook responded " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifyWebhook(t *testing.T) {
+	var events []webhookEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var event webhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events = append(events, event)
+	}))
+	defer server.Close()
+
+	*webhookURL = server.URL
+	defer func() { *webhookURL = "" }()
+	statusReasons = map[string]string{"63548": reasonHookFailed}
+	defer func() { statusReasons = map[string]string{} }()
+
+	notifyWebhook(inProgress, "0", "63547")
+	assert.Empty(t, events, "claims are not final")
+
+	notifyWebhook(patchSuccess, "84211", "63547")
+	notifyWebhook(tomcatDown, "-1", "63548")
+	hostname, _ := os.Hostname()
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "63547", events[0].PatchID)
+		assert.Equal(t, hostname, events[0].Host)
+		assert.Equal(t, "84211", events[0].StartUptime)
+		assert.Equal(t, stateSucceeded, events[0].Status)
+		assert.Equal(t, "failed/hook_failed", events[1].Status)
+		assert.Equal(t, tomcatDown, events[1].ResultValue)
+	}
+
+	// A broken receiver is only logged
+	server.Close()
+	notifyWebhook(patchSuccess, "84211", "63549")
+	assert.Error(t, postWebhook(server.URL, webhookEvent{}))
+}
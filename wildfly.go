@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// wildflyStartedPattern matches "WFLYSRV0025: WildFly Full 26.1.3.Final (WildFly Core 18.1.2.Final) started in 12345ms"
+var wildflyStartedPattern = regexp.MustCompile(`WFLYSRV002[56]: .* started (\(with errors\) )?in (\d+)ms`)
+
+// wildflyRunning is what checkStartup returns for a server the management API
+// says is running when its log has no startup line
+const wildflyRunning = "server-state running"
+
+const wildflyConfig = "standalone/configuration/standalone.xml"
+const wildflyDeploymentDir = "deployments/"
+
+// wildflyProfile drives a standalone WildFly/JBoss EAP server through its management CLI.
+// Properties become <system-properties> in standalone.xml and archives the patch
+// places under deployments/ are deployed through the CLI once the server runs.
+type wildflyProfile struct {
+	service    string // systemd unit, preferred over standalone.sh when set
+	controller string // management interface host:port
+	log        string
+}
+
+func newWildflyProfile(instance instanceConfig) wildflyProfile {
+	w := wildflyProfile{service: instance.Service, controller: "localhost:9990", log: "standalone/log/server.log"}
+	if instance.Controller != "" {
+		w.controller = instance.Controller
+	}
+	if instance.Log != "" {
+		w.log = instance.Log
+	}
+	return w
+}
+
+func (w wildflyProfile) name() string        { return "wildfly" }
+func (w wildflyProfile) propertyDir() string { return "standalone/configuration" }
+func (w wildflyProfile) logFile() string     { return w.log }
+
+func (w wildflyProfile) ownerFile() string {
+	if w.service != "" {
+		return "."
+	}
+	return "bin/standalone.sh"
+}
+
+// cli runs commands against the management API
+func (w wildflyProfile) cli(commands ...string) ([]byte, error) {
+	return exec.Command("bin/jboss-cli.sh", "--connect", "--controller="+w.controller,
+		"--commands="+strings.Join(commands, ",")).CombinedOutput()
+}
+
+func (w wildflyProfile) stop(dir string) {
+	defer trackPhase("stop")()
+
+	var out []byte
+	var err error
+	if w.service != "" {
+		out, err = exec.Command("systemctl", "stop", w.service).CombinedOutput()
+	} else {
+		out, err = w.cli(":shutdown(timeout=30)")
+	}
+	if err != nil {
+		log.Warning("Error when shutting down WildFly: ", err)
+	}
+	log.Debug("stopWildfly: ", string(out))
+
+	time.Sleep(time.Duration(overrides.shutdownWait(20)) * time.Second)
+	hardKillProcess(dir)
+	time.Sleep(10 * 1000 * time.Millisecond)
+	hardKillProcess(dir)
+	outputBuffer.Write(out)
+}
+
+func (w wildflyProfile) start(dir string, patchID string) {
+	// Move the old log so we can look for the startup line cleanly
+	os.Rename(w.log, w.log+"-pre-patch-"+patchID)
+
+	var out []byte
+	if w.service != "" {
+		out, _ = exec.Command("systemctl", "start", w.service).CombinedOutput()
+	} else {
+		// standalone.sh stays in the foreground, so detach it
+		out, _ = exec.Command("bash", "-c", "nohup bin/standalone.sh > standalone/log/console.log 2>&1 &").CombinedOutput()
+	}
+	log.Debug("startWildfly: ", string(out))
+	outputBuffer.Write(out)
+}
+
+// checkStartup asks the management API for the server state and then reads
+// the startup time from the log
+func (w wildflyProfile) checkStartup() string {
+	out, err := w.cli(":read-attribute(name=server-state)")
+	if err != nil || !strings.Contains(string(out), `"result" => "running"`) {
+		log.Debug("WildFly not running yet: ", strings.TrimSpace(string(out)))
+		return "false"
+	}
+
+	file, err := os.Open(w.log)
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if strings.Contains(scanner.Text(), igniteMismatchPattern) {
+				return "ignite"
+			}
+			if wildflyStartedPattern.MatchString(scanner.Text()) {
+				return scanner.Text()
+			}
+		}
+	}
+
+	// Running but the log line is missing, e.g. logging is sent elsewhere
+	return wildflyRunning
+}
+
+func (w wildflyProfile) startupMillis(logLine string) int64 {
+	if logLine == wildflyRunning {
+		return 0
+	}
+	match := wildflyStartedPattern.FindStringSubmatch(logLine)
+	if match == nil || match[1] != "" {
+		// Not found, or WFLYSRV0026 "started (with errors)"
+		return -1
+	}
+	k, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil || k <= 0 {
+		return -1
+	}
+	return k
+}
+
+func (w wildflyProfile) applyProperties(rawProperties string, patchID string) {
+	input, err := os.ReadFile(wildflyConfig)
+	if err != nil {
+		panic("Could not open " + wildflyConfig)
+	}
+	config := string(input)
+
+	for _, line := range strings.Split(rawProperties, "\n") {
+		if !strings.Contains(line, "=") || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		keyValue := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(keyValue[0])
+		if overrides.skipsProperty(key) {
+			continue
+		}
+		config, err = setSystemProperty(config, key, strings.TrimSpace(keyValue[1]))
+		if err != nil {
+			panic("Could not set system property " + key + ": " + err.Error())
+		}
+		log.Debug("Set WildFly system property: ", key)
+	}
+
+	// Keep the previous configuration around like the property files keep commented-out lines
+	os.WriteFile(wildflyConfig+"-pre-patch-"+patchID, input, 0644)
+	if err := os.WriteFile(wildflyConfig, []byte(config), 0644); err != nil {
+		panic("Could not write " + wildflyConfig)
+	}
+}
+
+// setSystemProperty adds or updates <property name=key value=value/> inside
+// <system-properties>, editing the text so the rest of standalone.xml is untouched
+func setSystemProperty(config string, key string, value string) (string, error) {
+	escapedValue := xmlEscape(value)
+	property := `<property name="` + xmlEscape(key) + `" value="` + escapedValue + `"/>`
+
+	existing := regexp.MustCompile(`<property\s+name="` + regexp.QuoteMeta(xmlEscape(key)) + `"\s+value="[^"]*"\s*/>`)
+	if existing.MatchString(config) {
+		return existing.ReplaceAllLiteralString(config, property), nil
+	}
+
+	if end := strings.Index(config, "</system-properties>"); end >= 0 {
+		return config[:end] + "    " + property + "\n    " + config[end:], nil
+	}
+
+	// The schema wants system-properties right after extensions
+	end := strings.Index(config, "</extensions>")
+	if end < 0 {
+		return config, errors.New("no <extensions> element in " + wildflyConfig)
+	}
+	end += len("</extensions>")
+	block := "\n    <system-properties>\n        " + property + "\n    </system-properties>"
+	return config[:end] + block + config[end:], nil
+}
+
+func xmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace(s)
+}
+
+// afterStartup deploys every archive the patch placed under deployments/
+func (w wildflyProfile) afterStartup() error {
+	var files []string
+	for _, written := range patchedFiles {
+		files = append(files, written...)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		ext := filepath.Ext(file)
+		if !strings.HasPrefix(file, wildflyDeploymentDir) || (ext != ".war" && ext != ".ear" && ext != ".jar") {
+			continue
+		}
+		out, err := w.cli("deploy " + file + " --force")
+		log.Debug("deploy ", file, ": ", string(out))
+		outputBuffer.Write(out)
+		if err != nil {
+			return errors.New("could not deploy " + file + ": " + err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWildflyStartupMillis(t *testing.T) {
+	wildfly := newWildflyProfile(instanceConfig{})
+	assert.Equal(t, int64(12345), wildfly.startupMillis("02:10:19,456 INFO  [org.jboss.as] (Controller Boot Thread) WFLYSRV0025: WildFly Full 26.1.3.Final (WildFly Core 18.1.2.Final) started in 12345ms - Started 612 of 830 services"))
+	assert.Equal(t, int64(-1), wildfly.startupMillis("02:10:19,456 ERROR [org.jboss.as] (Controller Boot Thread) WFLYSRV0026: WildFly Full 26.1.3.Final (WildFly Core 18.1.2.Final) started (with errors) in 9876ms - Started 600 of 830 services"))
+	assert.Equal(t, int64(0), wildfly.startupMillis(wildflyRunning))
+}
+
+func TestWildflyRunningWithoutLogLine(t *testing.T) {
+	activeProfile = newWildflyProfile(instanceConfig{})
+	defer func() { activeProfile = tomcatProfile{} }()
+
+	// The management API said running, that's a healthy server of unknown startup time
+	rv, startup := startupResult(wildflyRunning)
+	assert.Equal(t, patchSuccess, rv)
+	assert.Equal(t, "0", startup)
+
+	rv, startup = startupResult("02:10:19,456 ERROR [org.jboss.as] (Controller Boot Thread) WFLYSRV0026: WildFly Full 26.1.3.Final (WildFly Core 18.1.2.Final) started (with errors) in 9876ms - Started 600 of 830 services")
+	assert.Equal(t, tomcatDown, rv)
+	assert.Equal(t, "-1", startup)
+}
+
+func TestWildflyRegistry(t *testing.T) {
+	profile, err := profileFor(instanceConfig{Dir: "/opt/wildfly", Profile: "jboss", Controller: "127.0.0.1:19990"})
+	assert.NoError(t, err)
+	assert.Equal(t, wildflyProfile{controller: "127.0.0.1:19990", log: "standalone/log/server.log"}, profile)
+	assert.Equal(t, "bin/standalone.sh", profile.ownerFile())
+}
+
+func TestSetSystemProperty(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{
+			name:     "update existing",
+			config:   `<system-properties><property name="serverId" value="old"/></system-properties>`,
+			expected: `<system-properties><property name="serverId" value="a&amp;b"/></system-properties>`,
+		},
+		{
+			name:     "append to block",
+			config:   "<system-properties>\n    </system-properties>",
+			expected: "<system-properties>\n        <property name=\"serverId\" value=\"a&amp;b\"/>\n    </system-properties>",
+		},
+		{
+			name:     "create block",
+			config:   "<server>\n    <extensions>\n    </extensions>\n    <management/>",
+			expected: "<server>\n    <extensions>\n    </extensions>\n    <system-properties>\n        <property name=\"serverId\" value=\"a&amp;b\"/>\n    </system-properties>\n    <management/>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := setSystemProperty(tt.config, "serverId", "a&b")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, config)
+		})
+	}
+
+	_, err := setSystemProperty("<server/>", "serverId", "x")
+	assert.Error(t, err)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Maintenance windows are either absolute RFC 3339 times or daily local
+// "15:04" times. A daily window may wrap past midnight, e.g. 23:00 to 03:00.
+const dailyWindowLayout = "15:04"
+
+// parseWindowTime returns the time and whether it is a daily time of day
+func parseWindowTime(value string) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation(dailyWindowLayout, value, time.Local); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false, errors.New("must be RFC 3339 or HH:MM: " + value)
+	}
+	return t, false, nil
+}
+
+// validateWindow checks window_start and window_end are both set and the same kind
+func (p *PatchResponse) validateWindow() []string {
+	if p.WindowStart == "" && p.WindowEnd == "" {
+		return nil
+	}
+	if p.WindowStart == "" || p.WindowEnd == "" {
+		return []string{"window_start and window_end must be set together"}
+	}
+
+	var problems []string
+	_, startDaily, err := parseWindowTime(p.WindowStart)
+	if err != nil {
+		problems = append(problems, "window_start "+err.Error())
+	}
+	_, endDaily, err := parseWindowTime(p.WindowEnd)
+	if err != nil {
+		problems = append(problems, "window_end "+err.Error())
+	}
+	if len(problems) == 0 && startDaily != endDaily {
+		problems = append(problems, "window_start and window_end must both be HH:MM or both be RFC 3339")
+	}
+	return problems
+}
+
+// inWindow reports whether now falls inside the patch's maintenance window.
+// Patches without a window may be applied at any time.
+func (p *PatchResponse) inWindow(now time.Time) bool {
+	if p.WindowStart == "" {
+		return true
+	}
+	start, daily, _ := parseWindowTime(p.WindowStart)
+	end, _, _ := parseWindowTime(p.WindowEnd)
+	if !daily {
+		return !now.Before(start) && now.Before(end)
+	}
+
+	now = now.In(time.Local)
+	minute := now.Hour()*60 + now.Minute()
+	startMinute := start.Hour()*60 + start.Minute()
+	endMinute := end.Hour()*60 + end.Minute()
+	if startMinute <= endMinute {
+		return minute >= startMinute && minute < endMinute
+	}
+	return minute >= startMinute || minute < endMinute
+}
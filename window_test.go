@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInWindow(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 3, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	testCases := []struct {
+		name  string
+		start string
+		end   string
+		now   time.Time
+		want  bool
+	}{
+		{"No window", "", "", at(14, 0), true},
+		{"Inside daily", "02:00", "05:00", at(3, 30), true},
+		{"End is exclusive", "02:00", "05:00", at(5, 0), false},
+		{"Wraps midnight, late", "23:00", "03:00", at(23, 30), true},
+		{"Wraps midnight, early", "23:00", "03:00", at(1, 0), true},
+		{"Wraps midnight, outside", "23:00", "03:00", at(12, 0), false},
+		{"Absolute inside", "2024-03-01T00:00:00Z", "2030-01-01T00:00:00Z", at(12, 0), true},
+		{"Absolute over", "2024-01-01T00:00:00Z", "2024-02-01T00:00:00Z", at(12, 0), false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			patch := &PatchResponse{WindowStart: tc.start, WindowEnd: tc.end}
+			assert.Equal(t, tc.want, patch.inWindow(tc.now))
+		})
+	}
+}
+
+func TestValidateWindow(t *testing.T) {
+	assert.Empty(t, (&PatchResponse{WindowStart: "02:00", WindowEnd: "05:00"}).validateWindow())
+	assert.Equal(t, []string{"window_start and window_end must be set together"},
+		(&PatchResponse{WindowStart: "02:00"}).validateWindow())
+	assert.Equal(t, []string{"window_end must be RFC 3339 or HH:MM: 5am"},
+		(&PatchResponse{WindowStart: "02:00", WindowEnd: "5am"}).validateWindow())
+	assert.Equal(t, []string{"window_start and window_end must both be HH:MM or both be RFC 3339"},
+		(&PatchResponse{WindowStart: "02:00", WindowEnd: "2024-02-01T00:00:00Z"}).validateWindow())
+}